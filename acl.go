@@ -0,0 +1,67 @@
+package storageconsul
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// aclPolicy holds the ACL rules one token used by the storage needs
+type aclPolicy struct {
+	name  string
+	rules string
+}
+
+// aclPolicies returns the minimal ACL policies for the token of the storage and the tokens of its tenants
+func (cs *ConsulStorage) aclPolicies() []aclPolicy {
+	prefixes := []string{cs.Prefix}
+	if cs.FallbackPrefix != "" && cs.FallbackPrefix != cs.Prefix {
+		prefixes = append(prefixes, cs.FallbackPrefix)
+	}
+
+	names := make([]string, 0, len(cs.Tenants))
+	for name := range cs.Tenants {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var tenantPolicies []aclPolicy
+	for _, name := range names {
+		t := cs.Tenants[name]
+		if t == nil {
+			continue
+		}
+		// tenants without a token of their own are accessed with the token of the storage
+		if t.Token == "" {
+			prefixes = append(prefixes, t.Prefix)
+			continue
+		}
+		tenantPolicies = append(tenantPolicies, aclPolicy{
+			name:  "tenant " + name,
+			rules: cs.aclRules([]string{t.Prefix}),
+		})
+	}
+
+	return append([]aclPolicy{{name: "storage", rules: cs.aclRules(prefixes)}}, tenantPolicies...)
+}
+
+// aclRules returns the rules to read and write below prefixes, sessions are only needed for Consul locks
+func (cs *ConsulStorage) aclRules(prefixes []string) string {
+	var b strings.Builder
+	for _, prefix := range prefixes {
+		fmt.Fprintf(&b, "key_prefix %q {\n\tpolicy = \"write\"\n}\n", strings.Trim(prefix, "/")+"/")
+	}
+	if !cs.DisableLocks {
+		b.WriteString("session_prefix \"\" {\n\tpolicy = \"write\"\n}\n")
+		b.WriteString("node_prefix \"\" {\n\tpolicy = \"read\"\n}\n")
+	}
+	if cs.CertEvents {
+		b.WriteString("event_prefix \"caddy-cert-\" {\n\tpolicy = \"write\"\n}\n")
+	}
+	if cs.serviceEnabled() {
+		fmt.Fprintf(&b, "service %q {\n\tpolicy = \"write\"\n}\n", cs.Service.Name)
+	}
+	// reading the agent's node name checks the connection on startup
+	b.WriteString("agent_prefix \"\" {\n\tpolicy = \"read\"\n}\n")
+	return b.String()
+}
@@ -0,0 +1,68 @@
+package storageconsul
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_ACLPolicies(t *testing.T) {
+	cs := New()
+	cs.FallbackPrefix = "caddytls-old"
+	cs.Tenants = map[string]*Tenant{
+		"shared": {KeyPrefixes: []string{"certificates/shared"}, Prefix: "tenants/shared"},
+		"owned":  {KeyPrefixes: []string{"certificates/owned"}, Prefix: "tenants/owned", Token: "tenant-token"},
+	}
+
+	policies := cs.aclPolicies()
+	require.Len(t, policies, 2)
+
+	assert.Equal(t, "storage", policies[0].name)
+	assert.Equal(t, `key_prefix "caddytls/" {
+	policy = "write"
+}
+key_prefix "caddytls-old/" {
+	policy = "write"
+}
+key_prefix "tenants/shared/" {
+	policy = "write"
+}
+session_prefix "" {
+	policy = "write"
+}
+node_prefix "" {
+	policy = "read"
+}
+agent_prefix "" {
+	policy = "read"
+}
+`, policies[0].rules)
+
+	assert.Equal(t, "tenant owned", policies[1].name)
+	assert.Contains(t, policies[1].rules, `key_prefix "tenants/owned/"`)
+	assert.NotContains(t, policies[1].rules, `key_prefix "caddytls/"`)
+
+	cs.DisableLocks = true
+	assert.NotContains(t, cs.aclPolicies()[0].rules, "session_prefix")
+}
+
+func TestLoadStorageConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	jsonConfig := filepath.Join(dir, "caddy.json")
+	require.NoError(t, ioutil.WriteFile(jsonConfig, []byte(`{"storage": {"module": "consul", "prefix": "caddytls-green"}}`), 0644))
+
+	cs, err := loadStorageConfig(jsonConfig, "")
+	require.NoError(t, err)
+	assert.Equal(t, "caddytls-green", cs.Prefix)
+
+	require.NoError(t, ioutil.WriteFile(jsonConfig, []byte(`{"storage": {"module": "file_system"}}`), 0644))
+	_, err = loadStorageConfig(jsonConfig, "")
+	assert.Error(t, err)
+
+	_, err = loadStorageConfig(jsonConfig, "unknown")
+	assert.Error(t, err)
+}
@@ -0,0 +1,198 @@
+package storageconsul
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+	"github.com/pteich/errors"
+)
+
+// adminPath is the path below which the admin API routes of the storage are served
+const adminPath = "/consul-storage/"
+
+// Interface guards
+var (
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(new(AdminAPI))
+}
+
+// storages holds the provisioned storages in the order they were provisioned,
+// the admin API uses the latest one so it follows config reloads
+var storages = struct {
+	sync.Mutex
+	list []*ConsulStorage
+}{}
+
+// registerStorage makes cs available to the admin API
+func registerStorage(cs *ConsulStorage) {
+	storages.Lock()
+	defer storages.Unlock()
+	storages.list = append(storages.list, cs)
+}
+
+// unregisterStorage removes cs from the admin API
+func unregisterStorage(cs *ConsulStorage) {
+	storages.Lock()
+	defer storages.Unlock()
+	for i, registered := range storages.list {
+		if registered == cs {
+			storages.list = append(storages.list[:i], storages.list[i+1:]...)
+			return
+		}
+	}
+}
+
+// activeStorage returns the latest provisioned storage with name, any name if it is empty
+func activeStorage(name string) (*ConsulStorage, bool) {
+	storages.Lock()
+	defer storages.Unlock()
+	for i := len(storages.list) - 1; i >= 0; i-- {
+		if name == "" || storages.list[i].Name == name {
+			return storages.list[i], true
+		}
+	}
+	return nil, false
+}
+
+// AdminAPI adds routes to Caddy's admin API to browse and purge the keys of the storage. The routes are
+// protected like the rest of the admin API, values are never returned, only their metadata.
+type AdminAPI struct{}
+
+func (*AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: "admin.api.consul_storage",
+		New: func() caddy.Module {
+			return new(AdminAPI)
+		},
+	}
+}
+
+// Routes returns the admin routes of the storage
+func (api *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{Pattern: adminPath + "keys", Handler: caddy.AdminHandlerFunc(api.handleKeys)},
+		{Pattern: adminPath + "keys/", Handler: caddy.AdminHandlerFunc(api.handleKey)},
+		{Pattern: adminPath + "usage", Handler: caddy.AdminHandlerFunc(api.handleUsage)},
+	}
+}
+
+// handleKeys lists the keys below the prefix given as query parameter, recursively with recursive=true,
+// the keys can be filtered with the glob and suffix query parameters
+func (api *AdminAPI) handleKeys(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: errors.Errorf("method %s not allowed", r.Method)}
+	}
+
+	cs, err := adminStorage(r)
+	if err != nil {
+		return err
+	}
+
+	query := r.URL.Query()
+	recursive, _ := strconv.ParseBool(query.Get("recursive"))
+	filter := ListFilter{Glob: query.Get("glob"), Suffix: query.Get("suffix")}
+	keys, err := cs.ListFilter(r.Context(), query.Get("prefix"), recursive, filter)
+	if _, notExist := err.(certmagic.ErrNotExist); notExist {
+		keys, err = nil, nil
+	}
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+
+	return writeJSON(w, keys)
+}
+
+// handleKey returns the metadata of a key with GET and deletes it with DELETE
+func (api *AdminAPI) handleKey(w http.ResponseWriter, r *http.Request) error {
+	cs, err := adminStorage(r)
+	if err != nil {
+		return err
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, adminPath+"keys/")
+	if err := validateKey(key); err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		info, err := cs.StatContext(r.Context(), key)
+		if err != nil {
+			return apiError(err)
+		}
+		return writeJSON(w, keyInfo{Key: info.Key, Modified: info.Modified, Size: info.Size})
+
+	case http.MethodDelete:
+		if err := cs.DeleteContext(r.Context(), key); err != nil {
+			return apiError(err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+
+	return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: errors.Errorf("method %s not allowed", r.Method)}
+}
+
+// handleUsage returns the number of keys and bytes per top-level prefix
+func (api *AdminAPI) handleUsage(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{HTTPStatus: http.StatusMethodNotAllowed, Err: errors.Errorf("method %s not allowed", r.Method)}
+	}
+
+	cs, err := adminStorage(r)
+	if err != nil {
+		return err
+	}
+
+	usage, err := cs.Usage(r.Context())
+	if err != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+	}
+
+	return writeJSON(w, usage)
+}
+
+// keyInfo is the metadata of a key returned by the admin API
+type keyInfo struct {
+	Key      string    `json:"key"`
+	Modified time.Time `json:"modified"`
+	Size     int64     `json:"size"`
+}
+
+// adminStorage returns the storage the admin API works on, the one named by the instance query parameter
+func adminStorage(r *http.Request) (*ConsulStorage, error) {
+	name := r.URL.Query().Get("instance")
+	cs, ok := activeStorage(name)
+	if !ok && name != "" {
+		return nil, caddy.APIError{HTTPStatus: http.StatusNotFound, Err: errors.Errorf("no Consul storage named %s is configured", name)}
+	}
+	if !ok {
+		return nil, caddy.APIError{HTTPStatus: http.StatusNotFound, Err: errors.New("no Consul storage is configured")}
+	}
+	return cs, nil
+}
+
+// apiError maps storage errors to admin API errors
+func apiError(err error) error {
+	if _, notExist := err.(certmagic.ErrNotExist); notExist {
+		return caddy.APIError{HTTPStatus: http.StatusNotFound, Err: err}
+	}
+	return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,67 @@
+package storageconsul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminAPI(t *testing.T) {
+	api := new(AdminAPI)
+	handlers := make(map[string]caddy.AdminHandler)
+	for _, route := range api.Routes() {
+		handlers[route.Pattern] = route.Handler
+	}
+
+	serve := func(method, pattern, target string) (*httptest.ResponseRecorder, error) {
+		w := httptest.NewRecorder()
+		err := handlers[pattern].ServeHTTP(w, httptest.NewRequest(method, target, nil))
+		return w, err
+	}
+
+	_, err := serve(http.MethodGet, "/consul-storage/keys", "/consul-storage/keys")
+	assert.Equal(t, http.StatusNotFound, err.(caddy.APIError).HTTPStatus)
+
+	cs := setupConsulEnv(t)
+	registerStorage(cs)
+	defer unregisterStorage(cs)
+	require.NoError(t, cs.Store("certificates/example.com/example.com.crt", []byte("crt")))
+	require.NoError(t, cs.Store("certificates/example.com/example.com.key", []byte("key")))
+
+	w, err := serve(http.MethodGet, "/consul-storage/keys", "/consul-storage/keys?prefix=certificates&recursive=true")
+	require.NoError(t, err)
+	var keys []string
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&keys))
+	assert.ElementsMatch(t, []string{"certificates/example.com/example.com.crt", "certificates/example.com/example.com.key"}, keys)
+
+	w, err = serve(http.MethodGet, "/consul-storage/keys", "/consul-storage/keys?prefix=certificates&recursive=true&glob=*.crt")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&keys))
+	assert.Equal(t, []string{"certificates/example.com/example.com.crt"}, keys)
+
+	w, err = serve(http.MethodGet, "/consul-storage/keys/", "/consul-storage/keys/certificates/example.com/example.com.key")
+	require.NoError(t, err)
+	var info keyInfo
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&info))
+	assert.Equal(t, "certificates/example.com/example.com.key", info.Key)
+	assert.Equal(t, int64(3), info.Size)
+
+	w, err = serve(http.MethodGet, "/consul-storage/usage", "/consul-storage/usage")
+	require.NoError(t, err)
+	var usage map[string]PrefixUsage
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&usage))
+	assert.Equal(t, 2, usage["certificates"].Keys)
+
+	w, err = serve(http.MethodDelete, "/consul-storage/keys/", "/consul-storage/keys/certificates/example.com/example.com.key")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, w.Code)
+	assert.False(t, cs.Exists("certificates/example.com/example.com.key"))
+
+	_, err = serve(http.MethodDelete, "/consul-storage/keys/", "/consul-storage/keys/certificates/example.com/example.com.key")
+	assert.Equal(t, http.StatusNotFound, err.(caddy.APIError).HTTPStatus)
+}
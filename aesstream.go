@@ -0,0 +1,191 @@
+package storageconsul
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+
+	"github.com/pteich/errors"
+)
+
+// Backup archives are encrypted in chunks that are sealed with AES-GCM one by one, so the encrypted archive is
+// never held in memory as a whole. The nonce of each chunk is the random nonce prefix of the stream, the
+// chunk counter and a flag marking the last chunk, which detects reordered, dropped and truncated chunks.
+const (
+	// streamMagic starts an encrypted stream, it is followed by the chunk size and the nonce prefix
+	streamMagic = "\xffCSS"
+
+	// streamChunkSize is the size of the plaintext of every chunk but the last
+	streamChunkSize = 64 * 1024
+
+	streamNoncePrefixSize = 7
+)
+
+// streamNonce returns the nonce of chunk i
+func streamNonce(prefix []byte, i uint32, last bool) []byte {
+	nonce := make([]byte, streamNoncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[streamNoncePrefixSize:], i)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// encryptWriter encrypts everything written to it in chunks, Close seals the last chunk
+type encryptWriter struct {
+	w      io.Writer
+	gcm    cipher.AEAD
+	prefix []byte
+	chunk  uint32
+	buf    []byte
+	out    []byte
+}
+
+// newEncryptWriter returns a writer that encrypts to w with key, without a key data is written as is
+func newEncryptWriter(key []byte, w io.Writer) (io.WriteCloser, error) {
+	if len(key) == 0 {
+		return nopWriteCloser{w}, nil
+	}
+	gcm, err := aeadForKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ew := &encryptWriter{w: w, gcm: gcm, prefix: make([]byte, streamNoncePrefixSize), buf: make([]byte, 0, streamChunkSize)}
+	if _, err := io.ReadFull(rand.Reader, ew.prefix); err != nil {
+		return nil, errors.Wrap(err, "unable to generate nonce")
+	}
+
+	header := make([]byte, 0, len(streamMagic)+4+streamNoncePrefixSize)
+	header = append(header, streamMagic...)
+	header = append(header, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(header[len(streamMagic):], streamChunkSize)
+	if _, err := w.Write(append(header, ew.prefix...)); err != nil {
+		return nil, err
+	}
+	return ew, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// a full chunk is only sealed once more data follows, the last chunk is sealed by Close
+		if len(ew.buf) == streamChunkSize {
+			if err := ew.seal(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(ew.buf[len(ew.buf):streamChunkSize], p)
+		ew.buf = ew.buf[:len(ew.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// Close seals the last chunk, it doesn't close the underlying writer
+func (ew *encryptWriter) Close() error {
+	return ew.seal(true)
+}
+
+func (ew *encryptWriter) seal(last bool) error {
+	if ew.chunk == ^uint32(0) {
+		return errors.New("stream is too long")
+	}
+	ew.out = ew.gcm.Seal(ew.out[:0], streamNonce(ew.prefix, ew.chunk, last), ew.buf, nil)
+	ew.chunk++
+	ew.buf = ew.buf[:0]
+	_, err := ew.w.Write(ew.out)
+	return err
+}
+
+// decryptReader decrypts a stream written by encryptWriter chunk by chunk
+type decryptReader struct {
+	r         *bufio.Reader
+	gcm       cipher.AEAD
+	prefix    []byte
+	chunkSize int
+	chunk     uint32
+	in        []byte
+	plain     []byte
+	done      bool
+}
+
+// newDecryptReader returns a reader of the plaintext of the stream encrypted with key read from r, without a
+// key the data is read as is
+func newDecryptReader(key []byte, r io.Reader) (io.Reader, error) {
+	if len(key) == 0 {
+		return r, nil
+	}
+	gcm, err := aeadForKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(streamMagic)+4+streamNoncePrefixSize)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(streamMagic)]) != streamMagic {
+		return nil, errors.New("invalid encrypted stream")
+	}
+	chunkSize := int(binary.BigEndian.Uint32(header[len(streamMagic):]))
+	if chunkSize <= 0 || chunkSize > 16*streamChunkSize {
+		return nil, errors.Errorf("invalid chunk size %d of encrypted stream", chunkSize)
+	}
+
+	return &decryptReader{
+		r:         bufio.NewReader(r),
+		gcm:       gcm,
+		prefix:    header[len(streamMagic)+4:],
+		chunkSize: chunkSize,
+		in:        make([]byte, chunkSize+gcm.Overhead()),
+	}, nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.plain) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		if err := dr.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.plain)
+	dr.plain = dr.plain[n:]
+	return n, nil
+}
+
+// open reads and decrypts the next chunk, a chunk is the last one if the stream ends after it
+func (dr *decryptReader) open() error {
+	n, err := io.ReadFull(dr.r, dr.in)
+	last := err == io.ErrUnexpectedEOF || err == io.EOF
+	if err != nil && !last {
+		return errors.Wrap(err, "unable to read encrypted stream")
+	}
+	if !last {
+		if _, err := dr.r.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+
+	plain, err := dr.gcm.Open(dr.in[:0], streamNonce(dr.prefix, dr.chunk, last), dr.in[:n], nil)
+	if err != nil {
+		return errors.New("encrypted stream is corrupted or truncated")
+	}
+	dr.chunk++
+	dr.plain, dr.done = plain, last
+	return nil
+}
+
+// isEncryptedStream reports whether data starts like a stream written by encryptWriter
+func isEncryptedStream(data []byte) bool {
+	return len(data) >= len(streamMagic) && string(data[:len(streamMagic)]) == streamMagic
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,222 @@
+package storageconsul
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func encryptStream(t testing.TB, key, data []byte) []byte {
+	var buf bytes.Buffer
+	ew, err := newEncryptWriter(key, &buf)
+	require.NoError(t, err)
+	_, err = ew.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, ew.Close())
+	return buf.Bytes()
+}
+
+func decryptStream(key, data []byte) ([]byte, error) {
+	dr, err := newDecryptReader(key, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(dr)
+}
+
+func TestEncryptStream(t *testing.T) {
+	key := []byte(DefaultAESKey)
+
+	for _, size := range []int{0, 1, streamChunkSize - 1, streamChunkSize, streamChunkSize + 1, 3*streamChunkSize + 17} {
+		data := make([]byte, size)
+		_, err := rand.Read(data)
+		require.NoError(t, err)
+
+		encrypted := encryptStream(t, key, data)
+		assert.True(t, isEncryptedStream(encrypted))
+
+		decrypted, err := decryptStream(key, encrypted)
+		require.NoError(t, err, "size %d", size)
+		assert.Equal(t, data, decrypted, "size %d", size)
+	}
+}
+
+func TestEncryptStream_Tampered(t *testing.T) {
+	key := []byte(DefaultAESKey)
+	data := bytes.Repeat([]byte("a"), 2*streamChunkSize+10)
+	encrypted := encryptStream(t, key, data)
+	header := len(streamMagic) + 4 + streamNoncePrefixSize
+	chunk := streamChunkSize + 16
+
+	// dropping the last chunk makes the previous one the last, which it wasn't sealed as
+	_, err := decryptStream(key, encrypted[:header+2*chunk])
+	assert.Error(t, err)
+
+	_, err = decryptStream(key, encrypted[:len(encrypted)-1])
+	assert.Error(t, err)
+
+	flipped := append([]byte(nil), encrypted...)
+	flipped[header+chunk+5] ^= 1
+	_, err = decryptStream(key, flipped)
+	assert.Error(t, err)
+
+	_, err = decryptStream([]byte("consultls-0987654321-caddytls-32"), encrypted)
+	assert.Error(t, err)
+}
+
+func TestEncryptStream_NoKey(t *testing.T) {
+	encrypted := encryptStream(t, nil, []byte("plain"))
+	assert.Equal(t, []byte("plain"), encrypted)
+
+	decrypted, err := decryptStream(nil, encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("plain"), decrypted)
+}
+
+func TestConsulStorage_RestoreLegacyArchive(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+	require.NoError(t, cs.Store("certificates/a.example.com/a.example.com.crt", []byte("a")))
+
+	// archives of older versions are compressed and then encrypted as a whole
+	var buf bytes.Buffer
+	_, err := cs.WriteArchive(context.Background(), &buf)
+	require.NoError(t, err)
+	compressed, err := decryptStream(cs.AESKey, buf.Bytes())
+	require.NoError(t, err)
+	legacy, err := cs.encrypt(compressed)
+	require.NoError(t, err)
+
+	require.NoError(t, cs.Delete("certificates/a.example.com/a.example.com.crt"))
+	n, err := cs.RestoreArchive(context.Background(), bytes.NewReader(legacy))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	value, err := cs.Load("certificates/a.example.com/a.example.com.crt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a"), value)
+}
+
+// benchmarkArchiveData is a few MB of compressible data like the JSON of an archive
+func benchmarkArchiveData() []byte {
+	return bytes.Repeat([]byte(`{"key":"certificates/example.com/example.com.crt","value":"LS0tLS1CRUdJTiBDRVJUSUZJQ0FURS0tLS0t"},`), 40000)
+}
+
+// BenchmarkEncryptArchive_Buffered compresses into a buffer and encrypts it as a whole like archives were
+// written before they were encrypted as streams
+func BenchmarkEncryptArchive_Buffered(b *testing.B) {
+	cs := New()
+	data := benchmarkArchiveData()
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			b.Fatal(err)
+		}
+		encrypted, err := cs.encrypt(buf.Bytes())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ioutil.Discard.Write(encrypted); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkEncryptArchive_Stream(b *testing.B) {
+	cs := New()
+	data := benchmarkArchiveData()
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ew, err := newEncryptWriter(cs.AESKey, ioutil.Discard)
+		if err != nil {
+			b.Fatal(err)
+		}
+		zw := gzip.NewWriter(ew)
+		if _, err := zw.Write(data); err != nil {
+			b.Fatal(err)
+		}
+		if err := zw.Close(); err != nil {
+			b.Fatal(err)
+		}
+		if err := ew.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecryptArchive_Buffered(b *testing.B) {
+	cs := New()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(benchmarkArchiveData())
+	zw.Close()
+	encrypted, err := cs.encrypt(buf.Bytes())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.SetBytes(int64(len(benchmarkArchiveData())))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compressed, err := cs.decrypt(encrypted)
+		if err != nil {
+			b.Fatal(err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(compressed))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := ioutil.ReadAll(zr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecryptArchive_Stream(b *testing.B) {
+	cs := New()
+	var buf bytes.Buffer
+	ew, err := newEncryptWriter(cs.AESKey, &buf)
+	if err != nil {
+		b.Fatal(err)
+	}
+	zw := gzip.NewWriter(ew)
+	zw.Write(benchmarkArchiveData())
+	zw.Close()
+	ew.Close()
+	encrypted := buf.Bytes()
+
+	b.SetBytes(int64(len(benchmarkArchiveData())))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dr, err := newDecryptReader(cs.AESKey, bytes.NewReader(encrypted))
+		if err != nil {
+			b.Fatal(err)
+		}
+		zr, err := gzip.NewReader(dr)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := io.Copy(ioutil.Discard, zr); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package storageconsul
+
+import (
+	"github.com/caddyserver/caddy/v2"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+	"go.uber.org/zap"
+)
+
+// AppName is the name of the consul app in Caddy's config
+const AppName = "consul"
+
+// Interface guards
+var (
+	_ caddy.App          = (*App)(nil)
+	_ caddy.Provisioner  = (*App)(nil)
+	_ caddy.CleanerUpper = (*App)(nil)
+)
+
+func init() {
+	caddy.RegisterModule(new(App))
+}
+
+// App is a Caddy app that owns named Consul connections, so the connection settings
+// can be defined once and referenced by the storage and other Consul related modules.
+type App struct {
+	Connections map[string]*ConnectionConfig `json:"connections"`
+
+	logger  *zap.SugaredLogger
+	clients map[string]*consul.Client
+	shared  []*sharedClient
+}
+
+func (*App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID: AppName,
+		New: func() caddy.Module {
+			return new(App)
+		},
+	}
+}
+
+// Provision is called by Caddy to prepare the app and connects to all configured Consul instances
+func (app *App) Provision(ctx caddy.Context) error {
+	app.logger = ctx.Logger(app).Sugar()
+	app.clients = make(map[string]*consul.Client)
+
+	for name, conn := range app.Connections {
+		if conn == nil {
+			conn = &ConnectionConfig{Timeout: DefaultTimeout}
+		}
+
+		app.logger.Infof("connection %s is using Consul at %s", name, conn.Address)
+		sc, err := conn.acquireClient()
+		if err != nil {
+			return errors.Wrapf(err, "unable to connect to Consul for connection %s", name)
+		}
+
+		app.clients[name] = sc.client
+		app.shared = append(app.shared, sc)
+	}
+
+	return nil
+}
+
+// Start implements caddy.App, the connections are established during Provision
+func (app *App) Start() error {
+	return nil
+}
+
+// Stop implements caddy.App, the connections are released during Cleanup
+func (app *App) Stop() error {
+	return nil
+}
+
+// Cleanup gives back all Consul clients of the app
+func (app *App) Cleanup() error {
+	var err error
+	for _, sc := range app.shared {
+		if releaseErr := releaseClient(sc); releaseErr != nil {
+			err = releaseErr
+		}
+	}
+	app.shared = nil
+
+	return err
+}
+
+// Client returns the Consul client of the connection with the given name
+func (app *App) Client(name string) (*consul.Client, error) {
+	client, exists := app.clients[name]
+	if !exists {
+		return nil, errors.Errorf("Consul connection %s is not defined", name)
+	}
+	return client, nil
+}
+
+// appClient looks up the Consul client of a named connection of the consul app
+func appClient(ctx caddy.Context, name string) (*consul.Client, error) {
+	appIface, err := ctx.App(AppName)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to load consul app")
+	}
+
+	return appIface.(*App).Client(name)
+}
@@ -0,0 +1,32 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestApp_Client(t *testing.T) {
+	srv := newTestAgent(t)
+
+	app := &App{
+		Connections: map[string]*ConnectionConfig{
+			"default": {Address: srv.Listener.Addr().String(), Timeout: DefaultTimeout},
+		},
+	}
+
+	err := app.Provision(caddy.Context{Context: context.Background()})
+	require.NoError(t, err)
+
+	client, err := app.Client("default")
+	assert.NoError(t, err)
+	assert.NotNil(t, client)
+
+	_, err = app.Client("unknown")
+	assert.Error(t, err)
+
+	assert.NoError(t, app.Cleanup())
+}
@@ -0,0 +1,155 @@
+package storageconsul
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// archiveVersion is the version of the archive format
+const archiveVersion = 1
+
+// archive holds the raw KV pairs of all namespaces of a storage, values stay encrypted as stored
+type archive struct {
+	Version int            `json:"version"`
+	Created time.Time      `json:"created"`
+	Entries []archiveEntry `json:"entries"`
+}
+
+type archiveEntry struct {
+	Key   string `json:"key"`
+	Flags uint64 `json:"flags,omitempty"`
+	Value []byte `json:"value"`
+}
+
+// WriteArchive writes an archive of all keys of the storage to w and returns the number of keys in it. All keys
+// are read as of a single point in time and values are archived as stored, including blobs and hashed keys. The
+// gzipped archive is encrypted with the AES key as it is written, so it can only be restored with the same key.
+func (cs *ConsulStorage) WriteArchive(ctx context.Context, w io.Writer) (int, error) {
+	ctx, cancel := withTimeout(ctx, cs.ListTimeout)
+	defer cancel()
+
+	pairs, err := cs.snapshotPairs(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	a := archive{Version: archiveVersion, Created: time.Now().UTC()}
+	namespaces := cs.namespaces()
+	// prefixes may be nested, every key is archived once
+	seen := make(map[string]bool)
+	for _, kv := range pairs {
+		ns, _ := archiveNamespace(namespaces, kv.Key)
+		// locks are held by sessions of the running instances and can't be restored
+		if kv.Flags == consul.LockFlagValue || cs.inLockQueueDir(ns.prefix, kv.Key) || seen[kv.Key] {
+			continue
+		}
+		seen[kv.Key] = true
+		a.Entries = append(a.Entries, archiveEntry{Key: kv.Key, Flags: kv.Flags, Value: kv.Value})
+	}
+
+	// the pairs of the snapshot are held anyway, the archive is compressed and encrypted in chunks on its way
+	// to w instead of buffering it twice more
+	ew, err := newEncryptWriter(cs.AESKey, w)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to encrypt archive")
+	}
+	zw := gzip.NewWriter(ew)
+	if err := json.NewEncoder(zw).Encode(a); err != nil {
+		return 0, errors.Wrap(err, "unable to write archive")
+	}
+	if err := zw.Close(); err != nil {
+		return 0, errors.Wrap(err, "unable to write archive")
+	}
+	if err := ew.Close(); err != nil {
+		return 0, errors.Wrap(err, "unable to write archive")
+	}
+
+	return len(a.Entries), nil
+}
+
+// RestoreArchive writes the keys of an archive written by WriteArchive back to Consul and returns their
+// number, existing keys are overwritten. Keys outside the namespaces of the storage are rejected.
+func (cs *ConsulStorage) RestoreArchive(ctx context.Context, r io.Reader) (int, error) {
+	compressed, err := cs.decryptArchive(r)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to decrypt archive")
+	}
+	zr, err := gzip.NewReader(compressed)
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to decompress archive")
+	}
+
+	var a archive
+	if err := json.NewDecoder(zr).Decode(&a); err != nil {
+		return 0, errors.Wrap(err, "unable to decode archive")
+	}
+	if a.Version != archiveVersion {
+		return 0, errors.Errorf("unsupported archive version %d", a.Version)
+	}
+
+	ctx, cancel := withTimeout(ctx, cs.WriteTimeout)
+	defer cancel()
+
+	if cache := cs.cachedStat(); cache != nil {
+		defer cache.invalidatePrefix("")
+	}
+
+	namespaces := cs.namespaces()
+	for i, entry := range a.Entries {
+		ns, ok := archiveNamespace(namespaces, entry.Key)
+		if !ok {
+			return i, errors.Errorf("archived key %s is outside of the prefixes of the storage", entry.Key)
+		}
+		pair := &consul.KVPair{Key: entry.Key, Flags: entry.Flags, Value: entry.Value}
+		if _, err := ns.kv.Put(pair, cs.writeOptions(ctx)); err != nil {
+			return i, errors.Wrapf(err, "unable to restore %s", entry.Key)
+		}
+	}
+
+	cs.logger.Infof("restored %d keys from archive of %s", len(a.Entries), a.Created.Format(time.RFC3339))
+	return len(a.Entries), nil
+}
+
+// decryptArchive returns the reader of the compressed archive read from r, archives of older versions are
+// encrypted as a whole instead of in chunks
+func (cs *ConsulStorage) decryptArchive(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if len(cs.AESKey) == 0 {
+		return br, nil
+	}
+	if magic, _ := br.Peek(len(streamMagic)); isEncryptedStream(magic) {
+		return newDecryptReader(cs.AESKey, br)
+	}
+
+	encrypted, err := ioutil.ReadAll(br)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read archive")
+	}
+	compressed, err := cs.decrypt(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(compressed), nil
+}
+
+// archiveNamespace returns the namespace of namespaces the Consul key belongs to, the one with the longest prefix
+func archiveNamespace(namespaces []namespace, consulKey string) (namespace, bool) {
+	var found namespace
+	ok := false
+	for _, ns := range namespaces {
+		if strings.HasPrefix(consulKey, ns.prefix+"/") && len(ns.prefix) > len(found.prefix) {
+			found, ok = ns, true
+		}
+	}
+	return found, ok
+}
@@ -0,0 +1,48 @@
+package storageconsul
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_Archive(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+
+	require.NoError(t, cs.Store("certificates/a.example.com/a.example.com.crt", []byte("a")))
+	require.NoError(t, cs.Store("certificates/b.example.com/b.example.com.key", []byte("b")))
+	require.NoError(t, cs.Lock(context.Background(), "issue_cert_a.example.com"))
+	defer cs.Unlock("issue_cert_a.example.com")
+
+	var buf bytes.Buffer
+	n, err := cs.WriteArchive(context.Background(), &buf)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	// the archive is encrypted
+	assert.NotContains(t, buf.String(), "certificates")
+
+	require.NoError(t, cs.Delete("certificates/a.example.com/a.example.com.crt"))
+	require.NoError(t, cs.Store("certificates/b.example.com/b.example.com.key", []byte("changed")))
+
+	n, err = cs.RestoreArchive(context.Background(), bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	value, err := cs.Load("certificates/a.example.com/a.example.com.crt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a"), value)
+	value, err = cs.Load("certificates/b.example.com/b.example.com.key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("b"), value)
+
+	// archives can't be restored with another key
+	other := New()
+	other.AESKey = []byte("consultls-0987654321-caddytls-32")
+	other.ConsulClient = cs.ConsulClient
+	_, err = other.RestoreArchive(context.Background(), bytes.NewReader(buf.Bytes()))
+	assert.Error(t, err)
+	assert.Len(t, fc.kv, 3)
+}
@@ -0,0 +1,35 @@
+package storageconsul
+
+import (
+	"bytes"
+	"encoding/pem"
+
+	"github.com/pteich/errors"
+)
+
+// armorType is the PEM type of values stored with ArmorValues
+const armorType = "CADDY STORAGE VALUE"
+
+// armorBegin starts every armored value
+var armorBegin = []byte("-----BEGIN " + armorType + "-----")
+
+// armor encodes value as PEM block if ArmorValues is enabled, so it can be copied from `consul kv get`
+func (cs *ConsulStorage) armor(value []byte) []byte {
+	if !cs.ArmorValues {
+		return value
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: armorType, Bytes: value})
+}
+
+// unarmor returns the binary value of an armored value, other values are returned as they are so both
+// modes can be read at any time
+func unarmor(value []byte) ([]byte, error) {
+	if !bytes.HasPrefix(value, armorBegin) {
+		return value, nil
+	}
+	block, _ := pem.Decode(value)
+	if block == nil || block.Type != armorType {
+		return nil, errors.New("invalid armored value")
+	}
+	return block.Bytes, nil
+}
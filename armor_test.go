@@ -0,0 +1,38 @@
+package storageconsul
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_ArmorValues(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+
+	require.NoError(t, cs.Store("certificates/binary.com", []byte("binary")))
+	cs.ArmorValues = true
+	require.NoError(t, cs.Store("certificates/armored.com", []byte("armored")))
+
+	pair := fc.kv[cs.prefixKey("certificates/armored.com")]
+	assert.True(t, strings.HasPrefix(string(pair.Value), "-----BEGIN CADDY STORAGE VALUE-----\n"))
+	assert.True(t, strings.HasSuffix(string(pair.Value), "-----END CADDY STORAGE VALUE-----\n"))
+	format, ok := ParseValueFormat(pair.Flags)
+	require.True(t, ok)
+	assert.True(t, format.Armored)
+
+	// both modes are read regardless of the setting
+	for _, armor := range []bool{true, false} {
+		cs.ArmorValues = armor
+		loaded, err := cs.Load("certificates/armored.com")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("armored"), loaded)
+		loaded, err = cs.Load("certificates/binary.com")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("binary"), loaded)
+	}
+
+	_, err := unarmor([]byte("-----BEGIN CADDY STORAGE VALUE-----\nnot base64"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,95 @@
+package storageconsul
+
+import (
+	consul "github.com/hashicorp/consul/api"
+)
+
+const (
+	// BackendConsul stores values in Consul KV, it is the default
+	BackendConsul = "consul"
+
+	// BackendNomad stores values in Nomad Variables
+	BackendNomad = "nomad"
+)
+
+// Interface guards
+var (
+	_ kvStore    = (*consul.KV)(nil)
+	_ locker     = (*consul.Lock)(nil)
+	_ kvBackend  = (*consulStore)(nil)
+	_ kvBackend  = (*nomadStore)(nil)
+	_ kvBackend  = (*memoryStore)(nil)
+	_ kvTxn      = (*consul.Txn)(nil)
+	_ kvTxn      = (*consulStore)(nil)
+	_ kvTxn      = (*memoryStore)(nil)
+	_ kvSessions = (*consulStore)(nil)
+	_ kvEvents   = (*consulStore)(nil)
+)
+
+// kvStore is the part of Consul's KV API the storage uses, it is implemented by *consul.KV
+// and by the Nomad Variables backend
+type kvStore interface {
+	Get(key string, q *consul.QueryOptions) (*consul.KVPair, *consul.QueryMeta, error)
+	List(prefix string, q *consul.QueryOptions) (consul.KVPairs, *consul.QueryMeta, error)
+	Keys(prefix, separator string, q *consul.QueryOptions) ([]string, *consul.QueryMeta, error)
+	Put(p *consul.KVPair, q *consul.WriteOptions) (*consul.WriteMeta, error)
+	CAS(p *consul.KVPair, q *consul.WriteOptions) (bool, *consul.WriteMeta, error)
+	DeleteCAS(p *consul.KVPair, q *consul.WriteOptions) (bool, *consul.WriteMeta, error)
+	DeleteTree(prefix string, w *consul.WriteOptions) (*consul.WriteMeta, error)
+}
+
+// locker is a distributed lock, it is implemented by *consul.Lock and by Nomad variable locks
+type locker interface {
+	Lock(stopCh <-chan struct{}) (<-chan struct{}, error)
+	Unlock() error
+}
+
+// kvBackend stores the values and locks of the storage, it is implemented by Consul KV and by the
+// Nomad Variables and memory backends
+type kvBackend interface {
+	kvStore
+
+	// newLock returns the distributed lock for the Consul key consulKey, value is stored with the
+	// lock while it is held
+	newLock(consulKey string, value []byte) (locker, error)
+
+	// limitsKeys reports whether the backend limits the length of keys, long keys are always hashed then
+	limitsKeys() bool
+
+	// fitsKey reports whether consulKey can be stored as is, other keys are stored under their hash
+	fitsKey(consulKey string) bool
+
+	// close releases the connections of the backend
+	close()
+}
+
+// kvSessions is implemented by backends whose keys can be bound to sessions that are deleted or released
+// once the session is gone, like Consul KV
+type kvSessions interface {
+	Session() *consul.Session
+	Acquire(p *consul.KVPair, q *consul.WriteOptions) (bool, *consul.WriteMeta, error)
+}
+
+// kvEvents is implemented by backends that can fire user events, like Consul
+type kvEvents interface {
+	Event() *consul.Event
+}
+
+// kv returns the backend to access key with
+func (cs *ConsulStorage) kv(key string) kvBackend {
+	return cs.clientKV(cs.client(key))
+}
+
+// clientKV returns the backend to access the keys of client with, the Consul KV of the client unless
+// the storage uses another backend
+func (cs *ConsulStorage) clientKV(client *consul.Client) kvBackend {
+	if cs.backend != nil {
+		return cs.backend
+	}
+	return newConsulStore(cs, client)
+}
+
+// defaultKV returns the backend of the default prefix
+func (cs *ConsulStorage) defaultKV() kvBackend {
+	return cs.clientKV(cs.ConsulClient)
+}
@@ -0,0 +1,245 @@
+package storageconsul
+
+import (
+	"bytes"
+	"context"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/pteich/errors"
+)
+
+// Defaults of scheduled backups
+const (
+	DefaultBackupInterval = 24 * time.Hour
+	DefaultBackupKeep     = 7
+	DefaultBackupRegion   = "us-east-1"
+)
+
+// backupLockKey is the lock that keeps instances from uploading the same backup at once
+const backupLockKey = "backup_archive"
+
+// backupSuffix is the suffix of the objects of backups
+const backupSuffix = ".archive"
+
+// BackupConfig configures scheduled backups of the storage to an S3-compatible object storage, every
+// interval one instance uploads an encrypted archive of all keys and prunes the oldest backups
+type BackupConfig struct {
+	// Endpoint is the URL of the S3 API, e.g. https://s3.eu-central-1.amazonaws.com
+	Endpoint string `json:"endpoint"`
+	Bucket   string `json:"bucket"`
+	Region   string `json:"region"`
+	// AccessKey and SecretKey default to the AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	// Path is the object key prefix of the backups, the storage prefix by default
+	Path string `json:"path"`
+	// Interval is the time between backups, 24h by default
+	Interval caddy.Duration `json:"interval"`
+	// Keep is the number of backups that are kept, 7 by default
+	Keep int `json:"keep"`
+}
+
+// backupsEnabled reports whether scheduled backups are configured
+func (cs *ConsulStorage) backupsEnabled() bool {
+	return cs.Backup.Bucket != ""
+}
+
+// backupClient returns the S3 client of the configured backups
+func (cs *ConsulStorage) backupClient() (*s3Client, error) {
+	b := cs.Backup
+	region, accessKey, secretKey := b.Region, b.AccessKey, b.SecretKey
+	if region == "" {
+		region = DefaultBackupRegion
+	}
+	if accessKey == "" {
+		accessKey = cs.getenv("AWS_ACCESS_KEY_ID")
+	}
+	if secretKey == "" {
+		secretKey = cs.getenv("AWS_SECRET_ACCESS_KEY")
+	}
+	return newS3Client(b.Endpoint, b.Bucket, region, accessKey, secretKey)
+}
+
+// backupPath returns the object key prefix of the backups
+func (cs *ConsulStorage) backupPath() string {
+	if cs.Backup.Path != "" {
+		return strings.Trim(cs.Backup.Path, "/") + "/"
+	}
+	return strings.Trim(cs.Prefix, "/") + "/"
+}
+
+func (cs *ConsulStorage) backupInterval() time.Duration {
+	if cs.Backup.Interval > 0 {
+		return time.Duration(cs.Backup.Interval)
+	}
+	return DefaultBackupInterval
+}
+
+// listBackups returns the backups in the bucket, oldest first
+func (cs *ConsulStorage) listBackups(ctx context.Context, client *s3Client) ([]s3Object, error) {
+	objects, err := client.list(ctx, cs.backupPath())
+	if err != nil {
+		return nil, err
+	}
+
+	backups := objects[:0]
+	for _, obj := range objects {
+		if strings.HasSuffix(obj.Key, backupSuffix) {
+			backups = append(backups, obj)
+		}
+	}
+	// names start with the time of the backup
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Key < backups[j].Key })
+	return backups, nil
+}
+
+// UploadBackup uploads an encrypted archive of all keys to the configured bucket, prunes old backups and
+// returns the object key of the backup
+func (cs *ConsulStorage) UploadBackup(ctx context.Context) (string, error) {
+	// archives contain the private keys
+	if len(cs.AESKey) == 0 {
+		return "", errors.New("backups need an aes_key to encrypt the archives")
+	}
+
+	client, err := cs.backupClient()
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	n, err := cs.WriteArchive(ctx, &buf)
+	if err != nil {
+		return "", err
+	}
+
+	name := cs.backupPath() + time.Now().UTC().Format("20060102T150405Z") + backupSuffix
+	if err := client.put(ctx, name, buf.Bytes()); err != nil {
+		return "", errors.Wrap(err, "unable to upload backup")
+	}
+	cs.logger.Infof("uploaded backup of %d keys to %s", n, path.Join(cs.Backup.Bucket, name))
+
+	if err := cs.pruneBackups(ctx, client); err != nil {
+		cs.logger.Warnf("unable to prune old backups: %v", err)
+	}
+	return name, nil
+}
+
+// pruneBackups deletes all but the newest backups to keep
+func (cs *ConsulStorage) pruneBackups(ctx context.Context, client *s3Client) error {
+	keep := cs.Backup.Keep
+	if keep <= 0 {
+		keep = DefaultBackupKeep
+	}
+
+	backups, err := cs.listBackups(ctx, client)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		if err := client.delete(ctx, backups[0].Key); err != nil {
+			return err
+		}
+		cs.logger.Infof("pruned backup %s", backups[0].Key)
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// RestoreBackup restores the backup with the object key name, the latest one if name is empty
+func (cs *ConsulStorage) RestoreBackup(ctx context.Context, name string) (int, error) {
+	client, err := cs.backupClient()
+	if err != nil {
+		return 0, err
+	}
+
+	if name == "" {
+		backups, err := cs.listBackups(ctx, client)
+		if err != nil {
+			return 0, err
+		}
+		if len(backups) == 0 {
+			return 0, errors.Errorf("no backups in %s", path.Join(cs.Backup.Bucket, cs.backupPath()))
+		}
+		name = backups[len(backups)-1].Key
+	}
+
+	archive, err := client.get(ctx, name)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to download backup %s", name)
+	}
+	return cs.RestoreArchive(ctx, bytes.NewReader(archive))
+}
+
+// runBackups uploads a backup whenever the latest one is older than the interval until stop is closed
+func (cs *ConsulStorage) runBackups(stop <-chan struct{}) {
+	// check more often than the interval, so a backup another instance missed is made up for soon
+	check := cs.backupInterval() / 4
+	if check > time.Hour {
+		check = time.Hour
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+
+	for {
+		if err := cs.scheduledBackup(stop); err != nil {
+			cs.logger.Errorf("scheduled backup failed: %v", err)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// scheduledBackup uploads a backup if the latest one is older than the interval, a lock keeps instances
+// from uploading at the same time
+func (cs *ConsulStorage) scheduledBackup(stop <-chan struct{}) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	client, err := cs.backupClient()
+	if err != nil {
+		return err
+	}
+	due := func() (bool, error) {
+		backups, err := cs.listBackups(ctx, client)
+		if err != nil {
+			return false, err
+		}
+		return len(backups) == 0 || time.Since(backups[len(backups)-1].LastModified) >= cs.backupInterval(), nil
+	}
+
+	if ok, err := due(); err != nil || !ok {
+		return err
+	}
+
+	// another instance holding the lock is uploading the backup right now
+	lockCtx, lockCancel := context.WithTimeout(ctx, time.Second)
+	defer lockCancel()
+	if err := cs.Lock(lockCtx, backupLockKey); err != nil {
+		if _, taken := err.(LockTimeoutError); taken {
+			return nil
+		}
+		return err
+	}
+	defer cs.Unlock(backupLockKey)
+
+	if ok, err := due(); err != nil || !ok {
+		return err
+	}
+	_, err = cs.UploadBackup(ctx)
+	return err
+}
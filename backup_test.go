@@ -0,0 +1,140 @@
+package storageconsul
+
+import (
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 is a minimal in-memory implementation of the S3 API of a single bucket for unit tests
+type fakeS3 struct {
+	*httptest.Server
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	fs := &fakeS3{objects: make(map[string][]byte)}
+	fs.Server = httptest.NewServer(http.HandlerFunc(fs.handle))
+	t.Cleanup(fs.Close)
+	return fs
+}
+
+func (fs *fakeS3) handle(w http.ResponseWriter, r *http.Request) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		result := s3ListResult{}
+		for name := range fs.objects {
+			if strings.HasPrefix(name, r.URL.Query().Get("prefix")) {
+				result.Contents = append(result.Contents, s3Object{Key: name, LastModified: time.Now(), Size: int64(len(fs.objects[name]))})
+			}
+		}
+		sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+		xml.NewEncoder(w).Encode(result)
+	case r.Method == http.MethodGet:
+		obj, exists := fs.objects[key]
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write(obj)
+	case r.Method == http.MethodPut:
+		fs.objects[key], _ = ioutil.ReadAll(r.Body)
+	case r.Method == http.MethodDelete:
+		delete(fs.objects, key)
+	}
+}
+
+func TestConsulStorage_Backup(t *testing.T) {
+	s3 := newFakeS3(t)
+	cs, _ := newFakeConsulStorage(t)
+	cs.Backup = BackupConfig{Endpoint: s3.URL, Bucket: "bucket", AccessKey: "access", SecretKey: "secret", Keep: 2}
+
+	// older backups beyond the ones to keep are pruned
+	s3.objects["caddytls/20200101T000000Z.archive"] = []byte("old")
+	s3.objects["caddytls/20200102T000000Z.archive"] = []byte("old")
+
+	require.NoError(t, cs.Store("certificates/example.com/example.com.crt", []byte("crt")))
+	name, err := cs.UploadBackup(context.Background())
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(name, "caddytls/"))
+
+	var names []string
+	for name := range s3.objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"caddytls/20200102T000000Z.archive", name}, names)
+
+	require.NoError(t, cs.Delete("certificates/example.com/example.com.crt"))
+	n, err := cs.RestoreBackup(context.Background(), "")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.True(t, cs.Exists("certificates/example.com/example.com.crt"))
+}
+
+func TestConsulStorage_ScheduledBackup(t *testing.T) {
+	s3 := newFakeS3(t)
+	cs, _ := newFakeConsulStorage(t)
+	cs.Backup = BackupConfig{Endpoint: s3.URL, Bucket: "bucket", AccessKey: "access", SecretKey: "secret"}
+
+	require.NoError(t, cs.scheduledBackup(make(chan struct{})))
+	require.Len(t, s3.objects, 1)
+
+	// the latest backup is recent enough
+	require.NoError(t, cs.scheduledBackup(make(chan struct{})))
+	assert.Len(t, s3.objects, 1)
+}
+
+func TestConsulStorage_BackupNeedsKey(t *testing.T) {
+	s3 := newFakeS3(t)
+	cs, _ := newFakeConsulStorage(t)
+	cs.Backup = BackupConfig{Endpoint: s3.URL, Bucket: "bucket", AccessKey: "access", SecretKey: "secret"}
+	cs.AESKey = nil
+
+	assert.Error(t, cs.Validate())
+	_, err := cs.UploadBackup(context.Background())
+	assert.Error(t, err)
+	assert.Empty(t, s3.objects)
+}
+
+func TestConsulStorage_ScheduledBackupLockError(t *testing.T) {
+	s3 := newFakeS3(t)
+	cs, _ := newFakeConsulStorage(t)
+	cs.Backup = BackupConfig{Endpoint: s3.URL, Bucket: "bucket", AccessKey: "access", SecretKey: "secret"}
+
+	cs.Timeout = 1
+
+	// another instance uploads the backup
+	other := New()
+	other.ConsulClient = cs.ConsulClient
+	require.NoError(t, other.Lock(context.Background(), backupLockKey))
+	defer other.Unlock(backupLockKey)
+
+	assert.NoError(t, cs.scheduledBackup(make(chan struct{})))
+	assert.Empty(t, s3.objects)
+}
+
+func TestAWSCanonicalQuery(t *testing.T) {
+	assert.Equal(t, "list-type=2&prefix=caddy%20tls%2F", awsCanonicalQuery(map[string][]string{"prefix": {"caddy tls/"}, "list-type": {"2"}}))
+	assert.Equal(t, "/bucket/caddy%2Btls/a~b.archive", awsEscapePath("/bucket/caddy+tls/a~b.archive"))
+}
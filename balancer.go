@@ -0,0 +1,199 @@
+package storageconsul
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultEndpointCooldown is the time an endpoint that failed a request is skipped
+const DefaultEndpointCooldown = 10 * time.Second
+
+// endpoint is a Consul agent requests are sent to together with its health
+type endpoint struct {
+	host string
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+func (e *endpoint) healthy(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !now.Before(e.downUntil)
+}
+
+func (e *endpoint) markDown(cooldown time.Duration) {
+	e.mu.Lock()
+	e.downUntil = time.Now().Add(cooldown)
+	e.mu.Unlock()
+}
+
+// balancedTransport spreads stale reads round-robin over all healthy endpoints and pins all other requests,
+// writes, consistent reads and session requests, to one healthy endpoint, which only changes once it fails.
+// Endpoints failing a request or answering that their servers can't serve it are skipped for the cooldown,
+// failed reads are retried on the next endpoint.
+type balancedTransport struct {
+	next      http.RoundTripper
+	endpoints []*endpoint
+	cooldown  time.Duration
+
+	// counter is the round-robin position of stale reads, pinned is the index of the pinned endpoint
+	counter uint32
+	pinned  uint32
+}
+
+func newBalancedTransport(next http.RoundTripper, hosts []string) *balancedTransport {
+	t := &balancedTransport{next: next, cooldown: DefaultEndpointCooldown}
+	for _, host := range hosts {
+		t.endpoints = append(t.endpoints, &endpoint{host: host})
+	}
+	return t
+}
+
+// serverFailed reports whether resp says the endpoint can't serve requests right now, e.g. because its
+// servers lost their leader. A 500 is only a failure of the endpoint with an error like that, Consul also
+// answers with it for rejected requests, e.g. acquiring a lock with an invalidated session.
+func serverFailed(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	case http.StatusInternalServerError:
+		body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err != nil {
+			return true
+		}
+		msg := strings.ToLower(string(body))
+		return strings.Contains(msg, "no cluster leader") || strings.Contains(msg, "rpc error")
+	}
+	return false
+}
+
+// isStaleRead reports whether any endpoint may answer req
+func isStaleRead(req *http.Request) bool {
+	_, stale := req.URL.Query()["stale"]
+	return req.Method == http.MethodGet && stale
+}
+
+func (t *balancedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	stale := isStaleRead(req)
+	start := int(atomic.LoadUint32(&t.pinned))
+	if stale {
+		start = int(atomic.AddUint32(&t.counter, 1))
+	}
+
+	// only reads are retried, a failed write may have been applied by Consul already
+	retry := req.Method == http.MethodGet
+	order := t.order(start)
+	var resp *http.Response
+	var err error
+	for _, i := range order {
+		e := t.endpoints[i]
+		attempt := req.Clone(req.Context())
+		attempt.URL.Host = e.host
+		attempt.Host = ""
+
+		resp, err = t.next.RoundTrip(attempt)
+		if err == nil && !serverFailed(resp) {
+			if !stale {
+				atomic.StoreUint32(&t.pinned, uint32(i))
+			}
+			return resp, nil
+		}
+
+		// the response of the last endpoint tried is returned even if it failed
+		e.markDown(t.cooldown)
+		if !retry || req.Context().Err() != nil || i == order[len(order)-1] {
+			break
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}
+	return resp, err
+}
+
+// order returns the indexes of the healthy endpoints starting at start, followed by the unhealthy ones, so
+// requests are still tried when all endpoints failed recently
+func (t *balancedTransport) order(start int) []int {
+	now := time.Now()
+	order := make([]int, 0, len(t.endpoints))
+	var down []int
+	for n := 0; n < len(t.endpoints); n++ {
+		i := (start + n) % len(t.endpoints)
+		if t.endpoints[i].healthy(now) {
+			order = append(order, i)
+		} else {
+			down = append(down, i)
+		}
+	}
+	return append(order, down...)
+}
+
+// endpointHosts returns the hosts of address and the agent addresses of cc without duplicates
+func (cc ConnectionConfig) endpointHosts(address string) []string {
+	var hosts []string
+	seen := make(map[string]bool)
+	for _, addr := range append([]string{address}, cc.AgentAddresses...) {
+		if i := strings.Index(addr, "://"); i >= 0 {
+			addr = addr[i+3:]
+		}
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			hosts = append(hosts, addr)
+		}
+	}
+	return hosts
+}
+
+// splitTransport sends reads to a separate endpoint, e.g. the local agent, and all other requests, writes,
+// transactions and session requests, to next. Reads the read endpoint fails, including with a server error
+// like a missing leader, are retried with next.
+type splitTransport struct {
+	next   http.RoundTripper
+	reads  http.RoundTripper
+	scheme string
+	host   string
+}
+
+func newSplitTransport(next, reads http.RoundTripper, readAddress string) *splitTransport {
+	t := &splitTransport{next: next, reads: reads, host: readAddress}
+	if i := strings.Index(readAddress, "://"); i >= 0 {
+		t.scheme, t.host = readAddress[:i], readAddress[i+3:]
+	}
+	return t
+}
+
+// isRead reports whether req only reads and may be answered by the read endpoint, sessions are always
+// handled by the write endpoint, so locks belong to its node
+func isRead(req *http.Request) bool {
+	return req.Method == http.MethodGet && !strings.HasPrefix(req.URL.Path, "/v1/session/")
+}
+
+func (t *splitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !isRead(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	read := req.Clone(req.Context())
+	read.URL.Host = t.host
+	read.Host = ""
+	if t.scheme != "" {
+		read.URL.Scheme = t.scheme
+	}
+	resp, err := t.reads.RoundTrip(read)
+	if (err != nil || serverFailed(resp)) && req.Context().Err() == nil {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		return t.next.RoundTrip(req)
+	}
+	return resp, err
+}
@@ -0,0 +1,170 @@
+package storageconsul
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingAgents are HTTP servers counting the requests they received
+type countingAgents struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (ca *countingAgents) start(t *testing.T) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ca.mu.Lock()
+		ca.counts[r.Host]++
+		ca.mu.Unlock()
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+func TestBalancedTransport(t *testing.T) {
+	agents := &countingAgents{counts: make(map[string]int)}
+	a, b := agents.start(t), agents.start(t)
+	client := &http.Client{Transport: newBalancedTransport(http.DefaultTransport, []string{a, b})}
+
+	get := func(url string) {
+		resp, err := client.Get(url)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	for i := 0; i < 4; i++ {
+		get("http://" + a + "/v1/kv/caddytls/key?stale=")
+	}
+	assert.Equal(t, map[string]int{a: 2, b: 2}, agents.counts)
+
+	agents.counts = make(map[string]int)
+	for i := 0; i < 4; i++ {
+		get("http://" + a + "/v1/kv/caddytls/key?consistent=")
+	}
+	assert.Equal(t, map[string]int{a: 4}, agents.counts)
+}
+
+func TestBalancedTransport_Failover(t *testing.T) {
+	agents := &countingAgents{counts: make(map[string]int)}
+	b := agents.start(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	a := strings.TrimPrefix(down.URL, "http://")
+	down.Close()
+
+	transport := newBalancedTransport(http.DefaultTransport, []string{a, b})
+	client := &http.Client{Transport: transport}
+
+	// the read is retried on the next agent
+	resp, err := client.Get("http://" + a + "/v1/kv/caddytls/key")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, map[string]int{b: 1}, agents.counts)
+	assert.Equal(t, uint32(1), transport.pinned)
+
+	// the failed agent is skipped
+	req, err := http.NewRequest(http.MethodPut, "http://"+a+"/v1/kv/caddytls/key", strings.NewReader("value"))
+	require.NoError(t, err)
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, map[string]int{b: 2}, agents.counts)
+}
+
+func TestConnectionConfig_EndpointHosts(t *testing.T) {
+	cc := ConnectionConfig{AgentAddresses: []string{"https://10.0.0.2:8500", "127.0.0.1:8500", "10.0.0.3:8500"}}
+	assert.Equal(t, []string{"127.0.0.1:8500", "10.0.0.2:8500", "10.0.0.3:8500"}, cc.endpointHosts("127.0.0.1:8500"))
+}
+
+func TestSplitTransport(t *testing.T) {
+	agents := &countingAgents{counts: make(map[string]int)}
+	server, agent := agents.start(t), agents.start(t)
+	client := &http.Client{Transport: newSplitTransport(http.DefaultTransport, http.DefaultTransport, "http://"+agent)}
+
+	do := func(method, path string) {
+		req, err := http.NewRequest(method, "http://"+server+path, nil)
+		require.NoError(t, err)
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	do(http.MethodGet, "/v1/kv/caddytls/key")
+	do(http.MethodGet, "/v1/kv/caddytls/key?index=12")
+	assert.Equal(t, map[string]int{agent: 2}, agents.counts)
+
+	agents.counts = make(map[string]int)
+	do(http.MethodPut, "/v1/kv/caddytls/key")
+	do(http.MethodPut, "/v1/txn")
+	do(http.MethodGet, "/v1/session/info/123")
+	assert.Equal(t, map[string]int{server: 3}, agents.counts)
+
+	// reads fall back to the write endpoint if the agent is down
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	client.Transport = newSplitTransport(http.DefaultTransport, http.DefaultTransport, down.URL)
+	agents.counts = make(map[string]int)
+	do(http.MethodGet, "/v1/kv/caddytls/key")
+	assert.Equal(t, map[string]int{server: 1}, agents.counts)
+}
+
+func TestBalancedTransport_ServerErrors(t *testing.T) {
+	agents := &countingAgents{counts: make(map[string]int)}
+	b := agents.start(t)
+	status, body := http.StatusInternalServerError, "No cluster leader"
+	leaderless := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, body, status)
+	}))
+	t.Cleanup(leaderless.Close)
+	a := strings.TrimPrefix(leaderless.URL, "http://")
+
+	// reads answered without a leader are retried on the next agent, which is pinned then
+	transport := newBalancedTransport(http.DefaultTransport, []string{a, b})
+	client := &http.Client{Transport: transport}
+	resp, err := client.Get("http://" + a + "/v1/kv/caddytls/key")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]int{b: 1}, agents.counts)
+	assert.Equal(t, uint32(1), transport.pinned)
+
+	status = http.StatusServiceUnavailable
+	transport = newBalancedTransport(http.DefaultTransport, []string{a, b})
+	client.Transport = transport
+	resp, err = client.Get("http://" + a + "/v1/kv/caddytls/key")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]int{b: 2}, agents.counts)
+
+	// other errors are answers of a healthy endpoint and returned as they are
+	status, body = http.StatusInternalServerError, "invalid session"
+	transport = newBalancedTransport(http.DefaultTransport, []string{a, b})
+	client.Transport = transport
+	req, err := http.NewRequest(http.MethodPut, "http://"+a+"/v1/kv/caddytls/key?acquire=123", nil)
+	require.NoError(t, err)
+	resp, err = client.Do(req)
+	require.NoError(t, err)
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Equal(t, "invalid session\n", string(respBody))
+	assert.True(t, transport.endpoints[0].healthy(time.Now()))
+
+	// reads of the read endpoint without a leader fall back to the write endpoint
+	status, body = http.StatusInternalServerError, "No cluster leader"
+	client.Transport = newSplitTransport(http.DefaultTransport, http.DefaultTransport, leaderless.URL)
+	resp, err = client.Get("http://" + b + "/v1/kv/caddytls/key")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, map[string]int{b: 3}, agents.counts)
+}
@@ -0,0 +1,51 @@
+package storageconsul
+
+import "strings"
+
+// Encrypted values are bound to their key by passing the path of the key below the prefix as additional
+// data to AES-GCM, so a value copied or moved to another key fails to decrypt. Values below the fallback
+// prefix or of a tenant stay valid, as the prefix isn't part of the path.
+const (
+	// bindingFormatVersion is the first format version that binds encrypted values to their key
+	bindingFormatVersion = 2
+
+	// unboundFormat is the format of encrypted values written by versions that didn't bind them to their key
+	unboundFormat = "unbound"
+)
+
+// bindsValues reports whether new writes bind encrypted values to their key, values that aren't are
+// migrated once loaded
+func (cs *ConsulStorage) bindsValues() bool {
+	return len(cs.AESKey) > 0 && cs.writeFormatVersion() >= bindingFormatVersion
+}
+
+// requiresBinding reports whether encrypted values that aren't bound to their key are rejected
+func (cs *ConsulStorage) requiresBinding() bool {
+	return cs.RequireBoundValues && cs.bindsValues()
+}
+
+// boundKey returns the path below the prefix the value of key is bound to, for hashed keys this is the
+// hashed path so values listed without knowing their key can still be decrypted
+func (cs *ConsulStorage) boundKey(key string) string {
+	key = strings.Trim(normalizeKey(key), "/")
+	// paths of listed hashed values are bound as they are
+	if strings.HasPrefix(key, hashedKeysDir+"/") {
+		return key
+	}
+	if cs.isHashedKey(key) {
+		return hashedName(key)
+	}
+	return key
+}
+
+// EncryptStorageDataForKey encrypts data like EncryptStorageData but binds it to key, the result only
+// decrypts with DecryptStorageDataForKey and the same key. This is how Store encrypts values.
+func (cs *ConsulStorage) EncryptStorageDataForKey(key string, data *StorageData) ([]byte, error) {
+	return cs.encryptStorageData([]byte(cs.boundKey(key)), data)
+}
+
+// DecryptStorageDataForKey decrypts a value stored for key, values written by versions that didn't bind
+// them to their key are decrypted as well
+func (cs *ConsulStorage) DecryptStorageDataForKey(key string, bytes []byte) (*StorageData, error) {
+	return cs.decodeVersioned([]byte(cs.boundKey(key)), bytes)
+}
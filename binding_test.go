@@ -0,0 +1,90 @@
+package storageconsul
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_ValuesAreBoundToTheirKey(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+
+	require.NoError(t, cs.Store("certificates/a.example.com/a.example.com.key", []byte("key a")))
+	require.NoError(t, cs.Store("certificates/b.example.com/b.example.com.key", []byte("key b")))
+
+	// a value swapped to another key fails to decrypt
+	fc.kv[cs.prefixKey("certificates/b.example.com/b.example.com.key")].Value = fc.kv[cs.prefixKey("certificates/a.example.com/a.example.com.key")].Value
+	_, err := cs.Load("certificates/b.example.com/b.example.com.key")
+	assert.Error(t, err)
+
+	loaded, err := cs.Load("certificates/a.example.com/a.example.com.key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("key a"), loaded)
+}
+
+func TestConsulStorage_LoadBindsUnboundValues(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+
+	key := "certificates/example.com/example.com.crt"
+	require.NoError(t, cs.Store(key, []byte("placeholder")))
+
+	// a value written by a version without key binding
+	unbound, err := cs.DecryptStorageDataForKey(key, fc.kv[cs.prefixKey(key)].Value)
+	require.NoError(t, err)
+	unbound.Value, unbound.Checksum = []byte("crt data"), checksum([]byte("crt data"))
+	payload, err := cs.encryptStorageData(nil, unbound)
+	require.NoError(t, err)
+	fc.kv[cs.prefixKey(key)].Value = append([]byte(valueHeaderMagic+"\x01"), valuePayload(payload)...)
+
+	loaded, err := cs.Load(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), loaded)
+
+	// the value is rewritten bound to its key
+	migrated := fc.kv[cs.prefixKey(key)].Value
+	assert.True(t, strings.HasPrefix(string(migrated), valueHeaderMagic+"\x02"))
+	_, err = cs.DecryptStorageData(migrated)
+	assert.Error(t, err)
+	data, err := cs.DecryptStorageDataForKey(key, migrated)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), data.Value)
+}
+
+func TestConsulStorage_RequireBoundValues(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.RequireBoundValues = true
+
+	key := "certificates/example.com/example.com.key"
+	require.NoError(t, cs.Store(key, []byte("key")))
+
+	// an unbound value copied from another key
+	payload, err := cs.encryptStorageData(nil, &StorageData{Value: []byte("other key"), Checksum: checksum([]byte("other key"))})
+	require.NoError(t, err)
+	unbound := append([]byte(valueHeaderMagic+"\x01"), valuePayload(payload)...)
+	fc.kv[cs.prefixKey(key)].Value = unbound
+
+	_, err = cs.Load(key)
+	assert.Error(t, err)
+	assert.Equal(t, unbound, fc.kv[cs.prefixKey(key)].Value)
+}
+
+func TestConsulStorage_HashedValuesAreBoundToTheirHash(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+	cs.HashLongKeys = true
+	cs.MaxKeyLength = 64
+
+	longKey := "certificates/" + strings.Repeat("a", 80) + ".example.com"
+	require.NoError(t, cs.Store(longKey, []byte("long")))
+
+	keys, err := cs.List("certificates", true)
+	require.NoError(t, err)
+	assert.Contains(t, keys, longKey)
+
+	res, err := cs.ScanIntegrity(context.Background(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, 1, res.Checked)
+	assert.Empty(t, res.Failures)
+}
@@ -0,0 +1,77 @@
+package storageconsul
+
+import (
+	"context"
+	"sort"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// StoreBundle stores the values of related keys, e.g. a certificate together with its private key and
+// metadata, in one Consul transaction so a crash never leaves only some of them written. The keys have
+// to belong to the same tenant and there may be up to 64 of them. Backends without transactions like
+// Nomad store the values one after another.
+func (cs *ConsulStorage) StoreBundle(ctx context.Context, values map[string][]byte) error {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		if err := validateKey(key); err != nil {
+			return err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+
+	if len(keys) > maxTxnOps {
+		return errors.Errorf("bundle of %d keys exceeds the limit of %d keys per transaction", len(keys), maxTxnOps)
+	}
+	for _, key := range keys[1:] {
+		if cs.keyPrefix(key) != cs.keyPrefix(keys[0]) {
+			return errors.Errorf("keys %s and %s of the bundle belong to different tenants", keys[0], key)
+		}
+	}
+
+	ctx, cancel := withTimeout(ctx, cs.WriteTimeout)
+	defer cancel()
+	defer func() {
+		for _, key := range keys {
+			cs.invalidateStat(key)
+		}
+	}()
+
+	if _, ok := cs.txn(keys[0]); !ok {
+		for _, key := range keys {
+			if err := cs.StoreContext(ctx, key, values[key]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	ops := make(consul.TxnOps, 0, len(keys))
+	for _, key := range keys {
+		kv, err := cs.encodePair(ctx, key, values[key])
+		if err == nil {
+			err = cs.reserveQuota(ctx, key, kv)
+		}
+		if err != nil {
+			cs.forgetQuotas(keys)
+			return err
+		}
+		ops = append(ops, &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVSet, Key: kv.Key, Value: kv.Value, Flags: kv.Flags}})
+	}
+
+	cs.logger.Debugf("storing bundle of %d keys in Consul", len(keys))
+	if _, err := cs.runTxn(ctx, keys[0], ops); err != nil {
+		cs.forgetQuotas(keys)
+		return errors.Wrapf(err, "unable to store bundle of %s", keys[0])
+	}
+	for _, key := range keys {
+		cs.fireCertEvent(ctx, CertUpdatedEvent, key)
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package storageconsul
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_StoreBundle(t *testing.T) {
+	bundle := map[string][]byte{
+		"certificates/example.com/example.com.crt":  []byte("crt"),
+		"certificates/example.com/example.com.key":  []byte("key"),
+		"certificates/example.com/example.com.json": []byte("{}"),
+	}
+
+	fakeConsul, _ := newFakeConsulStorage(t)
+	for name, cs := range map[string]*ConsulStorage{"memory": setupConsulEnv(t), "consul": fakeConsul} {
+		t.Run(name, func(t *testing.T) {
+			require.NoError(t, cs.StoreBundle(context.Background(), bundle))
+			for key, value := range bundle {
+				loaded, err := cs.Load(key)
+				require.NoError(t, err)
+				assert.Equal(t, value, loaded)
+			}
+		})
+	}
+}
+
+func TestConsulStorage_StoreBundleTooLarge(t *testing.T) {
+	cs := setupConsulEnv(t)
+
+	bundle := make(map[string][]byte)
+	for i := 0; i <= maxTxnOps; i++ {
+		bundle["certificates/"+strconv.Itoa(i)] = []byte("crt")
+	}
+	assert.Error(t, cs.StoreBundle(context.Background(), bundle))
+	assert.False(t, cs.Exists("certificates/0"))
+}
+
+func TestConsulStorage_RunTxnRolledBack(t *testing.T) {
+	cs := setupConsulEnv(t)
+	require.NoError(t, cs.Store("certificates/example.com", []byte("crt")))
+
+	// the Check-And-Set fails as the key exists, so the first operation isn't applied either
+	_, err := cs.runTxn(context.Background(), "certificates/a.example.com", consul.TxnOps{
+		{KV: &consul.KVTxnOp{Verb: consul.KVSet, Key: cs.prefixKey("certificates/a.example.com"), Value: []byte("a")}},
+		{KV: &consul.KVTxnOp{Verb: consul.KVCAS, Key: cs.prefixKey("certificates/example.com"), Index: 0}},
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "cas "+cs.prefixKey("certificates/example.com"))
+	assert.False(t, cs.Exists("certificates/a.example.com"))
+}
@@ -0,0 +1,233 @@
+package storageconsul
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/caddyserver/certmagic"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// CASConflictError is returned by StoreCAS if the key was modified since the given index
+type CASConflictError struct {
+	Key   string
+	Index uint64
+}
+
+func (e CASConflictError) Error() string {
+	if e.Index == 0 {
+		return fmt.Sprintf("%s exists already", e.Key)
+	}
+	return fmt.Sprintf("%s was modified since index %d", e.Key, e.Index)
+}
+
+// seenIndexesSize is the number of keys whose modify index is remembered, the least recently used ones
+// are forgotten beyond it like keys that were never loaded
+const seenIndexesSize = 4096
+
+// keyIndexes remembers the modify index keys had when this instance last loaded or stored them
+type keyIndexes struct {
+	mu      sync.Mutex
+	indexes map[string]*list.Element
+	order   *list.List
+}
+
+type keyIndex struct {
+	key   string
+	index uint64
+}
+
+func newKeyIndexes() *keyIndexes {
+	return &keyIndexes{indexes: make(map[string]*list.Element), order: list.New()}
+}
+
+func (ki *keyIndexes) get(key string) uint64 {
+	ki.mu.Lock()
+	defer ki.mu.Unlock()
+	elem, ok := ki.indexes[key]
+	if !ok {
+		return 0
+	}
+	ki.order.MoveToFront(elem)
+	return elem.Value.(*keyIndex).index
+}
+
+func (ki *keyIndexes) set(key string, index uint64) {
+	ki.mu.Lock()
+	defer ki.mu.Unlock()
+	if elem, ok := ki.indexes[key]; ok {
+		if index == 0 {
+			ki.order.Remove(elem)
+			delete(ki.indexes, key)
+			return
+		}
+		elem.Value.(*keyIndex).index = index
+		ki.order.MoveToFront(elem)
+		return
+	}
+	if index == 0 {
+		return
+	}
+
+	ki.indexes[key] = ki.order.PushFront(&keyIndex{key: key, index: index})
+	if ki.order.Len() > seenIndexesSize {
+		oldest := ki.order.Back()
+		ki.order.Remove(oldest)
+		delete(ki.indexes, oldest.Value.(*keyIndex).key)
+	}
+}
+
+// comparesAndSets reports whether stores of key only succeed if it wasn't modified since it was last seen
+func (cs *ConsulStorage) comparesAndSets(key string) bool {
+	p := cs.policy(key)
+	return p != nil && p.CompareAndSet
+}
+
+// LoadIndex returns the value of key together with its modify index to pass to StoreCAS. Values only found
+// below the FallbackPrefix are returned with index 0, as StoreCAS writes below the current prefix.
+func (cs *ConsulStorage) LoadIndex(ctx context.Context, key string) ([]byte, uint64, error) {
+	ctx, cancel := withTimeout(ctx, cs.ReadTimeout)
+	defer cancel()
+	ctx, _ = cs.startOperation(ctx)
+
+	contents, index, err := cs.loadIndexed(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	return contents.Value, index, nil
+}
+
+// loadIndexed loads the stored data of key with the modify index of its current Consul key
+func (cs *ConsulStorage) loadIndexed(ctx context.Context, key string) (*StorageData, uint64, error) {
+	if err := validateKey(key); err != nil {
+		return nil, 0, err
+	}
+
+	cs.log(ctx).Debugf("loading data from Consul for %s", key)
+
+	kv, err := cs.getPair(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	} else if kv == nil {
+		return nil, 0, certmagic.ErrNotExist(errors.Errorf("key %s does not exist", cs.prefixKey(key)))
+	}
+
+	contents, err := cs.decodePair(ctx, key, kv)
+	if err != nil {
+		return nil, 0, err
+	}
+	if cs.expired(key, contents) {
+		return nil, 0, certmagic.ErrNotExist(errors.Errorf("key %s expired", cs.prefixKey(key)))
+	}
+	if unescaped, ok := cs.unescapedKey(key); ok && kv.Key == unescaped {
+		cs.log(ctx).Infof("migrating %s to escaped key %s", kv.Key, cs.prefixKey(key))
+		index, err := cs.migrateUnescapedKey(ctx, key, kv, contents.Value)
+		if err != nil {
+			cs.log(ctx).Warnf("unable to migrate %s: %v", kv.Key, err)
+			return contents, 0, nil
+		}
+		return contents, index, nil
+	}
+	if kv.Key != cs.prefixKey(key) {
+		return contents, 0, nil
+	}
+	return contents, kv.ModifyIndex, nil
+}
+
+// StoreCAS stores value for key only if the key still has the modify index index, as returned by LoadIndex,
+// so concurrent writers notice conflicts instead of overwriting each other's values. With index 0 the key is
+// only stored if it doesn't exist. A CASConflictError is returned if the key was modified in the meantime.
+// Writes aren't coalesced.
+func (cs *ConsulStorage) StoreCAS(ctx context.Context, key string, value []byte, index uint64) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	_, err := cs.storeCAS(ctx, key, value, index)
+	return err
+}
+
+// storeCAS writes value for key if it has the modify index index and returns its new modify index, which
+// is 0 if the backend doesn't report it
+func (cs *ConsulStorage) storeCAS(ctx context.Context, key string, value []byte, index uint64) (uint64, error) {
+	ctx, cancel := withTimeout(ctx, cs.WriteTimeout)
+	defer cancel()
+	defer cs.invalidateStat(key)
+
+	ctx, log := cs.startOperation(ctx)
+	log.Debugf("storing data in Consul for %s at index %d", key, index)
+
+	kv, err := cs.encodePair(ctx, key, value)
+	if err != nil {
+		return 0, err
+	}
+	if err := cs.reserveQuota(ctx, key, kv); err != nil {
+		return 0, err
+	}
+	newIndex, err := cs.putIndexed(ctx, key, kv, true, index)
+	if err != nil {
+		cs.quotaUsage.forget(quotaPrefix(key))
+		return 0, err
+	}
+	if cs.writesConsistently(key) {
+		if err := cs.confirmWrite(ctx, key, kv); err != nil {
+			return 0, err
+		}
+	}
+
+	cs.fireCertEvent(ctx, CertUpdatedEvent, key)
+	return newIndex, nil
+}
+
+// putIndexed writes kv, with cas only if the key still has the modify index index, and returns the new modify
+// index, which is 0 if the backend doesn't report it
+func (cs *ConsulStorage) putIndexed(ctx context.Context, key string, kv *consul.KVPair, cas bool, index uint64) (uint64, error) {
+	// a transaction reports the new modify index, plain requests don't
+	if _, ok := cs.txn(key); ok {
+		op := &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVSet, Key: kv.Key, Value: kv.Value, Flags: kv.Flags}}
+		if cas {
+			op.KV.Verb, op.KV.Index = consul.KVCAS, index
+		}
+		resp, err := cs.runTxn(ctx, key, consul.TxnOps{op})
+		if err != nil {
+			if cas && resp != nil && len(resp.Errors) > 0 {
+				return 0, CASConflictError{Key: key, Index: index}
+			}
+			return 0, errors.Wrapf(err, "unable to store data for %s", kv.Key)
+		}
+		if len(resp.Results) > 0 && resp.Results[0].KV != nil {
+			return resp.Results[0].KV.ModifyIndex, nil
+		}
+		return 0, nil
+	}
+
+	if !cas {
+		if _, err := cs.kv(key).Put(kv, cs.writeOptions(ctx)); err != nil {
+			return 0, errors.Wrapf(err, "unable to store data for %s", kv.Key)
+		}
+		return 0, nil
+	}
+	kv.ModifyIndex = index
+	stored, _, err := cs.kv(key).CAS(kv, cs.writeOptions(ctx))
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to store data for %s", kv.Key)
+	}
+	if !stored {
+		return 0, CASConflictError{Key: key, Index: index}
+	}
+	return 0, nil
+}
+
+// storeComparing stores value for key of a compare_and_set policy against the modify index the key had when
+// this instance last loaded or stored it
+func (cs *ConsulStorage) storeComparing(ctx context.Context, key string, value []byte) error {
+	index, err := cs.storeCAS(ctx, key, value, cs.seenIndexes.get(key))
+	if err != nil {
+		return err
+	}
+	cs.seenIndexes.set(key, index)
+	return nil
+}
@@ -0,0 +1,110 @@
+package storageconsul
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_StoreCAS(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+	ctx := context.Background()
+	key := "certificates/acme/example.com/example.com.json"
+
+	require.NoError(t, cs.StoreCAS(ctx, key, []byte("v1"), 0))
+	assert.Equal(t, CASConflictError{Key: key}, cs.StoreCAS(ctx, key, []byte("again"), 0))
+
+	value, index, err := cs.LoadIndex(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v1"), value)
+	assert.NotZero(t, index)
+
+	// another writer gets in between
+	require.NoError(t, cs.Store(key, []byte("other")))
+	assert.Equal(t, CASConflictError{Key: key, Index: index}, cs.StoreCAS(ctx, key, []byte("v2"), index))
+
+	_, index, err = cs.LoadIndex(ctx, key)
+	require.NoError(t, err)
+	require.NoError(t, cs.StoreCAS(ctx, key, []byte("v2"), index))
+
+	value, err = cs.Load(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v2"), value)
+}
+
+func TestConsulStorage_StoreCASAfterMigration(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+	ctx := context.Background()
+	key := "certificates/acme/example.com/example.com.json"
+
+	oldKey := []byte("consultls-0987654321-caddytls-32")
+	cs.AESKey = oldKey
+	require.NoError(t, cs.Store(key, []byte("v1")))
+
+	// the value is reencrypted with the new key on load
+	cs.AESKey = []byte(DefaultAESKey)
+	cs.PreviousAESKeys = [][]byte{oldKey}
+	value, index, err := cs.LoadIndex(ctx, key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v1"), value)
+
+	require.NoError(t, cs.StoreCAS(ctx, key, []byte("v2"), index))
+	value, err = cs.Load(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v2"), value)
+}
+
+func TestConsulStorage_CompareAndSetPolicy(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+	cs.KeyPolicies = map[string]*KeyPolicy{"meta": {KeyPrefixes: []string{"certificates"}, CompareAndSet: true}}
+	other, _ := newFakeConsulStorage(t)
+	other.ConsulClient = cs.ConsulClient
+
+	key := "certificates/acme/example.com/example.com.json"
+	require.NoError(t, cs.Store(key, []byte("v1")))
+	// consecutive stores of the same instance continue at the index of its last write
+	require.NoError(t, cs.Store(key, []byte("v2")))
+
+	_, err := other.Load(key)
+	require.NoError(t, err)
+	require.NoError(t, other.Store(key, []byte("from other")))
+
+	err = cs.Store(key, []byte("v3"))
+	assert.IsType(t, CASConflictError{}, err)
+
+	// after loading the current value it can be updated again
+	value, err := cs.Load(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("from other"), value)
+	require.NoError(t, cs.Store(key, []byte("v3")))
+
+	require.NoError(t, cs.Delete(key))
+	require.NoError(t, cs.Store(key, []byte("v4")))
+
+	// keys outside of the policy are stored as usual
+	require.NoError(t, cs.Store("acme/account.json", []byte("a")))
+	require.NoError(t, other.Store("acme/account.json", []byte("b")))
+	require.NoError(t, cs.Store("acme/account.json", []byte("c")))
+}
+
+func TestKeyIndexes_Bounded(t *testing.T) {
+	ki := newKeyIndexes()
+	for i := 0; i < seenIndexesSize; i++ {
+		ki.set(fmt.Sprintf("certificates/%d.crt", i), uint64(i+1))
+	}
+	// the first key was used recently and is kept
+	assert.Equal(t, uint64(1), ki.get("certificates/0.crt"))
+
+	ki.set("certificates/new.crt", 42)
+	assert.Len(t, ki.indexes, seenIndexesSize)
+	assert.Equal(t, uint64(0), ki.get("certificates/1.crt"))
+	assert.Equal(t, uint64(1), ki.get("certificates/0.crt"))
+	assert.Equal(t, uint64(42), ki.get("certificates/new.crt"))
+
+	ki.set("certificates/new.crt", 0)
+	assert.Equal(t, uint64(0), ki.get("certificates/new.crt"))
+	assert.Equal(t, seenIndexesSize-1, ki.order.Len())
+}
@@ -0,0 +1,98 @@
+package storageconsul
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"path"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/pteich/errors"
+)
+
+// certificatesDir is the directory certmagic stores the certificates of all issuers in
+const certificatesDir = "certificates"
+
+// CertificateResource is a certificate managed by certmagic with its private key and metadata, loaded from
+// the storage and parsed
+type CertificateResource struct {
+	certmagic.CertificateResource
+
+	// IssuerKey identifies the issuer the certificate is stored for, e.g. acme-v02.api.letsencrypt.org-directory
+	IssuerKey string
+
+	// Certificate is the chain with the private key, ready to be served
+	Certificate tls.Certificate
+
+	// Leaf is the parsed leaf certificate of the chain
+	Leaf *x509.Certificate
+}
+
+// GetCertificateResource loads the certificate of domain, e.g. example.com or *.example.com. If certificates of
+// several issuers are stored for the domain the one that expires last is returned.
+func (cs *ConsulStorage) GetCertificateResource(ctx context.Context, domain string) (*CertificateResource, error) {
+	issuers, err := cs.ListContext(ctx, certificatesDir, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var latest *CertificateResource
+	for _, issuer := range issuers {
+		res, err := cs.GetIssuerCertificateResource(ctx, path.Base(issuer), domain)
+		if _, notExist := err.(certmagic.ErrNotExist); notExist {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if latest == nil || res.Leaf.NotAfter.After(latest.Leaf.NotAfter) {
+			latest = res
+		}
+	}
+
+	if latest == nil {
+		return nil, certmagic.ErrNotExist(errors.Errorf("no certificate for %s", domain))
+	}
+	return latest, nil
+}
+
+// GetIssuerCertificateResource loads the certificate of domain stored for the issuer with issuerKey. The
+// certificate, private key and metadata are fetched with one request.
+func (cs *ConsulStorage) GetIssuerCertificateResource(ctx context.Context, issuerKey, domain string) (*CertificateResource, error) {
+	// certmagic drops the non-ASCII characters of internationalized domain names from their keys
+	domain = normalizeDomain(domain)
+	certKey := certmagic.StorageKeys.SiteCert(issuerKey, domain)
+	privateKeyKey := certmagic.StorageKeys.SitePrivateKey(issuerKey, domain)
+	metaKey := certmagic.StorageKeys.SiteMeta(issuerKey, domain)
+
+	// without the trailing slash the site prefix would also load every site starting with the domain
+	values, err := cs.LoadPrefix(ctx, certmagic.StorageKeys.CertsSitePrefix(issuerKey, domain)+"/")
+	if err != nil {
+		return nil, err
+	}
+	certPEM, privateKeyPEM := values[certKey], values[privateKeyKey]
+	if certPEM == nil || privateKeyPEM == nil {
+		return nil, certmagic.ErrNotExist(errors.Errorf("no certificate for %s of issuer %s", domain, issuerKey))
+	}
+
+	res := &CertificateResource{IssuerKey: issuerKey}
+	if meta, ok := values[metaKey]; ok {
+		if err := json.Unmarshal(meta, &res.CertificateResource); err != nil {
+			return nil, errors.Wrapf(err, "unable to decode metadata %s", metaKey)
+		}
+	}
+	res.CertificatePEM, res.PrivateKeyPEM = certPEM, privateKeyPEM
+
+	res.Certificate, err = tls.X509KeyPair(certPEM, privateKeyPEM)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse certificate %s", certKey)
+	}
+	res.Leaf, err = x509.ParseCertificate(res.Certificate.Certificate[0])
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to parse certificate %s", certKey)
+	}
+	res.Certificate.Leaf = res.Leaf
+
+	return res, nil
+}
@@ -0,0 +1,65 @@
+package storageconsul
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// storeCertificate stores a self-signed certificate for domain like certmagic does
+func storeCertificate(t *testing.T, cs *ConsulStorage, issuerKey, domain string, notAfter time.Time) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     notAfter,
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	require.NoError(t, cs.Store(certmagic.StorageKeys.SiteCert(issuerKey, domain), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert})))
+	require.NoError(t, cs.Store(certmagic.StorageKeys.SitePrivateKey(issuerKey, domain), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})))
+	require.NoError(t, cs.Store(certmagic.StorageKeys.SiteMeta(issuerKey, domain), []byte(`{"sans":["`+domain+`"],"issuer_data":{"url":"https://acme.example/cert"}}`)))
+}
+
+func TestConsulStorage_GetCertificateResource(t *testing.T) {
+	cs := setupConsulEnv(t)
+	ctx := context.Background()
+
+	expiry := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	storeCertificate(t, cs, "acme-v02.api.letsencrypt.org-directory", "*.example.com", expiry.Add(-time.Hour))
+	storeCertificate(t, cs, "acme.zerossl.com-v2-dv90", "*.example.com", expiry)
+	// a site whose name starts with the domain isn't mixed up with it
+	storeCertificate(t, cs, "acme.zerossl.com-v2-dv90", "*.example.com.au", expiry.Add(time.Hour))
+
+	res, err := cs.GetCertificateResource(ctx, "*.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, "acme.zerossl.com-v2-dv90", res.IssuerKey)
+	assert.Equal(t, []string{"*.example.com"}, res.SANs)
+	assert.Equal(t, map[string]interface{}{"url": "https://acme.example/cert"}, res.IssuerData)
+	assert.Equal(t, []string{"*.example.com"}, res.Leaf.DNSNames)
+	assert.True(t, res.Leaf.NotAfter.Equal(expiry))
+	assert.NotNil(t, res.Certificate.PrivateKey)
+
+	res, err = cs.GetIssuerCertificateResource(ctx, "acme-v02.api.letsencrypt.org-directory", "*.example.com")
+	require.NoError(t, err)
+	assert.True(t, res.Leaf.NotAfter.Equal(expiry.Add(-time.Hour)))
+
+	_, err = cs.GetCertificateResource(ctx, "example.org")
+	_, notExist := err.(certmagic.ErrNotExist)
+	assert.True(t, notExist, err)
+}
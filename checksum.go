@@ -0,0 +1,33 @@
+package storageconsul
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// CorruptedValueError is returned if a loaded value doesn't match the checksum stored with it
+type CorruptedValueError struct {
+	Key string
+}
+
+func (e CorruptedValueError) Error() string {
+	return fmt.Sprintf("value of %s is corrupted: checksum mismatch", e.Key)
+}
+
+// checksum returns the hex encoded SHA-256 of value
+func checksum(value []byte) string {
+	sum := sha256.Sum256(value)
+	return hex.EncodeToString(sum[:])
+}
+
+// verifyChecksum checks the value of data against its checksum, values stored without one are accepted
+func verifyChecksum(key string, data *StorageData) error {
+	if data.Checksum == "" || data.Checksum == checksum(data.Value) {
+		return nil
+	}
+
+	corruptedValues.Inc()
+	corruptedDebugVar.Add(1)
+	return CorruptedValueError{Key: key}
+}
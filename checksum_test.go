@@ -0,0 +1,36 @@
+package storageconsul
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_LoadVerifiesChecksum(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+
+	require.NoError(t, cs.Store("certificates/example.com", []byte("crt data")))
+
+	loaded, err := cs.Load("certificates/example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), loaded)
+
+	// tamper with the value without updating its checksum
+	pair := fc.kv[cs.prefixKey("certificates/example.com")]
+	data, err := cs.DecryptStorageDataForKey("certificates/example.com", pair.Value)
+	require.NoError(t, err)
+	data.Value = []byte("crt dat4")
+	pair.Value, err = cs.EncryptStorageDataForKey("certificates/example.com", data)
+	require.NoError(t, err)
+
+	before := testutil.ToFloat64(corruptedValues)
+	_, err = cs.Load("certificates/example.com")
+	assert.Equal(t, CorruptedValueError{Key: "certificates/example.com"}, err)
+	assert.Equal(t, before+1, testutil.ToFloat64(corruptedValues))
+}
+
+func TestVerifyChecksumAcceptsValuesWithoutChecksum(t *testing.T) {
+	assert.NoError(t, verifyChecksum("key", &StorageData{Value: []byte("crt data")}))
+}
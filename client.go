@@ -0,0 +1,356 @@
+package storageconsul
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// clientPool holds the Consul clients shared between all modules of the process
+var clientPool = caddy.NewUsagePool()
+
+// ConnectionConfig describes how to connect to Consul
+type ConnectionConfig struct {
+	Address     string `json:"address"`
+	Token       string `json:"token"`
+	Timeout     int    `json:"timeout"`
+	TlsEnabled  bool   `json:"tls_enabled"`
+	TlsInsecure bool   `json:"tls_insecure"`
+
+	// AgentAddresses are further Consul agents next to Address, stale reads are spread over all of them
+	// while all other requests stick to one of them, agents failing requests are skipped for a while
+	AgentAddresses []string `json:"agent_addresses"`
+
+	// IgnoreEnv ignores all environment variables, CONSUL_HTTP_* as well as the ones of the storage, so only
+	// the config and the defaults apply
+	IgnoreEnv bool `json:"ignore_env"`
+
+	// ReadAddress is the Consul agent reads are sent to, e.g. the local one, while writes, transactions and
+	// sessions go to Address, e.g. the servers
+	ReadAddress string `json:"read_address"`
+
+	// TokenFile is read for the ACL token instead of using Token, it is reread every TokenFileInterval
+	// so the token can be rotated without recreating the client or dropping held locks
+	TokenFile         string         `json:"token_file"`
+	TokenFileInterval caddy.Duration `json:"token_file_interval"`
+
+	// TlsCAFile or TlsCAPem verify the Consul endpoint with a custom CA bundle, TlsServerName
+	// overrides the name its certificate is checked against, e.g. behind an internal load balancer
+	TlsCAFile     string `json:"tls_ca_file"`
+	TlsCAPem      string `json:"tls_ca_pem"`
+	TlsServerName string `json:"tls_server_name"`
+
+	// SpiffeSocket is the SPIFFE Workload API socket, e.g. of the SPIRE agent, the client certificate for
+	// mutual TLS with Consul is fetched from, rotated SVIDs are used as soon as the Workload API sends them
+	SpiffeSocket string `json:"spiffe_socket"`
+
+	// TlsServerCertPin is the base64 encoded SHA-256 hash of the public key (SPKI) of the Consul server's
+	// certificate, servers presenting another key are rejected while the certificate chain isn't verified
+	TlsServerCertPin string `json:"tls_server_cert_pin"`
+
+	// Username and Password authenticate with HTTP basic auth, for Consul APIs fronted by a
+	// reverse proxy, the ACL token is sent in addition
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// RateLimit limits the requests per second toward Consul with bursts of up to RateBurst requests,
+	// a zero value disables the limit
+	RateLimit float64 `json:"rate_limit"`
+	RateBurst int     `json:"rate_burst"`
+
+	// MaxConcurrentRequests bounds the number of in-flight requests toward Consul,
+	// a zero value disables the limit
+	MaxConcurrentRequests int `json:"max_concurrent_requests"`
+
+	// ThrottleRetries is the number of times a request rejected by Consul's rate limits is retried
+	// after the delay Consul asks for, zero uses the default and a negative value disables retries
+	ThrottleRetries int `json:"throttle_retries"`
+
+	// DisableHTTP2 keeps connections to Consul on HTTP/1.1, MaxIdleConns, IdleConnTimeout and KeepAlive
+	// tune how many warm connections are kept and for how long, zero values keep the defaults
+	DisableHTTP2    bool           `json:"disable_http2"`
+	MaxIdleConns    int            `json:"max_idle_conns"`
+	IdleConnTimeout caddy.Duration `json:"idle_conn_timeout"`
+	KeepAlive       caddy.Duration `json:"keep_alive"`
+
+	// ProxyURL is the HTTP, HTTPS or SOCKS5 proxy Consul is reached through, e.g. socks5://proxy:1080,
+	// without it HTTP_PROXY, HTTPS_PROXY and NO_PROXY are honored
+	ProxyURL string `json:"proxy_url"`
+
+	// Headers are set on every request to Consul, e.g. for an authenticating proxy or API gateway in front
+	// of it, values may contain placeholders like {env.GATEWAY_KEY}
+	Headers map[string]string `json:"headers"`
+
+	// HTTPClient or Transport can be set by library users to send the Consul requests through their own
+	// HTTP client or transport, e.g. for proxies or observability middleware. The TLS settings above
+	// are not applied to them and clients using them are never shared.
+	HTTPClient *http.Client      `json:"-"`
+	Transport  http.RoundTripper `json:"-"`
+
+	// envSuffix is appended to the names of the environment variables that are read
+	envSuffix string
+}
+
+// sharedClient is a Consul client together with its HTTP client that is shared using clientPool
+type sharedClient struct {
+	client     *consul.Client
+	httpClient *http.Client
+	tokenFile  *tokenFile
+	svids      *svidSource
+	// poolKey is the key of the client in clientPool, empty for clients that aren't shared
+	poolKey string
+}
+
+// Destruct implements caddy.Destructor and is called once the last user of the client is cleaned up
+func (sc *sharedClient) Destruct() error {
+	if sc.tokenFile != nil {
+		sc.tokenFile.close()
+	}
+	if sc.svids != nil {
+		sc.svids.close()
+	}
+	sc.httpClient.CloseIdleConnections()
+	return nil
+}
+
+// poolKey identifies Consul clients with identical connection settings, including the ones from ENV
+func (cc ConnectionConfig) poolKey() (string, error) {
+	key, err := json.Marshal(struct {
+		ConnectionConfig
+		Env resolvedEnv `json:"env"`
+	}{cc, cc.resolveEnv()})
+	if err != nil {
+		return "", errors.Wrap(err, "unable to build Consul client key")
+	}
+	return string(key), nil
+}
+
+// acquireClient returns a Consul client for cc, reusing an existing one with identical settings.
+// It must be given back with releaseClient.
+func (cc ConnectionConfig) acquireClient() (*sharedClient, error) {
+	// custom HTTP clients and transports can't be compared, so we don't share them
+	if cc.HTTPClient != nil || cc.Transport != nil {
+		return cc.newClient()
+	}
+
+	key, err := cc.poolKey()
+	if err != nil {
+		return nil, err
+	}
+
+	val, _, err := clientPool.LoadOrNew(key, func() (caddy.Destructor, error) {
+		sc, err := cc.newClient()
+		if err != nil {
+			return nil, err
+		}
+		sc.poolKey = key
+		return sc, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return val.(*sharedClient), nil
+}
+
+// releaseClient gives back a client obtained by acquireClient, clients that aren't shared are destructed
+// right away
+func releaseClient(sc *sharedClient) error {
+	if sc == nil {
+		return nil
+	}
+	if sc.poolKey == "" {
+		return sc.Destruct()
+	}
+
+	_, err := clientPool.Delete(sc.poolKey)
+	return err
+}
+
+// newClient creates a Consul client with the connection settings of cc
+func (cc ConnectionConfig) newClient() (*sharedClient, error) {
+	// get the default config, explicit settings take precedence over the ones from ENV
+	consulCfg := cc.consulConfig()
+	if cc.Address != "" {
+		consulCfg.Address = cc.Address
+	}
+	if cc.Token != "" {
+		// Consul's client prefers a token file from ENV over the token
+		consulCfg.Token = cc.Token
+		consulCfg.TokenFile = ""
+	}
+	if cc.Username != "" || cc.Password != "" {
+		consulCfg.HttpAuth = &consul.HttpBasicAuth{Username: cc.Username, Password: cc.Password}
+	}
+	if cc.TlsEnabled {
+		consulCfg.Scheme = "https"
+	}
+	if cc.TlsInsecure {
+		consulCfg.TLSConfig.InsecureSkipVerify = true
+	}
+	if cc.TlsCAFile != "" || cc.TlsCAPem != "" {
+		consulCfg.TLSConfig.CAFile = cc.TlsCAFile
+		consulCfg.TLSConfig.CAPem = []byte(cc.TlsCAPem)
+		consulCfg.TLSConfig.CAPath = ""
+	}
+	if cc.TlsServerName != "" {
+		consulCfg.TLSConfig.Address = cc.TlsServerName
+	}
+
+	// set a dial context to prevent default keepalive
+	keepAlive := time.Duration(cc.Timeout) * time.Second
+	if cc.KeepAlive > 0 {
+		keepAlive = time.Duration(cc.KeepAlive)
+	}
+	consulCfg.Transport.DialContext = (&net.Dialer{
+		Timeout:   time.Duration(cc.Timeout) * time.Second,
+		KeepAlive: keepAlive,
+	}).DialContext
+	cc.tuneTransport(consulCfg.Transport)
+
+	// build the HTTP client ourselves to be able to wrap its transport
+	httpClient, err := cc.httpClient(consulCfg)
+	if err != nil {
+		return nil, err
+	}
+	reads := httpClient.Transport
+	if hosts := cc.endpointHosts(consulCfg.Address); len(hosts) > 1 {
+		httpClient.Transport = newBalancedTransport(httpClient.Transport, hosts)
+	}
+	if cc.ReadAddress != "" {
+		httpClient.Transport = newSplitTransport(httpClient.Transport, reads, cc.ReadAddress)
+	}
+	httpClient.Transport = cc.wrapTransport(httpClient.Transport)
+	if httpClient.Transport, err = cc.withHeaders(httpClient.Transport); err != nil {
+		return nil, err
+	}
+
+	// the client certificate is taken from the latest SVID on every handshake
+	var svids *svidSource
+	if cc.SpiffeSocket != "" {
+		svids, err = newSVIDSource(cc.SpiffeSocket, time.Duration(cc.Timeout)*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		consulCfg.Transport.TLSClientConfig.GetClientCertificate = svids.clientCertificate
+	}
+
+	// the token of a token file is set on each request, so it can change during the lifetime of the client
+	var tokens *tokenFile
+	if cc.TokenFile != "" {
+		tokens, err = newTokenFile(cc.TokenFile, time.Duration(cc.TokenFileInterval))
+		if err != nil {
+			if svids != nil {
+				svids.close()
+			}
+			return nil, err
+		}
+		consulCfg.Token = ""
+		consulCfg.TokenFile = ""
+		httpClient.Transport = &tokenTransport{next: httpClient.Transport, tokens: tokens}
+	}
+	consulCfg.HttpClient = httpClient
+
+	// create the Consul API client
+	sc := &sharedClient{httpClient: consulCfg.HttpClient, tokenFile: tokens, svids: svids}
+	consulClient, err := consul.NewClient(consulCfg)
+	if err != nil {
+		sc.Destruct()
+		return nil, errors.Wrap(err, "unable to create Consul client")
+	}
+	if _, err := consulClient.Agent().NodeName(); err != nil {
+		sc.Destruct()
+		return nil, errors.Wrap(err, "unable to ping Consul")
+	}
+	sc.client = consulClient
+
+	return sc, nil
+}
+
+// tuneTransport applies the proxy, HTTP/2 and idle connection settings to transport
+func (cc ConnectionConfig) tuneTransport(transport *http.Transport) {
+	transport.Proxy = cc.proxy()
+	if cc.DisableHTTP2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	if cc.MaxIdleConns > 0 {
+		transport.MaxIdleConns = cc.MaxIdleConns
+		transport.MaxIdleConnsPerHost = cc.MaxIdleConns
+	}
+	if cc.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(cc.IdleConnTimeout)
+	}
+}
+
+// httpClient returns the HTTP client to use for Consul requests, preferring the ones supplied by library users
+func (cc ConnectionConfig) httpClient(consulCfg *consul.Config) (*http.Client, error) {
+	switch {
+	case cc.HTTPClient != nil:
+		// copy the client so wrapping its transport doesn't affect other users of it
+		httpClient := *cc.HTTPClient
+		if httpClient.Transport == nil {
+			httpClient.Transport = http.DefaultTransport
+		}
+		return &httpClient, nil
+	case cc.Transport != nil:
+		return &http.Client{Transport: cc.Transport}, nil
+	}
+
+	httpClient, err := consul.NewHttpClient(consulCfg.Transport, consulCfg.TLSConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create HTTP client for Consul")
+	}
+	if cc.TlsServerCertPin != "" {
+		if err := pinCertificate(consulCfg.Transport.TLSClientConfig, cc.TlsServerCertPin); err != nil {
+			return nil, err
+		}
+	}
+	return httpClient, nil
+}
+
+// Connect creates the Consul client using the connection settings of cs. It is called
+// by Provision and can be used to set up a ConsulStorage outside of Caddy.
+func (cs *ConsulStorage) Connect() error {
+	cs.applyName()
+	switch cs.Backend {
+	case BackendNomad:
+		return cs.connectNomad()
+	case BackendMemory:
+		cs.backend = sharedMemoryStore()
+		return nil
+	}
+
+	if err := cs.createConsulClient(); err != nil {
+		return err
+	}
+
+	cs.addAccountsTenant()
+	return cs.connectTenants()
+}
+
+// createConsulClient obtains a Consul client for the connection settings of cs,
+// reusing the one of another instance with identical settings
+func (cs *ConsulStorage) createConsulClient() error {
+	sc, err := cs.ConnectionConfig.acquireClient()
+	if err != nil {
+		return err
+	}
+
+	cs.ConsulClient = sc.client
+	cs.sharedClient = sc
+	return nil
+}
+
+// releaseConsulClient gives back the client obtained by createConsulClient
+func (cs *ConsulStorage) releaseConsulClient() error {
+	err := releaseClient(cs.sharedClient)
+	cs.sharedClient = nil
+	return err
+}
@@ -0,0 +1,185 @@
+package storageconsul
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestAgent returns a fake Consul agent that only answers the ping during client creation
+func newTestAgent(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v1/agent/self" {
+			w.Write([]byte(`{"Config":{"NodeName":"test"}}`))
+			return
+		}
+		http.NotFound(w, r)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestConsulStorage_SharedClient(t *testing.T) {
+	srv := newTestAgent(t)
+
+	cs1 := New()
+	cs1.Address = srv.Listener.Addr().String()
+	cs2 := New()
+	cs2.Address = srv.Listener.Addr().String()
+	cs3 := New()
+	cs3.Address = srv.Listener.Addr().String()
+	cs3.Token = "other-token"
+
+	require.NoError(t, cs1.createConsulClient())
+	require.NoError(t, cs2.createConsulClient())
+	require.NoError(t, cs3.createConsulClient())
+
+	assert.Same(t, cs1.ConsulClient, cs2.ConsulClient)
+	assert.NotSame(t, cs1.ConsulClient, cs3.ConsulClient)
+
+	assert.NoError(t, cs1.Cleanup())
+	assert.NoError(t, cs2.Cleanup())
+	assert.NoError(t, cs3.Cleanup())
+
+	key, err := cs1.ConnectionConfig.poolKey()
+	require.NoError(t, err)
+	clientPool.Range(func(k, value interface{}) bool {
+		assert.NotEqual(t, key, k)
+		return true
+	})
+}
+
+type countingTransport struct {
+	requests int
+}
+
+func (ct *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ct.requests++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestConsulStorage_CustomTransport(t *testing.T) {
+	srv := newTestAgent(t)
+	transport := &countingTransport{}
+
+	cs := New()
+	cs.Address = srv.Listener.Addr().String()
+	cs.Transport = transport
+
+	require.NoError(t, cs.Connect())
+	assert.Equal(t, 1, transport.requests)
+	assert.Empty(t, cs.sharedClient.poolKey)
+	assert.NoError(t, cs.Cleanup())
+}
+
+func TestConsulStorage_CustomTransportCleanup(t *testing.T) {
+	srv := newTestAgent(t)
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(tokenPath, []byte("secret"), 0600))
+
+	cs := New()
+	cs.Address = srv.Listener.Addr().String()
+	cs.Transport = &countingTransport{}
+	cs.TokenFile = tokenPath
+
+	require.NoError(t, cs.Connect())
+	tokens := cs.sharedClient.tokenFile
+	require.NotNil(t, tokens)
+	require.NoError(t, cs.Cleanup())
+
+	select {
+	case <-tokens.stop:
+	default:
+		t.Fatal("token file watcher of unshared client wasn't stopped")
+	}
+}
+
+func TestConsulStorage_CustomHTTPClient(t *testing.T) {
+	srv := newTestAgent(t)
+	transport := &countingTransport{}
+
+	cs := New()
+	cs.Address = srv.Listener.Addr().String()
+	cs.HTTPClient = &http.Client{Transport: transport}
+
+	require.NoError(t, cs.Connect())
+	assert.Equal(t, 1, transport.requests)
+	assert.NoError(t, cs.Cleanup())
+}
+
+func TestConnectionConfig_TuneTransport(t *testing.T) {
+	transport := &http.Transport{ForceAttemptHTTP2: true, MaxIdleConns: 100, IdleConnTimeout: 90 * time.Second}
+
+	ConnectionConfig{}.tuneTransport(transport)
+	assert.True(t, transport.ForceAttemptHTTP2)
+	assert.Equal(t, 100, transport.MaxIdleConns)
+
+	ConnectionConfig{
+		DisableHTTP2:    true,
+		MaxIdleConns:    16,
+		IdleConnTimeout: caddy.Duration(time.Minute),
+	}.tuneTransport(transport)
+	assert.False(t, transport.ForceAttemptHTTP2)
+	assert.NotNil(t, transport.TLSNextProto)
+	assert.Equal(t, 16, transport.MaxIdleConns)
+	assert.Equal(t, 16, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, time.Minute, transport.IdleConnTimeout)
+}
+
+func TestConnectionConfig_CustomCAAndServerName(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Config":{"NodeName":"test"}}`))
+	}))
+	defer srv.Close()
+
+	caPem := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}))
+
+	cc := ConnectionConfig{
+		Address:       srv.Listener.Addr().String(),
+		Timeout:       DefaultTimeout,
+		TlsEnabled:    true,
+		TlsCAPem:      caPem,
+		TlsServerName: "example.com",
+	}
+	sc, err := cc.newClient()
+	require.NoError(t, err)
+	sc.Destruct()
+
+	// the certificate of the test server isn't valid for this name
+	cc.TlsServerName = "consul.internal"
+	_, err = cc.newClient()
+	assert.Error(t, err)
+
+	// without the CA the certificate isn't trusted at all
+	cc.TlsCAPem, cc.TlsServerName = "", ""
+	_, err = cc.newClient()
+	assert.Error(t, err)
+}
+
+func TestConnectionConfig_BasicAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if username, password, ok := r.BasicAuth(); !ok || username != "caddy" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"Config":{"NodeName":"test"}}`))
+	}))
+	defer srv.Close()
+
+	cc := ConnectionConfig{Address: srv.Listener.Addr().String(), Timeout: DefaultTimeout}
+	_, err := cc.newClient()
+	assert.Error(t, err)
+
+	cc.Username, cc.Password = "caddy", "secret"
+	_, err = cc.newClient()
+	assert.NoError(t, err)
+}
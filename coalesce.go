@@ -0,0 +1,98 @@
+package storageconsul
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// writeCoalescer collects the writes to a key within a window, so only the last value is written to Consul
+type writeCoalescer struct {
+	mu      sync.Mutex
+	pending map[string]*pendingWrite
+	// writing holds the last burst of a key whose window passed until it is written
+	writing map[string]*pendingWrite
+}
+
+// pendingWrite is the value of a key written at the end of its window, done is closed once it is written
+type pendingWrite struct {
+	value []byte
+	done  chan struct{}
+	err   error
+}
+
+func newWriteCoalescer() *writeCoalescer {
+	return &writeCoalescer{pending: make(map[string]*pendingWrite), writing: make(map[string]*pendingWrite)}
+}
+
+// store writes value for key with write once window passed since the first write of the burst, values
+// given in between replace it. All callers of a burst wait for the write and get its result, a caller whose
+// ctx is done returns early, the value is written anyway. Bursts of a key are written in order.
+func (wc *writeCoalescer) store(ctx context.Context, key string, value []byte, window time.Duration, write func(ctx context.Context, key string, value []byte) error) error {
+	// the caller may reuse its slice while the value waits
+	value = append([]byte(nil), value...)
+
+	wc.mu.Lock()
+	w, ok := wc.pending[key]
+	if ok {
+		w.value = value
+		coalescedWrites.Add(1)
+	} else {
+		w = &pendingWrite{value: value, done: make(chan struct{})}
+		wc.pending[key] = w
+		time.AfterFunc(window, func() {
+			wc.mu.Lock()
+			delete(wc.pending, key)
+			previous := wc.writing[key]
+			wc.writing[key] = w
+			value := w.value
+			wc.mu.Unlock()
+
+			// an older burst still being written must not land after this one
+			if previous != nil {
+				<-previous.done
+			}
+			w.err = write(context.Background(), key, value)
+			close(w.done)
+
+			wc.mu.Lock()
+			if wc.writing[key] == w {
+				delete(wc.writing, key)
+			}
+			wc.mu.Unlock()
+		})
+	}
+	wc.mu.Unlock()
+
+	select {
+	case <-w.done:
+		return w.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// wait blocks until all pending writes are written
+func (wc *writeCoalescer) wait() {
+	wc.mu.Lock()
+	pending := make([]*pendingWrite, 0, len(wc.pending)+len(wc.writing))
+	for _, w := range wc.pending {
+		pending = append(pending, w)
+	}
+	for _, w := range wc.writing {
+		pending = append(pending, w)
+	}
+	wc.mu.Unlock()
+
+	for _, w := range pending {
+		<-w.done
+	}
+}
+
+// coalesceWindow returns the window writes to key are coalesced in, zero if they are written right away
+func (cs *ConsulStorage) coalesceWindow(key string) time.Duration {
+	if p := cs.policy(key); p != nil && cs.writes != nil {
+		return time.Duration(p.CoalesceWindow)
+	}
+	return 0
+}
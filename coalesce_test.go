@@ -0,0 +1,87 @@
+package storageconsul
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_CoalesceWrites(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.KeyPolicies = map[string]*KeyPolicy{"ocsp": {KeyPrefixes: []string{"ocsp"}, CoalesceWindow: caddy.Duration(100 * time.Millisecond)}}
+
+	fc.mu.Lock()
+	before := fc.index
+	fc.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for i, value := range []string{"first", "second", "last"} {
+		wg.Add(1)
+		go func(value string) {
+			defer wg.Done()
+			assert.NoError(t, cs.Store("ocsp/example.com", []byte(value)))
+		}(value)
+		// keep the order of the writes within the window
+		if i < 2 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	wg.Wait()
+
+	loaded, err := cs.Load("ocsp/example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("last"), loaded)
+	fc.mu.Lock()
+	assert.Equal(t, before+1, fc.index)
+	fc.mu.Unlock()
+
+	// keys without the policy are written right away
+	require.NoError(t, cs.Store("certificates/example.com.crt", []byte("crt")))
+
+	// a caller giving up doesn't stop the write
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, cs.StoreContext(ctx, "ocsp/example.org", []byte("staple")))
+	assert.Eventually(t, func() bool { return cs.Exists("ocsp/example.org") }, time.Second, 10*time.Millisecond)
+}
+
+func TestWriteCoalescer_Order(t *testing.T) {
+	wc := newWriteCoalescer()
+	release := make(chan struct{})
+	var mu sync.Mutex
+	var written []string
+	write := func(ctx context.Context, key string, value []byte) error {
+		if string(value) == "old" {
+			<-release
+		}
+		mu.Lock()
+		written = append(written, string(value))
+		mu.Unlock()
+		return nil
+	}
+
+	// the caller's slice is copied, it may be reused once store returns
+	value := []byte("old")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, wc.store(ctx, "ocsp/example.com", value, 10*time.Millisecond, write))
+	copy(value, "bad")
+
+	// a newer burst starting while the old one is written lands last
+	time.Sleep(50 * time.Millisecond)
+	done := make(chan error)
+	go func() {
+		done <- wc.store(context.Background(), "ocsp/example.com", []byte("new"), time.Millisecond, write)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	require.NoError(t, <-done)
+
+	wc.wait()
+	assert.Equal(t, []string{"old", "new"}, written)
+}
@@ -0,0 +1,281 @@
+package storageconsul
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/caddyserver/certmagic"
+	"github.com/pteich/errors"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "consul-storage",
+		Func:  cmdConsulStorage,
+		Usage: "acl-policy|delete-prefix|import|sync|backup|restore [--config <path>] [--adapter <name>] [--workers <n>] [--resume] [--format <format>] [--key-prefix <prefix>] [--to <path>] [--delete] [--dry-run] [<prefix>|<dir>|<backup>]",
+		Short: "Tools for the Consul TLS storage",
+		Long: `
+Tools for the Consul TLS storage.
+
+acl-policy prints the minimal Consul ACL policy the storage configured in the
+given config needs: write access to its KV prefixes and, unless locks are
+disabled, to sessions. Tenants with their own token get a separate policy.
+
+delete-prefix deletes all keys below the given prefix of the storage, e.g. the
+certificates of a decommissioned site, in batched Consul transactions.
+
+import copies all keys of a file storage directory, like Caddy's data
+directory, into the storage with --workers concurrent writes (default 8).
+With --resume keys that were imported already are skipped, so an
+interrupted import can be continued. With --format the argument is an export
+file of another storage instead: "tar" for a (gzipped) tar archive of a file
+storage directory, "dynamodb" for DynamoDB JSON of the DynamoDB storage or
+"redis" for the redis-dump of the Redis storage. --key-prefix is removed from
+the exported keys, e.g. the key prefix of the Redis storage.
+
+sync copies the keys below the optional prefix that are missing or differ in
+the storage configured in the config given with --to, e.g. for a migration to
+another Consul cluster. Keys are compared by checksum, so repeated syncs only
+copy what changed. --delete removes keys missing in the source from the
+destination, --dry-run only prints what would be done.
+
+backup uploads an encrypted archive of all keys to the configured backup
+bucket right away, restore restores the given backup or the latest one.
+
+Without --config a Caddyfile in the current directory is used.`,
+		Flags: func() *flag.FlagSet {
+			fs := flag.NewFlagSet("consul-storage", flag.ExitOnError)
+			fs.String("config", "", "Configuration file")
+			fs.String("adapter", "", "Name of config adapter to apply")
+			fs.Int("workers", DefaultImportWorkers, "Number of keys imported concurrently")
+			fs.Bool("resume", false, "Skip keys that were imported already")
+			fs.String("format", "", "Format of the export to import instead of a directory: tar, dynamodb or redis")
+			fs.String("key-prefix", "", "Prefix to remove from the keys of the imported export")
+			fs.String("to", "", "Configuration file of the destination storage of sync")
+			fs.Bool("delete", false, "Delete keys missing in the source with sync")
+			fs.Bool("dry-run", false, "Only print what sync would do")
+			return fs
+		}(),
+	})
+}
+
+func cmdConsulStorage(fl caddycmd.Flags) (int, error) {
+	switch fl.Arg(0) {
+	case "acl-policy", "delete-prefix", "import", "sync", "backup", "restore":
+	default:
+		return caddy.ExitCodeFailedStartup, errors.Errorf("unknown subcommand %q, use acl-policy, delete-prefix, import, sync, backup or restore", fl.Arg(0))
+	}
+
+	cs, err := loadStorageConfig(fl.String("config"), fl.String("adapter"))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	switch fl.Arg(0) {
+	case "delete-prefix":
+		return cmdDeletePrefix(cs, fl.Arg(1))
+	case "import":
+		return cmdImport(cs, fl.Arg(1), fl.String("format"), fl.String("key-prefix"), fl.Int("workers"), fl.Bool("resume"))
+	case "backup", "restore":
+		return cmdBackup(cs, fl.Arg(0), fl.Arg(1))
+	case "sync":
+		return cmdSync(cs, fl.String("to"), fl.String("adapter"), fl.Arg(1), SyncOptions{Delete: fl.Bool("delete"), DryRun: fl.Bool("dry-run")})
+	}
+
+	for _, policy := range cs.aclPolicies() {
+		fmt.Printf("# ACL policy for the token of the %s\n%s\n", policy.name, policy.rules)
+	}
+
+	return 0, nil
+}
+
+// cmdDeletePrefix deletes all keys below prefix
+func cmdDeletePrefix(cs *ConsulStorage, prefix string) (int, error) {
+	if prefix == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("delete-prefix needs the prefix to delete")
+	}
+
+	if err := cs.Connect(); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cs.Cleanup()
+
+	keys, err := cs.ListContext(context.Background(), prefix, true)
+	if _, notExist := err.(certmagic.ErrNotExist); err != nil && !notExist {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	if err := cs.DeleteKeys(context.Background(), keys); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	fmt.Printf("deleted %d keys below %s\n", len(keys), prefix)
+	return 0, nil
+}
+
+// cmdImport imports all keys of the file storage in dir or of the export file in dir if format is set
+func cmdImport(cs *ConsulStorage, dir, format, keyPrefix string, workers int, resume bool) (int, error) {
+	if dir == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("import needs the directory of the file storage or the export file to import")
+	}
+
+	var src certmagic.Storage = &certmagic.FileStorage{Path: dir}
+	if format != "" {
+		f, err := os.Open(dir)
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, errors.Wrap(err, "unable to open export")
+		}
+		src, err = OpenExport(f, format, keyPrefix)
+		f.Close()
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+	}
+
+	if err := cs.Connect(); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cs.Cleanup()
+
+	result, err := cs.Import(context.Background(), src, ImportOptions{
+		Workers: workers,
+		Resume:  resume,
+		Progress: func(p ImportProgress) {
+			if p.Err != nil {
+				fmt.Fprintf(os.Stderr, "unable to import %s: %v\n", p.Key, p.Err)
+			}
+			if p.Done%100 == 0 || p.Done == p.Total {
+				fmt.Printf("%d of %d keys processed\n", p.Done, p.Total)
+			}
+		},
+	})
+	fmt.Printf("imported %d keys, skipped %d, failed %d\n", result.Imported, result.Skipped, len(result.Failed))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	return 0, nil
+}
+
+// cmdSync syncs the keys below prefix to the storage configured in destConfig
+func cmdSync(cs *ConsulStorage, destConfig, adapterName, prefix string, opts SyncOptions) (int, error) {
+	if destConfig == "" {
+		return caddy.ExitCodeFailedStartup, errors.New("sync needs the config of the destination storage with --to")
+	}
+	dst, err := loadStorageConfig(destConfig, adapterName)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	for _, storage := range []*ConsulStorage{cs, dst} {
+		if err := storage.Connect(); err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		defer storage.Cleanup()
+	}
+
+	opts.Prefix = prefix
+	result, err := cs.Sync(context.Background(), dst, opts)
+	for _, key := range result.Copied {
+		fmt.Printf("copy %s\n", key)
+	}
+	for _, key := range result.Deleted {
+		fmt.Printf("delete %s\n", key)
+	}
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+
+	fmt.Printf("%d keys copied, %d deleted, %d unchanged\n", len(result.Copied), len(result.Deleted), result.Unchanged)
+	return 0, nil
+}
+
+// cmdBackup uploads a backup or restores the backup name
+func cmdBackup(cs *ConsulStorage, subcommand, name string) (int, error) {
+	if !cs.backupsEnabled() {
+		return caddy.ExitCodeFailedStartup, errors.New("no backup_bucket is configured")
+	}
+
+	if err := cs.Connect(); err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	defer cs.Cleanup()
+
+	if subcommand == "backup" {
+		name, err := cs.UploadBackup(context.Background())
+		if err != nil {
+			return caddy.ExitCodeFailedStartup, err
+		}
+		fmt.Printf("uploaded backup %s\n", name)
+		return 0, nil
+	}
+
+	n, err := cs.RestoreBackup(context.Background(), name)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	fmt.Printf("restored %d keys\n", n)
+	return 0, nil
+}
+
+// loadStorageConfig returns the Consul storage configured in configFile, adapted with adapterName if given
+func loadStorageConfig(configFile, adapterName string) (*ConsulStorage, error) {
+	if configFile == "" {
+		configFile = "Caddyfile"
+	}
+	if adapterName == "" && strings.HasPrefix(filepath.Base(configFile), "Caddyfile") && filepath.Ext(configFile) != ".json" {
+		adapterName = "caddyfile"
+	}
+
+	config, err := ioutil.ReadFile(configFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading config file")
+	}
+
+	if adapterName != "" {
+		adapter := caddyconfig.GetAdapter(adapterName)
+		if adapter == nil {
+			return nil, errors.Errorf("unrecognized config adapter: %s", adapterName)
+		}
+		config, _, err = adapter.Adapt(config, map[string]interface{}{"filename": configFile})
+		if err != nil {
+			return nil, errors.Wrapf(err, "adapting config using %s", adapterName)
+		}
+	}
+
+	var cfg struct {
+		Storage json.RawMessage `json:"storage"`
+	}
+	if err := json.Unmarshal(config, &cfg); err != nil {
+		return nil, errors.Wrap(err, "decoding config")
+	}
+
+	var module struct {
+		Module string `json:"module"`
+	}
+	if len(cfg.Storage) > 0 {
+		if err := json.Unmarshal(cfg.Storage, &module); err != nil {
+			return nil, errors.Wrap(err, "decoding storage config")
+		}
+	}
+	if module.Module != "consul" {
+		return nil, errors.Errorf("%s doesn't configure the consul storage", configFile)
+	}
+
+	cs := New()
+	if err := json.Unmarshal(cfg.Storage, cs); err != nil {
+		return nil, errors.Wrap(err, "decoding storage config")
+	}
+	if err := cs.configure(); err != nil {
+		return nil, err
+	}
+
+	return cs, nil
+}
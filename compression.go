@@ -0,0 +1,85 @@
+package storageconsul
+
+import (
+	_ "embed"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pteich/errors"
+)
+
+// CompressionZstd compresses values with zstd and a dictionary trained on certificate data
+const CompressionZstd = "zstd"
+
+// maxDecompressedSize guards against values that decompress to excessive sizes
+const maxDecompressedSize = 64 << 20
+
+// pemDict is a zstd dictionary trained on PEM certificates, keys and certmagic's JSON metadata,
+// regenerate it with tools/gendict
+//go:embed pem.zdict
+var pemDict []byte
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// zstdCodec returns the shared encoder and decoder, both are safe for concurrent use
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderDict(pemDict))
+		if zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderDicts(pemDict), zstd.WithDecoderMaxMemory(maxDecompressedSize))
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// validCompression checks that compression names a supported algorithm
+func validCompression(compression string) error {
+	switch compression {
+	case "", "none", CompressionZstd:
+		return nil
+	default:
+		return errors.Errorf("unsupported compression %s", compression)
+	}
+}
+
+// compressData compresses the value of data if compression is enabled
+func (cs *ConsulStorage) compressData(data *StorageData) error {
+	if err := validCompression(cs.Compression); err != nil || cs.Compression != CompressionZstd {
+		return err
+	}
+
+	encoder, _, err := zstdCodec()
+	if err != nil {
+		return errors.Wrap(err, "unable to create zstd encoder")
+	}
+	data.Value = encoder.EncodeAll(data.Value, nil)
+	data.Compression = CompressionZstd
+	return nil
+}
+
+// decompressData decompresses the value of data, independent of the configured compression
+func decompressData(data *StorageData) error {
+	switch data.Compression {
+	case "":
+		return nil
+	case CompressionZstd:
+		_, decoder, err := zstdCodec()
+		if err != nil {
+			return errors.Wrap(err, "unable to create zstd decoder")
+		}
+		value, err := decoder.DecodeAll(data.Value, nil)
+		if err != nil {
+			return errors.Wrap(err, "unable to decompress value")
+		}
+		data.Value, data.Compression = value, ""
+		return nil
+	default:
+		return errors.Errorf("unsupported compression %s", data.Compression)
+	}
+}
@@ -0,0 +1,59 @@
+package storageconsul
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testCertificate = `-----BEGIN CERTIFICATE-----
+MIIBszCCAVmgAwIBAgICA+gwCgYIKoZIzj0EAwMwMTELMAkGA1UEBhMCVVMxFjAU
+BgNVBAoTDUxldCdzIEVuY3J5cHQxCjAIBgNVBAMTAUUxMB4XDTI0MDEwMTAwMDAw
+MFoXDTI0MDQwMTAwMDAwMFowHDEaMBgGA1UEAxMRaG9zdDAuZXhhbXBsZTAuY29t
+MFkwEwYHKoZIzj0CAQYIKoZIzj0DAQcDQgAE2Jt0i2bFJpYHrX6q2E8iHk2Nq9xM
+-----END CERTIFICATE-----
+`
+
+func TestConsulStorage_CompressionZstd(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.Compression = CompressionZstd
+
+	value := []byte(testCertificate)
+	require.NoError(t, cs.Store("certificates/example.com/example.com.crt", value))
+
+	data, err := cs.DecryptStorageDataForKey("certificates/example.com/example.com.crt", fc.kv[cs.prefixKey("certificates/example.com/example.com.crt")].Value)
+	require.NoError(t, err)
+	assert.Equal(t, CompressionZstd, data.Compression)
+	assert.Less(t, len(data.Value), len(value))
+
+	loaded, err := cs.Load("certificates/example.com/example.com.crt")
+	require.NoError(t, err)
+	assert.Equal(t, value, loaded)
+
+	// compressed values stay readable after compression was disabled
+	cs.Compression = ""
+	loaded, err = cs.Load("certificates/example.com/example.com.crt")
+	require.NoError(t, err)
+	assert.Equal(t, value, loaded)
+}
+
+func TestConsulStorage_CompressionWithDedup(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+	cs.Compression = CompressionZstd
+	cs.DedupValues = true
+
+	value := bytes.Repeat([]byte(testCertificate), 4)
+	require.NoError(t, cs.Store("certificates/example.com/example.com.crt", value))
+
+	loaded, err := cs.Load("certificates/example.com/example.com.crt")
+	require.NoError(t, err)
+	assert.Equal(t, value, loaded)
+}
+
+func TestValidCompression(t *testing.T) {
+	assert.NoError(t, validCompression(""))
+	assert.NoError(t, validCompression(CompressionZstd))
+	assert.Error(t, validCompression("gzip"))
+}
@@ -1,5 +1,7 @@
 package storageconsul
 
+import "time"
+
 const (
 	// DefaultPrefix defines the default prefix in KV store
 	DefaultPrefix = "caddytls"
@@ -13,6 +15,42 @@ const (
 	// DefaultTimeout is the default timeout for Consul connections
 	DefaultTimeout = 10
 
+	// DefaultLockRetryInterval is the pause between attempts to reacquire a lost lock while Consul is unavailable
+	DefaultLockRetryInterval = time.Second
+
+	// DefaultLockPollInterval is the initial pause between attempts to acquire a contended lock
+	DefaultLockPollInterval = 250 * time.Millisecond
+
+	// DefaultMaxLockPollInterval caps the pause between attempts to acquire a contended lock
+	DefaultMaxLockPollInterval = 5 * time.Second
+
+	// DefaultSlowLockThreshold is the time waiting for a lock after which a warning is logged
+	DefaultSlowLockThreshold = 10 * time.Second
+
+	// DefaultLockMonitorRetries is the number of failed requests after which a held lock is considered lost
+	DefaultLockMonitorRetries = 5
+
+	// DefaultThrottleRetries is the number of times a request rejected by Consul's rate limits is retried
+	DefaultThrottleRetries = 3
+
+	// DefaultThrottleDelay is the initial pause before retrying a throttled request if Consul doesn't ask for one
+	DefaultThrottleDelay = time.Second
+
+	// DefaultMaxThrottleDelay caps the pause before retrying a throttled request
+	DefaultMaxThrottleDelay = 30 * time.Second
+
+	// DefaultMaxKeyLength is the length of Consul keys above which keys are hashed if enabled
+	DefaultMaxKeyLength = 512
+
+	// DefaultKeySeparator joins the segments of keys below the prefix
+	DefaultKeySeparator = "/"
+
+	// DefaultTokenFileInterval is the interval in which a token file is reread
+	DefaultTokenFileInterval = 10 * time.Second
+
+	// DefaultDedupMinSize is the size from which values are deduplicated if enabled
+	DefaultDedupMinSize = 1024
+
 	// EnvNameAESKey defines the env variable name to override AES key
 	EnvNameAESKey = "CADDY_CLUSTERING_CONSUL_AESKEY"
 
@@ -0,0 +1,28 @@
+package storageconsul
+
+import (
+	"bytes"
+	"context"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// writesConsistently reports whether writes of key are read back from the leader before they return
+func (cs *ConsulStorage) writesConsistently(key string) bool {
+	p := cs.policy(key)
+	return p != nil && p.ConsistentWrite
+}
+
+// confirmWrite reads kv back with a consistent read, which the leader only answers once the write is
+// committed by the Raft quorum, and fails if the stored value differs
+func (cs *ConsulStorage) confirmWrite(ctx context.Context, key string, kv *consul.KVPair) error {
+	stored, _, err := cs.kv(key).Get(kv.Key, cs.queryOptions(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "unable to confirm write of %s", kv.Key)
+	}
+	if stored == nil || !bytes.Equal(stored.Value, kv.Value) {
+		return errors.Errorf("write of %s was not confirmed by a consistent read", kv.Key)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_ConsistentWrite(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.KeyPolicies = map[string]*KeyPolicy{"keys": {KeyPrefixes: []string{"acme/ca.example.com/users"}, ConsistentWrite: true}}
+
+	key := "acme/ca.example.com/users/admin/admin.key"
+	require.NoError(t, cs.Store(key, []byte("account key")))
+	assert.Contains(t, fc.reads[cs.prefixKey(key)], "consistent")
+
+	// other keys are written without reading them back
+	other := "certificates/example.com/example.com.crt"
+	require.NoError(t, cs.Store(other, []byte("cert")))
+	assert.NotContains(t, fc.reads, cs.prefixKey(other))
+
+	// a stored value that differs from the written one isn't confirmed
+	err := cs.confirmWrite(context.Background(), key, &consul.KVPair{Key: cs.prefixKey(key), Value: []byte("lost")})
+	assert.Error(t, err)
+	err = cs.confirmWrite(context.Background(), key, &consul.KVPair{Key: cs.prefixKey("missing"), Value: []byte("lost")})
+	assert.Error(t, err)
+}
@@ -0,0 +1,69 @@
+package storageconsul
+
+import (
+	"os"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// consulStore is the backend of Consul KV accessed with one Consul client, the storage uses a separate one
+// for the client of every tenant
+type consulStore struct {
+	*consul.KV
+	client *consul.Client
+	cs     *ConsulStorage
+}
+
+func newConsulStore(cs *ConsulStorage, client *consul.Client) *consulStore {
+	return &consulStore{KV: client.KV(), client: client, cs: cs}
+}
+
+// newLock returns a Consul lock bound to a session that is renewed while the lock is held
+func (s *consulStore) newLock(consulKey string, value []byte) (locker, error) {
+	hostname, _ := os.Hostname()
+	opts := &consul.LockOptions{
+		Key:          consulKey,
+		Value:        value,
+		SessionName:  "caddy lock on " + hostname,
+		LockWaitTime: time.Duration(s.cs.Timeout) * time.Second,
+		LockTryOnce:  true,
+		// ride out leader elections and agent restarts instead of giving up the lock at the first error
+		MonitorRetries:   DefaultLockMonitorRetries,
+		MonitorRetryTime: DefaultLockRetryInterval,
+	}
+	if s.cs.deletesLockKeys() {
+		opts.SessionOpts = &consul.SessionEntry{
+			Name:     opts.SessionName,
+			TTL:      consul.DefaultLockSessionTTL,
+			Behavior: consul.SessionBehaviorDelete,
+		}
+	}
+	return s.client.LockOpts(opts)
+}
+
+// Txn applies ops with Consul's transaction API, it shadows the deprecated KV transactions of *consul.KV
+func (s *consulStore) Txn(ops consul.TxnOps, q *consul.QueryOptions) (bool, *consul.TxnResponse, *consul.QueryMeta, error) {
+	return s.client.Txn().Txn(ops, q)
+}
+
+// Session returns Consul's session API
+func (s *consulStore) Session() *consul.Session {
+	return s.client.Session()
+}
+
+// Event returns Consul's user event API
+func (s *consulStore) Event() *consul.Event {
+	return s.client.Event()
+}
+
+func (s *consulStore) limitsKeys() bool {
+	return false
+}
+
+func (s *consulStore) fitsKey(string) bool {
+	return true
+}
+
+// close does nothing, the Consul clients are given back by the storage
+func (s *consulStore) close() {}
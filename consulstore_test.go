@@ -0,0 +1,41 @@
+package storageconsul
+
+import (
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_ConsulBackend(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.Tenants = map[string]*Tenant{
+		"customer-a": {KeyPrefixes: []string{"certificates/a.example.com"}, Prefix: "tenants/a", Token: "token-a"},
+	}
+	require.NoError(t, cs.connectTenants())
+
+	// every tenant is accessed with the Consul backend of its own client
+	kv, ok := cs.kv("certificates/a.example.com/a.example.com.crt").(*consulStore)
+	require.True(t, ok)
+	assert.Same(t, cs.Tenants["customer-a"].client, kv.client)
+	kv, ok = cs.kv("certificates/b.example.com/b.example.com.crt").(*consulStore)
+	require.True(t, ok)
+	assert.Same(t, cs.ConsulClient, kv.client)
+
+	_, sessions := cs.defaultKV().(kvSessions)
+	assert.True(t, sessions)
+	assert.False(t, cs.defaultKV().limitsKeys())
+
+	txn, ok := cs.txn("certificates/b.example.com/b.example.com.crt")
+	require.True(t, ok)
+	ops := consul.TxnOps{{KV: &consul.KVTxnOp{Verb: consul.KVSet, Key: "caddytls/txn", Value: []byte("value")}}}
+	committed, _, _, err := txn.Txn(ops, nil)
+	require.NoError(t, err)
+	assert.True(t, committed)
+
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	assert.Equal(t, 1, fc.txns)
+	assert.Equal(t, []byte("value"), fc.kv["caddytls/txn"].Value)
+}
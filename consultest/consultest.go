@@ -0,0 +1,71 @@
+// Package consultest starts a Consul test server for tests of code that uses the Consul storage, so they
+// neither need a Consul agent managed by hand nor a hardcoded token. The consul binary has to be on the
+// PATH, tests are skipped without it.
+package consultest
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/hashicorp/go-uuid"
+
+	storageconsul "github.com/pteich/caddy-tlsconsul"
+)
+
+// Server is a Consul test server with ACLs enabled
+type Server struct {
+	*testutil.TestServer
+
+	// Token is the ACL master token of the server
+	Token string
+}
+
+// StartServer starts a Consul test server that is stopped once t and its subtests finished. ACLs deny
+// everything by default and a random master token is generated, so missing tokens are noticed.
+func StartServer(t *testing.T) *Server {
+	t.Helper()
+	if _, err := exec.LookPath("consul"); err != nil {
+		t.Skip("consul not found on the PATH, install it to run this test")
+	}
+
+	token, err := uuid.GenerateUUID()
+	if err != nil {
+		t.Fatalf("unable to generate token: %v", err)
+	}
+
+	srv, err := testutil.NewTestServerConfigT(t, func(c *testutil.TestServerConfig) {
+		c.ACL.Enabled = true
+		c.ACL.DefaultPolicy = "deny"
+		c.ACL.Tokens.Master = token
+		c.PrimaryDatacenter = "dc1"
+	})
+	if err != nil {
+		t.Fatalf("unable to start Consul test server: %v", err)
+	}
+	t.Cleanup(func() { srv.Stop() })
+
+	srv.WaitForLeader(t)
+	return &Server{TestServer: srv, Token: token}
+}
+
+// NewStorage returns a storage connected to the server with its master token, opts are applied after
+// that. The storage is cleaned up once t finished.
+func (s *Server) NewStorage(t *testing.T, opts ...storageconsul.Option) *storageconsul.ConsulStorage {
+	t.Helper()
+
+	opts = append([]storageconsul.Option{storageconsul.WithAddress(s.HTTPAddr), storageconsul.WithToken(s.Token)}, opts...)
+	cs, err := storageconsul.NewWithOptions(opts...)
+	if err != nil {
+		t.Fatalf("unable to connect storage to Consul test server: %v", err)
+	}
+	t.Cleanup(func() { cs.Cleanup() })
+	return cs
+}
+
+// NewStorage starts a Consul test server and returns a storage connected to it, both are cleaned up once
+// t finished. Use StartServer to connect several storages to the same server.
+func NewStorage(t *testing.T, opts ...storageconsul.Option) *storageconsul.ConsulStorage {
+	t.Helper()
+	return StartServer(t).NewStorage(t, opts...)
+}
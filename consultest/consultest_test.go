@@ -0,0 +1,29 @@
+package consultest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	storageconsul "github.com/pteich/caddy-tlsconsul"
+)
+
+func TestServer_NewStorage(t *testing.T) {
+	srv := StartServer(t)
+	cs := srv.NewStorage(t, storageconsul.WithPrefix("consultest"))
+	other := srv.NewStorage(t, storageconsul.WithPrefix("consultest"))
+
+	require.NoError(t, cs.Store("certificates/example.com/example.com.crt", []byte("crt data")))
+
+	loaded, err := other.Load("certificates/example.com/example.com.crt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), loaded)
+}
+
+func TestNewStorage(t *testing.T) {
+	cs := NewStorage(t)
+
+	require.NoError(t, cs.Verify(context.Background()))
+}
@@ -6,36 +6,88 @@ import (
 	"crypto/rand"
 	"encoding/json"
 	"io"
+	"sync"
 
 	"github.com/pteich/errors"
 )
 
-func (cs *ConsulStorage) encrypt(bytes []byte) ([]byte, error) {
-	// No key? No encrypt
-	if len(cs.AESKey) == 0 {
-		return bytes, nil
+// aeads caches the AES-GCM instance of each key so the key schedule isn't derived on every call,
+// an AEAD holds no per-call state and is safe for concurrent use
+var aeads = struct {
+	sync.RWMutex
+	m map[string]cipher.AEAD
+}{m: make(map[string]cipher.AEAD)}
+
+// aeadForKey returns the cached AES-GCM instance for key
+func aeadForKey(key []byte) (cipher.AEAD, error) {
+	aeads.RLock()
+	gcm, ok := aeads.m[string(key)]
+	aeads.RUnlock()
+	if ok {
+		return gcm, nil
 	}
 
-	c, err := aes.NewCipher(cs.AESKey)
+	c, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to create AES cipher")
 	}
 
-	gcm, err := cipher.NewGCM(c)
+	gcm, err = cipher.NewGCM(c)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to create GCM cipher")
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
-	_, err = io.ReadFull(rand.Reader, nonce)
+	aeads.Lock()
+	aeads.m[string(key)] = gcm
+	aeads.Unlock()
+
+	return gcm, nil
+}
+
+// scratchBuffers holds buffers for plaintexts that don't outlive a single encrypt or decrypt
+var scratchBuffers = sync.Pool{
+	New: func() interface{} {
+		return new([]byte)
+	},
+}
+
+func (cs *ConsulStorage) encrypt(bytes []byte) ([]byte, error) {
+	return cs.seal(nil, bytes)
+}
+
+// seal encrypts bytes with aad as additional data, which has to be passed again to decrypt them
+func (cs *ConsulStorage) seal(aad []byte, bytes []byte) ([]byte, error) {
+	// No key? No encrypt
+	if len(cs.AESKey) == 0 {
+		return bytes, nil
+	}
+
+	gcm, err := aeadForKey(cs.AESKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// allocate the nonce and the sealed output at once
+	out := make([]byte, gcm.NonceSize(), gcm.NonceSize()+len(bytes)+gcm.Overhead())
+	_, err = io.ReadFull(rand.Reader, out)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to generate nonce")
 	}
 
-	return gcm.Seal(nonce, nonce, bytes, nil), nil
+	return gcm.Seal(out, out, bytes, aad), nil
 }
 
 func (cs *ConsulStorage) EncryptStorageData(data *StorageData) ([]byte, error) {
+	return cs.encryptStorageData(nil, data)
+}
+
+// encryptStorageData encodes and encrypts data with aad as additional data, formats that don't bind values
+// to their key are encrypted without
+func (cs *ConsulStorage) encryptStorageData(aad []byte, data *StorageData) ([]byte, error) {
+	if cs.writeFormatVersion() < bindingFormatVersion {
+		aad = nil
+	}
+
 	// JSON marshal, then encrypt if key is there
 	bytes, err := json.Marshal(data)
 	if err != nil {
@@ -43,30 +95,45 @@ func (cs *ConsulStorage) EncryptStorageData(data *StorageData) ([]byte, error) {
 	}
 
 	// Prefix with simple prefix and then encrypt
-	bytes = append([]byte(cs.ValuePrefix), bytes...)
-	return cs.encrypt(bytes)
+	if len(cs.AESKey) == 0 {
+		return cs.wrapValue(data, append([]byte(cs.ValuePrefix), bytes...), false), nil
+	}
+
+	scratch := scratchBuffers.Get().(*[]byte)
+	defer scratchBuffers.Put(scratch)
+
+	*scratch = append(append((*scratch)[:0], cs.ValuePrefix...), bytes...)
+	encrypted, err := cs.seal(aad, *scratch)
+	if err != nil {
+		return nil, err
+	}
+	return cs.wrapValue(data, encrypted, true), nil
 }
 
 func (cs *ConsulStorage) decrypt(bytes []byte) ([]byte, error) {
+	return decryptWithKey(cs.AESKey, bytes)
+}
+
+func decryptWithKey(key []byte, bytes []byte) ([]byte, error) {
+	return openWithKey(nil, key, bytes, nil)
+}
+
+// openWithKey decrypts bytes sealed with aad as additional data with key and appends the plaintext to dst
+func openWithKey(dst []byte, key []byte, bytes []byte, aad []byte) ([]byte, error) {
 	// No key? No decrypt
-	if len(cs.AESKey) == 0 {
+	if len(key) == 0 {
 		return bytes, nil
 	}
 	if len(bytes) < aes.BlockSize {
 		return nil, errors.New("invalid contents")
 	}
 
-	block, err := aes.NewCipher(cs.AESKey)
+	gcm, err := aeadForKey(key)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to create AES cipher")
+		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, errors.Wrap(err, "unable to create GCM cipher")
-	}
-
-	out, err := gcm.Open(nil, bytes[:gcm.NonceSize()], bytes[gcm.NonceSize():], nil)
+	out, err := gcm.Open(dst, bytes[:gcm.NonceSize()], bytes[gcm.NonceSize():], aad)
 	if err != nil {
 		return nil, errors.Wrap(err, "decryption failure")
 	}
@@ -75,12 +142,38 @@ func (cs *ConsulStorage) decrypt(bytes []byte) ([]byte, error) {
 }
 
 func (cs *ConsulStorage) DecryptStorageData(bytes []byte) (*StorageData, error) {
-	// We have to decrypt if there is an AES key and then JSON unmarshal
-	bytes, err := cs.decrypt(bytes)
+	return cs.decodeVersioned(nil, bytes)
+}
+
+// decodeUnbound decodes the payload of a format version that doesn't bind values to their key
+func (cs *ConsulStorage) decodeUnbound(aad []byte, bytes []byte) (*StorageData, error) {
+	return cs.decodePayload(nil, bytes)
+}
+
+// decodePayload decrypts the payload of a value following its format header with aad as additional data
+// and unmarshals it
+func (cs *ConsulStorage) decodePayload(aad []byte, bytes []byte) (*StorageData, error) {
+	// No key? Just unmarshal
+	if len(cs.AESKey) == 0 {
+		return cs.unmarshalStorageData(bytes)
+	}
+
+	// We have to decrypt if there is an AES key and then JSON unmarshal, the plaintext
+	// is only needed until it is unmarshaled so a scratch buffer is used
+	scratch := scratchBuffers.Get().(*[]byte)
+	defer scratchBuffers.Put(scratch)
+
+	plaintext, err := openWithKey((*scratch)[:0], cs.AESKey, bytes, aad)
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to decrypt data")
 	}
+	*scratch = plaintext
+
+	return cs.unmarshalStorageData(plaintext)
+}
 
+// unmarshalStorageData unmarshals decrypted bytes prefixed with the value prefix
+func (cs *ConsulStorage) unmarshalStorageData(bytes []byte) (*StorageData, error) {
 	// Simple sanity check of the beginning of the byte array just to check
 	if len(bytes) < len(cs.ValuePrefix) || string(bytes[:len(cs.ValuePrefix)]) != cs.ValuePrefix {
 		return nil, errors.New("invalid data format")
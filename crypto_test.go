@@ -1,9 +1,12 @@
 package storageconsul
 
 import (
-	"github.com/stretchr/testify/assert"
+	"bytes"
+	"sync"
 	"testing"
 	"time"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestConsulStorage_EncryptDecryptStorageData(t *testing.T) {
@@ -25,3 +28,66 @@ func TestConsulStorage_EncryptDecryptStorageData(t *testing.T) {
 	assert.Equal(t, sd.Value, decryptedData.Value)
 	assert.Equal(t, sd.Modified.Format(time.RFC822), decryptedData.Modified.Format(time.RFC822))
 }
+
+func TestConsulStorage_EncryptDecryptConcurrently(t *testing.T) {
+	cs := New()
+	other := New()
+	other.AESKey = []byte("consultls-0987654321-caddytls-32")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for _, storage := range []*ConsulStorage{cs, other} {
+				value := bytes.Repeat([]byte{byte(i)}, 100*i)
+				encryptedData, err := storage.EncryptStorageData(&StorageData{Value: value})
+				assert.NoError(t, err)
+
+				original := append([]byte(nil), encryptedData...)
+				decryptedData, err := storage.DecryptStorageData(encryptedData)
+				assert.NoError(t, err)
+				assert.Equal(t, value, decryptedData.Value)
+				assert.Equal(t, original, encryptedData)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func benchmarkStorageData() *StorageData {
+	value := make([]byte, 2048)
+	for i := range value {
+		value[i] = byte('A' + i%26)
+	}
+	return &StorageData{Value: value, Modified: time.Now()}
+}
+
+func BenchmarkConsulStorage_EncryptStorageData(b *testing.B) {
+	cs := New()
+	sd := benchmarkStorageData()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cs.EncryptStorageData(sd); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkConsulStorage_DecryptStorageData(b *testing.B) {
+	cs := New()
+	encryptedData, err := cs.EncryptStorageData(benchmarkStorageData())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := cs.DecryptStorageData(encryptedData); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package storageconsul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/pteich/errors"
+)
+
+const (
+	// decryptWebhookTimeout is the time a decryption failure webhook may take to respond
+	decryptWebhookTimeout = 10 * time.Second
+	// decryptAlertQueue is the number of failures waiting to be posted before further ones are dropped
+	decryptAlertQueue = 32
+)
+
+// DecryptFailure is posted as JSON to the DecryptFailureWebhook whenever a loaded value can't be decrypted
+type DecryptFailure struct {
+	Key        string    `json:"key"`
+	Error      string    `json:"error"`
+	Hostname   string    `json:"hostname"`
+	InstanceID string    `json:"instance_id,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// validWebhook checks that webhook is an HTTP or HTTPS URL
+func validWebhook(webhook string) error {
+	u, err := url.Parse(webhook)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.Errorf("decrypt_failure_webhook %s must be an http or https URL", webhook)
+	}
+	return nil
+}
+
+// decryptFailed reports that the value of key can't be decrypted, as a wrong AES key or corrupted data would
+// otherwise look like any other failed Load
+func (cs *ConsulStorage) decryptFailed(ctx context.Context, key string, err error) {
+	decryptFailures.Inc()
+	decryptFailuresDebugVar.Add(1)
+	cs.log(ctx).Errorf("unable to decrypt %s, check the aes_key: %v", key, err)
+
+	if cs.OnDecryptFailure != nil {
+		cs.OnDecryptFailure(key, err)
+	}
+	if cs.DecryptFailureWebhook != "" {
+		hostname, _ := os.Hostname()
+		cs.decryptAlerter().post(DecryptFailure{
+			Key:        key,
+			Error:      err.Error(),
+			Hostname:   hostname,
+			InstanceID: cs.instanceID,
+			Time:       time.Now().UTC(),
+		})
+	}
+}
+
+// decryptAlerter returns the alerter posting to the DecryptFailureWebhook, starting it on first use
+func (cs *ConsulStorage) decryptAlerter() *decryptAlerter {
+	cs.muAlerts.Lock()
+	defer cs.muAlerts.Unlock()
+
+	if cs.alerts == nil {
+		cs.alerts = newDecryptAlerter(cs.DecryptFailureWebhook, cs.logger)
+	}
+	return cs.alerts
+}
+
+// stopDecryptAlerter stops posting to the DecryptFailureWebhook
+func (cs *ConsulStorage) stopDecryptAlerter() {
+	cs.muAlerts.Lock()
+	defer cs.muAlerts.Unlock()
+
+	if cs.alerts != nil {
+		cs.alerts.close()
+		cs.alerts = nil
+	}
+}
+
+// decryptAlerter posts decryption failures to a webhook one at a time, so a failing AES key doesn't start a
+// request for every Load
+type decryptAlerter struct {
+	webhook string
+	client  *http.Client
+	logger  *zap.SugaredLogger
+	queue   chan DecryptFailure
+	stop    chan struct{}
+}
+
+func newDecryptAlerter(webhook string, logger *zap.SugaredLogger) *decryptAlerter {
+	da := &decryptAlerter{
+		webhook: webhook,
+		client:  &http.Client{Timeout: decryptWebhookTimeout},
+		logger:  logger,
+		queue:   make(chan DecryptFailure, decryptAlertQueue),
+		stop:    make(chan struct{}),
+	}
+	go da.run()
+	return da
+}
+
+// post queues failure, it is dropped if the webhook can't keep up
+func (da *decryptAlerter) post(failure DecryptFailure) {
+	select {
+	case da.queue <- failure:
+	default:
+		da.logger.Warnf("dropping decryption failure alert for %s, the webhook can't keep up", failure.Key)
+	}
+}
+
+func (da *decryptAlerter) close() {
+	close(da.stop)
+}
+
+func (da *decryptAlerter) run() {
+	for {
+		select {
+		case <-da.stop:
+			return
+		case failure := <-da.queue:
+			da.send(failure)
+		}
+	}
+}
+
+// send posts failure to the webhook
+func (da *decryptAlerter) send(failure DecryptFailure) {
+	body, err := json.Marshal(failure)
+	if err != nil {
+		return
+	}
+
+	resp, err := da.client.Post(da.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		da.logger.Warnf("unable to call decryption failure webhook: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		da.logger.Warnf("decryption failure webhook responded with %s", resp.Status)
+	}
+}
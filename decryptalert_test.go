@@ -0,0 +1,79 @@
+package storageconsul
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestConsulStorage_DecryptFailure(t *testing.T) {
+	posted := make(chan DecryptFailure, 1)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var failure DecryptFailure
+		json.NewDecoder(r.Body).Decode(&failure)
+		posted <- failure
+	}))
+	defer webhook.Close()
+
+	cs, _ := newFakeConsulStorage(t)
+	require.NoError(t, cs.Store("certificates/example.com.key", []byte("key")))
+
+	var failed []string
+	reader := New()
+	reader.ConsulClient = cs.ConsulClient
+	reader.AESKey = []byte("another-key-12345678901234567890")
+	reader.DecryptFailureWebhook = webhook.URL
+	reader.OnDecryptFailure = func(key string, err error) {
+		failed = append(failed, key)
+	}
+
+	before := testutil.ToFloat64(decryptFailures)
+	_, err := reader.Load("certificates/example.com.key")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"certificates/example.com.key"}, failed)
+	assert.Equal(t, before+1, testutil.ToFloat64(decryptFailures))
+
+	select {
+	case failure := <-posted:
+		assert.Equal(t, "certificates/example.com.key", failure.Key)
+		assert.NotEmpty(t, failure.Error)
+		assert.NotEmpty(t, failure.Hostname)
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook wasn't called")
+	}
+
+	assert.Error(t, validWebhook("ftp://alerts.example.com"))
+	assert.NoError(t, validWebhook("https://alerts.example.com/caddy"))
+	reader.stopDecryptAlerter()
+}
+
+func TestDecryptAlerter_Bounded(t *testing.T) {
+	var posted int32
+	release := make(chan struct{})
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&posted, 1)
+		<-release
+	}))
+	defer webhook.Close()
+
+	da := newDecryptAlerter(webhook.URL, zap.NewNop().Sugar())
+	defer da.close()
+
+	for i := 0; i < 2*decryptAlertQueue; i++ {
+		da.post(DecryptFailure{Key: "certificates/example.com.key"})
+	}
+	assert.Eventually(t, func() bool { return atomic.LoadInt32(&posted) == 1 }, 5*time.Second, 10*time.Millisecond)
+	close(release)
+
+	assert.Eventually(t, func() bool { return len(da.queue) == 0 }, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.LessOrEqual(t, atomic.LoadInt32(&posted), int32(decryptAlertQueue+1))
+}
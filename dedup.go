@@ -0,0 +1,107 @@
+package storageconsul
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"strings"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// blobsDir is the directory below the prefix that holds deduplicated values by their content hash
+const blobsDir = "_blobs"
+
+// dedupsValue reports whether value is stored once under its content hash
+func (cs *ConsulStorage) dedupsValue(value []byte) bool {
+	if !cs.DedupValues {
+		return false
+	}
+
+	minSize := cs.DedupMinSize
+	if minSize <= 0 {
+		minSize = DefaultDedupMinSize
+	}
+
+	return len(value) >= minSize
+}
+
+// contentHash returns the name of the blob holding value, it is keyed with the AES key
+// so the stored hashes don't reveal which well-known values are stored
+func (cs *ConsulStorage) contentHash(value []byte) string {
+	mac := hmac.New(sha256.New, cs.AESKey)
+	mac.Write(value)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// blobKey returns the Consul key of the blob named hash in the namespace of key
+func (cs *ConsulStorage) blobKey(key, hash string) string {
+	return path.Join(cs.keyPrefix(key), blobsDir, hash)
+}
+
+// inBlobsDir reports whether the Consul key below prefix holds a deduplicated value, blobs stay after
+// dedup_values is turned off as long as values reference them
+func (cs *ConsulStorage) inBlobsDir(prefix, consulKey string) bool {
+	return strings.HasPrefix(consulKey, path.Join(prefix, blobsDir)+"/")
+}
+
+// storeBlob stores value under its content hash unless an identical blob exists already and returns the hash
+func (cs *ConsulStorage) storeBlob(ctx context.Context, key string, value []byte) (string, error) {
+	hash := cs.contentHash(value)
+	blobKey := cs.blobKey(key, hash)
+
+	data := &StorageData{
+		Value:    value,
+		Modified: time.Now(),
+		Checksum: checksum(value),
+	}
+	if err := cs.compressData(data); err != nil {
+		return "", errors.Wrapf(err, "unable to compress data for %s", blobKey)
+	}
+
+	encryptedValue, err := cs.encryptStorageData([]byte(path.Join(blobsDir, hash)), data)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to encode data for %s", blobKey)
+	}
+
+	cs.checkValueSize(ctx, blobKey, len(encryptedValue))
+
+	// a Check-And-Set with index 0 only writes the blob if it doesn't exist yet
+	blob := &consul.KVPair{Key: blobKey, Value: encryptedValue, Flags: cs.blobFlags(data)}
+	stored, _, err := cs.kv(key).CAS(blob, cs.writeOptions(ctx))
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to store data for %s", blobKey)
+	}
+	if stored {
+		blobsStored.Add(1)
+	}
+
+	return hash, nil
+}
+
+// loadBlob sets the value of data that references a blob to the contents of the blob
+func (cs *ConsulStorage) loadBlob(ctx context.Context, key string, data *StorageData) error {
+	blobKey := cs.blobKey(key, data.Blob)
+
+	kv, _, err := cs.kv(key).Get(blobKey, cs.queryOptions(ctx))
+	if err != nil {
+		return errors.Wrapf(err, "unable to obtain data for %s", blobKey)
+	} else if kv == nil {
+		return errors.Errorf("blob %s referenced by %s does not exist", blobKey, key)
+	}
+
+	blob, err := cs.decodeVersioned([]byte(path.Join(blobsDir, data.Blob)), kv.Value)
+	if err != nil {
+		return errors.Wrapf(err, "unable to decrypt data for %s", blobKey)
+	}
+	if err := decompressData(blob); err != nil {
+		return errors.Wrapf(err, "unable to decompress data for %s", blobKey)
+	}
+
+	data.Value = blob.Value
+	return nil
+}
@@ -0,0 +1,62 @@
+package storageconsul
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_DedupValues(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.DedupValues = true
+
+	chain := bytes.Repeat([]byte("intermediate"), 200)
+	require.NoError(t, cs.Store("certificates/a.example.com/a.example.com.crt", chain))
+	require.NoError(t, cs.Store("certificates/b.example.com/b.example.com.crt", chain))
+	require.NoError(t, cs.Store("certificates/b.example.com/b.example.com.key", []byte("small")))
+
+	blobs := 0
+	for key, pair := range fc.kv {
+		if strings.HasPrefix(key, "caddytls/_blobs/") {
+			blobs++
+			continue
+		}
+		assert.Less(t, len(pair.Value), len(chain), key)
+	}
+	assert.Equal(t, 1, blobs)
+
+	for _, key := range []string{"certificates/a.example.com/a.example.com.crt", "certificates/b.example.com/b.example.com.crt"} {
+		loaded, err := cs.Load(key)
+		require.NoError(t, err)
+		assert.Equal(t, chain, loaded)
+
+		info, err := cs.Stat(key)
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(chain)), info.Size)
+	}
+
+	loaded, err := cs.Load("certificates/b.example.com/b.example.com.key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("small"), loaded)
+
+	keys, err := cs.List("", true)
+	require.NoError(t, err)
+	assert.Len(t, keys, 3)
+
+	// blobs referenced by stored values aren't listed after deduplication is turned off
+	cs.DedupValues = false
+	keys, err = cs.List("", true)
+	require.NoError(t, err)
+	assert.Len(t, keys, 3)
+}
+
+func TestConsulStorage_UnmarshalCaddyfileDedup(t *testing.T) {
+	for _, config := range []string{"dedup_values maybe", "dedup_min_size large"} {
+		d := caddyfile.NewTestDispenser("consul {\n" + config + "\n}")
+		assert.Error(t, New().UnmarshalCaddyfile(d), config)
+	}
+}
@@ -0,0 +1,74 @@
+package storageconsul
+
+import (
+	"context"
+
+	"github.com/caddyserver/certmagic"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// DeleteKeys deletes keys in Consul transactions of up to 64 operations instead of one round trip per key,
+// for pruning large prefixes. Keys that don't exist are skipped. Backends without transactions delete
+// the keys one by one.
+func (cs *ConsulStorage) DeleteKeys(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := validateKey(key); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := withTimeout(ctx, cs.WriteTimeout)
+	defer cancel()
+	defer func() {
+		for _, key := range keys {
+			cs.invalidateStat(key)
+		}
+	}()
+
+	if len(keys) == 0 {
+		return nil
+	}
+	if _, ok := cs.txn(keys[0]); !ok {
+		for _, key := range keys {
+			if err := cs.DeleteContext(ctx, key); err != nil {
+				if _, notExist := err.(certmagic.ErrNotExist); !notExist {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	// a transaction can only span keys accessed with the same client
+	batches := make(map[string]consul.TxnOps)
+	// order holds the first key of each namespace, it selects the client for the batch
+	var order []string
+	for _, key := range keys {
+		prefix := cs.keyPrefix(key)
+		if _, exists := batches[prefix]; !exists {
+			order = append(order, key)
+		}
+		for _, consulKey := range cs.consulKeys(key) {
+			batches[prefix] = append(batches[prefix], &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: consulKey}})
+		}
+	}
+
+	cs.logger.Debugf("deleting %d keys from Consul", len(keys))
+	for _, key := range order {
+		prefix := cs.keyPrefix(key)
+		ops := batches[prefix]
+		for len(ops) > 0 {
+			n := len(ops)
+			if n > maxTxnOps {
+				n = maxTxnOps
+			}
+			if _, err := cs.runTxn(ctx, key, ops[:n]); err != nil {
+				return errors.Wrapf(err, "unable to delete keys below %s", prefix)
+			}
+			ops = ops[n:]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package storageconsul
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_DeleteKeys(t *testing.T) {
+	fakeConsul, _ := newFakeConsulStorage(t)
+	for name, cs := range map[string]*ConsulStorage{"memory": setupConsulEnv(t), "consul": fakeConsul} {
+		t.Run(name, func(t *testing.T) {
+			// more keys than fit into one transaction
+			var keys []string
+			for i := 0; i < 2*maxTxnOps+10; i++ {
+				key := "ocsp/example-" + strconv.Itoa(i) + ".com"
+				require.NoError(t, cs.Store(key, []byte("staple")))
+				keys = append(keys, key)
+			}
+			require.NoError(t, cs.Store("certificates/example.com", []byte("crt")))
+
+			require.NoError(t, cs.DeleteKeys(context.Background(), append(keys, "ocsp/missing.com")))
+
+			_, err := cs.List("ocsp", true)
+			assert.Error(t, err)
+			assert.True(t, cs.Exists("certificates/example.com"))
+		})
+	}
+}
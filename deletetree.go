@@ -0,0 +1,56 @@
+package storageconsul
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pteich/errors"
+)
+
+// minDeleteTreeDepth is the number of path segments a directory needs to be deleted recursively,
+// so a mistake can't wipe whole directories like certificates or acme at once
+const minDeleteTreeDepth = 2
+
+// deleteTree deletes all keys below the directory dir from the prefix and the fallback prefix
+// and reports whether there were any
+func (cs *ConsulStorage) deleteTree(ctx context.Context, dir string) (bool, error) {
+	dir = strings.Trim(dir, "/")
+	if strings.Count(dir, "/")+1 < minDeleteTreeDepth {
+		return false, errors.Errorf("refusing to delete top-level directory %s recursively", cs.prefixKey(dir))
+	}
+
+	keys, err := cs.listKeys(ctx, dir, true)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to list directory %s", cs.prefixKey(dir))
+	}
+	if len(keys) == 0 {
+		// nothing to delete
+		return false, nil
+	}
+
+	cs.logger.Infof("deleting directory %s with %d keys from Consul", dir, len(keys))
+
+	// values stored under hashed keys are outside of the directory and deleted one by one
+	if cs.hashesLongKeys() {
+		for _, key := range keys {
+			if !cs.isHashedKey(key) {
+				continue
+			}
+			if err := cs.DeleteContext(ctx, key); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	for _, consulKey := range cs.consulKeys(dir) {
+		if _, err := cs.kv(dir).DeleteTree(consulKey+cs.keySeparator(), cs.writeOptions(ctx)); err != nil {
+			return false, errors.Wrapf(err, "unable to delete directory %s", consulKey)
+		}
+	}
+
+	if cache := cs.cachedStat(); cache != nil {
+		cache.invalidatePrefix(dir + "/")
+	}
+
+	return true, nil
+}
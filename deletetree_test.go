@@ -0,0 +1,57 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_RecursiveDelete(t *testing.T) {
+	cs := setupConsulEnv(t)
+	site := "certificates/acme-v02.api.letsencrypt.org-directory/example.com"
+	require.NoError(t, cs.Store(site+"/example.com.crt", []byte("crt")))
+	require.NoError(t, cs.Store(site+"/example.com.key", []byte("key")))
+	require.NoError(t, cs.Store("certificates/acme-v02.api.letsencrypt.org-directory/example.org/example.org.crt", []byte("crt")))
+
+	// directories are only deleted if enabled
+	_, notExist := cs.Delete(site).(certmagic.ErrNotExist)
+	assert.True(t, notExist)
+	assert.True(t, cs.Exists(site+"/example.com.crt"))
+
+	cs.RecursiveDelete = true
+	require.NoError(t, cs.Delete(site))
+	assert.False(t, cs.Exists(site+"/example.com.crt"))
+	assert.False(t, cs.Exists(site+"/example.com.key"))
+	assert.True(t, cs.Exists("certificates/acme-v02.api.letsencrypt.org-directory/example.org/example.org.crt"))
+
+	// top-level directories are never deleted as a whole
+	assert.Error(t, cs.Delete("certificates"))
+	assert.True(t, cs.Exists("certificates/acme-v02.api.letsencrypt.org-directory/example.org/example.org.crt"))
+}
+
+// failingKeysBackend fails to list keys
+type failingKeysBackend struct {
+	kvBackend
+}
+
+func (failingKeysBackend) Keys(string, string, *consul.QueryOptions) ([]string, *consul.QueryMeta, error) {
+	return nil, nil, errors.New("connection refused")
+}
+
+func TestConsulStorage_DeleteTreeListError(t *testing.T) {
+	cs := New()
+	cs.backend = newMemoryStore()
+	deleted, err := cs.deleteTree(context.Background(), "certificates/example.com")
+	require.NoError(t, err)
+	assert.False(t, deleted)
+
+	// a failed list isn't mistaken for an empty directory
+	cs.backend = failingKeysBackend{kvBackend: newMemoryStore()}
+	_, err = cs.deleteTree(context.Background(), "certificates/example.com")
+	assert.Error(t, err)
+}
@@ -0,0 +1,161 @@
+package storageconsul
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// Sources of settings, explicit config takes precedence over environment variables, which take precedence
+// over the defaults
+const (
+	SourceConfig  = "config"
+	SourceEnv     = "env"
+	SourceDefault = "default"
+)
+
+// getenv returns the environment variable name, or nothing if the environment is ignored. Named storages
+// only read the variable with their suffix, e.g. CONSUL_HTTP_ADDR_EU for the storage named eu.
+func (cc ConnectionConfig) getenv(name string) string {
+	if cc.IgnoreEnv {
+		return ""
+	}
+	if cc.envSuffix != "" {
+		return os.Getenv(name + "_" + cc.envSuffix)
+	}
+	return os.Getenv(name)
+}
+
+// consulConfig returns the defaults of the Consul client, which the Consul API client reads from its
+// environment variables unless the environment is ignored
+func (cc ConnectionConfig) consulConfig() *consul.Config {
+	cfg := consul.DefaultConfig()
+	if cc.IgnoreEnv || cc.envSuffix != "" {
+		cfg.Address = "127.0.0.1:8500"
+		cfg.Scheme = "http"
+		cfg.Token = ""
+		cfg.TokenFile = ""
+		cfg.HttpAuth = nil
+		cfg.Namespace = ""
+		cfg.TLSConfig = consul.TLSConfig{}
+	}
+	if cc.envSuffix != "" {
+		cc.applyConsulEnv(cfg)
+	}
+	return cfg
+}
+
+// settingSource returns where a setting comes from, the config if it is configured or the first of the
+// environment variables envs that is set
+func (cc ConnectionConfig) settingSource(configured bool, envs ...string) string {
+	var set []string
+	for _, env := range envs {
+		if cc.getenv(env) != "" {
+			set = append(set, env)
+		}
+	}
+
+	switch {
+	case configured && len(set) > 0:
+		return fmt.Sprintf("%s, overrides %s %s", SourceConfig, SourceEnv, strings.Join(set, " "))
+	case configured:
+		return SourceConfig
+	case len(set) > 0:
+		return SourceEnv + " " + set[0]
+	}
+	return SourceDefault
+}
+
+// applyEnv applies the environment variables of the storage to the settings that are not configured and
+// returns where each setting comes from
+func (cs *ConsulStorage) applyEnv() []string {
+	var sources []string
+	source := func(name string, configured bool, envs ...string) {
+		sources = append(sources, name+"="+cs.settingSource(configured, envs...))
+	}
+
+	// the defaults of New can't be told apart from the same values in the config
+	aesKeyConfigured := !bytes.Equal(cs.AESKey, []byte(DefaultAESKey))
+	prefixConfigured := cs.Prefix != DefaultPrefix
+	valuePrefixConfigured := cs.ValuePrefix != DefaultValuePrefix
+	source("aes_key", aesKeyConfigured, EnvNameAESKey)
+	source("prefix", prefixConfigured, EnvNamePrefix)
+	source("value_prefix", valuePrefixConfigured, EnvValuePrefix)
+
+	if aesKey := cs.getenv(EnvNameAESKey); aesKey != "" && !aesKeyConfigured {
+		cs.AESKey = []byte(aesKey)
+	}
+	if prefix := cs.getenv(EnvNamePrefix); prefix != "" && !prefixConfigured {
+		cs.Prefix = prefix
+	}
+	if valuePrefix := cs.getenv(EnvValuePrefix); valuePrefix != "" && !valuePrefixConfigured {
+		cs.ValuePrefix = valuePrefix
+	}
+
+	switch cs.Backend {
+	case BackendNomad:
+		source("nomad_address", cs.Nomad.Address != "", "NOMAD_ADDR")
+		source("nomad_token", cs.Nomad.Token != "", "NOMAD_TOKEN")
+		source("nomad_namespace", cs.Nomad.Namespace != "", "NOMAD_NAMESPACE")
+		source("nomad_region", cs.Nomad.Region != "", "NOMAD_REGION")
+	case "", BackendConsul:
+		if cs.Connection != "" {
+			break
+		}
+		source("address", cs.Address != "", consul.HTTPAddrEnvName)
+		source("token", cs.Token != "" || cs.TokenFile != "", consul.HTTPTokenEnvName, consul.HTTPTokenFileEnvName)
+		source("username", cs.Username != "", consul.HTTPAuthEnvName)
+		source("tls_enabled", cs.TlsEnabled, consul.HTTPSSLEnvName)
+		source("tls_insecure", cs.TlsInsecure, consul.HTTPSSLVerifyEnvName)
+		source("tls_ca", cs.TlsCAFile != "" || cs.TlsCAPem != "", consul.HTTPCAFile, consul.HTTPCAPath)
+		source("tls_server_name", cs.TlsServerName != "", consul.HTTPTLSServerName)
+	}
+
+	return sources
+}
+
+// resolvedEnv holds the settings of the Consul client that come from ENV and the modification times of the
+// files it reads. It is part of the key of shared clients, so the client of a reloaded config picks up changed
+// variables and rotated TLS files instead of reusing the client created with the old ones.
+type resolvedEnv struct {
+	Address   string                `json:"address"`
+	Scheme    string                `json:"scheme"`
+	Token     string                `json:"token"`
+	TokenFile string                `json:"token_file"`
+	HttpAuth  *consul.HttpBasicAuth `json:"http_auth"`
+	Namespace string                `json:"namespace"`
+	TLS       consul.TLSConfig      `json:"tls"`
+	Files     map[string]time.Time  `json:"files"`
+	Headers   http.Header           `json:"headers"`
+}
+
+// resolveEnv returns the settings cc resolves from ENV and files right now
+func (cc ConnectionConfig) resolveEnv() resolvedEnv {
+	cfg := cc.consulConfig()
+	env := resolvedEnv{
+		Address:   cfg.Address,
+		Scheme:    cfg.Scheme,
+		Token:     cfg.Token,
+		TokenFile: cfg.TokenFile,
+		HttpAuth:  cfg.HttpAuth,
+		Namespace: cfg.Namespace,
+		TLS:       cfg.TLSConfig,
+		Files:     make(map[string]time.Time),
+	}
+	// headers with placeholders that can't be resolved fail when the client is created
+	env.Headers, _ = cc.resolveHeaders()
+	for _, file := range []string{cfg.TokenFile, cfg.TLSConfig.CAFile, cfg.TLSConfig.CertFile, cfg.TLSConfig.KeyFile, cc.TlsCAFile} {
+		if file == "" {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			env.Files[file] = info.ModTime()
+		}
+	}
+	return env
+}
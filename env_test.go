@@ -0,0 +1,100 @@
+package storageconsul
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_ApplyEnv(t *testing.T) {
+	os.Setenv(EnvNameAESKey, "consultls-env-key-1234-caddytls-")
+	defer os.Unsetenv(EnvNameAESKey)
+	os.Setenv(EnvNamePrefix, "envprefix")
+	defer os.Unsetenv(EnvNamePrefix)
+	os.Setenv(consul.HTTPAddrEnvName, "consul.env:8500")
+	defer os.Unsetenv(consul.HTTPAddrEnvName)
+
+	// explicit config takes precedence over ENV, which takes precedence over the defaults
+	cs := New()
+	cs.Prefix = "configprefix"
+	sources := cs.applyEnv()
+	assert.Equal(t, []byte("consultls-env-key-1234-caddytls-"), cs.AESKey)
+	assert.Equal(t, "configprefix", cs.Prefix)
+	assert.Equal(t, DefaultValuePrefix, cs.ValuePrefix)
+	assert.Contains(t, sources, "aes_key=env "+EnvNameAESKey)
+	assert.Contains(t, sources, "prefix=config, overrides env "+EnvNamePrefix)
+	assert.Contains(t, sources, "value_prefix=default")
+	assert.Contains(t, sources, "address=env "+consul.HTTPAddrEnvName)
+
+	cs = New()
+	cs.IgnoreEnv = true
+	sources = cs.applyEnv()
+	assert.Equal(t, []byte(DefaultAESKey), cs.AESKey)
+	assert.Equal(t, DefaultPrefix, cs.Prefix)
+	assert.Contains(t, sources, "address=default")
+	assert.Equal(t, "127.0.0.1:8500", cs.consulConfig().Address)
+}
+
+func TestConnectionConfig_ConsulConfig(t *testing.T) {
+	os.Setenv(consul.HTTPSSLVerifyEnvName, "false")
+	defer os.Unsetenv(consul.HTTPSSLVerifyEnvName)
+	os.Setenv(consul.HTTPTokenEnvName, "env-token")
+	defer os.Unsetenv(consul.HTTPTokenEnvName)
+
+	cc := ConnectionConfig{}
+	cfg := cc.consulConfig()
+	assert.True(t, cfg.TLSConfig.InsecureSkipVerify)
+	assert.Equal(t, "env-token", cfg.Token)
+
+	cc.IgnoreEnv = true
+	cfg = cc.consulConfig()
+	assert.False(t, cfg.TLSConfig.InsecureSkipVerify)
+	assert.Empty(t, cfg.Token)
+}
+
+func TestConnectionConfig_ReloadEnv(t *testing.T) {
+	first, second := newFakeConsul(t), newFakeConsul(t)
+
+	os.Setenv(consul.HTTPAddrEnvName, first.Listener.Addr().String())
+	defer os.Unsetenv(consul.HTTPAddrEnvName)
+	cc := ConnectionConfig{Timeout: DefaultTimeout}
+	sc, err := cc.acquireClient()
+	require.NoError(t, err)
+	defer releaseClient(sc)
+	_, err = sc.client.KV().Put(&consul.KVPair{Key: "caddytls/first"}, nil)
+	require.NoError(t, err)
+
+	// a reloaded config with the same settings connects to the new address from ENV
+	os.Setenv(consul.HTTPAddrEnvName, second.Listener.Addr().String())
+	reloaded, err := cc.acquireClient()
+	require.NoError(t, err)
+	defer releaseClient(reloaded)
+	assert.NotEqual(t, sc.poolKey, reloaded.poolKey)
+	_, err = reloaded.client.KV().Put(&consul.KVPair{Key: "caddytls/second"}, nil)
+	require.NoError(t, err)
+
+	assert.Contains(t, first.kv, "caddytls/first")
+	assert.Contains(t, second.kv, "caddytls/second")
+}
+
+func TestConnectionConfig_PoolKeyFiles(t *testing.T) {
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, []byte("ca"), 0600))
+
+	cc := ConnectionConfig{TlsCAFile: caFile}
+	key, err := cc.poolKey()
+	require.NoError(t, err)
+
+	// a rotated CA file needs a new client
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(caFile, later, later))
+	rotated, err := cc.poolKey()
+	require.NoError(t, err)
+	assert.NotEqual(t, key, rotated)
+}
@@ -0,0 +1,81 @@
+package storageconsul
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/pteich/errors"
+)
+
+// Envelopes the encoded values can be stored in
+const (
+	// EnvelopeBinary stores values as the format header followed by the payload
+	EnvelopeBinary = "binary"
+	// EnvelopeJSON stores values as self-describing JSON document
+	EnvelopeJSON = "json"
+)
+
+// valueEnvelope is the JSON document values are stored in with the JSON envelope
+type valueEnvelope struct {
+	Version          int       `json:"version"`
+	Encrypted        bool      `json:"encrypted"`
+	EncryptedPayload []byte    `json:"encrypted_payload"`
+	Checksum         string    `json:"checksum"`
+	Modified         time.Time `json:"modified"`
+	Size             int       `json:"size"`
+}
+
+// jsonEnvelope reports whether values are written in the JSON envelope
+func (cs *ConsulStorage) jsonEnvelope() bool {
+	return cs.ValueEnvelope == EnvelopeJSON
+}
+
+// wrapValue returns the value to store for the payload of data in the configured envelope
+func (cs *ConsulStorage) wrapValue(data *StorageData, payload []byte, encrypted bool) []byte {
+	if !cs.jsonEnvelope() {
+		return cs.withValueHeader(payload)
+	}
+
+	value, err := json.MarshalIndent(valueEnvelope{
+		Version:          FormatVersion,
+		Encrypted:        encrypted,
+		EncryptedPayload: payload,
+		Checksum:         checksum(payload),
+		Modified:         data.Modified.UTC(),
+		Size:             len(payload),
+	}, "", "  ")
+	if err != nil {
+		return cs.withValueHeader(payload)
+	}
+	return value
+}
+
+// unwrapValue returns the binary value of an armored value or one in the JSON envelope, so values in any
+// envelope are read regardless of the setting
+func unwrapValue(value []byte) ([]byte, error) {
+	value, err := unarmor(value)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.HasPrefix(bytes.TrimLeft(value, " \t\r\n"), []byte("{")) {
+		return value, nil
+	}
+	// binary values without header may start with a brace by chance
+	var env valueEnvelope
+	if err := json.Unmarshal(value, &env); err != nil || env.EncryptedPayload == nil {
+		return value, nil
+	}
+
+	if _, ok := valueDecoders[byte(env.Version)]; !ok || env.Version == 0 {
+		return nil, UnsupportedFormatError{Version: env.Version}
+	}
+	if env.Checksum != checksum(env.EncryptedPayload) {
+		return nil, errors.New("checksum of the JSON envelope doesn't match its payload")
+	}
+
+	binary := make([]byte, 0, len(valueHeaderMagic)+1+len(env.EncryptedPayload))
+	binary = append(append(binary, valueHeaderMagic...), byte(env.Version))
+	return append(binary, env.EncryptedPayload...), nil
+}
@@ -0,0 +1,50 @@
+package storageconsul
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_JSONEnvelope(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+
+	require.NoError(t, cs.Store("certificates/binary.com", []byte("binary")))
+	cs.ValueEnvelope = EnvelopeJSON
+	require.NoError(t, cs.Store("certificates/json.com", []byte("json")))
+
+	pair := fc.kv[cs.prefixKey("certificates/json.com")]
+	var env map[string]interface{}
+	require.NoError(t, json.Unmarshal(pair.Value, &env))
+	for _, field := range []string{"version", "encrypted", "encrypted_payload", "checksum", "modified", "size"} {
+		assert.Contains(t, env, field)
+	}
+	assert.Equal(t, float64(FormatVersion), env["version"])
+	assert.Equal(t, true, env["encrypted"])
+	format, ok := ParseValueFormat(pair.Flags)
+	require.True(t, ok)
+	assert.True(t, format.JSON)
+
+	// both envelopes are read regardless of the setting
+	for _, envelope := range []string{EnvelopeJSON, EnvelopeBinary} {
+		cs.ValueEnvelope = envelope
+		loaded, err := cs.Load("certificates/json.com")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("json"), loaded)
+		loaded, err = cs.Load("certificates/binary.com")
+		require.NoError(t, err)
+		assert.Equal(t, []byte("binary"), loaded)
+	}
+
+	// a payload that doesn't match the checksum is rejected
+	env["checksum"] = checksum([]byte("other"))
+	tampered, err := json.Marshal(env)
+	require.NoError(t, err)
+	_, err = unwrapValue(tampered)
+	assert.Error(t, err)
+
+	cs.ValueEnvelope = "xml"
+	assert.Error(t, cs.Validate())
+}
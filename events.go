@@ -0,0 +1,52 @@
+package storageconsul
+
+import (
+	"context"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// Names of the Consul user events fired with CertEvents, their payload is the domain of the certificate
+const (
+	CertUpdatedEvent = "caddy-cert-updated"
+	CertDeletedEvent = "caddy-cert-deleted"
+)
+
+// certDomain returns the domain of the certificate stored under key in certmagic's layout
+// certificates/<issuer>/<domain>/<domain>.crt, wildcard domains are stored with a wildcard_ prefix
+func certDomain(key string) (string, bool) {
+	parts := strings.Split(key, "/")
+	if len(parts) != 4 || parts[0] != certificatesDir || parts[3] != parts[2]+".crt" {
+		return "", false
+	}
+	domain := parts[2]
+	if strings.HasPrefix(domain, "wildcard_") {
+		domain = "*" + strings.TrimPrefix(domain, "wildcard_")
+	}
+	return domain, true
+}
+
+// fireCertEvent fires the Consul user event name if key is a certificate and CertEvents is enabled, so
+// consul watch handlers across the fleet can react to it. Failures are only logged, the certificate is
+// stored anyway.
+func (cs *ConsulStorage) fireCertEvent(ctx context.Context, name, key string) {
+	if !cs.CertEvents {
+		return
+	}
+	events, ok := cs.kv(key).(kvEvents)
+	if !ok {
+		return
+	}
+	domain, ok := certDomain(key)
+	if !ok {
+		return
+	}
+
+	event := &consul.UserEvent{Name: name, Payload: []byte(domain)}
+	if _, _, err := events.Event().Fire(event, cs.writeOptions(ctx)); err != nil {
+		cs.log(ctx).Warnf("unable to fire event %s for %s: %v", name, domain, err)
+		return
+	}
+	cs.log(ctx).Debugf("fired event %s for %s", name, domain)
+}
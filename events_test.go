@@ -0,0 +1,50 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCertDomain(t *testing.T) {
+	for key, domain := range map[string]string{
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.crt":                     "example.com",
+		"certificates/acme-v02.api.letsencrypt.org-directory/wildcard_.example.com/wildcard_.example.com.crt": "*.example.com",
+	} {
+		got, ok := certDomain(key)
+		assert.True(t, ok, key)
+		assert.Equal(t, domain, got)
+	}
+
+	for _, key := range []string{
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.key",
+		"certificates/acme-v02.api.letsencrypt.org-directory/example.com/example.com.json",
+		"acme/acme-v02.api.letsencrypt.org-directory/users/mail@example.com/mail.crt",
+	} {
+		_, ok := certDomain(key)
+		assert.False(t, ok, key)
+	}
+}
+
+func TestConsulStorage_CertEvents(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.CertEvents = true
+
+	const dir = "certificates/acme-v02.api.letsencrypt.org-directory/example.com/"
+	require.NoError(t, cs.Store(dir+"example.com.key", []byte("key")))
+	require.NoError(t, cs.Store(dir+"example.com.crt", []byte("crt")))
+	require.NoError(t, cs.StoreBundle(context.Background(), map[string][]byte{dir + "example.com.crt": []byte("renewed"), dir + "example.com.json": []byte("{}")}))
+	require.NoError(t, cs.Delete(dir+"example.com.crt"))
+
+	require.Len(t, fc.events, 3)
+	for i, name := range []string{CertUpdatedEvent, CertUpdatedEvent, CertDeletedEvent} {
+		assert.Equal(t, name, fc.events[i].Name)
+		assert.Equal(t, []byte("example.com"), fc.events[i].Payload)
+	}
+
+	cs.CertEvents = false
+	require.NoError(t, cs.Store(dir+"example.com.crt", []byte("crt")))
+	assert.Len(t, fc.events, 3)
+}
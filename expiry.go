@@ -0,0 +1,186 @@
+package storageconsul
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+const (
+	// challengeTokensDir is the directory below an issuer's certificates where certmagic shares challenge
+	// tokens for distributed solving, e.g. certificates/<issuer>/challenge_tokens/<domain>.json
+	challengeTokensDir = "challenge_tokens"
+
+	// expiryInterval is the interval in which expired keys are deleted
+	expiryInterval = time.Minute
+)
+
+// isChallengeToken reports whether key is an ACME challenge token shared by certmagic
+func isChallengeToken(key string) bool {
+	parts := strings.Split(key, "/")
+	return len(parts) > 3 && parts[0] == certificatesDir && parts[2] == challengeTokensDir
+}
+
+// keyTTL returns the time key lives after it was last stored, zero if it never expires
+func (cs *ConsulStorage) keyTTL(key string) time.Duration {
+	if p := cs.policy(key); p != nil && p.TTL > 0 {
+		return time.Duration(p.TTL)
+	}
+	if cs.ChallengeTokenTTL > 0 && isChallengeToken(key) {
+		return time.Duration(cs.ChallengeTokenTTL)
+	}
+	return 0
+}
+
+// expired reports whether the TTL of key passed since contents were stored, values without a modification
+// time never expire
+func (cs *ConsulStorage) expired(key string, contents *StorageData) bool {
+	ttl := cs.keyTTL(key)
+	return ttl > 0 && !contents.Modified.IsZero() && time.Since(contents.Modified) > ttl
+}
+
+// expiryEnabled reports whether any keys expire and have to be deleted periodically
+func (cs *ConsulStorage) expiryEnabled() bool {
+	if cs.ChallengeTokenTTL > 0 {
+		return true
+	}
+	for _, p := range cs.KeyPolicies {
+		if p != nil && p.TTL > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// runExpiry deletes expired keys every expiryInterval until stop is closed
+func (cs *ConsulStorage) runExpiry(stop <-chan struct{}) {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		deleted, err := cs.ExpireKeys(context.Background())
+		if err != nil {
+			cs.logger.Errorf("deleting expired keys failed: %v", err)
+			continue
+		}
+		if deleted > 0 {
+			cs.logger.Infof("deleted %d expired keys", deleted)
+		}
+	}
+}
+
+// ExpireKeys deletes the keys of key policies with a TTL and the challenge tokens with ChallengeTokenTTL that
+// weren't stored again within it and returns how many were deleted. Keys stored again in between are kept.
+func (cs *ConsulStorage) ExpireKeys(ctx context.Context) (int, error) {
+	ctx, cancel := withTimeout(ctx, cs.ListTimeout)
+	defer cancel()
+
+	prefixes, err := cs.expiringPrefixes(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, prefix := range prefixes {
+		n, err := cs.expirePrefix(ctx, prefix)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// expiringPrefixes returns the key prefixes with keys that may expire
+func (cs *ConsulStorage) expiringPrefixes(ctx context.Context) ([]string, error) {
+	var prefixes []string
+	for _, p := range cs.KeyPolicies {
+		if p != nil && p.TTL > 0 {
+			prefixes = append(prefixes, p.KeyPrefixes...)
+		}
+	}
+
+	if cs.ChallengeTokenTTL > 0 {
+		issuers, err := cs.ListContext(ctx, certificatesDir, false)
+		if _, notExist := err.(certmagic.ErrNotExist); err != nil && !notExist {
+			return nil, err
+		}
+		for _, issuer := range issuers {
+			prefixes = append(prefixes, path.Join(issuer, challengeTokensDir))
+		}
+	}
+	return prefixes, nil
+}
+
+// expirePrefix deletes the expired keys below prefix, including the ones stored under their hash
+func (cs *ConsulStorage) expirePrefix(ctx context.Context, prefix string) (int, error) {
+	deleted := 0
+	for _, ns := range cs.namespaces() {
+		if !cs.listsNamespace(ns, prefix) {
+			continue
+		}
+
+		nsPrefix := path.Join(ns.prefix, cs.encodeKey(prefix)) + cs.keySeparator()
+		pairs, _, err := ns.kv.List(nsPrefix, cs.queryOptions(ctx))
+		if err != nil {
+			return deleted, errors.Wrapf(err, "unable to list keys at %s", nsPrefix)
+		}
+
+		// long keys and all keys with FlatKeys are stored under their hash and found by the original key in their value
+		if cs.hashesLongKeys() {
+			hashedPairs, _, err := ns.kv.List(path.Join(ns.prefix, hashedKeysDir)+"/", cs.queryOptions(ctx))
+			if err != nil {
+				return deleted, errors.Wrap(err, "unable to list hashed keys")
+			}
+			pairs = append(pairs, hashedPairs...)
+		}
+
+		for _, kv := range pairs {
+			if kv.Flags == consul.LockFlagValue || cs.inBlobsDir(ns.prefix, kv.Key) || cs.inLockQueueDir(ns.prefix, kv.Key) {
+				continue
+			}
+
+			key := cs.storageKey(ns.prefix, kv.Key)
+			hashed := cs.inHashedKeysDir(ns.prefix, kv.Key)
+			if !hashed && (cs.tenant(key) != ns.tenant || cs.keyTTL(key) == 0) {
+				continue
+			}
+			contents, _, err := cs.decodeStorageData(cs.boundKey(key), kv.Value)
+			if err != nil {
+				continue
+			}
+			if hashed {
+				key = contents.Key
+				if key == "" || !strings.HasPrefix(key, path.Clean(prefix)+"/") || cs.tenant(key) != ns.tenant || cs.keyTTL(key) == 0 {
+					continue
+				}
+			}
+			if !cs.expired(key, contents) {
+				continue
+			}
+
+			// a key stored again since it was listed changed its index and is kept
+			ok, _, err := ns.kv.DeleteCAS(kv, cs.writeOptions(ctx))
+			if err != nil {
+				return deleted, errors.Wrapf(err, "unable to delete expired key %s", kv.Key)
+			}
+			if ok {
+				cs.log(ctx).Debugf("deleted expired key %s", kv.Key)
+				cs.invalidateStat(key)
+				deleted++
+			}
+		}
+	}
+	return deleted, nil
+}
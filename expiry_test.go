@@ -0,0 +1,102 @@
+package storageconsul
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// storeModified stores value for key as if it was stored at modified
+func storeModified(t *testing.T, cs *ConsulStorage, key string, value []byte, modified time.Time) {
+	data, err := cs.encodeStorageData(key, &StorageData{Key: key, Value: value, Modified: modified})
+	require.NoError(t, err)
+	_, err = cs.ConsulClient.KV().Put(&consul.KVPair{Key: cs.prefixKey(key), Value: data}, nil)
+	require.NoError(t, err)
+}
+
+func TestConsulStorage_ChallengeTokenTTL(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.ChallengeTokenTTL = caddy.Duration(time.Hour)
+
+	stale := "certificates/acme-v02.api.letsencrypt.org-directory/challenge_tokens/a.example.com.json"
+	fresh := "certificates/acme-v02.api.letsencrypt.org-directory/challenge_tokens/b.example.com.json"
+	cert := "certificates/acme-v02.api.letsencrypt.org-directory/a.example.com/a.example.com.crt"
+	storeModified(t, cs, stale, []byte("token"), time.Now().Add(-2*time.Hour))
+	storeModified(t, cs, cert, []byte("cert"), time.Now().Add(-2*time.Hour))
+	require.NoError(t, cs.Store(fresh, []byte("token")))
+
+	// expired keys can't be loaded before they are deleted
+	_, err := cs.Load(stale)
+	assert.Error(t, err)
+
+	deleted, err := cs.ExpireKeys(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.NotContains(t, fc.kv, cs.prefixKey(stale))
+
+	value, err := cs.Load(fresh)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("token"), value)
+	value, err = cs.Load(cert)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("cert"), value)
+}
+
+func TestConsulStorage_PolicyTTL(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.KeyPolicies = map[string]*KeyPolicy{
+		"ephemeral": {KeyPrefixes: []string{"ephemeral"}, TTL: caddy.Duration(time.Minute)},
+		"kept":      {KeyPrefixes: []string{"ephemeral/kept"}},
+	}
+	assert.True(t, cs.expiryEnabled())
+
+	storeModified(t, cs, "ephemeral/old", []byte("old"), time.Now().Add(-time.Hour))
+	storeModified(t, cs, "ephemeral/kept/old", []byte("old"), time.Now().Add(-time.Hour))
+
+	deleted, err := cs.ExpireKeys(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+	assert.NotContains(t, fc.kv, cs.prefixKey("ephemeral/old"))
+	assert.Contains(t, fc.kv, cs.prefixKey("ephemeral/kept/old"))
+
+	// nothing to do without keys
+	cs, _ = newFakeConsulStorage(t)
+	cs.ChallengeTokenTTL = caddy.Duration(time.Hour)
+	deleted, err = cs.ExpireKeys(context.Background())
+	require.NoError(t, err)
+	assert.Zero(t, deleted)
+}
+
+func TestConsulStorage_ExpireHashedKeys(t *testing.T) {
+	for name, configure := range map[string]func(cs *ConsulStorage){
+		"hashed long keys": func(cs *ConsulStorage) { cs.HashLongKeys, cs.MaxKeyLength = true, 64 },
+		"flat keys":        func(cs *ConsulStorage) { cs.FlatKeys = true },
+		"key separator":    func(cs *ConsulStorage) { cs.KeySeparator = ":" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			cs, fc := newFakeConsulStorage(t)
+			configure(cs)
+			cs.ChallengeTokenTTL = caddy.Duration(time.Hour)
+
+			stale := "certificates/acme-v02.api.letsencrypt.org-directory/challenge_tokens/" + strings.Repeat("a", 80) + ".json"
+			fresh := "certificates/acme-v02.api.letsencrypt.org-directory/challenge_tokens/b.example.com.json"
+			storeModified(t, cs, stale, []byte("token"), time.Now().Add(-2*time.Hour))
+			require.NoError(t, cs.Store(fresh, []byte("token")))
+
+			deleted, err := cs.ExpireKeys(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, 1, deleted)
+			assert.NotContains(t, fc.kv, cs.prefixKey(stale))
+
+			value, err := cs.Load(fresh)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("token"), value)
+		})
+	}
+}
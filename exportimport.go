@@ -0,0 +1,284 @@
+package storageconsul
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/pteich/errors"
+)
+
+// Export formats of other storages OpenExport understands
+const (
+	// ExportFormatTar is a tar archive, optionally gzipped, of a file storage directory like Caddy's data directory
+	ExportFormatTar = "tar"
+
+	// ExportFormatDynamoDB is the DynamoDB JSON of a table of the DynamoDB storage, either the lines of an
+	// export to S3 or the output of aws dynamodb scan
+	ExportFormatDynamoDB = "dynamodb"
+
+	// ExportFormatRedis is the JSON lines written by redis-dump of the keys of the Redis storage
+	ExportFormatRedis = "redis"
+)
+
+// exportedValue is a value read from an export
+type exportedValue struct {
+	value    []byte
+	modified time.Time
+}
+
+// exportStorage is a read-only storage of the values of an export, it is the source of an Import
+type exportStorage struct {
+	values map[string]exportedValue
+}
+
+// OpenExport reads the export of another storage in format from r, gzipped exports are decompressed. keyPrefix
+// is removed from the exported keys, e.g. the key prefix of the Redis storage or the name of the data directory
+// in a tar archive, keys outside of it are left out. The returned storage is read-only and meant as the source of
+// an Import, which writes the values in the layout and with the encryption of this storage.
+func OpenExport(r io.Reader, format, keyPrefix string) (certmagic.Storage, error) {
+	r, err := maybeGunzip(r)
+	if err != nil {
+		return nil, err
+	}
+
+	es := &exportStorage{values: make(map[string]exportedValue)}
+	switch format {
+	case ExportFormatTar:
+		err = es.readTar(r)
+	case ExportFormatDynamoDB:
+		err = es.readDynamoDB(r)
+	case ExportFormatRedis:
+		err = es.readRedis(r)
+	default:
+		return nil, errors.Errorf("unknown export format %q, use %s, %s or %s", format, ExportFormatTar, ExportFormatDynamoDB, ExportFormatRedis)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read %s export", format)
+	}
+
+	keyPrefix = strings.Trim(keyPrefix, "/")
+	if keyPrefix == "" {
+		return es, nil
+	}
+	stripped := &exportStorage{values: make(map[string]exportedValue)}
+	for key, v := range es.values {
+		if strings.HasPrefix(key, keyPrefix+"/") {
+			stripped.values[strings.TrimPrefix(key, keyPrefix+"/")] = v
+		}
+	}
+	return stripped, nil
+}
+
+// maybeGunzip decompresses r if it starts like gzip
+func maybeGunzip(r io.Reader) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); !bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		return br, nil
+	}
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to decompress export")
+	}
+	return zr, nil
+}
+
+// add adds a value of the export, keys that can't be stored are left out
+func (es *exportStorage) add(key string, value []byte, modified time.Time) {
+	key = strings.Trim(path.Clean("/"+key), "/")
+	if key == "" || validateKey(key) != nil {
+		return
+	}
+	es.values[key] = exportedValue{value: value, modified: modified}
+}
+
+// readTar reads the regular files of a tar archive, the locks directory of file storages is left out
+func (es *exportStorage) readTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		if name == "locks" || strings.HasPrefix(name, "locks/") || strings.Contains(name, "/locks/") {
+			continue
+		}
+
+		value, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return errors.Wrapf(err, "unable to read %s", hdr.Name)
+		}
+		es.add(name, value, hdr.ModTime)
+	}
+}
+
+// dynamoDBAttribute is an attribute value in DynamoDB JSON
+type dynamoDBAttribute struct {
+	S *string `json:"S"`
+	B []byte  `json:"B"`
+}
+
+// dynamoDBItems is a line of an export to S3 with a single Item or the output of a scan with all Items
+type dynamoDBItems struct {
+	Item  map[string]dynamoDBAttribute   `json:"Item"`
+	Items []map[string]dynamoDBAttribute `json:"Items"`
+}
+
+// readDynamoDB reads items with the PrimaryKey, Contents and LastUpdated attributes of the DynamoDB storage
+func (es *exportStorage) readDynamoDB(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var items dynamoDBItems
+		if err := dec.Decode(&items); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if items.Item != nil {
+			items.Items = append(items.Items, items.Item)
+		}
+
+		for _, item := range items.Items {
+			key := item["PrimaryKey"].S
+			if key == nil {
+				return errors.New("item without PrimaryKey")
+			}
+			var modified time.Time
+			if updated := item["LastUpdated"].S; updated != nil {
+				modified, _ = time.Parse(time.RFC3339Nano, *updated)
+			}
+			es.add(*key, item["Contents"].B, modified)
+		}
+	}
+}
+
+// redisDumpEntry is a line written by redis-dump
+type redisDumpEntry struct {
+	Key   string          `json:"key"`
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// redisStorageData is the JSON the Redis storage stores each value in
+type redisStorageData struct {
+	Value       []byte    `json:"value"`
+	Modified    time.Time `json:"modified"`
+	Compression int       `json:"compression"`
+	Encryption  int       `json:"encryption"`
+}
+
+// readRedis reads the string keys of a redis-dump, values in the JSON of the Redis storage are unwrapped and
+// others are taken as they are
+func (es *exportStorage) readRedis(r io.Reader) error {
+	dec := json.NewDecoder(r)
+	for {
+		var entry redisDumpEntry
+		if err := dec.Decode(&entry); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if entry.Type != "" && entry.Type != "string" {
+			continue
+		}
+
+		var raw string
+		if err := json.Unmarshal(entry.Value, &raw); err != nil {
+			return errors.Wrapf(err, "value of %s is not a string", entry.Key)
+		}
+
+		var data redisStorageData
+		if err := json.Unmarshal([]byte(raw), &data); err != nil || data.Value == nil {
+			es.add(entry.Key, []byte(raw), time.Time{})
+			continue
+		}
+		if data.Compression != 0 || data.Encryption != 0 {
+			return errors.Errorf("value of %s is compressed or encrypted, export it without", entry.Key)
+		}
+		es.add(entry.Key, data.Value, data.Modified)
+	}
+}
+
+func (es *exportStorage) Lock(ctx context.Context, key string) error {
+	return errors.New("export is read-only")
+}
+
+func (es *exportStorage) Unlock(key string) error {
+	return errors.New("export is read-only")
+}
+
+func (es *exportStorage) Store(key string, value []byte) error {
+	return errors.New("export is read-only")
+}
+
+func (es *exportStorage) Delete(key string) error {
+	return errors.New("export is read-only")
+}
+
+func (es *exportStorage) Load(key string) ([]byte, error) {
+	v, ok := es.values[key]
+	if !ok {
+		return nil, certmagic.ErrNotExist(errors.Errorf("key %s does not exist", key))
+	}
+	return v.value, nil
+}
+
+func (es *exportStorage) Exists(key string) bool {
+	_, ok := es.values[key]
+	return ok
+}
+
+func (es *exportStorage) List(prefix string, recursive bool) ([]string, error) {
+	prefix = strings.Trim(prefix, "/")
+	found := make(map[string]bool)
+	for key := range es.values {
+		rest := key
+		if prefix != "" {
+			if !strings.HasPrefix(key, prefix+"/") {
+				continue
+			}
+			rest = strings.TrimPrefix(key, prefix+"/")
+		}
+		if !recursive {
+			rest = strings.SplitN(rest, "/", 2)[0]
+		}
+		found[path.Join(prefix, rest)] = true
+	}
+	if len(found) == 0 {
+		return nil, certmagic.ErrNotExist(errors.Errorf("no keys at %s", prefix))
+	}
+
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (es *exportStorage) Stat(key string) (certmagic.KeyInfo, error) {
+	if v, ok := es.values[key]; ok {
+		return certmagic.KeyInfo{Key: key, Modified: v.modified, Size: int64(len(v.value)), IsTerminal: true}, nil
+	}
+	if keys, err := es.List(key, false); err == nil && len(keys) > 0 {
+		return certmagic.KeyInfo{Key: key, IsTerminal: false}, nil
+	}
+	return certmagic.KeyInfo{}, certmagic.ErrNotExist(errors.Errorf("key %s does not exist", key))
+}
@@ -0,0 +1,104 @@
+package storageconsul
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenExport_Tar(t *testing.T) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(zw)
+	files := map[string]string{
+		"caddy/certificates/acme/example.com/example.com.crt": "crt",
+		"caddy/locks/issue_cert_example.com.lock":             "lock",
+	}
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(content)), Typeflag: tar.TypeReg, ModTime: time.Now()}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, zw.Close())
+
+	src, err := OpenExport(&buf, ExportFormatTar, "caddy")
+	require.NoError(t, err)
+
+	keys, err := src.List("", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"certificates/acme/example.com/example.com.crt"}, keys)
+
+	info, err := src.Stat("certificates/acme")
+	require.NoError(t, err)
+	assert.False(t, info.IsTerminal)
+}
+
+func TestOpenExport_DynamoDB(t *testing.T) {
+	export := `{"Item":{"PrimaryKey":{"S":"certificates/acme/example.com/example.com.crt"},"Contents":{"B":"Y3J0"},"LastUpdated":{"S":"2021-06-01T10:00:00Z"}}}
+{"Item":{"PrimaryKey":{"S":"certificates/acme/example.com/example.com.key"},"Contents":{"B":"a2V5"}}}
+`
+	src, err := OpenExport(strings.NewReader(export), ExportFormatDynamoDB, "")
+	require.NoError(t, err)
+
+	value, err := src.Load("certificates/acme/example.com/example.com.crt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("crt"), value)
+
+	info, err := src.Stat("certificates/acme/example.com/example.com.crt")
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC), info.Modified)
+
+	scan := `{"Items":[{"PrimaryKey":{"S":"acme/account.json"},"Contents":{"B":"e30="}}],"Count":1}`
+	src, err = OpenExport(strings.NewReader(scan), ExportFormatDynamoDB, "")
+	require.NoError(t, err)
+	assert.True(t, src.Exists("acme/account.json"))
+}
+
+func TestOpenExport_Redis(t *testing.T) {
+	export := `{"db":0,"key":"caddy/certificates/acme/example.com/example.com.crt","ttl":-1,"type":"string","value":"{\"value\":\"Y3J0\",\"modified\":\"2021-06-01T10:00:00Z\"}"}
+{"db":0,"key":"caddy/acme/plain","ttl":-1,"type":"string","value":"plain"}
+{"db":0,"key":"other/key","ttl":-1,"type":"string","value":"other"}
+{"db":0,"key":"caddy/queue","ttl":-1,"type":"list","value":["a"]}
+`
+	src, err := OpenExport(strings.NewReader(export), ExportFormatRedis, "caddy")
+	require.NoError(t, err)
+
+	keys, err := src.List("", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"acme/plain", "certificates/acme/example.com/example.com.crt"}, keys)
+
+	value, err := src.Load("certificates/acme/example.com/example.com.crt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("crt"), value)
+
+	encrypted := `{"key":"caddy/a","type":"string","value":"{\"value\":\"Y3J0\",\"encryption\":1}"}`
+	_, err = OpenExport(strings.NewReader(encrypted), ExportFormatRedis, "caddy")
+	assert.Error(t, err)
+
+	_, err = OpenExport(strings.NewReader(export), "etcd", "")
+	assert.Error(t, err)
+}
+
+func TestConsulStorage_ImportExport(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+
+	export := `{"Item":{"PrimaryKey":{"S":"certificates/acme/example.com/example.com.crt"},"Contents":{"B":"Y3J0"}}}`
+	src, err := OpenExport(strings.NewReader(export), ExportFormatDynamoDB, "")
+	require.NoError(t, err)
+
+	result, err := cs.Import(context.Background(), src, ImportOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Imported)
+
+	value, err := cs.Load("certificates/acme/example.com/example.com.crt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("crt"), value)
+}
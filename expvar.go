@@ -0,0 +1,41 @@
+package storageconsul
+
+import (
+	"expvar"
+)
+
+// debugVars holds internal counters of all storages of the process, they are published with expvar
+// and served by Caddy's admin endpoint at /debug/vars for troubleshooting without Prometheus
+var debugVars = expvar.NewMap("caddy_storage_consul")
+
+var (
+	statCacheHits           = newDebugCounter("stat_cache_hits")
+	statCacheMisses         = newDebugCounter("stat_cache_misses")
+	throttleRetries         = newDebugCounter("throttle_retries")
+	lockRetries             = newDebugCounter("lock_retries")
+	locksReacquired         = newDebugCounter("locks_reacquired")
+	locksLost               = newDebugCounter("locks_lost")
+	heldLocks               = newDebugCounter("held_locks")
+	blobsStored             = newDebugCounter("blobs_stored")
+	corruptedDebugVar       = newDebugCounter("corrupted_values")
+	largeValuesDebugVar     = newDebugCounter("large_values")
+	decryptFailuresDebugVar = newDebugCounter("decrypt_failures")
+	coalescedWrites         = newDebugCounter("coalesced_writes")
+	overwritesDebugVar      = newDebugCounter("overwrites_detected")
+	quotaRejectionsDebugVar = newDebugCounter("quota_rejections")
+)
+
+func newDebugCounter(name string) *expvar.Int {
+	v := new(expvar.Int)
+	debugVars.Set(name, v)
+	return v
+}
+
+// countStatCache counts a lookup in the stat cache as hit or miss
+func countStatCache(hit bool) {
+	if hit {
+		statCacheHits.Add(1)
+	} else {
+		statCacheMisses.Add(1)
+	}
+}
@@ -0,0 +1,32 @@
+package storageconsul
+
+import (
+	"context"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugVars(t *testing.T) {
+	cs := setupConsulEnv(t)
+	cs.StatCacheTTL = caddy.Duration(time.Minute)
+
+	hits, misses, held := statCacheHits.Value(), statCacheMisses.Value(), heldLocks.Value()
+
+	require.NoError(t, cs.Store("certificates/example.com", []byte("crt")))
+	assert.True(t, cs.Exists("certificates/example.com"))
+	assert.True(t, cs.Exists("certificates/example.com"))
+	assert.Equal(t, hits+1, statCacheHits.Value())
+	assert.Equal(t, misses+1, statCacheMisses.Value())
+
+	require.NoError(t, cs.Lock(context.Background(), "issue_cert_example.com"))
+	assert.Equal(t, held+1, heldLocks.Value())
+	require.NoError(t, cs.Unlock("issue_cert_example.com"))
+	assert.Equal(t, held, heldLocks.Value())
+
+	assert.NotNil(t, expvar.Get("caddy_storage_consul").(*expvar.Map).Get("stat_cache_hits"))
+}
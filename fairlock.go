@@ -0,0 +1,196 @@
+package storageconsul
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+const (
+	// lockQueueDir is the directory below the prefix that holds the tickets of instances waiting for a lock
+	lockQueueDir = "_lockqueue"
+
+	// lockTicketTTL is the TTL of the session a ticket is bound to, Consul deletes the ticket once the session
+	// of a waiter that is gone expires
+	lockTicketTTL = 15 * time.Second
+)
+
+// lockTicket is the place of a waiter in the lock queue of a key
+type lockTicket struct {
+	key string
+	// session is the session the ticket is bound to, backends without sessions renew the ticket instead
+	session string
+	stop    chan struct{}
+	renewed int
+	// seen holds the modify index of the other tickets and when it was first seen by the local clock, so
+	// tickets that aren't renewed anymore are noticed without comparing times of other hosts
+	seen map[string]ticketSeen
+}
+
+type ticketSeen struct {
+	index uint64
+	since time.Time
+}
+
+// lockQueue returns the Consul directory holding the tickets of the waiters for the lock of key,
+// it is named after the hash of key so it fits backends with short keys
+func (cs *ConsulStorage) lockQueue(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return path.Join(cs.keyPrefix(key), lockQueueDir, hex.EncodeToString(sum[:16]))
+}
+
+// inLockQueueDir reports whether the Consul key below prefix is a ticket of a lock queue
+func (cs *ConsulStorage) inLockQueueDir(prefix, consulKey string) bool {
+	return cs.FairLocks && strings.HasPrefix(consulKey, path.Join(prefix, lockQueueDir)+"/")
+}
+
+// staleTicketAge returns the time after which the ticket of a waiter of a backend without sessions is dropped
+// if it wasn't renewed, a waiter renews it at least once per attempt to acquire the lock and backoff
+func (cs *ConsulStorage) staleTicketAge() time.Duration {
+	return 2 * (time.Duration(cs.Timeout)*time.Second + lockTicketTTL/3)
+}
+
+// enqueueLock adds a ticket for key to its lock queue. With Consul the ticket is bound to a session that is
+// renewed until the ticket is dequeued.
+func (cs *ConsulStorage) enqueueLock(ctx context.Context, key string) (*lockTicket, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return nil, errors.Wrap(err, "unable to create lock ticket")
+	}
+
+	t := &lockTicket{key: path.Join(cs.lockQueue(key), hex.EncodeToString(random)), seen: make(map[string]ticketSeen)}
+	kv, ok := cs.kv(key).(kvSessions)
+	if !ok {
+		if err := cs.renewTicket(ctx, key, t); err != nil {
+			return nil, err
+		}
+		return t, nil
+	}
+
+	hostname, _ := os.Hostname()
+	sessions := kv.Session()
+	id, _, err := sessions.Create(&consul.SessionEntry{
+		Name:     "caddy lock queue on " + hostname,
+		TTL:      lockTicketTTL.String(),
+		Behavior: consul.SessionBehaviorDelete,
+	}, cs.writeOptions(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to create session for lock ticket %s", t.key)
+	}
+
+	acquired, _, err := kv.Acquire(&consul.KVPair{Key: t.key, Session: id}, cs.writeOptions(ctx))
+	if err != nil || !acquired {
+		_, _ = sessions.Destroy(id, nil)
+		if err == nil {
+			err = errors.New("ticket is taken")
+		}
+		return nil, errors.Wrapf(err, "unable to store lock ticket %s", t.key)
+	}
+
+	t.session, t.stop = id, make(chan struct{})
+	go func() {
+		if err := sessions.RenewPeriodic(lockTicketTTL.String(), id, nil, t.stop); err != nil {
+			cs.logger.Warnf("unable to renew session of lock ticket %s: %v", t.key, err)
+		}
+	}()
+	return t, nil
+}
+
+// renewTicket stores a new value in the ticket of a backend without sessions, which changes its modify index.
+// The position in the queue is kept as it is ordered by the creation index of the tickets.
+func (cs *ConsulStorage) renewTicket(ctx context.Context, key string, t *lockTicket) error {
+	t.renewed++
+	pair := &consul.KVPair{Key: t.key, Value: []byte(strconv.Itoa(t.renewed))}
+	if _, err := cs.kv(key).Put(pair, cs.writeOptions(ctx)); err != nil {
+		return errors.Wrapf(err, "unable to store lock ticket %s", t.key)
+	}
+	return nil
+}
+
+// stale reports whether pair is the ticket of a waiter that is gone. Consul deletes tickets of expired
+// sessions, so tickets without one are leftovers. With backends without sessions a ticket is stale once
+// its modify index didn't change for the staleTicketAge.
+func (cs *ConsulStorage) stale(t *lockTicket, pair *consul.KVPair) bool {
+	if t.session != "" {
+		return pair.Session == ""
+	}
+
+	seen, ok := t.seen[pair.Key]
+	if !ok || seen.index != pair.ModifyIndex {
+		t.seen[pair.Key] = ticketSeen{index: pair.ModifyIndex, since: time.Now()}
+		return false
+	}
+	return time.Since(seen.since) > cs.staleTicketAge()
+}
+
+// lockTurn reports whether t is the oldest live ticket in the lock queue of key, so its owner may try
+// to acquire the lock. Tickets of waiters that are gone are removed on the way.
+func (cs *ConsulStorage) lockTurn(ctx context.Context, key string, t *lockTicket) (bool, error) {
+	if t == nil {
+		return true, nil
+	}
+
+	if t.session == "" {
+		if err := cs.renewTicket(ctx, key, t); err != nil {
+			return false, err
+		}
+	}
+
+	pairs, _, err := cs.kv(key).List(cs.lockQueue(key)+"/", cs.queryOptions(ctx))
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to list lock queue of %s", cs.prefixKey(key))
+	}
+
+	live := pairs[:0]
+	queued := false
+	for _, pair := range pairs {
+		if pair.Key == t.key {
+			queued = true
+		} else if cs.stale(t, pair) {
+			cs.log(ctx).Debugf("dropping stale lock ticket %s", pair.Key)
+			_, _, _ = cs.kv(key).DeleteCAS(pair, cs.writeOptions(ctx))
+			continue
+		}
+		live = append(live, pair)
+	}
+	if !queued {
+		return false, errors.Errorf("lock ticket %s is gone", t.key)
+	}
+
+	sort.Slice(live, func(i, j int) bool {
+		if live[i].CreateIndex != live[j].CreateIndex {
+			return live[i].CreateIndex < live[j].CreateIndex
+		}
+		return live[i].Key < live[j].Key
+	})
+	return live[0].Key == t.key, nil
+}
+
+// dequeueLock removes t from the lock queue of key and stops renewing its session
+func (cs *ConsulStorage) dequeueLock(key string, t *lockTicket) {
+	ctx, cancel := withTimeout(context.Background(), cs.WriteTimeout)
+	defer cancel()
+
+	// stopping the renewal destroys the session, which deletes the ticket as well
+	if t.stop != nil {
+		defer close(t.stop)
+	}
+
+	pair, _, err := cs.kv(key).Get(t.key, cs.queryOptions(ctx))
+	if err == nil && pair != nil {
+		_, _, err = cs.kv(key).DeleteCAS(pair, cs.writeOptions(ctx))
+	}
+	if err != nil {
+		cs.logger.Warnf("unable to remove lock ticket %s: %v", t.key, err)
+	}
+}
@@ -0,0 +1,117 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_FairLocks(t *testing.T) {
+	storages := make([]*ConsulStorage, 3)
+	for i := range storages {
+		storages[i] = setupConsulEnv(t)
+		storages[i].FairLocks = true
+	}
+
+	require.NoError(t, storages[0].Lock(context.Background(), "issue_cert_example.com"))
+
+	// the second storage queues up before the third one and gets the lock first
+	acquired := make(chan int, 2)
+	for _, i := range []int{1, 2} {
+		i := i
+		go func() {
+			if err := storages[i].Lock(context.Background(), "issue_cert_example.com"); err == nil {
+				acquired <- i
+			}
+		}()
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	require.NoError(t, storages[0].Unlock("issue_cert_example.com"))
+	assert.Equal(t, 1, <-acquired)
+	require.NoError(t, storages[1].Unlock("issue_cert_example.com"))
+	assert.Equal(t, 2, <-acquired)
+	require.NoError(t, storages[2].Unlock("issue_cert_example.com"))
+
+	// the queue is empty again and doesn't show up in listings
+	keys, _ := storages[0].List("", true)
+	assert.NotContains(t, keys, lockQueueDir)
+	pairs, _, err := storages[0].kv("").List(storages[0].lockQueue("issue_cert_example.com")+"/", nil)
+	require.NoError(t, err)
+	assert.Empty(t, pairs)
+}
+
+func TestConsulStorage_LockTurn(t *testing.T) {
+	cs := setupConsulEnv(t)
+	cs.FairLocks = true
+	ctx := context.Background()
+
+	first, err := cs.enqueueLock(ctx, "issue_cert_example.com")
+	require.NoError(t, err)
+	second, err := cs.enqueueLock(ctx, "issue_cert_example.com")
+	require.NoError(t, err)
+
+	turn, err := cs.lockTurn(ctx, "issue_cert_example.com", second)
+	require.NoError(t, err)
+	assert.False(t, turn)
+	turn, err = cs.lockTurn(ctx, "issue_cert_example.com", first)
+	require.NoError(t, err)
+	assert.True(t, turn)
+
+	// renewing keeps the place in the queue
+	turn, err = cs.lockTurn(ctx, "issue_cert_example.com", second)
+	require.NoError(t, err)
+	assert.False(t, turn)
+
+	// the ticket of a waiter that stopped renewing it is dropped once it didn't change for long enough
+	seen := second.seen[first.key]
+	seen.since = time.Now().Add(-cs.staleTicketAge() - time.Second)
+	second.seen[first.key] = seen
+	turn, err = cs.lockTurn(ctx, "issue_cert_example.com", second)
+	require.NoError(t, err)
+	assert.True(t, turn)
+
+	cs.dequeueLock("issue_cert_example.com", second)
+}
+
+func TestConsulStorage_LockTicketSessions(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.FairLocks = true
+	ctx := context.Background()
+
+	first, err := cs.enqueueLock(ctx, "issue_cert_example.com")
+	require.NoError(t, err)
+	second, err := cs.enqueueLock(ctx, "issue_cert_example.com")
+	require.NoError(t, err)
+
+	fc.mu.Lock()
+	require.NotNil(t, fc.kv[first.key])
+	assert.Equal(t, first.session, fc.kv[first.key].Session)
+	assert.Equal(t, consul.SessionBehaviorDelete, fc.sessions[first.session].Behavior)
+	fc.mu.Unlock()
+
+	turn, err := cs.lockTurn(ctx, "issue_cert_example.com", second)
+	require.NoError(t, err)
+	assert.False(t, turn)
+
+	// Consul deletes the ticket once the session of its waiter expires
+	fc.mu.Lock()
+	fc.invalidateSessions(first.session)
+	fc.mu.Unlock()
+	turn, err = cs.lockTurn(ctx, "issue_cert_example.com", second)
+	require.NoError(t, err)
+	assert.True(t, turn)
+
+	// dequeuing destroys the session
+	cs.dequeueLock("issue_cert_example.com", second)
+	assert.Eventually(t, func() bool {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		return fc.sessions[second.session] == nil
+	}, time.Second, 10*time.Millisecond)
+	close(first.stop)
+}
@@ -0,0 +1,371 @@
+package storageconsul
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeConsul is a minimal in-memory implementation of the Consul KV HTTP API for unit tests
+type fakeConsul struct {
+	*httptest.Server
+	mu     sync.Mutex
+	kv     map[string]*consul.KVPair
+	tokens map[string]string
+	reads  map[string]url.Values
+	index  uint64
+	// txns counts the transactions
+	txns int
+	// events holds the user events fired
+	events []*consul.UserEvent
+	// services holds the services registered with the agent and checks the status of their checks
+	services map[string]*consul.AgentServiceRegistration
+	checks   map[string]string
+
+	// sessions holds the sessions that exist by their ID
+	sessions map[string]*consul.SessionEntry
+
+	// changed is closed and replaced on every write to wake up blocking queries
+	changed chan struct{}
+}
+
+func newFakeConsul(t *testing.T) *fakeConsul {
+	fc := &fakeConsul{kv: make(map[string]*consul.KVPair), tokens: make(map[string]string), reads: make(map[string]url.Values), sessions: make(map[string]*consul.SessionEntry), services: make(map[string]*consul.AgentServiceRegistration), checks: make(map[string]string), changed: make(chan struct{})}
+	// like Consul the index never starts at 0
+	fc.index = 1
+	fc.Server = httptest.NewServer(http.HandlerFunc(fc.handle))
+	t.Cleanup(fc.Close)
+	return fc
+}
+
+// newFakeConsulStorage returns a ConsulStorage connected to a fresh fakeConsul
+func newFakeConsulStorage(t *testing.T) (*ConsulStorage, *fakeConsul) {
+	fc := newFakeConsul(t)
+
+	cs := New()
+	cs.Address = fc.Listener.Addr().String()
+	require.NoError(t, cs.Connect())
+	t.Cleanup(func() { cs.Cleanup() })
+
+	return cs, fc
+}
+
+func (fc *fakeConsul) handle(w http.ResponseWriter, r *http.Request) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+
+	// blocking queries wait until the index moved past the given one or the wait time is over
+	if index, err := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); err == nil && r.Method == http.MethodGet {
+		var timeout <-chan time.Time
+		if wait, err := time.ParseDuration(r.URL.Query().Get("wait")); err == nil {
+			timeout = time.After(wait)
+		}
+	wait:
+		for fc.index <= index {
+			changed := fc.changed
+			fc.mu.Unlock()
+			select {
+			case <-changed:
+			case <-timeout:
+				fc.mu.Lock()
+				break wait
+			case <-r.Context().Done():
+				fc.mu.Lock()
+				return
+			}
+			fc.mu.Lock()
+		}
+	}
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(fc.index, 10))
+
+	switch {
+	case r.URL.Path == "/v1/agent/self":
+		w.Write([]byte(`{"Config":{"NodeName":"test"}}`))
+	case strings.HasPrefix(r.URL.Path, "/v1/session/"):
+		fc.handleSession(w, r, strings.TrimPrefix(r.URL.Path, "/v1/session/"))
+	case strings.HasPrefix(r.URL.Path, "/v1/kv/"):
+		fc.handleKV(w, r, strings.TrimPrefix(r.URL.Path, "/v1/kv/"))
+	case r.URL.Path == "/v1/txn":
+		fc.handleTxn(w, r)
+	case strings.HasPrefix(r.URL.Path, "/v1/event/fire/"):
+		payload, _ := ioutil.ReadAll(r.Body)
+		event := &consul.UserEvent{ID: strconv.Itoa(len(fc.events)), Name: strings.TrimPrefix(r.URL.Path, "/v1/event/fire/"), Payload: payload}
+		fc.events = append(fc.events, event)
+		json.NewEncoder(w).Encode(event)
+	case r.URL.Path == "/v1/agent/service/register":
+		var reg consul.AgentServiceRegistration
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fc.services[reg.ID] = &reg
+		if reg.Check != nil {
+			fc.checks[reg.Check.CheckID] = consul.HealthCritical
+		}
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/service/deregister/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/service/deregister/")
+		if reg, ok := fc.services[id]; ok && reg.Check != nil {
+			delete(fc.checks, reg.Check.CheckID)
+		}
+		delete(fc.services, id)
+	case strings.HasPrefix(r.URL.Path, "/v1/agent/check/update/"):
+		id := strings.TrimPrefix(r.URL.Path, "/v1/agent/check/update/")
+		var update struct{ Status string }
+		json.NewDecoder(r.Body).Decode(&update)
+		if _, ok := fc.checks[id]; !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fc.checks[id] = update.Status
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (fc *fakeConsul) handleKV(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+
+	switch r.Method {
+	case http.MethodGet:
+		fc.reads[key] = query
+		_, keysOnly := query["keys"]
+		_, recurse := query["recurse"]
+		if keysOnly {
+			json.NewEncoder(w).Encode(fc.keys(key, query.Get("separator")))
+			return
+		}
+
+		var pairs consul.KVPairs
+		if recurse {
+			for _, k := range fc.keys(key, "") {
+				pairs = append(pairs, fc.kv[k])
+			}
+		} else if pair, exists := fc.kv[key]; exists {
+			pairs = append(pairs, pair)
+		}
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(pairs)
+
+	case http.MethodPut:
+		value, _ := ioutil.ReadAll(r.Body)
+		if cas := query.Get("cas"); cas != "" && !fc.casMatches(key, cas) {
+			w.Write([]byte("false"))
+			return
+		}
+		flags, _ := strconv.ParseUint(query.Get("flags"), 10, 64)
+		pair := &consul.KVPair{Key: key, Value: value, Flags: flags}
+		existing, exists := fc.kv[key]
+		if exists {
+			pair.CreateIndex = existing.CreateIndex
+			pair.Session = existing.Session
+			pair.LockIndex = existing.LockIndex
+		}
+		if session := query.Get("acquire"); session != "" {
+			if fc.sessions[session] == nil || (pair.Session != "" && pair.Session != session) {
+				w.Write([]byte("false"))
+				return
+			}
+			if pair.Session != session {
+				pair.LockIndex++
+			}
+			pair.Session = session
+		}
+		if session := query.Get("release"); session != "" {
+			if pair.Session != session {
+				w.Write([]byte("false"))
+				return
+			}
+			pair.Session = ""
+		}
+		fc.index++
+		pair.ModifyIndex = fc.index
+		if !exists {
+			pair.CreateIndex = fc.index
+		}
+		fc.kv[key] = pair
+		fc.tokens[key] = r.Header.Get("X-Consul-Token")
+		fc.notify()
+		w.Write([]byte("true"))
+
+	case http.MethodDelete:
+		if _, recurse := query["recurse"]; recurse {
+			for _, k := range fc.keys(key, "") {
+				delete(fc.kv, k)
+			}
+			w.Write([]byte("true"))
+			return
+		}
+		if cas := query.Get("cas"); cas != "" && !fc.casMatches(key, cas) {
+			w.Write([]byte("false"))
+			return
+		}
+		fc.index++
+		delete(fc.kv, key)
+		fc.notify()
+		w.Write([]byte("true"))
+	}
+}
+
+// handleTxn applies the KV operations set, cas, delete and delete-cas atomically after the checks of cas,
+// delete-cas, check-index and check-not-exists passed, transactions of reads with get-tree don't change the index
+func (fc *fakeConsul) handleTxn(w http.ResponseWriter, r *http.Request) {
+	var ops consul.TxnOps
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := consul.TxnResponse{}
+	for i, op := range ops {
+		if (op.KV.Verb == consul.KVCAS || op.KV.Verb == consul.KVDeleteCAS || op.KV.Verb == consul.KVCheckIndex) && !fc.casMatches(op.KV.Key, strconv.FormatUint(op.KV.Index, 10)) {
+			resp.Errors = append(resp.Errors, &consul.TxnError{OpIndex: i, What: "index mismatch"})
+		}
+		if _, exists := fc.kv[op.KV.Key]; op.KV.Verb == consul.KVCheckNotExists && exists {
+			resp.Errors = append(resp.Errors, &consul.TxnError{OpIndex: i, What: "key already exists"})
+		}
+	}
+	if len(resp.Errors) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(resp)
+		return
+	}
+
+	readOnly := true
+	for _, op := range ops {
+		readOnly = readOnly && (op.KV.Verb == consul.KVGetTree || op.KV.Verb == consul.KVCheckIndex || op.KV.Verb == consul.KVCheckNotExists)
+	}
+	if !readOnly {
+		fc.index++
+	}
+	fc.txns++
+	for _, op := range ops {
+		switch op.KV.Verb {
+		case consul.KVSet, consul.KVCAS:
+			pair := &consul.KVPair{Key: op.KV.Key, Value: op.KV.Value, Flags: op.KV.Flags, CreateIndex: fc.index, ModifyIndex: fc.index}
+			if existing, exists := fc.kv[op.KV.Key]; exists {
+				pair.CreateIndex = existing.CreateIndex
+			}
+			fc.kv[op.KV.Key] = pair
+			resp.Results = append(resp.Results, &consul.TxnResult{KV: &consul.KVPair{Key: pair.Key, ModifyIndex: pair.ModifyIndex}})
+		case consul.KVDelete, consul.KVDeleteCAS:
+			delete(fc.kv, op.KV.Key)
+		case consul.KVGetTree:
+			for _, key := range fc.keys(op.KV.Key, "") {
+				resp.Results = append(resp.Results, &consul.TxnResult{KV: fc.kv[key]})
+			}
+		}
+	}
+	fc.notify()
+	json.NewEncoder(w).Encode(resp)
+}
+
+func (fc *fakeConsul) handleSession(w http.ResponseWriter, r *http.Request, endpoint string) {
+	switch {
+	case endpoint == "create":
+		fc.index++
+		entry := &consul.SessionEntry{}
+		json.NewDecoder(r.Body).Decode(entry)
+		entry.ID = "session-" + strconv.FormatUint(fc.index, 10)
+		fc.sessions[entry.ID] = entry
+		id := entry.ID
+		json.NewEncoder(w).Encode(map[string]string{"ID": id})
+	case strings.HasPrefix(endpoint, "renew/"):
+		id := strings.TrimPrefix(endpoint, "renew/")
+		if fc.sessions[id] == nil {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode([]*consul.SessionEntry{{ID: id, TTL: "15s"}})
+	case strings.HasPrefix(endpoint, "info/"):
+		var entries []*consul.SessionEntry
+		if entry := fc.sessions[strings.TrimPrefix(endpoint, "info/")]; entry != nil {
+			entries = append(entries, entry)
+		}
+		json.NewEncoder(w).Encode(entries)
+	case strings.HasPrefix(endpoint, "destroy/"):
+		fc.invalidateSessions(strings.TrimPrefix(endpoint, "destroy/"))
+		w.Write([]byte("true"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// invalidateSessions drops the given sessions, or all if none are given, and releases or deletes the keys
+// they held depending on their behavior just like Consul does if sessions expire or the agent holding them restarts
+func (fc *fakeConsul) invalidateSessions(ids ...string) {
+	if len(ids) == 0 {
+		for id := range fc.sessions {
+			ids = append(ids, id)
+		}
+	}
+
+	fc.index++
+	for _, id := range ids {
+		entry := fc.sessions[id]
+		delete(fc.sessions, id)
+		for key, pair := range fc.kv {
+			if pair.Session != id {
+				continue
+			}
+			if entry != nil && entry.Behavior == consul.SessionBehaviorDelete {
+				delete(fc.kv, key)
+				continue
+			}
+			pair.Session = ""
+			pair.ModifyIndex = fc.index
+		}
+	}
+	fc.notify()
+}
+
+func (fc *fakeConsul) notify() {
+	close(fc.changed)
+	fc.changed = make(chan struct{})
+}
+
+func (fc *fakeConsul) casMatches(key, cas string) bool {
+	index, _ := strconv.ParseUint(cas, 10, 64)
+	pair, exists := fc.kv[key]
+	if index == 0 {
+		return !exists
+	}
+	return exists && pair.ModifyIndex == index
+}
+
+// keys returns all keys with prefix, with a separator keys are folded like Consul does
+func (fc *fakeConsul) keys(prefix, separator string) []string {
+	found := make(map[string]bool)
+	for k := range fc.kv {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		if separator != "" {
+			if i := strings.Index(k[len(prefix):], separator); i >= 0 {
+				k = k[:len(prefix)+i+len(separator)]
+			}
+		}
+		found[k] = true
+	}
+
+	keys := make([]string, 0, len(found))
+	for k := range found {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,45 @@
+package storageconsul
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// fallbackKey returns the Consul key for key below the FallbackPrefix,
+// it reports false if no fallback is configured or key belongs to a tenant
+func (cs *ConsulStorage) fallbackKey(key string) (string, bool) {
+	if cs.FallbackPrefix == "" || cs.FallbackPrefix == cs.Prefix || cs.tenant(key) != nil {
+		return "", false
+	}
+	return path.Join(cs.FallbackPrefix, strings.TrimPrefix(cs.prefixKey(key), cs.Prefix+"/")), true
+}
+
+// consulKeys returns the Consul keys key may be stored under, the current one first
+func (cs *ConsulStorage) consulKeys(key string) []string {
+	keys := []string{cs.prefixKey(key)}
+	if unescaped, ok := cs.unescapedKey(key); ok {
+		keys = append(keys, unescaped)
+	}
+	if fallback, ok := cs.fallbackKey(key); ok {
+		keys = append(keys, fallback)
+	}
+	return keys
+}
+
+// getPair returns the KV pair of key from the current prefix or, if it's not there, from the fallback prefix
+func (cs *ConsulStorage) getPair(ctx context.Context, key string) (*consul.KVPair, error) {
+	for _, consulKey := range cs.consulKeys(key) {
+		kv, _, err := cs.kv(key).Get(consulKey, cs.readOptions(ctx, key))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to obtain data for %s", consulKey)
+		}
+		if kv != nil {
+			return kv, nil
+		}
+	}
+	return nil, nil
+}
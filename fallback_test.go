@@ -0,0 +1,60 @@
+package storageconsul
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_FallbackPrefix(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+
+	// write with the old prefix
+	cs.Prefix = "caddytls-old"
+	require.NoError(t, cs.Store("certificates/old.example.com", []byte("old")))
+	require.NoError(t, cs.Store("certificates/both.example.com", []byte("outdated")))
+
+	cs.Prefix = "caddytls"
+	cs.FallbackPrefix = "caddytls-old"
+	require.NoError(t, cs.Store("certificates/both.example.com", []byte("renewed")))
+	require.NoError(t, cs.Store("certificates/new.example.com", []byte("new")))
+
+	value, err := cs.Load("certificates/old.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("old"), value)
+
+	value, err = cs.Load("certificates/both.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("renewed"), value)
+
+	assert.True(t, cs.Exists("certificates/old.example.com"))
+	info, err := cs.Stat("certificates/old.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), info.Size)
+
+	keys, err := cs.List("certificates", true)
+	require.NoError(t, err)
+	sort.Strings(keys)
+	assert.Equal(t, []string{
+		"certificates/both.example.com",
+		"certificates/new.example.com",
+		"certificates/old.example.com",
+	}, keys)
+
+	// writes only go to the new prefix
+	require.NoError(t, cs.Store("certificates/old.example.com", []byte("moved")))
+	assert.Contains(t, fc.kv, "caddytls/certificates/old.example.com")
+
+	// deletes remove the key from both prefixes
+	require.NoError(t, cs.Delete("certificates/old.example.com"))
+	assert.NotContains(t, fc.kv, "caddytls/certificates/old.example.com")
+	assert.NotContains(t, fc.kv, "caddytls-old/certificates/old.example.com")
+	assert.False(t, cs.Exists("certificates/old.example.com"))
+
+	err = cs.Delete("certificates/old.example.com")
+	_, notExist := err.(certmagic.ErrNotExist)
+	assert.True(t, notExist)
+}
@@ -0,0 +1,103 @@
+package storageconsul
+
+// Values are tagged with their format in the Flags field of their KV pair, so tooling and migrations can tell
+// how a value is encoded without downloading and decrypting it. The upper 16 bits hold a marker that keeps
+// format flags apart from flags set by others, like consul.LockFlagValue on lock keys.
+const (
+	formatFlagsMarker uint64 = 0xcadd << 48
+	formatFlagsMask   uint64 = 0xffff << 48
+
+	// the format version of the value is kept in bits 8 to 15
+	formatVersionShift = 8
+
+	flagEncrypted  uint64 = 1 << 0
+	flagCompressed uint64 = 1 << 1
+	flagBlobRef    uint64 = 1 << 2
+	flagBlob       uint64 = 1 << 3
+	flagArmored    uint64 = 1 << 4
+	flagJSON       uint64 = 1 << 5
+)
+
+// ValueFormat describes how a value is stored, as encoded in the Flags of its KV pair
+type ValueFormat struct {
+	// Version is the version of the value format
+	Version int `json:"version"`
+	// Encrypted is set for values encrypted with the AES key
+	Encrypted bool `json:"encrypted"`
+	// Compressed is set for compressed values
+	Compressed bool `json:"compressed"`
+	// BlobRef is set for values that only reference a deduplicated blob
+	BlobRef bool `json:"blob_ref,omitempty"`
+	// Blob is set for the deduplicated blobs in the _blobs directory
+	Blob bool `json:"blob,omitempty"`
+	// Armored is set for values stored as PEM block
+	Armored bool `json:"armored,omitempty"`
+	// JSON is set for values stored in the JSON envelope
+	JSON bool `json:"json,omitempty"`
+}
+
+// Flags returns the KV Flags encoding f
+func (f ValueFormat) Flags() uint64 {
+	flags := formatFlagsMarker | uint64(f.Version&0xff)<<formatVersionShift
+	if f.Encrypted {
+		flags |= flagEncrypted
+	}
+	if f.Compressed {
+		flags |= flagCompressed
+	}
+	if f.BlobRef {
+		flags |= flagBlobRef
+	}
+	if f.Blob {
+		flags |= flagBlob
+	}
+	if f.Armored {
+		flags |= flagArmored
+	}
+	if f.JSON {
+		flags |= flagJSON
+	}
+	return flags
+}
+
+// ParseValueFormat decodes the format of a value from the Flags of its KV pair, false is returned for
+// values stored before format flags were added and for keys not written by this storage
+func ParseValueFormat(flags uint64) (ValueFormat, bool) {
+	if flags&formatFlagsMask != formatFlagsMarker {
+		return ValueFormat{}, false
+	}
+	return ValueFormat{
+		Version:    int(flags >> formatVersionShift & 0xff),
+		Encrypted:  flags&flagEncrypted != 0,
+		Compressed: flags&flagCompressed != 0,
+		BlobRef:    flags&flagBlobRef != 0,
+		Blob:       flags&flagBlob != 0,
+		Armored:    flags&flagArmored != 0,
+		JSON:       flags&flagJSON != 0,
+	}, true
+}
+
+// valueFlags returns the format flags of data stored for key
+func (cs *ConsulStorage) valueFlags(key string, data *StorageData) uint64 {
+	p := cs.policy(key)
+	return ValueFormat{
+		Version:    cs.writeFormatVersion(),
+		Encrypted:  len(cs.AESKey) > 0 && (p == nil || !p.Unencrypted),
+		Compressed: data.Compression != "",
+		BlobRef:    data.Blob != "",
+		Armored:    cs.ArmorValues,
+		JSON:       cs.jsonEnvelope(),
+	}.Flags()
+}
+
+// blobFlags returns the format flags of a deduplicated blob
+func (cs *ConsulStorage) blobFlags(data *StorageData) uint64 {
+	return ValueFormat{
+		Version:    cs.writeFormatVersion(),
+		Encrypted:  len(cs.AESKey) > 0,
+		Compressed: data.Compression != "",
+		Blob:       true,
+		Armored:    cs.ArmorValues,
+		JSON:       cs.jsonEnvelope(),
+	}.Flags()
+}
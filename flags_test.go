@@ -0,0 +1,52 @@
+package storageconsul
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValueFormat_Flags(t *testing.T) {
+	f := ValueFormat{Version: FormatVersion, Encrypted: true, Compressed: true}
+	parsed, ok := ParseValueFormat(f.Flags())
+	require.True(t, ok)
+	assert.Equal(t, f, parsed)
+
+	// flags of older values and lock keys don't carry a format
+	_, ok = ParseValueFormat(0)
+	assert.False(t, ok)
+	_, ok = ParseValueFormat(consul.LockFlagValue)
+	assert.False(t, ok)
+}
+
+func TestConsulStorage_FormatFlags(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.Compression = CompressionZstd
+	cs.DedupValues = true
+
+	chain := bytes.Repeat([]byte("intermediate"), 200)
+	require.NoError(t, cs.Store("certificates/a.example.com/a.example.com.crt", chain))
+	require.NoError(t, cs.Store("certificates/a.example.com/a.example.com.key", []byte("key")))
+
+	format, ok := ParseValueFormat(fc.kv["caddytls/certificates/a.example.com/a.example.com.key"].Flags)
+	require.True(t, ok)
+	assert.Equal(t, ValueFormat{Version: FormatVersion, Encrypted: true, Compressed: true}, format)
+
+	format, ok = ParseValueFormat(fc.kv["caddytls/certificates/a.example.com/a.example.com.crt"].Flags)
+	require.True(t, ok)
+	assert.True(t, format.BlobRef)
+	assert.False(t, format.Compressed)
+
+	for key, pair := range fc.kv {
+		if strings.HasPrefix(key, "caddytls/_blobs/") {
+			format, ok := ParseValueFormat(pair.Flags)
+			require.True(t, ok)
+			assert.True(t, format.Blob)
+			assert.True(t, format.Compressed)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package storageconsul
+
+import "fmt"
+
+// valueHeaderMagic starts the header of values in a versioned format, it is followed by a single version byte.
+// 0xff never starts UTF-8 text, so the header can't be confused with the value prefix of unencrypted values.
+const valueHeaderMagic = "\xffCSV"
+
+// FormatVersion is the version of the value format written by this version of the plugin, values without a
+// header are version 0. Since version 2 encrypted values are bound to their key.
+const FormatVersion = 2
+
+// valueDecoders decode the payload following the header of each supported format version, aad is the
+// additional data the payload was encrypted with
+var valueDecoders = map[byte]func(cs *ConsulStorage, aad []byte, payload []byte) (*StorageData, error){
+	0: (*ConsulStorage).decodeUnbound,
+	1: (*ConsulStorage).decodeUnbound,
+	2: (*ConsulStorage).decodePayload,
+}
+
+// UnsupportedFormatError is returned for values written in a format version this plugin doesn't know,
+// usually by a newer version of the plugin
+type UnsupportedFormatError struct {
+	Version int
+}
+
+func (e UnsupportedFormatError) Error() string {
+	return fmt.Sprintf("value format version %d is not supported, the value was probably written by a newer version of this plugin", e.Version)
+}
+
+// writeFormatVersion returns the format version of new writes
+func (cs *ConsulStorage) writeFormatVersion() int {
+	if cs.LegacyValueFormat {
+		return 0
+	}
+	return FormatVersion
+}
+
+// withValueHeader prefixes payload with the header of the written format version and armors the value
+func (cs *ConsulStorage) withValueHeader(payload []byte) []byte {
+	version := cs.writeFormatVersion()
+	if version == 0 {
+		return cs.armor(payload)
+	}
+
+	value := make([]byte, 0, len(valueHeaderMagic)+1+len(payload))
+	value = append(append(value, valueHeaderMagic...), byte(version))
+	return cs.armor(append(value, payload...))
+}
+
+// splitValueHeader returns the format version of value and the payload following its header
+func splitValueHeader(value []byte) (byte, []byte, error) {
+	if len(value) <= len(valueHeaderMagic) || string(value[:len(valueHeaderMagic)]) != valueHeaderMagic {
+		return 0, value, nil
+	}
+
+	version := value[len(valueHeaderMagic)]
+	if _, ok := valueDecoders[version]; !ok || version == 0 {
+		return 0, nil, UnsupportedFormatError{Version: int(version)}
+	}
+	return version, value[len(valueHeaderMagic)+1:], nil
+}
+
+// decodeVersioned decodes value with the decoder of its format version
+func (cs *ConsulStorage) decodeVersioned(aad []byte, value []byte) (*StorageData, error) {
+	value, err := unwrapValue(value)
+	if err != nil {
+		return nil, err
+	}
+
+	version, payload, err := splitValueHeader(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return valueDecoders[version](cs, aad, payload)
+}
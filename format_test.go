@@ -0,0 +1,44 @@
+package storageconsul
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_ValueHeader(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+
+	require.NoError(t, cs.Store("certificates/example.com", []byte("versioned")))
+	require.NoError(t, cs.Store("certificates/legacy.com", []byte("replaced")))
+	value := fc.kv[cs.prefixKey("certificates/example.com")].Value
+	assert.True(t, strings.HasPrefix(string(value), valueHeaderMagic+"\x02"))
+
+	// values written without a header stay readable and are rewritten bound to their key
+	legacy := New()
+	legacy.LegacyValueFormat = true
+	unversioned, err := legacy.EncryptStorageData(&StorageData{Value: []byte("unversioned"), Checksum: checksum([]byte("unversioned"))})
+	require.NoError(t, err)
+	assert.False(t, strings.HasPrefix(string(unversioned), valueHeaderMagic))
+	fc.kv[cs.prefixKey("certificates/legacy.com")].Value = unversioned
+
+	loaded, err := cs.Load("certificates/legacy.com")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("unversioned"), loaded)
+	assert.True(t, strings.HasPrefix(string(fc.kv[cs.prefixKey("certificates/legacy.com")].Value), valueHeaderMagic+"\x02"))
+}
+
+func TestConsulStorage_UnsupportedFormat(t *testing.T) {
+	cs := New()
+
+	_, err := cs.DecryptStorageData([]byte(valueHeaderMagic + "\x07payload"))
+	assert.Equal(t, UnsupportedFormatError{Version: 7}, err)
+}
+
+// valuePayload returns the payload of a stored value following its format header
+func valuePayload(value []byte) []byte {
+	_, payload, _ := splitValueHeader(value)
+	return payload
+}
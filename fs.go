@@ -0,0 +1,177 @@
+package storageconsul
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/pteich/errors"
+)
+
+// FS returns a read-only fs.FS view of all keys stored under the configured prefix,
+// keys are files with their decrypted values as contents and path segments are directories
+func (cs *ConsulStorage) FS() fs.FS {
+	return &consulFS{cs: cs}
+}
+
+type consulFS struct {
+	cs *ConsulStorage
+}
+
+// Open implements fs.FS
+func (cfs *consulFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+
+	ctx := context.Background()
+
+	if name != "." {
+		data, err := cfs.cs.loadStorageData(ctx, name)
+		if err == nil {
+			return &consulFile{
+				info:   fileInfo{name: path.Base(name), size: int64(len(data.Value)), modTime: data.Modified},
+				Reader: bytes.NewReader(data.Value),
+			}, nil
+		}
+		if _, notExist := err.(certmagic.ErrNotExist); !notExist {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+
+	entries, err := cfs.readDir(ctx, name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return &consulDir{
+		info:    fileInfo{name: path.Base(name), dir: true},
+		entries: entries,
+	}, nil
+}
+
+// readDir returns the entries right below dir using Consul's separator support
+func (cfs *consulFS) readDir(ctx context.Context, dir string) ([]fs.DirEntry, error) {
+	sep := cfs.cs.keySeparator()
+	prefix := cfs.cs.Prefix + "/"
+	if dir != "." {
+		prefix = cfs.cs.prefixKey(dir) + sep
+	}
+
+	keys, _, err := cfs.cs.clientKV(cfs.cs.ConsulClient).Keys(prefix, sep, cfs.cs.queryOptions(ctx))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list keys at %s", prefix)
+	}
+	if len(keys) == 0 && dir != "." {
+		return nil, fs.ErrNotExist
+	}
+
+	entries := make([]fs.DirEntry, 0, len(keys))
+	for _, key := range keys {
+		name := strings.TrimPrefix(key, prefix)
+		if name == "" {
+			continue
+		}
+
+		if strings.HasSuffix(name, sep) {
+			entries = append(entries, fileInfo{name: cfs.cs.decodeKey(strings.TrimSuffix(name, sep)), dir: true})
+			continue
+		}
+		entries = append(entries, &fileEntry{cfs: cfs, key: cfs.cs.storageKey(cfs.cs.Prefix, key), name: cfs.cs.decodeKey(name)})
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+// fileInfo implements fs.FileInfo and fs.DirEntry for keys and directories
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi fileInfo) Name() string               { return fi.name }
+func (fi fileInfo) Size() int64                { return fi.size }
+func (fi fileInfo) ModTime() time.Time         { return fi.modTime }
+func (fi fileInfo) IsDir() bool                { return fi.dir }
+func (fi fileInfo) Sys() interface{}           { return nil }
+func (fi fileInfo) Type() fs.FileMode          { return fi.Mode().Type() }
+func (fi fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+func (fi fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+// fileEntry is a directory entry for a key that loads its info only when needed
+type fileEntry struct {
+	cfs  *consulFS
+	key  string
+	name string
+}
+
+func (fe *fileEntry) Name() string      { return fe.name }
+func (fe *fileEntry) IsDir() bool       { return false }
+func (fe *fileEntry) Type() fs.FileMode { return 0 }
+
+func (fe *fileEntry) Info() (fs.FileInfo, error) {
+	data, err := fe.cfs.cs.loadStorageData(context.Background(), fe.key)
+	if err != nil {
+		return nil, err
+	}
+	return fileInfo{name: fe.name, size: int64(len(data.Value)), modTime: data.Modified}, nil
+}
+
+// consulFile is a key opened for reading
+type consulFile struct {
+	*bytes.Reader
+	info fileInfo
+}
+
+func (f *consulFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f *consulFile) Close() error               { return nil }
+
+// consulDir is a directory opened for reading its entries
+type consulDir struct {
+	info    fileInfo
+	entries []fs.DirEntry
+	offset  int
+}
+
+func (d *consulDir) Stat() (fs.FileInfo, error) { return d.info, nil }
+func (d *consulDir) Close() error               { return nil }
+
+func (d *consulDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.name, Err: errors.New("is a directory")}
+}
+
+// ReadDir implements fs.ReadDirFile
+func (d *consulDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n <= 0 {
+		d.offset = len(d.entries)
+		return remaining, nil
+	}
+
+	if len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(remaining) {
+		n = len(remaining)
+	}
+	d.offset += n
+	return remaining[:n], nil
+}
@@ -0,0 +1,36 @@
+package storageconsul
+
+import (
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_FS(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+
+	require.NoError(t, cs.Store("certificates/example.com/example.com.crt", []byte("crt data")))
+	require.NoError(t, cs.Store("certificates/example.com/example.com.key", []byte("key data")))
+	require.NoError(t, cs.Store("last_clean.json", []byte("{}")))
+
+	fsys := cs.FS()
+
+	content, err := fs.ReadFile(fsys, "certificates/example.com/example.com.crt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), content)
+
+	entries, err := fs.ReadDir(fsys, ".")
+	assert.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "certificates", entries[0].Name())
+	assert.True(t, entries[0].IsDir())
+	assert.Equal(t, "last_clean.json", entries[1].Name())
+
+	_, err = fs.Stat(fsys, "certificates/missing.crt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.NoError(t, fstest.TestFS(fsys, "certificates/example.com/example.com.crt", "certificates/example.com/example.com.key", "last_clean.json"))
+}
@@ -0,0 +1,96 @@
+package storageconsul
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// handoffKey identifies storages that can take over each other's locks, they use the same Consul clients and
+// store locks under the same keys. It is empty for storages that can't hand off their locks.
+func (cs *ConsulStorage) handoffKey() string {
+	if _, sessions := cs.defaultKV().(kvSessions); !sessions || cs.ConsulClient == nil {
+		return ""
+	}
+
+	// pooled clients are only the same if the connection settings didn't change
+	parts := []string{fmt.Sprintf("%p", cs.ConsulClient), cs.Name, cs.Prefix}
+	var tenants []string
+	for _, t := range cs.Tenants {
+		if t != nil {
+			tenants = append(tenants, fmt.Sprintf("%p %s %s", t.client, t.Prefix, strings.Join(t.KeyPrefixes, ",")))
+		}
+	}
+	sort.Strings(tenants)
+	return strings.Join(append(parts, tenants...), "\x00")
+}
+
+// peer returns the latest registered other storage with the same handoff key, on a config reload it is the
+// storage of the previous config while the new one is provisioned and the new one while the old one is cleaned up
+func (cs *ConsulStorage) peer() *ConsulStorage {
+	key := cs.handoffKey()
+	if key == "" {
+		return nil
+	}
+
+	storages.Lock()
+	defer storages.Unlock()
+	for i := len(storages.list) - 1; i >= 0; i-- {
+		if other := storages.list[i]; other != cs && other.handoffKey() == key {
+			return other
+		}
+	}
+	return nil
+}
+
+// adoptLocalLocks shares the in-process locks of the storage of the previous config, so a lock still held for
+// an issuance started before a config reload also blocks the storage of the new config
+func (cs *ConsulStorage) adoptLocalLocks() {
+	if prev := cs.peer(); prev != nil {
+		cs.localLocks = prev.localLocks
+	}
+}
+
+// handOffLocks moves the held locks to the storage of the new config instead of releasing them, if its
+// connection settings are unchanged. Unlock calls of issuances started before the reload are passed on to it.
+func (cs *ConsulStorage) handOffLocks() {
+	next := cs.peer()
+	if next == nil || next.localLocks != cs.localLocks {
+		return
+	}
+
+	cs.muLocks.Lock()
+	locks := cs.locks
+	cs.locks = make(map[string]*heldLock)
+	cs.successor = next
+	cs.muLocks.Unlock()
+
+	next.muLocks.Lock()
+	for key, h := range locks {
+		next.locks[key] = h
+	}
+	next.muLocks.Unlock()
+
+	// only one watcher at a time may reacquire a lost lock, the one of this storage is stopped first
+	for key, h := range locks {
+		h.stopWatching()
+		go next.watchLock(key, h)
+	}
+
+	if len(locks) > 0 {
+		cs.logger.Infof("handed off %d held locks to the reloaded storage", len(locks))
+	}
+}
+
+// lockSuccessor returns the storage the lock of key was handed off to, nil if cs holds it or it wasn't handed off
+func (cs *ConsulStorage) lockSuccessor(key string) *ConsulStorage {
+	if cs.localLocksOnly(key) {
+		return nil
+	}
+	cs.muLocks.RLock()
+	defer cs.muLocks.RUnlock()
+	if _, exists := cs.locks[key]; exists {
+		return nil
+	}
+	return cs.successor
+}
@@ -0,0 +1,102 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// reloadedStorage provisions a storage at address like a config reload does before the old one is cleaned up
+func reloadedStorage(t *testing.T, address, prefix string) *ConsulStorage {
+	cs := New()
+	cs.Address = address
+	cs.Prefix = prefix
+	require.NoError(t, cs.Connect())
+	cs.adoptLocalLocks()
+	registerStorage(cs)
+	t.Cleanup(func() { cs.Cleanup() })
+	return cs
+}
+
+func TestConsulStorage_HandOffLocks(t *testing.T) {
+	fc := newFakeConsul(t)
+	address := fc.Listener.Addr().String()
+	key := "issue_cert_example.com"
+
+	old := reloadedStorage(t, address, DefaultPrefix)
+	require.NoError(t, old.Lock(context.Background(), key))
+	session := fc.kv[old.prefixKey(key)].Session
+	require.NotEmpty(t, session)
+
+	next := reloadedStorage(t, address, DefaultPrefix)
+	assert.Same(t, old.ConsulClient, next.ConsulClient)
+	require.NoError(t, old.Cleanup())
+
+	// the lock is still held by the issuance that started before the reload
+	assert.Equal(t, session, fc.kv[old.prefixKey(key)].Session)
+	assert.NoError(t, old.CheckLock(key))
+	assert.NoError(t, next.CheckLock(key))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Error(t, next.Lock(ctx, key))
+
+	require.NoError(t, old.Unlock(key))
+	assert.Empty(t, fc.kv[old.prefixKey(key)].Session)
+	require.NoError(t, next.Lock(context.Background(), key))
+	require.NoError(t, next.Unlock(key))
+}
+
+func TestConsulStorage_HandOffLocksChangedSettings(t *testing.T) {
+	fc := newFakeConsul(t)
+	address := fc.Listener.Addr().String()
+	key := "issue_cert_example.com"
+
+	old := reloadedStorage(t, address, DefaultPrefix)
+	require.NoError(t, old.Lock(context.Background(), key))
+
+	// a storage with another prefix doesn't take over the locks, they are released
+	reloadedStorage(t, address, "caddytls-new")
+	require.NoError(t, old.Cleanup())
+	assert.Empty(t, fc.kv[old.prefixKey(key)].Session)
+}
+
+func TestConsulStorage_HandOffLocksReacquired(t *testing.T) {
+	fc := newFakeConsul(t)
+	address := fc.Listener.Addr().String()
+	key := "issue_cert_example.com"
+
+	old := reloadedStorage(t, address, DefaultPrefix)
+	require.NoError(t, old.Lock(context.Background(), key))
+	consulKey := old.prefixKey(key)
+	fc.mu.Lock()
+	session := fc.kv[consulKey].Session
+	fc.mu.Unlock()
+
+	next := reloadedStorage(t, address, DefaultPrefix)
+	require.NoError(t, old.Cleanup())
+
+	// only the watcher of the new storage reacquires the lock and keeps it
+	fc.mu.Lock()
+	fc.invalidateSessions()
+	fc.mu.Unlock()
+	require.Eventually(t, func() bool {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		return fc.kv[consulKey].Session != "" && fc.kv[consulKey].Session != session
+	}, 5*time.Second, 10*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	fc.mu.Lock()
+	assert.NotEmpty(t, fc.kv[consulKey].Session)
+	fc.mu.Unlock()
+	assert.NoError(t, next.CheckLock(key))
+
+	require.NoError(t, old.Unlock(key))
+	fc.mu.Lock()
+	assert.Empty(t, fc.kv[consulKey].Session)
+	fc.mu.Unlock()
+}
@@ -0,0 +1,91 @@
+package storageconsul
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"path"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// hashedKeysDir is the directory below the prefix that holds values stored under hashed keys
+const hashedKeysDir = "_hashed"
+
+// hashesLongKeys reports whether long keys are stored under their hash, it is always done
+// with backends that limit the length of keys and with FlatKeys, which hashes all keys
+func (cs *ConsulStorage) hashesLongKeys() bool {
+	return cs.HashLongKeys || cs.FlatKeys || cs.defaultKV().limitsKeys()
+}
+
+// isHashedKey reports whether key is stored under its hash
+func (cs *ConsulStorage) isHashedKey(key string) bool {
+	if !cs.hashesLongKeys() {
+		return false
+	}
+	if cs.FlatKeys {
+		return true
+	}
+
+	if !cs.kv(key).fitsKey(cs.rawPrefixKey(key)) {
+		return true
+	}
+
+	maxLength := cs.MaxKeyLength
+	if maxLength <= 0 {
+		maxLength = DefaultMaxKeyLength
+	}
+
+	return len(cs.rawPrefixKey(key)) > maxLength
+}
+
+// hashedKey returns the Consul key for a long key
+func (cs *ConsulStorage) hashedKey(key string) string {
+	return path.Join(cs.keyPrefix(key), hashedName(key))
+}
+
+// hashedName returns the path of a long key below the prefix
+func hashedName(key string) string {
+	sum := sha256.Sum256([]byte(normalizeKey(key)))
+	return path.Join(hashedKeysDir, hex.EncodeToString(sum[:]))
+}
+
+// inHashedKeysDir reports whether the Consul key below prefix holds a value stored under a hashed key
+func (cs *ConsulStorage) inHashedKeysDir(prefix, consulKey string) bool {
+	return cs.hashesLongKeys() && strings.HasPrefix(consulKey, path.Join(prefix, hashedKeysDir)+"/")
+}
+
+// listHashedKeys returns the original keys of all values stored under hashed keys in ns that match prefix
+func (cs *ConsulStorage) listHashedKeys(ctx context.Context, ns namespace, prefix string) ([]string, error) {
+	pairs, _, err := ns.kv.List(path.Join(ns.prefix, hashedKeysDir)+"/", cs.queryOptions(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list hashed keys")
+	}
+
+	var keys []string
+	for _, pair := range pairs {
+		key, ok := cs.originalKey(ns.prefix, pair)
+		if ok && strings.HasPrefix(key, prefix) && cs.tenant(key) == ns.tenant {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// originalKey returns the key a value stored under a hashed key below prefix was stored for, which is
+// only kept in the value itself
+func (cs *ConsulStorage) originalKey(prefix string, pair *consul.KVPair) (string, bool) {
+	// with FlatKeys locks are stored under their hash as well
+	if pair.Flags == consul.LockFlagValue {
+		return "", false
+	}
+	contents, _, err := cs.decodeStorageData(cs.storageKey(prefix, pair.Key), pair.Value)
+	if err != nil {
+		cs.logger.Warnf("unable to decrypt data for %s: %v", pair.Key, err)
+		return "", false
+	}
+	return contents.Key, contents.Key != ""
+}
@@ -0,0 +1,83 @@
+package storageconsul
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_HashLongKeys(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.HashLongKeys = true
+	cs.MaxKeyLength = 64
+
+	shortKey := "certificates/example.com/example.com.crt"
+	longKey := "certificates/" + strings.Repeat("sub.", 20) + "example.com/example.com.crt"
+
+	require.NoError(t, cs.Store(shortKey, []byte("short")))
+	require.NoError(t, cs.Store(longKey, []byte("long")))
+
+	_, exists := fc.kv[cs.hashedKey(longKey)]
+	assert.True(t, exists)
+	_, exists = fc.kv[cs.rawPrefixKey(shortKey)]
+	assert.True(t, exists)
+
+	value, err := cs.Load(longKey)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("long"), value)
+
+	keys, err := cs.List("certificates", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{shortKey, longKey}, keys)
+
+	keys, err = cs.List("", true)
+	assert.NoError(t, err)
+	assert.Len(t, keys, 2)
+
+	require.NoError(t, cs.Delete(longKey))
+	assert.False(t, cs.Exists(longKey))
+}
+
+func TestConsulStorage_HashLongKeysBackends(t *testing.T) {
+	// the memory backend keeps Consul's defaults
+	cs := New()
+	cs.backend = newMemoryStore()
+	assert.False(t, cs.hashesLongKeys())
+	cs.HashLongKeys = true
+	assert.True(t, cs.hashesLongKeys())
+
+	// Nomad always hashes keys that are too long for it
+	nomad := newFakeNomadStorage(t, newFakeNomad(t))
+	assert.True(t, nomad.hashesLongKeys())
+}
+
+func TestConsulStorage_FlatKeys(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.FlatKeys = true
+
+	key := "certificates/acme/example.com/example.com.crt"
+	require.NoError(t, cs.Store(key, []byte("data")))
+	require.NoError(t, cs.Lock(context.Background(), "issue_cert_example.com"))
+	defer cs.Unlock("issue_cert_example.com")
+
+	fc.mu.Lock()
+	for consulKey := range fc.kv {
+		assert.True(t, strings.HasPrefix(consulKey, cs.Prefix+"/"+hashedKeysDir+"/"), consulKey)
+	}
+	fc.mu.Unlock()
+
+	value, err := cs.Load(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), value)
+
+	keys, err := cs.List("certificates", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+
+	keys, err = cs.List("certificates/acme", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"certificates/acme/example.com"}, keys)
+}
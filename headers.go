@@ -0,0 +1,61 @@
+package storageconsul
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/pteich/errors"
+)
+
+// headerTransport sets static headers on every request, e.g. for an authenticating proxy in front of Consul
+type headerTransport struct {
+	next    http.RoundTripper
+	headers http.Header
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for name, values := range t.headers {
+		if http.CanonicalHeaderKey(name) == "Host" {
+			req.Host = values[0]
+			continue
+		}
+		req.Header[name] = values
+	}
+	return t.next.RoundTrip(req)
+}
+
+// resolveHeaders returns the configured headers with placeholders like {env.GATEWAY_KEY} replaced, headers
+// whose placeholders can't be resolved are an error
+func (cc ConnectionConfig) resolveHeaders() (http.Header, error) {
+	if len(cc.Headers) == 0 {
+		return nil, nil
+	}
+
+	repl := caddy.NewReplacer()
+	headers := make(http.Header, len(cc.Headers))
+	for name, value := range cc.Headers {
+		if name == "" {
+			return nil, errors.New("header names must not be empty")
+		}
+		if cc.IgnoreEnv {
+			headers.Set(name, value)
+			continue
+		}
+		resolved, err := repl.ReplaceOrErr(value, true, true)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to resolve placeholders in header %s", name)
+		}
+		headers.Set(name, resolved)
+	}
+	return headers, nil
+}
+
+// withHeaders wraps next to set the configured headers on every request
+func (cc ConnectionConfig) withHeaders(next http.RoundTripper) (http.RoundTripper, error) {
+	headers, err := cc.resolveHeaders()
+	if err != nil || headers == nil {
+		return next, err
+	}
+	return &headerTransport{next: next, headers: headers}, nil
+}
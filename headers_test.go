@@ -0,0 +1,47 @@
+package storageconsul
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnectionConfig_Headers(t *testing.T) {
+	var got http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		w.Write([]byte(`{"Config":{"NodeName":"test"}}`))
+	}))
+	defer srv.Close()
+
+	os.Setenv("CADDY_TLSCONSUL_TEST_GATEWAY_KEY", "secret")
+	defer os.Unsetenv("CADDY_TLSCONSUL_TEST_GATEWAY_KEY")
+
+	cc := ConnectionConfig{
+		Address: srv.Listener.Addr().String(),
+		Timeout: DefaultTimeout,
+		Headers: map[string]string{
+			"x-gateway-key": "{env.CADDY_TLSCONSUL_TEST_GATEWAY_KEY}",
+			"X-Team":        "platform",
+		},
+	}
+	sc, err := cc.newClient()
+	require.NoError(t, err)
+	sc.Destruct()
+	assert.Equal(t, "secret", got.Get("X-Gateway-Key"))
+	assert.Equal(t, "platform", got.Get("X-Team"))
+
+	// unresolvable placeholders are an error
+	cc.Headers = map[string]string{"X-Gateway-Key": "{env.CADDY_TLSCONSUL_TEST_MISSING}"}
+	_, err = cc.newClient()
+	assert.Error(t, err)
+
+	cc.IgnoreEnv = true
+	headers, err := cc.resolveHeaders()
+	require.NoError(t, err)
+	assert.Equal(t, "{env.CADDY_TLSCONSUL_TEST_MISSING}", headers.Get("X-Gateway-Key"))
+}
@@ -0,0 +1,62 @@
+package storageconsul
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// issueLockPrefix starts the names of the locks certmagic takes while it obtains a certificate for a domain
+const issueLockPrefix = "issue_cert_"
+
+// ocspDir is the directory certmagic stores OCSP staples in, named after the first domain of the certificate
+const ocspDir = "ocsp"
+
+// domainProfile maps domain names to their ASCII form for lookups. Underscores and other characters certmagic
+// uses in keys, like wildcard_ for wildcard domains, are accepted.
+var domainProfile = idna.New(idna.MapForLookup(), idna.StrictDomainName(false), idna.Transitional(false))
+
+// normalizeDomain returns the ASCII form of domain in lower case, so the unicode and punycode spelling of an
+// internationalized domain name and any mix of cases map to the same key. Names that can't be converted are
+// only lower-cased.
+func normalizeDomain(domain string) string {
+	if isLowerASCII(domain) {
+		return domain
+	}
+	ascii, err := domainProfile.ToASCII(domain)
+	if err != nil {
+		return strings.ToLower(domain)
+	}
+	return ascii
+}
+
+// normalizeKey normalizes the domain names in the keys certmagic builds for them: the segments below the
+// certificates and ocsp directories and the names of issue locks. Keys without anything to normalize are
+// returned as they are.
+func normalizeKey(key string) string {
+	if isLowerASCII(key) {
+		return key
+	}
+
+	segments := strings.Split(strings.Trim(key, "/"), "/")
+	switch {
+	case len(segments) == 1 && strings.HasPrefix(segments[0], issueLockPrefix):
+		return issueLockPrefix + normalizeDomain(strings.TrimPrefix(segments[0], issueLockPrefix))
+	case len(segments) > 1 && (segments[0] == certificatesDir || segments[0] == ocspDir):
+		for i := 1; i < len(segments); i++ {
+			segments[i] = normalizeDomain(segments[i])
+		}
+		return strings.Join(segments, "/")
+	}
+	return key
+}
+
+// isLowerASCII reports whether s consists of ASCII characters other than upper-case letters only
+func isLowerASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= 0x80 || ('A' <= c && c <= 'Z') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNormalizeKey(t *testing.T) {
+	for key, want := range map[string]string{
+		"certificates/acme/münchen.de/münchen.de.crt":               "certificates/acme/xn--mnchen-3ya.de/xn--mnchen-3ya.de.crt",
+		"certificates/acme/MÜNCHEN.de/MÜNCHEN.de.key":               "certificates/acme/xn--mnchen-3ya.de/xn--mnchen-3ya.de.key",
+		"certificates/acme/xn--MNCHEN-3ya.de/xn--mnchen-3ya.de.crt": "certificates/acme/xn--mnchen-3ya.de/xn--mnchen-3ya.de.crt",
+		"certificates/acme/Example.COM/Example.COM.json":            "certificates/acme/example.com/example.com.json",
+		"certificates/acme/wildcard_.bücher.example/x.crt":          "certificates/acme/wildcard_.xn--bcher-kva.example/x.crt",
+		"ocsp/bücher.example-1234":                                  "ocsp/xn--bcher-kva.example-1234",
+		"issue_cert_*.Bücher.example":                               "issue_cert_*.xn--bcher-kva.example",
+		"/certificates/acme/example.com/example.com.crt":            "/certificates/acme/example.com/example.com.crt",
+		"acme/Account.json":                                         "acme/Account.json",
+		"Bücher/Ärger":                                              "Bücher/Ärger",
+	} {
+		assert.Equal(t, want, normalizeKey(key), key)
+	}
+}
+
+func TestConsulStorage_IDNKeys(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+
+	require.NoError(t, cs.Store("certificates/acme/münchen.de/münchen.de.crt", []byte("crt data")))
+	assert.Contains(t, fc.kv, cs.Prefix+"/certificates/acme/xn--mnchen-3ya.de/xn--mnchen-3ya.de.crt")
+
+	// an instance using the punycode spelling finds the certificate
+	loaded, err := cs.Load("certificates/acme/xn--mnchen-3ya.de/xn--mnchen-3ya.de.crt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), loaded)
+	assert.True(t, cs.Exists("certificates/acme/MÜNCHEN.de/MÜNCHEN.de.crt"))
+
+	keys, err := cs.List("certificates/acme", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"certificates/acme/xn--mnchen-3ya.de/xn--mnchen-3ya.de.crt"}, keys)
+}
+
+func TestConsulStorage_IDNLocks(t *testing.T) {
+	cs := setupConsulEnv(t)
+	cs2 := setupConsulEnv(t)
+
+	// both spellings take the same lock
+	require.NoError(t, cs.Lock(context.Background(), "issue_cert_münchen.de"))
+	defer cs.Unlock("issue_cert_münchen.de")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, cs2.Lock(ctx, "issue_cert_xn--mnchen-3ya.de"))
+}
+
+func TestConsulStorage_IDNLocksOneProcess(t *testing.T) {
+	cs := setupConsulEnv(t)
+
+	require.NoError(t, cs.Lock(context.Background(), "issue_cert_münchen.de"))
+	assert.NoError(t, cs.CheckLock("issue_cert_MÜNCHEN.de"))
+	_, held := cs.GetLock("issue_cert_xn--mnchen-3ya.de")
+	_, consulLock := cs.defaultKV().(*consulStore)
+	assert.Equal(t, consulLock, held)
+
+	// the same process waits for the lock under another spelling as well
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, cs.Lock(ctx, "issue_cert_xn--mnchen-3ya.de"))
+
+	// and releases it under any spelling
+	require.NoError(t, cs.Unlock("issue_cert_xn--mnchen-3ya.de"))
+	assert.Error(t, cs.CheckLock("issue_cert_münchen.de"))
+	require.NoError(t, cs.Lock(context.Background(), "issue_cert_MÜNCHEN.de"))
+	assert.NoError(t, cs.Unlock("issue_cert_münchen.de"))
+}
+
+func TestConsulStorage_GetCertificateResourceIDN(t *testing.T) {
+	cs := setupConsulEnv(t)
+
+	storeCertificate(t, cs, "acme-v02.api.letsencrypt.org-directory", "*.xn--bcher-kva.example", time.Now().Add(time.Hour))
+
+	res, err := cs.GetCertificateResource(context.Background(), "*.Bücher.example")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"*.xn--bcher-kva.example"}, res.SANs)
+}
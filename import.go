@@ -0,0 +1,152 @@
+package storageconsul
+
+import (
+	"context"
+	"sync"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/pteich/errors"
+)
+
+// DefaultImportWorkers is the number of keys Import writes concurrently by default
+const DefaultImportWorkers = 8
+
+// ImportOptions configure Import
+type ImportOptions struct {
+	// Prefix limits the import to the keys below it in the source
+	Prefix string
+	// Workers is the number of keys written concurrently, DefaultImportWorkers if zero
+	Workers int
+	// Resume skips keys that exist already and weren't modified in the source since, so an interrupted
+	// import can be continued without writing everything again
+	Resume bool
+	// Progress is called after each key, calls are serialized
+	Progress func(ImportProgress)
+}
+
+// ImportProgress reports the result of a single key of an import
+type ImportProgress struct {
+	Key string
+	// Done is the number of keys processed so far out of Total, directories listed by the source
+	// are not counted once they are found
+	Done, Total int
+	// Skipped is set for keys skipped by Resume
+	Skipped bool
+	// Err is the error importing the key failed with
+	Err error
+}
+
+// ImportResult summarizes an import
+type ImportResult struct {
+	Imported int
+	Skipped  int
+	// Failed holds the error of each key that couldn't be imported
+	Failed map[string]error
+}
+
+// Import copies all keys of src, e.g. a certmagic.FileStorage, into the storage with bounded concurrency.
+// Keys that fail are reported and the import continues with the others, an error is returned afterwards
+// if any key failed.
+func (cs *ConsulStorage) Import(ctx context.Context, src certmagic.Storage, opts ImportOptions) (ImportResult, error) {
+	result := ImportResult{Failed: make(map[string]error)}
+
+	keys, err := src.List(opts.Prefix, true)
+	if _, notExist := err.(certmagic.ErrNotExist); err != nil && !notExist {
+		return result, errors.Wrapf(err, "unable to list keys to import below %s", opts.Prefix)
+	}
+
+	workers := opts.Workers
+	if workers <= 0 {
+		workers = DefaultImportWorkers
+	}
+
+	var mu sync.Mutex
+	total := len(keys)
+	report := func(key string, outcome importOutcome, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		skipped := outcome == importSkipped
+		switch {
+		case outcome == importDirectory:
+			total--
+			return
+		case err != nil:
+			result.Failed[key] = err
+		case skipped:
+			result.Skipped++
+		default:
+			result.Imported++
+		}
+		if opts.Progress != nil {
+			done := result.Imported + result.Skipped + len(result.Failed)
+			opts.Progress(ImportProgress{Key: key, Done: done, Total: total, Skipped: skipped, Err: err})
+		}
+	}
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range queue {
+				outcome, err := cs.importKey(ctx, src, key, opts.Resume)
+				report(key, outcome, err)
+			}
+		}()
+	}
+
+feed:
+	for _, key := range keys {
+		select {
+		case queue <- key:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	cs.logger.Infof("imported %d keys, skipped %d and failed %d of %d", result.Imported, result.Skipped, len(result.Failed), total)
+	if err := ctx.Err(); err != nil {
+		return result, errors.Wrap(err, "import aborted")
+	}
+	if len(result.Failed) > 0 {
+		return result, errors.Errorf("unable to import %d of %d keys", len(result.Failed), total)
+	}
+	return result, nil
+}
+
+// importOutcome is the result of importing a single key
+type importOutcome int
+
+const (
+	importStored importOutcome = iota
+	importSkipped
+	importDirectory
+)
+
+// importKey copies key from src, with resume it is skipped if it exists already and is not older than in src.
+// Directories, which some storages list as well, are left out.
+func (cs *ConsulStorage) importKey(ctx context.Context, src certmagic.Storage, key string, resume bool) (importOutcome, error) {
+	srcInfo, err := src.Stat(key)
+	if err != nil {
+		return importStored, err
+	}
+	if !srcInfo.IsTerminal {
+		return importDirectory, nil
+	}
+
+	if resume {
+		info, err := cs.StatContext(ctx, key)
+		if err == nil && !info.Modified.Before(srcInfo.Modified) {
+			return importSkipped, nil
+		}
+	}
+
+	value, err := src.Load(key)
+	if err != nil {
+		return importStored, err
+	}
+	return importStored, cs.StoreContext(ctx, key, value)
+}
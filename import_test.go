@@ -0,0 +1,48 @@
+package storageconsul
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_Import(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	src := &certmagic.FileStorage{Path: t.TempDir()}
+
+	keys := make(map[string]bool)
+	for i := 0; i < 25; i++ {
+		key := "certificates/acme/example-" + strconv.Itoa(i) + ".com/example.crt"
+		require.NoError(t, src.Store(key, []byte("crt "+key)))
+		keys[key] = true
+	}
+
+	var progress []ImportProgress
+	result, err := cs.Import(context.Background(), src, ImportOptions{Workers: 4, Progress: func(p ImportProgress) {
+		progress = append(progress, p)
+	}})
+	require.NoError(t, err)
+	assert.Equal(t, 25, result.Imported)
+	require.Len(t, progress, 25)
+	assert.Equal(t, 25, progress[24].Done)
+	assert.Equal(t, 25, progress[24].Total)
+
+	for key := range keys {
+		value, err := cs.Load(key)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("crt "+key), value)
+	}
+
+	// resuming skips the keys that were imported already
+	require.NoError(t, src.Store("certificates/acme/new.com/new.crt", []byte("new")))
+	writes := fc.index
+	result, err = cs.Import(context.Background(), src, ImportOptions{Resume: true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Imported)
+	assert.Equal(t, 25, result.Skipped)
+	assert.Equal(t, writes+1, fc.index)
+}
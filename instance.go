@@ -0,0 +1,76 @@
+package storageconsul
+
+import (
+	"strconv"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// envSuffix returns the suffix of the environment variables of the storage named name, its upper-cased
+// name with everything but letters and digits replaced by underscores
+func envSuffix(name string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// applyName makes a named storage read only the environment variables with its suffix
+func (cs *ConsulStorage) applyName() {
+	if cs.Name != "" {
+		cs.ConnectionConfig.envSuffix = envSuffix(cs.Name)
+	}
+}
+
+// applyConsulEnv applies the CONSUL_HTTP_* variables with the suffix of a named storage to cfg like the
+// Consul API client does with the variables without suffix
+func (cc ConnectionConfig) applyConsulEnv(cfg *consul.Config) {
+	if addr := cc.getenv(consul.HTTPAddrEnvName); addr != "" {
+		cfg.Address = addr
+	}
+	if tokenFile := cc.getenv(consul.HTTPTokenFileEnvName); tokenFile != "" {
+		cfg.TokenFile = tokenFile
+	}
+	if token := cc.getenv(consul.HTTPTokenEnvName); token != "" {
+		cfg.Token = token
+	}
+	if auth := cc.getenv(consul.HTTPAuthEnvName); auth != "" {
+		username, password := auth, ""
+		if i := strings.Index(auth, ":"); i >= 0 {
+			username, password = auth[:i], auth[i+1:]
+		}
+		cfg.HttpAuth = &consul.HttpBasicAuth{Username: username, Password: password}
+	}
+	if enabled, _ := strconv.ParseBool(cc.getenv(consul.HTTPSSLEnvName)); enabled {
+		cfg.Scheme = "https"
+	}
+	if v := cc.getenv(consul.HTTPTLSServerName); v != "" {
+		cfg.TLSConfig.Address = v
+	}
+	if v := cc.getenv(consul.HTTPCAFile); v != "" {
+		cfg.TLSConfig.CAFile = v
+	}
+	if v := cc.getenv(consul.HTTPCAPath); v != "" {
+		cfg.TLSConfig.CAPath = v
+	}
+	if v := cc.getenv(consul.HTTPClientCert); v != "" {
+		cfg.TLSConfig.CertFile = v
+	}
+	if v := cc.getenv(consul.HTTPClientKey); v != "" {
+		cfg.TLSConfig.KeyFile = v
+	}
+	if v := cc.getenv(consul.HTTPSSLVerifyEnvName); v != "" {
+		if verify, err := strconv.ParseBool(v); err == nil && !verify {
+			cfg.TLSConfig.InsecureSkipVerify = true
+		}
+	}
+	if v := cc.getenv(consul.HTTPNamespaceEnvName); v != "" {
+		cfg.Namespace = v
+	}
+}
@@ -0,0 +1,64 @@
+package storageconsul
+
+import (
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvSuffix(t *testing.T) {
+	assert.Equal(t, "EU", envSuffix("eu"))
+	assert.Equal(t, "EU_WEST_1", envSuffix("eu-west.1"))
+}
+
+func TestConsulStorage_NamedInstances(t *testing.T) {
+	eu, us := newFakeConsul(t), newFakeConsul(t)
+	os.Setenv(consul.HTTPAddrEnvName+"_EU", eu.Listener.Addr().String())
+	defer os.Unsetenv(consul.HTTPAddrEnvName + "_EU")
+	os.Setenv(consul.HTTPAddrEnvName+"_US", us.Listener.Addr().String())
+	defer os.Unsetenv(consul.HTTPAddrEnvName + "_US")
+	os.Setenv(EnvNamePrefix+"_EU", "caddytls-eu")
+	defer os.Unsetenv(EnvNamePrefix + "_EU")
+	os.Setenv(EnvNamePrefix, "caddytls-shared")
+	defer os.Unsetenv(EnvNamePrefix)
+
+	storages := make(map[string]*ConsulStorage)
+	for _, name := range []string{"eu", "us"} {
+		cs := New()
+		cs.Name = name
+		require.NoError(t, cs.configure())
+		require.NoError(t, cs.Connect())
+		defer cs.Cleanup()
+		storages[name] = cs
+	}
+
+	// variables without the suffix are ignored by named storages
+	assert.Equal(t, "caddytls-eu", storages["eu"].Prefix)
+	assert.Equal(t, DefaultPrefix, storages["us"].Prefix)
+
+	key := "certificates/example.com/example.com.crt"
+	require.NoError(t, storages["eu"].Store(key, []byte("eu")))
+	require.NoError(t, storages["us"].Store(key, []byte("us")))
+	assert.Contains(t, eu.kv, "caddytls-eu/"+key)
+	assert.NotContains(t, eu.kv, DefaultPrefix+"/"+key)
+	assert.Contains(t, us.kv, DefaultPrefix+"/"+key)
+
+	// the admin API picks a storage by name
+	registerStorage(storages["eu"])
+	defer unregisterStorage(storages["eu"])
+	registerStorage(storages["us"])
+	defer unregisterStorage(storages["us"])
+
+	cs, err := adminStorage(httptest.NewRequest("GET", "/consul-storage/keys?instance=eu", nil))
+	require.NoError(t, err)
+	assert.Equal(t, storages["eu"], cs)
+	cs, err = adminStorage(httptest.NewRequest("GET", "/consul-storage/keys", nil))
+	require.NoError(t, err)
+	assert.Equal(t, storages["us"], cs)
+	_, err = adminStorage(httptest.NewRequest("GET", "/consul-storage/keys?instance=asia", nil))
+	assert.Error(t, err)
+}
@@ -0,0 +1,120 @@
+package storageconsul
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// IntegrityResult is the outcome of an integrity scan
+type IntegrityResult struct {
+	// Checked is the number of values checked
+	Checked int
+	// Failures holds the error of every value that can't be decrypted, decompressed or doesn't match its
+	// checksum by its key
+	Failures map[string]error
+}
+
+// scannedPair is a stored value found by an integrity scan with the prefix of its namespace
+type scannedPair struct {
+	prefix string
+	pair   *consul.KVPair
+}
+
+// integrityScanEnabled reports whether the stored values are checked periodically
+func (cs *ConsulStorage) integrityScanEnabled() bool {
+	return cs.IntegrityScanInterval > 0
+}
+
+// runIntegrityScan checks the stored values every IntegrityScanInterval until stop is closed
+func (cs *ConsulStorage) runIntegrityScan(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(cs.IntegrityScanInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		res, err := cs.ScanIntegrity(context.Background(), cs.IntegrityScanSample)
+		if err != nil {
+			cs.logger.Errorf("integrity scan failed: %v", err)
+			continue
+		}
+		for key, err := range res.Failures {
+			cs.logger.Errorf("integrity scan: %s: %v", key, err)
+		}
+		cs.logger.Infof("integrity scan checked %d values, %d failed", res.Checked, len(res.Failures))
+	}
+}
+
+// ScanIntegrity checks that stored values decrypt, decompress and match their checksum, so a wrong AES
+// key or corrupted values are noticed before a renewal needs them. With sample > 0 only that many random
+// values are checked, otherwise all of them. Values aren't migrated or otherwise written by the scan.
+func (cs *ConsulStorage) ScanIntegrity(ctx context.Context, sample int) (IntegrityResult, error) {
+	ctx, cancel := withTimeout(ctx, cs.ListTimeout)
+	defer cancel()
+
+	var pairs []scannedPair
+	seen := make(map[string]bool)
+	for _, ns := range cs.namespaces() {
+		nsPairs, _, err := ns.kv.List(ns.prefix+"/", cs.queryOptions(ctx))
+		if err != nil {
+			return IntegrityResult{}, errors.Wrapf(err, "unable to list keys at %s", ns.prefix)
+		}
+		for _, pair := range nsPairs {
+			// lock keys and tickets hold no stored value, blobs are checked with the values referencing them
+			if seen[pair.Key] || pair.Flags == consul.LockFlagValue || cs.inBlobsDir(ns.prefix, pair.Key) || cs.inLockQueueDir(ns.prefix, pair.Key) {
+				continue
+			}
+			seen[pair.Key] = true
+			pairs = append(pairs, scannedPair{prefix: ns.prefix, pair: pair})
+		}
+	}
+
+	if sample > 0 && sample < len(pairs) {
+		rand.Shuffle(len(pairs), func(i, j int) { pairs[i], pairs[j] = pairs[j], pairs[i] })
+		pairs = pairs[:sample]
+	}
+
+	res := IntegrityResult{Failures: make(map[string]error)}
+	for _, p := range pairs {
+		key, err := cs.checkPair(ctx, p.prefix, p.pair)
+		res.Checked++
+		if err != nil {
+			res.Failures[key] = err
+		}
+	}
+
+	integrityChecks.Add(float64(res.Checked))
+	integrityFailures.Set(float64(len(res.Failures)))
+	return res, nil
+}
+
+// checkPair decodes the value of pair below prefix like a Load without migrating it and returns its key
+func (cs *ConsulStorage) checkPair(ctx context.Context, prefix string, pair *consul.KVPair) (string, error) {
+	key := cs.storageKey(prefix, pair.Key)
+	contents, _, err := cs.decodeStorageData(key, pair.Value)
+	if err != nil {
+		return key, errors.Wrap(err, "unable to decrypt data")
+	}
+	// values under hashed keys carry their original key
+	if cs.inHashedKeysDir(prefix, pair.Key) && contents.Key != "" {
+		key = contents.Key
+	}
+
+	if err := decompressData(contents); err != nil {
+		return key, errors.Wrap(err, "unable to decompress data")
+	}
+	if contents.Blob != "" {
+		if err := cs.loadBlob(ctx, key, contents); err != nil {
+			return key, err
+		}
+	}
+	return key, verifyChecksum(key, contents)
+}
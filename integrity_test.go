@@ -0,0 +1,46 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_ScanIntegrity(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	ctx := context.Background()
+
+	for _, key := range []string{"certificates/a.crt", "certificates/b.crt", "certificates/c.crt"} {
+		require.NoError(t, cs.Store(key, []byte("value of "+key)))
+	}
+	require.NoError(t, cs.Lock(ctx, "certificates/a.crt.lock"))
+	defer cs.Unlock("certificates/a.crt.lock")
+
+	res, err := cs.ScanIntegrity(ctx, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.Checked)
+	assert.Empty(t, res.Failures)
+
+	// a value encrypted with another key can't be decrypted
+	other := New()
+	other.AESKey = []byte("another-key-12345678901234567890")
+	value, err := other.EncryptStorageData(&StorageData{Value: []byte("foreign")})
+	require.NoError(t, err)
+	fc.mu.Lock()
+	fc.kv[cs.prefixKey("certificates/b.crt")].Value = value
+	fc.mu.Unlock()
+
+	res, err = cs.ScanIntegrity(ctx, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 3, res.Checked)
+	require.Len(t, res.Failures, 1)
+	assert.Contains(t, res.Failures, "certificates/b.crt")
+	assert.Equal(t, float64(1), testutil.ToFloat64(integrityFailures))
+
+	res, err = cs.ScanIntegrity(ctx, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, res.Checked)
+}
@@ -0,0 +1,179 @@
+package storageconsul
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// InvalidKeyError is returned for keys that can't be stored in Consul KV
+type InvalidKeyError struct {
+	Key    string
+	Reason string
+}
+
+func (e InvalidKeyError) Error() string {
+	return fmt.Sprintf("invalid key %q: %s", e.Key, e.Reason)
+}
+
+// validateKey checks that key can be mapped to a Consul KV key
+func validateKey(key string) error {
+	trimmed := strings.Trim(key, "/")
+	if trimmed == "" {
+		return InvalidKeyError{Key: key, Reason: "key is empty"}
+	}
+	if strings.Contains(trimmed, "//") {
+		return InvalidKeyError{Key: key, Reason: "key contains an empty path segment"}
+	}
+	return nil
+}
+
+// escapeKey maps key to a representation Consul accepts. Control characters, invalid UTF-8 and the
+// escape character % itself are percent-encoded, as are the dot segments ./.. that would otherwise
+// be resolved along the way. Leading and trailing slashes are insignificant and removed.
+func escapeKey(key string) string {
+	segments := strings.Split(strings.Trim(key, "/"), "/")
+	for i, segment := range segments {
+		switch segment {
+		case ".":
+			segments[i] = "%2E"
+		case "..":
+			segments[i] = "%2E%2E"
+		default:
+			segments[i] = escapeSegment(segment)
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+func escapeSegment(segment string) string {
+	var b strings.Builder
+	for i := 0; i < len(segment); {
+		r, size := utf8.DecodeRuneInString(segment[i:])
+		if (r == utf8.RuneError && size == 1) || r < 0x20 || r == 0x7f || r == '%' {
+			fmt.Fprintf(&b, "%%%02X", segment[i])
+			i++
+			continue
+		}
+		b.WriteString(segment[i : i+size])
+		i += size
+	}
+	return b.String()
+}
+
+// validKeySeparator checks that sep consists of ASCII punctuation only, so it can be escaped within segments
+func validKeySeparator(sep string) error {
+	if sep == "" {
+		return errors.New("separator is empty")
+	}
+	for _, c := range []byte(sep) {
+		if c == '%' || c >= utf8.RuneSelf || !unicode.IsPunct(rune(c)) && !unicode.IsSymbol(rune(c)) {
+			return errors.Errorf("%q may only consist of punctuation other than %%", sep)
+		}
+	}
+	if sep != DefaultKeySeparator && strings.Contains(sep, "/") {
+		return errors.Errorf("%q must not contain /", sep)
+	}
+	return nil
+}
+
+// keySeparator returns the separator of the segments of keys below the prefix
+func (cs *ConsulStorage) keySeparator() string {
+	if cs.KeySeparator == "" {
+		return DefaultKeySeparator
+	}
+	return cs.KeySeparator
+}
+
+// encodeKey escapes the normalized key and joins its segments with the key separator. Characters of the
+// separator are percent-encoded within segments, so the separator only ever appears between them.
+func (cs *ConsulStorage) encodeKey(key string) string {
+	escaped := escapeKey(normalizeKey(key))
+	sep := cs.keySeparator()
+	if sep == DefaultKeySeparator || escaped == "" {
+		return escaped
+	}
+
+	segments := strings.Split(escaped, "/")
+	for i, segment := range segments {
+		if !strings.ContainsAny(segment, sep) {
+			continue
+		}
+		var b strings.Builder
+		for _, c := range []byte(segment) {
+			if strings.IndexByte(sep, c) >= 0 {
+				fmt.Fprintf(&b, "%%%02X", c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+		segments[i] = b.String()
+	}
+	return strings.Join(segments, sep)
+}
+
+// decodeKey reverses encodeKey
+func (cs *ConsulStorage) decodeKey(encoded string) string {
+	if sep := cs.keySeparator(); sep != DefaultKeySeparator {
+		return unescapeKey(strings.ReplaceAll(encoded, sep, "/"))
+	}
+
+	// keys stored before keys were escaped, like foo%41, aren't in the escaped form and are returned as they are
+	decoded := unescapeKey(encoded)
+	if escapeKey(decoded) != strings.Trim(encoded, "/") {
+		return encoded
+	}
+	return decoded
+}
+
+// unescapedKey returns the Consul key key was stored under before keys were escaped, it reports false if
+// that is the current key anyway
+func (cs *ConsulStorage) unescapedKey(key string) (string, bool) {
+	if cs.isHashedKey(key) || cs.keySeparator() != DefaultKeySeparator {
+		return "", false
+	}
+	unescaped := path.Join(cs.keyPrefix(key), normalizeKey(key))
+	return unescaped, unescaped != cs.prefixKey(key)
+}
+
+// migrateUnescapedKey moves the value of key found under its unescaped Consul key to the current one and
+// returns its new modify index, the value is only written if the current key doesn't exist yet
+func (cs *ConsulStorage) migrateUnescapedKey(ctx context.Context, key string, kv *consul.KVPair, value []byte) (uint64, error) {
+	index, err := cs.storeCAS(ctx, key, value, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	// the value may have been rewritten in the current format since it was read
+	old, _, err := cs.kv(key).Get(kv.Key, cs.queryOptions(ctx))
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to obtain data for %s", kv.Key)
+	}
+	if old != nil {
+		if _, _, err := cs.kv(key).DeleteCAS(old, cs.writeOptions(ctx)); err != nil {
+			return 0, errors.Wrapf(err, "unable to delete data for %s", kv.Key)
+		}
+	}
+	return index, nil
+}
+
+// unescapeKey reverses escapeKey for keys read from Consul
+func unescapeKey(key string) string {
+	if !strings.Contains(key, "%") {
+		return key
+	}
+
+	unescaped, err := url.PathUnescape(key)
+	if err != nil {
+		// not written by escapeKey, return as is
+		return key
+	}
+	return unescaped
+}
@@ -0,0 +1,149 @@
+package storageconsul
+
+import (
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEscapeKey_RoundTrip(t *testing.T) {
+	keys := []string{
+		"certificates/example.com/example.com.crt",
+		"certificates/xn--mnchen-3ya.de/xn--mnchen-3ya.de.crt",
+		"certificates/münchen.de/münchen.de.crt",
+		"acme/100%/key",
+		"acme/tab\there/key",
+		"acme/../key",
+		"acme/./key",
+		"acme/invalid\xffutf8",
+	}
+
+	for _, key := range keys {
+		escaped := escapeKey(key)
+		assert.NotContains(t, escaped, "/../", key)
+		assert.NotContains(t, escaped, "/./", key)
+		assert.NotContains(t, escaped, "\t", key)
+		assert.Equal(t, key, unescapeKey(escaped), key)
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	assert.NoError(t, validateKey("certificates/example.com"))
+	assert.NoError(t, validateKey("/certificates/example.com"))
+
+	err := validateKey("")
+	assert.IsType(t, InvalidKeyError{}, err)
+
+	err = validateKey("certificates//example.com")
+	assert.IsType(t, InvalidKeyError{}, err)
+}
+
+func TestConsulStorage_ExoticKeys(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+
+	key := "acme/../weird%key\x01"
+	require.NoError(t, cs.Store(key, []byte("data")))
+
+	_, exists := fc.kv[cs.Prefix+"/acme/%2E%2E/weird%25key%01"]
+	assert.True(t, exists)
+
+	value, err := cs.Load(key)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("data"), value)
+
+	keys, err := cs.List("acme", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+
+	err = cs.Store("acme//key", []byte("data"))
+	assert.IsType(t, InvalidKeyError{}, err)
+}
+
+func TestConsulStorage_UnescapedKeys(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+
+	// keys stored before keys were escaped
+	value, err := cs.encodeStorageData("acme/100%/key", &StorageData{Value: []byte("legacy")})
+	require.NoError(t, err)
+	fc.mu.Lock()
+	fc.kv[cs.Prefix+"/acme/100%/key"] = &consul.KVPair{Key: cs.Prefix + "/acme/100%/key", Value: value, ModifyIndex: 1}
+	fc.kv[cs.Prefix+"/acme/foo%41"] = &consul.KVPair{Key: cs.Prefix + "/acme/foo%41", Value: value, ModifyIndex: 1}
+	fc.mu.Unlock()
+
+	keys, err := cs.List("acme", true)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"acme/100%/key", "acme/foo%41"}, keys)
+	assert.True(t, cs.Exists("acme/foo%41"))
+	assert.False(t, cs.Exists("acme/fooA"))
+
+	loaded, err := cs.Load("acme/100%/key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("legacy"), loaded)
+
+	// the value was moved to the escaped key
+	fc.mu.Lock()
+	_, unescaped := fc.kv[cs.Prefix+"/acme/100%/key"]
+	_, escaped := fc.kv[cs.Prefix+"/acme/100%25/key"]
+	fc.mu.Unlock()
+	assert.False(t, unescaped)
+	assert.True(t, escaped)
+
+	loaded, err = cs.Load("acme/100%/key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("legacy"), loaded)
+
+	require.NoError(t, cs.Delete("acme/foo%41"))
+	assert.False(t, cs.Exists("acme/foo%41"))
+}
+
+func TestConsulStorage_KeySeparator(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.KeySeparator = "."
+	cs.RecursiveDelete = true
+
+	key := "certificates/acme/example.com/example.com.crt"
+	require.NoError(t, cs.Store(key, []byte("data")))
+	require.NoError(t, cs.Store("certificates/acme/other.com/other.com.crt", []byte("other")))
+
+	fc.mu.Lock()
+	_, exists := fc.kv[cs.Prefix+"/certificates.acme.example%2Ecom.example%2Ecom%2Ecrt"]
+	fc.mu.Unlock()
+	assert.True(t, exists)
+
+	value, err := cs.Load(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), value)
+
+	keys, err := cs.List("certificates/acme", false)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"certificates/acme/example.com", "certificates/acme/other.com"}, keys)
+
+	keys, err = cs.List("certificates", true)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{key, "certificates/acme/other.com/other.com.crt"}, keys)
+
+	require.NoError(t, cs.Delete("certificates/acme/example.com"))
+	assert.False(t, cs.Exists(key))
+	assert.True(t, cs.Exists("certificates/acme/other.com/other.com.crt"))
+}
+
+func TestConsulStorage_EncodeKey(t *testing.T) {
+	cs := New()
+	for _, sep := range []string{"/", ".", "::", "-"} {
+		cs.KeySeparator = sep
+		for _, key := range []string{"certificates/a-b.example.com/a-b.example.com.crt", "acme/a:::b/key", "acme/./key"} {
+			assert.Equal(t, key, cs.decodeKey(cs.encodeKey(key)), "%s with %q", key, sep)
+		}
+	}
+}
+
+func TestValidKeySeparator(t *testing.T) {
+	for _, sep := range []string{"/", ".", "::", "|", "-"} {
+		assert.NoError(t, validKeySeparator(sep), sep)
+	}
+	for _, sep := range []string{"", "%", "a", " ", "./", "ä"} {
+		assert.Error(t, validKeySeparator(sep), sep)
+	}
+}
@@ -0,0 +1,67 @@
+package storageconsul
+
+import (
+	"bytes"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// Layouts of the values below the prefix
+const (
+	// LayoutNative stores values encrypted and with metadata in the format of this plugin
+	LayoutNative = "native"
+
+	// LayoutRaw stores the bare values certmagic hands over without encryption or metadata, like storage
+	// plugins that put values into Consul KV as they are or a Caddy data directory imported with consul kv
+	LayoutRaw = "raw"
+
+	// LayoutMixed writes native values but reads raw values as well and migrates them when they are loaded,
+	// for switching from a plugin using the raw layout or running both side by side for a while
+	LayoutMixed = "mixed"
+)
+
+// rawLayoutFormat is the format of values read in the raw layout
+const rawLayoutFormat = "raw layout"
+
+// validLayout checks the layout and the options that would change the key structure of the raw layout
+func (cs *ConsulStorage) validLayout() error {
+	switch cs.Layout {
+	case "", LayoutNative, LayoutMixed:
+		return nil
+	case LayoutRaw:
+	default:
+		return errors.Errorf("must be %s, %s or %s, got %q", LayoutNative, LayoutRaw, LayoutMixed, cs.Layout)
+	}
+
+	if cs.Backend != "" && cs.Backend != BackendConsul {
+		return errors.New("raw requires the consul backend")
+	}
+	if cs.HashLongKeys || cs.FlatKeys || cs.DedupValues || (cs.KeySeparator != "" && cs.KeySeparator != DefaultKeySeparator) {
+		return errors.New("raw can't be combined with hash_long_keys, flat_keys, dedup_values or key_separator")
+	}
+	return nil
+}
+
+// writesRawValues reports whether values are stored in the raw layout
+func (cs *ConsulStorage) writesRawValues() bool {
+	return cs.Layout == LayoutRaw
+}
+
+// readsRawValues reports whether values that aren't in the native format are read in the raw layout
+func (cs *ConsulStorage) readsRawValues() bool {
+	return cs.Layout == LayoutRaw || cs.Layout == LayoutMixed
+}
+
+// encodeRawPair returns the KV pair to store value of key with in the raw layout
+func (cs *ConsulStorage) encodeRawPair(key string, value []byte) *consul.KVPair {
+	return &consul.KVPair{Key: cs.prefixKey(key), Value: value}
+}
+
+// decodeRaw returns value as it is, values that carry the header of the native format are never raw
+func decodeRaw(value []byte) (*StorageData, error) {
+	if bytes.HasPrefix(value, []byte(valueHeaderMagic)) || bytes.HasPrefix(value, armorBegin) {
+		return nil, errors.New("value is in the native format")
+	}
+	return &StorageData{Value: value}, nil
+}
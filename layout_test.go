@@ -0,0 +1,80 @@
+package storageconsul
+
+import (
+	"bytes"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const rawCertificate = "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+
+func TestConsulStorage_RawLayout(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.Layout = LayoutRaw
+
+	key := "certificates/acme/example.com/example.com.crt"
+	require.NoError(t, cs.Store(key, []byte(rawCertificate)))
+
+	fc.mu.Lock()
+	pair := fc.kv[cs.Prefix+"/"+key]
+	fc.mu.Unlock()
+	require.NotNil(t, pair)
+	assert.Equal(t, []byte(rawCertificate), pair.Value)
+
+	value, err := cs.Load(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte(rawCertificate), value)
+
+	info, err := cs.Stat(key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(rawCertificate)), info.Size)
+
+	keys, err := cs.List("certificates", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{key}, keys)
+}
+
+func TestConsulStorage_MixedLayout(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	key := "certificates/acme/example.com/example.com.json"
+	consulKey := cs.Prefix + "/" + key
+
+	fc.mu.Lock()
+	fc.index++
+	fc.kv[consulKey] = &consul.KVPair{Key: consulKey, Value: []byte(`{"sans":["example.com"]}`), ModifyIndex: fc.index}
+	fc.mu.Unlock()
+
+	// raw values of other plugins can't be read in the native layout
+	_, err := cs.Load(key)
+	assert.Error(t, err)
+
+	cs.Layout = LayoutMixed
+	value, err := cs.Load(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`{"sans":["example.com"]}`), value)
+
+	// the value is migrated to the native format when it's loaded
+	fc.mu.Lock()
+	migrated := fc.kv[consulKey].Value
+	fc.mu.Unlock()
+	assert.False(t, bytes.Contains(migrated, []byte("example.com")))
+
+	value, err = cs.Load(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`{"sans":["example.com"]}`), value)
+}
+
+func TestConsulStorage_ValidateLayout(t *testing.T) {
+	cs := New()
+	cs.Layout = "redis"
+	assert.Error(t, cs.Validate())
+
+	cs.Layout = LayoutRaw
+	assert.NoError(t, cs.Validate())
+
+	cs.FlatKeys = true
+	assert.Error(t, cs.Validate())
+}
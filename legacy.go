@@ -0,0 +1,192 @@
+package storageconsul
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// legacyFormat decodes values written by an older version of this plugin
+type legacyFormat struct {
+	name   string
+	decode func(cs *ConsulStorage, aad []byte, value []byte) (*StorageData, error)
+}
+
+const (
+	// previousKeyFormat is the format of values encrypted with one of the PreviousAESKeys
+	previousKeyFormat = "previous key"
+
+	// unencryptedFormat is the format of values stored without encryption
+	unencryptedFormat = "unencrypted"
+)
+
+// legacyFormats are tried in order if a value can't be decoded in the current format
+var legacyFormats = []legacyFormat{
+	{name: previousKeyFormat, decode: decodePreviousKey},
+	{name: unencryptedFormat, decode: decodeUnencrypted},
+	{name: "unprefixed", decode: decodeUnprefixed},
+}
+
+// decodePreviousKey decodes values that were encrypted with a key that has been rotated since
+func decodePreviousKey(cs *ConsulStorage, aad []byte, value []byte) (*StorageData, error) {
+	for _, key := range cs.PreviousAESKeys {
+		decrypted, err := openWithKey(nil, key, value, aad)
+		if err != nil {
+			continue
+		}
+		return cs.unmarshalStorageData(decrypted)
+	}
+	return nil, errors.New("no previous key matches")
+}
+
+// decodeUnencrypted decodes values that were stored without an AES key
+func decodeUnencrypted(cs *ConsulStorage, aad []byte, value []byte) (*StorageData, error) {
+	if len(cs.AESKey) == 0 {
+		return nil, errors.New("not encrypted in the first place")
+	}
+	return cs.unmarshalStorageData(value)
+}
+
+// decodeUnprefixed decodes values that were encrypted without the value prefix
+func decodeUnprefixed(cs *ConsulStorage, aad []byte, value []byte) (*StorageData, error) {
+	decrypted, err := openWithKey(nil, cs.AESKey, value, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	data := &StorageData{}
+	if err := json.Unmarshal(decrypted, data); err != nil {
+		return nil, errors.Wrap(err, "unable to unmarshal result")
+	}
+	return data, nil
+}
+
+// decodeStorageData decodes value stored at the bound key in the current format or one of the legacy formats,
+// the name of the legacy format is returned if one was used
+func (cs *ConsulStorage) decodeStorageData(bound string, value []byte) (*StorageData, string, error) {
+	original := value
+	value, err := unwrapValue(value)
+	if err != nil {
+		if cs.readsRawValues() {
+			if data, rawErr := decodeRaw(original); rawErr == nil {
+				return data, rawLayoutFormat, nil
+			}
+		}
+		return nil, "", err
+	}
+
+	// legacy formats are tried on the payload of versioned values too, an unsupported version
+	// may also be a headerless value that happens to start like a header
+	version, payload, headerErr := splitValueHeader(value)
+	if headerErr != nil {
+		version, payload = 0, value
+	}
+
+	data, err := cs.decodeVersioned([]byte(bound), value)
+	if err == nil {
+		if version < bindingFormatVersion && cs.bindsValues() {
+			if cs.requiresBinding() {
+				return nil, "", errors.Errorf("value of %s isn't bound to its key", bound)
+			}
+			return data, unboundFormat, nil
+		}
+		return data, "", nil
+	}
+
+	var aad []byte
+	if version >= bindingFormatVersion {
+		aad = []byte(bound)
+	}
+	for _, format := range legacyFormats {
+		if format.name == unencryptedFormat && !cs.readsUnencrypted(bound) {
+			continue
+		}
+		// encrypted values of older formats aren't bound to their key
+		if format.name != unencryptedFormat && aad == nil && cs.requiresBinding() {
+			continue
+		}
+		if data, legacyErr := format.decode(cs, aad, payload); legacyErr == nil {
+			return data, format.name, nil
+		}
+	}
+
+	// anything else is a bare value if values of other plugins are read as well
+	if cs.readsRawValues() {
+		if data, rawErr := decodeRaw(original); rawErr == nil {
+			return data, rawLayoutFormat, nil
+		}
+	}
+
+	return nil, "", err
+}
+
+// readsUnencrypted reports whether an unencrypted value is accepted for key although an AES key is set
+func (cs *ConsulStorage) readsUnencrypted(key string) bool {
+	p := cs.policy(key)
+	return cs.AllowUnencryptedMigration || (p != nil && p.Unencrypted)
+}
+
+// migratesFormat reports whether values read in the legacy format should be rewritten
+func (cs *ConsulStorage) migratesFormat(key, format string) bool {
+	switch format {
+	case previousKeyFormat:
+		return cs.ReencryptOnLoad
+	case rawLayoutFormat:
+		return cs.Layout == LayoutMixed
+	case unencryptedFormat:
+		// values of keys stored without encryption on purpose
+		p := cs.policy(key)
+		return p == nil || !p.Unencrypted
+	}
+	return format != ""
+}
+
+// migrateValue rewrites a value read in a legacy format in the current format and returns its new modify index,
+// the write only succeeds if the value wasn't modified in the meantime
+func (cs *ConsulStorage) migrateValue(ctx context.Context, key string, kv *consul.KVPair, data *StorageData) (uint64, error) {
+	if data.Checksum == "" {
+		data.Checksum = checksum(data.Value)
+	}
+	// values of the raw layout carry no modification time
+	if data.Modified.IsZero() {
+		data.Modified = time.Now()
+	}
+
+	// keep referencing a blob instead of inlining its contents
+	migrated := *data
+	if migrated.Blob != "" {
+		migrated.Value = nil
+	} else if err := cs.compressData(&migrated); err != nil {
+		return 0, errors.Wrapf(err, "unable to compress data for %s", kv.Key)
+	}
+
+	value, err := cs.encodeStorageData(key, &migrated)
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to encode data for %s", kv.Key)
+	}
+
+	pair := &consul.KVPair{Key: kv.Key, Value: value, Flags: cs.valueFlags(key, &migrated)}
+	index, err := cs.putIndexed(ctx, key, pair, true, kv.ModifyIndex)
+	if _, conflict := err.(CASConflictError); conflict {
+		return kv.ModifyIndex, nil
+	} else if err != nil {
+		return 0, err
+	}
+	if index != 0 {
+		return index, nil
+	}
+
+	// plain writes don't report the new modify index, it is only taken if nobody wrote the key since
+	stored, _, err := cs.kv(key).Get(kv.Key, cs.queryOptions(ctx))
+	if err != nil {
+		return 0, errors.Wrapf(err, "unable to obtain data for %s", kv.Key)
+	}
+	if stored == nil || !bytes.Equal(stored.Value, value) {
+		return kv.ModifyIndex, nil
+	}
+	return stored.ModifyIndex, nil
+}
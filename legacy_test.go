@@ -0,0 +1,92 @@
+package storageconsul
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_LoadMigratesLegacyValues(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.AllowUnencryptedMigration = true
+
+	data, err := json.Marshal(&StorageData{Value: []byte("crt data"), Modified: time.Now()})
+	require.NoError(t, err)
+
+	unencrypted := append([]byte(cs.ValuePrefix), data...)
+	unprefixed, err := cs.encrypt(data)
+	require.NoError(t, err)
+
+	for name, value := range map[string][]byte{"unencrypted": unencrypted, "unprefixed": unprefixed} {
+		t.Run(name, func(t *testing.T) {
+			key := "certificates/" + name
+			require.NoError(t, cs.Store(key, []byte("placeholder")))
+			fc.kv[cs.prefixKey(key)].Value = value
+
+			loaded, err := cs.Load(key)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("crt data"), loaded)
+
+			// the value is rewritten in the current format
+			migrated, err := cs.DecryptStorageDataForKey(key, fc.kv[cs.prefixKey(key)].Value)
+			require.NoError(t, err)
+			assert.Equal(t, []byte("crt data"), migrated.Value)
+		})
+	}
+}
+
+func TestConsulStorage_LoadRejectsUnencryptedValues(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+
+	data, err := json.Marshal(&StorageData{Value: []byte("injected"), Modified: time.Now()})
+	require.NoError(t, err)
+
+	key := "certificates/example.com/example.com.key"
+	require.NoError(t, cs.Store(key, []byte("key")))
+	fc.kv[cs.prefixKey(key)].Value = append([]byte(cs.ValuePrefix), data...)
+
+	_, err = cs.Load(key)
+	assert.Error(t, err)
+
+	// the value isn't encrypted and thereby trusted
+	_, err = cs.DecryptStorageDataForKey(key, fc.kv[cs.prefixKey(key)].Value)
+	assert.Error(t, err)
+}
+
+func TestConsulStorage_DecodeStorageDataRejectsGarbage(t *testing.T) {
+	cs := New()
+
+	_, _, err := cs.decodeStorageData("certificates/garbage", []byte("definitely not a stored value"))
+	assert.Error(t, err)
+}
+
+func TestConsulStorage_LoadReencryptsWithCurrentKey(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+
+	oldKey := []byte("consultls-0987654321-caddytls-32")
+	cs.AESKey = oldKey
+	require.NoError(t, cs.Store("certificates/rotated", []byte("crt data")))
+	require.NoError(t, cs.Store("certificates/kept", []byte("crt data")))
+
+	cs.AESKey = []byte(DefaultAESKey)
+	cs.PreviousAESKeys = [][]byte{oldKey}
+
+	loaded, err := cs.Load("certificates/rotated")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), loaded)
+
+	_, err = cs.DecryptStorageDataForKey("certificates/rotated", fc.kv[cs.prefixKey("certificates/rotated")].Value)
+	assert.NoError(t, err)
+
+	// without reencrypt_on_load the value stays encrypted with the previous key
+	cs.ReencryptOnLoad = false
+	loaded, err = cs.Load("certificates/kept")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("crt data"), loaded)
+
+	_, err = cs.DecryptStorageDataForKey("certificates/kept", fc.kv[cs.prefixKey("certificates/kept")].Value)
+	assert.Error(t, err)
+}
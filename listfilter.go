@@ -0,0 +1,60 @@
+package storageconsul
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/pteich/errors"
+)
+
+// ListFilter selects the keys returned by ListFilter, an empty filter matches all keys
+type ListFilter struct {
+	// Glob is a path.Match pattern keys have to match, e.g. *.crt. Patterns without a slash are matched
+	// against the last element of the key, others against the whole key.
+	Glob string `json:"glob,omitempty"`
+	// Suffix is a suffix keys have to end with, e.g. .json
+	Suffix string `json:"suffix,omitempty"`
+}
+
+// match reports whether key passes the filter
+func (f ListFilter) match(key string) bool {
+	if f.Suffix != "" && !strings.HasSuffix(key, f.Suffix) {
+		return false
+	}
+	if f.Glob == "" {
+		return true
+	}
+	name := key
+	if !strings.Contains(f.Glob, "/") {
+		name = path.Base(key)
+	}
+	matched, _ := path.Match(f.Glob, name)
+	return matched
+}
+
+// ListFilter lists the keys at prefix like ListContext and returns only those that match filter. Consul only
+// filters by prefix, so the filter is applied to the listed keys, which still saves callers from loading or
+// iterating keys they aren't interested in.
+func (cs *ConsulStorage) ListFilter(ctx context.Context, prefix string, recursive bool, filter ListFilter) ([]string, error) {
+	if _, err := path.Match(filter.Glob, ""); err != nil {
+		return nil, errors.Wrapf(err, "invalid glob %s", filter.Glob)
+	}
+
+	keys, err := cs.ListContext(ctx, prefix, recursive)
+	if err != nil {
+		return nil, err
+	}
+
+	matched := keys[:0]
+	for _, key := range keys {
+		if filter.match(key) {
+			matched = append(matched, key)
+		}
+	}
+	if len(matched) == 0 {
+		return matched, certmagic.ErrNotExist(errors.Errorf("no keys at %s match the filter", prefix))
+	}
+	return matched, nil
+}
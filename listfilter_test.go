@@ -0,0 +1,43 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_ListFilter(t *testing.T) {
+	cs := setupConsulEnv(t)
+	ctx := context.Background()
+
+	const dir = "certificates/acme-v02.api.letsencrypt.org-directory/"
+	for _, key := range []string{dir + "example.com/example.com.crt", dir + "example.com/example.com.key", dir + "example.org/example.org.crt", dir + "example.org/example.org.json"} {
+		require.NoError(t, cs.Store(key, []byte(key)))
+	}
+
+	keys, err := cs.ListFilter(ctx, "certificates", true, ListFilter{Glob: "*.crt"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{dir + "example.com/example.com.crt", dir + "example.org/example.org.crt"}, keys)
+
+	keys, err = cs.ListFilter(ctx, "certificates", true, ListFilter{Glob: "certificates/*/example.org/*"})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{dir + "example.org/example.org.crt", dir + "example.org/example.org.json"}, keys)
+
+	keys, err = cs.ListFilter(ctx, "certificates", true, ListFilter{Suffix: ".json"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{dir + "example.org/example.org.json"}, keys)
+
+	keys, err = cs.ListFilter(ctx, "certificates", true, ListFilter{})
+	require.NoError(t, err)
+	assert.Len(t, keys, 4)
+
+	_, err = cs.ListFilter(ctx, "certificates", true, ListFilter{Glob: "*.pem"})
+	_, notExist := err.(certmagic.ErrNotExist)
+	assert.True(t, notExist)
+
+	_, err = cs.ListFilter(ctx, "certificates", true, ListFilter{Glob: "[*.crt"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,51 @@
+package storageconsul
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/pteich/errors"
+)
+
+// ListInfo returns the KeyInfo of all keys at prefix from a single list request per namespace, instead of a
+// List followed by a Stat of every key. Keys are terminal, without recursive the directories directly below
+// prefix are returned as non-terminal entries with the newest modification time and the total size of the
+// keys below them.
+func (cs *ConsulStorage) ListInfo(ctx context.Context, prefix string, recursive bool) ([]certmagic.KeyInfo, error) {
+	data, err := cs.loadPrefixData(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return nil, certmagic.ErrNotExist(errors.Errorf("no keys at %s", prefix))
+	}
+
+	entries := make(map[string]*certmagic.KeyInfo, len(data))
+	for key, contents := range data {
+		name, terminal := key, true
+		if !recursive {
+			parts := strings.SplitN(strings.TrimPrefix(key, prefix+"/"), "/", 2)
+			name, terminal = path.Join(prefix, parts[0]), len(parts) == 1
+		}
+
+		info, ok := entries[name]
+		if !ok {
+			info = &certmagic.KeyInfo{Key: name, IsTerminal: terminal}
+			entries[name] = info
+		}
+		if contents.Modified.After(info.Modified) {
+			info.Modified = contents.Modified
+		}
+		info.Size += int64(len(contents.Value))
+	}
+
+	infos := make([]certmagic.KeyInfo, 0, len(entries))
+	for _, info := range entries {
+		infos = append(infos, *info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos, nil
+}
@@ -0,0 +1,40 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_ListInfo(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+	ctx := context.Background()
+
+	require.NoError(t, cs.Store("certificates/example.com/example.com.crt", []byte("crt")))
+	require.NoError(t, cs.Store("certificates/example.com/example.com.key", []byte("key!")))
+	require.NoError(t, cs.Store("certificates/index", []byte("index")))
+
+	infos, err := cs.ListInfo(ctx, "certificates", true)
+	require.NoError(t, err)
+	require.Len(t, infos, 3)
+	assert.Equal(t, "certificates/example.com/example.com.crt", infos[0].Key)
+	assert.Equal(t, int64(3), infos[0].Size)
+	assert.True(t, infos[0].IsTerminal)
+	stat, err := cs.Stat("certificates/example.com/example.com.crt")
+	require.NoError(t, err)
+	assert.True(t, stat.Modified.Equal(infos[0].Modified))
+
+	infos, err = cs.ListInfo(ctx, "certificates", false)
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	assert.Equal(t, certmagic.KeyInfo{Key: "certificates/example.com", Modified: infos[0].Modified, Size: 7}, infos[0])
+	assert.Equal(t, "certificates/index", infos[1].Key)
+	assert.True(t, infos[1].IsTerminal)
+
+	_, err = cs.ListInfo(ctx, "acme", true)
+	_, notExist := err.(certmagic.ErrNotExist)
+	assert.True(t, notExist)
+}
@@ -0,0 +1,102 @@
+package storageconsul
+
+import (
+	"context"
+	"path"
+	"strings"
+
+	"github.com/caddyserver/certmagic"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// LoadPrefix returns the values of all keys under prefix, fetched with a single request per namespace
+// instead of a List followed by a Load of every key. A prefix ending with a slash only matches the keys
+// of that directory, without it a prefix like certificates/example.com also matches example.community.
+func (cs *ConsulStorage) LoadPrefix(ctx context.Context, prefix string) (map[string][]byte, error) {
+	data, err := cs.loadPrefixData(ctx, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]byte, len(data))
+	for key, contents := range data {
+		values[key] = contents.Value
+	}
+
+	if len(values) == 0 {
+		return values, certmagic.ErrNotExist(errors.Errorf("no keys at %s", prefix))
+	}
+
+	return values, nil
+}
+
+// loadPrefixData returns the decoded stored data of all keys under prefix
+func (cs *ConsulStorage) loadPrefixData(ctx context.Context, prefix string) (map[string]*StorageData, error) {
+	if prefix != "" {
+		if err := validateKey(prefix); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := withTimeout(ctx, cs.ListTimeout)
+	defer cancel()
+
+	values := make(map[string]*StorageData)
+
+	for _, ns := range cs.namespaces() {
+		if !cs.listsNamespace(ns, prefix) {
+			continue
+		}
+
+		nsPrefix := path.Join(ns.prefix, cs.encodeKey(prefix))
+		if strings.HasSuffix(prefix, "/") {
+			nsPrefix += cs.keySeparator()
+		}
+		pairs, _, err := ns.kv.List(nsPrefix, cs.queryOptions(ctx))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to list data at %s", nsPrefix)
+		}
+
+		// long keys are stored under their hash and found by the original key in their value
+		if cs.hashesLongKeys() && !strings.HasPrefix(path.Join(ns.prefix, hashedKeysDir), nsPrefix) {
+			hashedPairs, _, err := ns.kv.List(path.Join(ns.prefix, hashedKeysDir)+"/", cs.queryOptions(ctx))
+			if err != nil {
+				return nil, errors.Wrap(err, "unable to list hashed keys")
+			}
+			pairs = append(pairs, hashedPairs...)
+		}
+
+		for _, kv := range pairs {
+			// lock keys hold the lock owner instead of a value
+			if kv.Flags == consul.LockFlagValue || cs.inBlobsDir(ns.prefix, kv.Key) || cs.inLockQueueDir(ns.prefix, kv.Key) {
+				continue
+			}
+
+			key := cs.storageKey(ns.prefix, kv.Key)
+			hashed := cs.inHashedKeysDir(ns.prefix, kv.Key)
+			if !hashed && (!strings.HasPrefix(kv.Key, nsPrefix) || cs.tenant(key) != ns.tenant) {
+				continue
+			}
+
+			contents, err := cs.decodePair(ctx, key, kv)
+			if err != nil {
+				return nil, err
+			}
+
+			if hashed {
+				key = contents.Key
+				if key == "" || !strings.HasPrefix(key, prefix) || cs.tenant(key) != ns.tenant {
+					continue
+				}
+			}
+
+			// keys below the prefix take precedence over the ones below the fallback prefix
+			if _, exists := values[key]; !exists {
+				values[key] = contents
+			}
+		}
+	}
+
+	return values, nil
+}
@@ -0,0 +1,65 @@
+package storageconsul
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_LoadPrefixDirectory(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+	cs.HashLongKeys = true
+	cs.MaxKeyLength = 64
+
+	longSite := "certificates/example.com/" + strings.Repeat("a", 80) + ".crt"
+	require.NoError(t, cs.Store("certificates/example.com/example.com.crt", []byte("crt")))
+	require.NoError(t, cs.Store(longSite, []byte("long")))
+	require.NoError(t, cs.Store("certificates/example.community/example.community.crt", []byte("other")))
+	require.NoError(t, cs.Store("certificates/example.community/"+strings.Repeat("a", 80)+".crt", []byte("other long")))
+
+	// with the trailing slash sites that only start with the domain are left out
+	values, err := cs.LoadPrefix(context.Background(), "certificates/example.com/")
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]byte{"certificates/example.com/example.com.crt": []byte("crt"), longSite: []byte("long")}, values)
+
+	values, err = cs.LoadPrefix(context.Background(), "certificates/example.com")
+	require.NoError(t, err)
+	assert.Len(t, values, 4)
+}
+
+func TestConsulStorage_LoadPrefix(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+	cs.HashLongKeys = true
+	cs.MaxKeyLength = 64
+	cs.DedupValues = true
+	cs.DedupMinSize = 8
+
+	longKey := "certificates/" + strings.Repeat("a", 80) + ".example.com"
+	stored := map[string][]byte{
+		"certificates/a.example.com/a.example.com.crt": []byte("crt a"),
+		"certificates/a.example.com/a.example.com.key": []byte("key a"),
+		"certificates/b.example.com/b.example.com.crt": []byte("shared chain"),
+		"certificates/c.example.com/c.example.com.crt": []byte("shared chain"),
+		longKey: []byte("long"),
+	}
+	for key, value := range stored {
+		require.NoError(t, cs.Store(key, value))
+	}
+	require.NoError(t, cs.Store("acme/account.json", []byte("account")))
+
+	values, err := cs.LoadPrefix(context.Background(), "certificates")
+	require.NoError(t, err)
+	assert.Equal(t, stored, values)
+
+	values, err = cs.LoadPrefix(context.Background(), "certificates/a.example.com")
+	require.NoError(t, err)
+	assert.Len(t, values, 2)
+
+	_, err = cs.LoadPrefix(context.Background(), "ocsp")
+	_, notExist := err.(certmagic.ErrNotExist)
+	assert.True(t, notExist)
+}
@@ -0,0 +1,44 @@
+package storageconsul
+
+import (
+	"context"
+
+	"github.com/pteich/errors"
+)
+
+// LoadWait waits until key exists with a modify index greater than index and returns its value together
+// with the index to pass to the next call. It uses Consul blocking queries, so instances can wait for a
+// certificate another instance is issuing instead of polling. An index of 0 returns an existing key at once.
+func (cs *ConsulStorage) LoadWait(ctx context.Context, key string, index uint64) ([]byte, uint64, error) {
+	if err := validateKey(key); err != nil {
+		return nil, 0, err
+	}
+
+	for {
+		opts := cs.queryOptions(ctx)
+		opts.WaitIndex = index
+
+		kv, meta, err := cs.kv(key).Get(cs.prefixKey(key), opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, index, ctx.Err()
+			}
+			return nil, index, errors.Wrapf(err, "unable to obtain data for %s", cs.prefixKey(key))
+		}
+
+		if kv != nil && kv.ModifyIndex > index {
+			contents, err := cs.decodePair(ctx, key, kv)
+			if err != nil {
+				return nil, meta.LastIndex, err
+			}
+			return contents.Value, meta.LastIndex, nil
+		}
+
+		// Consul resets the index e.g. after a snapshot restore, start over in that case
+		if meta.LastIndex < index {
+			index = 0
+			continue
+		}
+		index = meta.LastIndex
+	}
+}
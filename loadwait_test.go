@@ -0,0 +1,47 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_LoadWait(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cs.Store("certificates/example.com/example.com.key", []byte("key"))
+		cs.Store("certificates/example.com/example.com.crt", []byte("crt"))
+	}()
+
+	value, index, err := cs.LoadWait(ctx, "certificates/example.com/example.com.crt", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("crt"), value)
+
+	// the returned index waits for the next change
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cs.Store("certificates/example.com/example.com.crt", []byte("renewed"))
+	}()
+
+	value, _, err = cs.LoadWait(ctx, "certificates/example.com/example.com.crt", index)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("renewed"), value)
+}
+
+func TestConsulStorage_LoadWaitCanceled(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, _, err := cs.LoadWait(ctx, "certificates/example.com/example.com.crt", 0)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
@@ -0,0 +1,77 @@
+package storageconsul
+
+import (
+	"context"
+	"sync"
+
+	"github.com/pteich/errors"
+)
+
+// localLocker coordinates lock acquisition between goroutines of the same process
+// so that only one of them at a time reaches out to Consul for a given key
+type localLocker struct {
+	mu    sync.Mutex
+	locks map[string]*localLock
+}
+
+// localLock is a context aware mutex for a single key
+type localLock struct {
+	sem  chan struct{}
+	refs int
+}
+
+func newLocalLocker() *localLocker {
+	return &localLocker{
+		locks: make(map[string]*localLock),
+	}
+}
+
+// lock acquires the in-process lock for key or blocks until it gets one or ctx is done
+func (ll *localLocker) lock(ctx context.Context, key string) error {
+	ll.mu.Lock()
+	l, exists := ll.locks[key]
+	if !exists {
+		l = &localLock{sem: make(chan struct{}, 1)}
+		ll.locks[key] = l
+	}
+	l.refs++
+	ll.mu.Unlock()
+
+	select {
+	case l.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		ll.release(key, l)
+		return ctx.Err()
+	}
+}
+
+// unlock releases the in-process lock for key
+func (ll *localLocker) unlock(key string) error {
+	ll.mu.Lock()
+	l, exists := ll.locks[key]
+	ll.mu.Unlock()
+	if !exists {
+		return errors.Errorf("local lock %s not found", key)
+	}
+
+	select {
+	case <-l.sem:
+	default:
+		return errors.Errorf("local lock %s is not held", key)
+	}
+
+	ll.release(key, l)
+	return nil
+}
+
+// release drops a reference to l and removes it once nobody holds or waits for it
+func (ll *localLocker) release(key string, l *localLock) {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(ll.locks, key)
+	}
+}
@@ -0,0 +1,78 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLocalLocker_LockUnlock(t *testing.T) {
+	ll := newLocalLocker()
+
+	err := ll.lock(context.Background(), "key")
+	assert.NoError(t, err)
+
+	err = ll.unlock("key")
+	assert.NoError(t, err)
+	assert.Empty(t, ll.locks)
+
+	err = ll.unlock("key")
+	assert.Error(t, err)
+}
+
+func TestLocalLocker_Contention(t *testing.T) {
+	ll := newLocalLocker()
+
+	err := ll.lock(context.Background(), "key")
+	assert.NoError(t, err)
+
+	acquired := make(chan struct{})
+	go func() {
+		assert.NoError(t, ll.lock(context.Background(), "key"))
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("second lock acquired while first one is held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.NoError(t, ll.unlock("key"))
+	<-acquired
+	assert.NoError(t, ll.unlock("key"))
+	assert.Empty(t, ll.locks)
+}
+
+func TestLocalLocker_ContextCanceled(t *testing.T) {
+	ll := newLocalLocker()
+
+	err := ll.lock(context.Background(), "key")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err = ll.lock(ctx, "key")
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	assert.NoError(t, ll.unlock("key"))
+	assert.Empty(t, ll.locks)
+}
+
+func TestConsulStorage_DisableLocks(t *testing.T) {
+	cs := New()
+	cs.DisableLocks = true
+
+	err := cs.Lock(context.Background(), "key")
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Error(t, cs.Lock(ctx, "key"))
+
+	err = cs.Unlock("key")
+	assert.NoError(t, err)
+}
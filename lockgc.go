@@ -0,0 +1,129 @@
+package storageconsul
+
+import (
+	"context"
+	"encoding/json"
+	"path"
+	"strings"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// LockGCResult counts what a lock garbage collection removed
+type LockGCResult struct {
+	// DeletedLocks is the number of lock keys deleted that were released or whose session was gone
+	DeletedLocks int
+	// DeletedTickets is the number of lock queue tickets deleted whose waiter stopped renewing them
+	DeletedTickets int
+	// DestroyedSessions is the number of sessions destroyed that held a lock longer than LockGCMaxAge
+	DestroyedSessions int
+}
+
+// lockGCEnabled reports whether lock keys are collected periodically, only Consul locks leave keys behind
+func (cs *ConsulStorage) lockGCEnabled() bool {
+	_, sessions := cs.defaultKV().(kvSessions)
+	return cs.LockGCInterval > 0 && sessions
+}
+
+// runLockGC collects lock keys every LockGCInterval until stop is closed
+func (cs *ConsulStorage) runLockGC(stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Duration(cs.LockGCInterval))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+
+		res, err := cs.CollectLocks(context.Background())
+		if err != nil {
+			cs.logger.Errorf("lock garbage collection failed: %v", err)
+			continue
+		}
+		if res != (LockGCResult{}) {
+			cs.logger.Infof("lock garbage collection deleted %d lock keys and %d lock tickets and destroyed %d sessions",
+				res.DeletedLocks, res.DeletedTickets, res.DestroyedSessions)
+		}
+	}
+}
+
+// CollectLocks deletes lock keys below all prefixes that are released or whose session is gone, e.g. after
+// an instance crashed, and lock queue tickets that aren't bound to a session. With LockGCMaxAge the
+// sessions of locks held longer are destroyed, which frees locks of instances that hang. Keys that
+// changed in between are kept, so a lock acquired again meanwhile is never touched.
+func (cs *ConsulStorage) CollectLocks(ctx context.Context) (LockGCResult, error) {
+	var res LockGCResult
+	kv, ok := cs.defaultKV().(kvSessions)
+	if !ok {
+		return res, nil
+	}
+
+	ctx, cancel := withTimeout(ctx, cs.ListTimeout)
+	defer cancel()
+
+	sessions := kv.Session()
+	for _, ns := range cs.namespaces() {
+		pairs, _, err := ns.kv.List(ns.prefix+"/", cs.queryOptions(ctx))
+		if err != nil {
+			return res, errors.Wrapf(err, "unable to list locks at %s", ns.prefix)
+		}
+
+		for _, pair := range pairs {
+			switch {
+			case strings.HasPrefix(pair.Key, path.Join(ns.prefix, lockQueueDir)+"/"):
+				// tickets of waiters are bound to their session and deleted by Consul once it expires
+				if pair.Session != "" {
+					continue
+				}
+				if ok, _, err := ns.kv.DeleteCAS(pair, cs.writeOptions(ctx)); err != nil {
+					return res, errors.Wrapf(err, "unable to delete lock ticket %s", pair.Key)
+				} else if ok {
+					res.DeletedTickets++
+				}
+
+			case pair.Flags == consul.LockFlagValue:
+				if pair.Session != "" {
+					entry, _, err := sessions.Info(pair.Session, cs.queryOptions(ctx))
+					if err != nil {
+						return res, errors.Wrapf(err, "unable to read session of lock %s", pair.Key)
+					}
+					if entry != nil {
+						if cs.lockExpired(pair) {
+							cs.log(ctx).Warnf("destroying session %s of lock %s held for longer than %s", pair.Session, pair.Key, time.Duration(cs.LockGCMaxAge))
+							if _, err := sessions.Destroy(pair.Session, cs.writeOptions(ctx)); err != nil {
+								return res, errors.Wrapf(err, "unable to destroy session of lock %s", pair.Key)
+							}
+							res.DestroyedSessions++
+						}
+						continue
+					}
+				}
+				if ok, _, err := ns.kv.DeleteCAS(pair, cs.writeOptions(ctx)); err != nil {
+					return res, errors.Wrapf(err, "unable to delete lock %s", pair.Key)
+				} else if ok {
+					cs.log(ctx).Debugf("deleted stale lock %s", pair.Key)
+					res.DeletedLocks++
+				}
+			}
+		}
+	}
+
+	return res, nil
+}
+
+// lockExpired reports whether the held lock pair was acquired longer than LockGCMaxAge ago according to its
+// owner info, locks of older versions without owner info never expire
+func (cs *ConsulStorage) lockExpired(pair *consul.KVPair) bool {
+	if cs.LockGCMaxAge <= 0 {
+		return false
+	}
+	var owner LockOwner
+	if err := json.Unmarshal(pair.Value, &owner); err != nil || owner.Acquired.IsZero() {
+		return false
+	}
+	return time.Since(owner.Acquired) > time.Duration(cs.LockGCMaxAge)
+}
@@ -0,0 +1,55 @@
+package storageconsul
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_CollectLocks(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	ctx := context.Background()
+
+	// a released lock leaves its key behind, a held lock is kept
+	require.NoError(t, cs.Lock(ctx, "released"))
+	require.NoError(t, cs.Unlock("released"))
+	require.NoError(t, cs.Lock(ctx, "held"))
+	defer cs.Unlock("held")
+	require.NoError(t, cs.Store("value", []byte("value")))
+
+	fc.mu.Lock()
+	// the lock of a hanging instance and the ticket of a waiter that is gone
+	fc.sessions["session-hanging"] = &consul.SessionEntry{ID: "session-hanging"}
+	owner, _ := json.Marshal(LockOwner{Hostname: "hanging", Acquired: time.Now().Add(-48 * time.Hour)})
+	fc.kv[cs.prefixKey("hanging")] = &consul.KVPair{Key: cs.prefixKey("hanging"), Value: owner, Flags: consul.LockFlagValue, Session: "session-hanging", ModifyIndex: fc.index}
+	ticket := cs.lockQueue("held") + "/stale"
+	fc.kv[ticket] = &consul.KVPair{Key: ticket, Value: []byte(time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)), ModifyIndex: fc.index}
+	fc.mu.Unlock()
+
+	res, err := cs.CollectLocks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, LockGCResult{DeletedLocks: 1, DeletedTickets: 1}, res)
+	assert.False(t, cs.Exists("released"))
+	_, err = cs.LockOwner(ctx, "held")
+	assert.NoError(t, err)
+	assert.True(t, cs.Exists("value"))
+
+	// locks held for longer than the max age are freed
+	cs.LockGCMaxAge = caddy.Duration(24 * time.Hour)
+	res, err = cs.CollectLocks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, LockGCResult{DestroyedSessions: 1}, res)
+	_, err = cs.LockOwner(ctx, "held")
+	assert.NoError(t, err)
+
+	// the key released with the destroyed session is deleted on the next run
+	res, err = cs.CollectLocks(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, LockGCResult{DeletedLocks: 1}, res)
+}
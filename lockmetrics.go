@@ -0,0 +1,36 @@
+package storageconsul
+
+import (
+	"context"
+	"time"
+)
+
+// slowLockThreshold returns the time waiting for a lock after which a warning is logged, zero if disabled
+func (cs *ConsulStorage) slowLockThreshold() time.Duration {
+	switch {
+	case cs.SlowLockThreshold < 0:
+		return 0
+	case cs.SlowLockThreshold == 0:
+		return DefaultSlowLockThreshold
+	}
+	return time.Duration(cs.SlowLockThreshold)
+}
+
+// observeLockWait records how long Lock waited for key and whether it gave up, slow waits are logged
+// as contention is otherwise invisible until issuances start failing
+func (cs *ConsulStorage) observeLockWait(ctx context.Context, key string, wait time.Duration, err error) {
+	threshold := cs.slowLockThreshold()
+
+	if err != nil {
+		if ctx.Err() != nil {
+			lockTimeouts.Inc()
+			cs.log(ctx).Warnf("%v", err)
+		}
+		return
+	}
+
+	lockWaitSeconds.Observe(wait.Seconds())
+	if threshold > 0 && wait > threshold {
+		cs.log(ctx).Warnf("waited %s for lock %s", wait.Round(time.Millisecond), key)
+	}
+}
@@ -0,0 +1,33 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_LockTimeouts(t *testing.T) {
+	cs := setupConsulEnv(t)
+	cs2 := setupConsulEnv(t)
+
+	require.NoError(t, cs.Lock(context.Background(), "issue_cert_example.com"))
+	defer cs.Unlock("issue_cert_example.com")
+
+	timeouts := testutil.ToFloat64(lockTimeouts)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.Error(t, cs2.Lock(ctx, "issue_cert_example.com"))
+	assert.Equal(t, timeouts+1, testutil.ToFloat64(lockTimeouts))
+}
+
+func TestConsulStorage_SlowLockThreshold(t *testing.T) {
+	cs := New()
+	assert.Equal(t, DefaultSlowLockThreshold, cs.slowLockThreshold())
+
+	cs.SlowLockThreshold = -1
+	assert.Zero(t, cs.slowLockThreshold())
+}
@@ -0,0 +1,61 @@
+package storageconsul
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/pteich/errors"
+)
+
+// LockOwner describes the instance holding a lock, it is stored as value of the lock key so operators
+// inspecting Consul can see which instance holds a stuck lock
+type LockOwner struct {
+	Hostname   string    `json:"hostname"`
+	PID        int       `json:"pid"`
+	InstanceID string    `json:"instance_id,omitempty"`
+	Acquired   time.Time `json:"acquired"`
+}
+
+// lockOwner returns the owner info of a lock acquired now by this instance
+func (cs *ConsulStorage) lockOwner() LockOwner {
+	hostname, _ := os.Hostname()
+	return LockOwner{
+		Hostname:   hostname,
+		PID:        os.Getpid(),
+		InstanceID: cs.instanceID,
+		Acquired:   time.Now().UTC(),
+	}
+}
+
+// lockValue returns the encoded owner info to store with a lock acquired now
+func (cs *ConsulStorage) lockValue() []byte {
+	value, err := json.Marshal(cs.lockOwner())
+	if err != nil {
+		return nil
+	}
+	return value
+}
+
+// LockOwner returns the owner info of the lock of key, whichever instance holds it
+func (cs *ConsulStorage) LockOwner(ctx context.Context, key string) (LockOwner, error) {
+	ctx, cancel := withTimeout(ctx, cs.ReadTimeout)
+	defer cancel()
+
+	kv, _, err := cs.kv(key).Get(cs.prefixKey(key), cs.queryOptions(ctx))
+	if err != nil {
+		return LockOwner{}, errors.Wrapf(err, "unable to obtain lock %s", cs.prefixKey(key))
+	}
+	if kv == nil || kv.Session == "" {
+		return LockOwner{}, certmagic.ErrNotExist(errors.Errorf("lock %s is not held", cs.prefixKey(key)))
+	}
+
+	var owner LockOwner
+	if err := json.Unmarshal(kv.Value, &owner); err != nil {
+		// locks of older versions have no owner info
+		return LockOwner{}, errors.Errorf("lock %s has no owner info", cs.prefixKey(key))
+	}
+	return owner, nil
+}
@@ -0,0 +1,31 @@
+package storageconsul
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_LockOwner(t *testing.T) {
+	cs := setupConsulEnv(t)
+	cs2 := setupConsulEnv(t)
+
+	require.NoError(t, cs.Lock(context.Background(), "issue_cert_example.com"))
+
+	// any instance can see who holds the lock
+	owner, err := cs2.LockOwner(context.Background(), "issue_cert_example.com")
+	require.NoError(t, err)
+	hostname, _ := os.Hostname()
+	assert.Equal(t, hostname, owner.Hostname)
+	assert.Equal(t, os.Getpid(), owner.PID)
+	assert.False(t, owner.Acquired.IsZero())
+
+	require.NoError(t, cs.Unlock("issue_cert_example.com"))
+	_, err = cs2.LockOwner(context.Background(), "issue_cert_example.com")
+	_, notExist := err.(certmagic.ErrNotExist)
+	assert.True(t, notExist)
+}
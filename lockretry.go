@@ -0,0 +1,66 @@
+package storageconsul
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// LockTimeoutError is returned by Lock if it gave up waiting for a contended lock because the LockTimeout
+// passed or the context of the caller, e.g. certmagic's, was done. The lock may be retried later.
+type LockTimeoutError struct {
+	Key    string
+	Waited time.Duration
+	// Err is the error of the context, context.DeadlineExceeded or context.Canceled
+	Err error
+}
+
+func (e LockTimeoutError) Error() string {
+	return fmt.Sprintf("gave up waiting for lock %s after %s: %v", e.Key, e.Waited.Round(time.Millisecond), e.Err)
+}
+
+func (e LockTimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports that the lock timed out, like net.Error does for network timeouts
+func (e LockTimeoutError) Timeout() bool {
+	return true
+}
+
+// lockBackoff returns the pauses between attempts to acquire a contended lock. They start at
+// LockRetryInterval and grow by half with every attempt up to LockMaxRetryInterval, so short
+// contention is resolved quickly while long waits don't keep hammering Consul.
+type lockBackoff struct {
+	next time.Duration
+	max  time.Duration
+}
+
+// newLockBackoff returns the backoff for one Lock call
+func (cs *ConsulStorage) newLockBackoff() *lockBackoff {
+	interval, max := time.Duration(cs.LockRetryInterval), time.Duration(cs.LockMaxRetryInterval)
+	if interval <= 0 {
+		interval = DefaultLockPollInterval
+	}
+	if max <= 0 {
+		max = DefaultMaxLockPollInterval
+	}
+	// waiters in a fair lock queue have to renew their ticket before it goes stale
+	if cs.FairLocks && max > lockTicketTTL/3 {
+		max = lockTicketTTL / 3
+	}
+	if interval > max {
+		interval = max
+	}
+	return &lockBackoff{next: interval, max: max}
+}
+
+// wait returns the pause before the next attempt, with some jitter so waiters don't retry in lockstep
+func (b *lockBackoff) wait() time.Duration {
+	current := b.next
+	b.next += b.next / 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	return current - time.Duration(rand.Int63n(int64(current)/5+1))
+}
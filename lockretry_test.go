@@ -0,0 +1,64 @@
+package storageconsul
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLockBackoff(t *testing.T) {
+	cs := New()
+	cs.LockRetryInterval = caddy.Duration(100 * time.Millisecond)
+	cs.LockMaxRetryInterval = caddy.Duration(200 * time.Millisecond)
+
+	b := cs.newLockBackoff()
+	for _, expected := range []time.Duration{100, 150, 200, 200} {
+		wait := b.wait()
+		// up to a fifth is taken off as jitter
+		assert.LessOrEqual(t, int64(wait), int64(expected*time.Millisecond))
+		assert.GreaterOrEqual(t, int64(wait), int64(expected*time.Millisecond*4/5))
+	}
+}
+
+func TestLockBackoff_FairLocks(t *testing.T) {
+	cs := New()
+	cs.FairLocks = true
+	cs.LockMaxRetryInterval = caddy.Duration(time.Minute)
+
+	// tickets are renewed before they go stale
+	assert.Equal(t, lockTicketTTL/3, cs.newLockBackoff().max)
+	assert.Equal(t, DefaultLockPollInterval, cs.newLockBackoff().next)
+}
+
+func TestConsulStorage_LockTimeoutError(t *testing.T) {
+	cs := setupConsulEnv(t)
+	cs2 := setupConsulEnv(t)
+	cs2.LockTimeout = caddy.Duration(50 * time.Millisecond)
+
+	require.NoError(t, cs.Lock(context.Background(), "issue_cert_example.com"))
+	defer cs.Unlock("issue_cert_example.com")
+
+	// the lock_timeout of the storage applies
+	err := cs2.Lock(context.Background(), "issue_cert_example.com")
+	var timeoutErr LockTimeoutError
+	require.True(t, errors.As(err, &timeoutErr))
+	assert.Equal(t, "issue_cert_example.com", timeoutErr.Key)
+	assert.GreaterOrEqual(t, int64(timeoutErr.Waited), int64(50*time.Millisecond))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, timeoutErr.Timeout())
+
+	// so does the deadline of the caller
+	cs2.LockTimeout = 0
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.True(t, errors.As(cs2.Lock(ctx, "issue_cert_example.com"), &timeoutErr))
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	assert.True(t, errors.Is(cs2.Lock(ctx, "issue_cert_example.com"), context.Canceled))
+}
@@ -0,0 +1,300 @@
+package storageconsul
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+	"go.uber.org/zap"
+)
+
+// LockLostError is returned by Unlock if the Consul lock of a key got lost while it was held
+// and couldn't be reacquired, another instance may have held the lock in the meantime
+type LockLostError struct {
+	Key string
+}
+
+func (e LockLostError) Error() string {
+	return fmt.Sprintf("lock %s was lost", e.Key)
+}
+
+// heldLock is a Consul lock held by this instance
+type heldLock struct {
+	// released is closed by Unlock to stop reacquiring a lost lock
+	released chan struct{}
+	// logger logs with the operation ID of the Lock call that acquired the lock
+	logger *zap.SugaredLogger
+
+	// mu guards the fields below, the watcher of the lock changes them when it reacquires the lock
+	mu   sync.Mutex
+	lock locker
+	// active is closed when the current session of the lock is lost
+	active <-chan struct{}
+	// lost is set if the lock got lost and couldn't be reacquired
+	lost bool
+	// state is the state of the lock key right after the lock was acquired
+	state lockState
+	// stopWatch is closed to stop the watcher of the lock when the lock is handed off, watched is closed
+	// once the watcher stopped
+	stopWatch chan struct{}
+	watched   chan struct{}
+}
+
+func newHeldLock(lock locker, active <-chan struct{}, state lockState, logger *zap.SugaredLogger) *heldLock {
+	return &heldLock{
+		released:  make(chan struct{}),
+		logger:    logger,
+		lock:      lock,
+		active:    active,
+		state:     state,
+		stopWatch: make(chan struct{}),
+		watched:   make(chan struct{}),
+	}
+}
+
+// current returns the lock as last acquired and whether it got lost
+func (h *heldLock) current() (locker, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lock, h.lost
+}
+
+// stopWatching stops the watcher of the lock and waits until it stopped, a lock it is reacquiring right now
+// is either kept or left lost for the next watcher
+func (h *heldLock) stopWatching() {
+	h.mu.Lock()
+	stop, watched := h.stopWatch, h.watched
+	h.mu.Unlock()
+
+	close(stop)
+	<-watched
+
+	h.mu.Lock()
+	h.stopWatch, h.watched = make(chan struct{}), make(chan struct{})
+	h.mu.Unlock()
+}
+
+// lockState is the state of the key of a held lock, a change of it while the lock is lost reveals that
+// another instance held the lock in between
+type lockState struct {
+	// lockIndex counts the acquisitions of the lock, it is 0 for backends that don't report it
+	lockIndex   uint64
+	modifyIndex uint64
+}
+
+// readLockState returns the state of the key of the lock of key
+func (cs *ConsulStorage) readLockState(key string) (lockState, error) {
+	ctx, cancel := withTimeout(context.Background(), cs.ReadTimeout)
+	defer cancel()
+
+	kv, _, err := cs.kv(key).Get(cs.prefixKey(key), cs.queryOptions(ctx))
+	if err != nil {
+		return lockState{}, errors.Wrapf(err, "unable to obtain lock %s", cs.prefixKey(key))
+	}
+	if kv == nil {
+		return lockState{}, errors.Errorf("lock %s doesn't exist", cs.prefixKey(key))
+	}
+	return lockState{lockIndex: kv.LockIndex, modifyIndex: kv.ModifyIndex}, nil
+}
+
+// CheckLock returns nil if this instance still holds the lock of key and a LockLostError if it got lost
+// to another instance, long running work guarded by the lock can call it before committing its results
+func (cs *ConsulStorage) CheckLock(key string) error {
+	key = normalizeKey(key)
+	if cs.localLocksOnly(key) {
+		return nil
+	}
+
+	if next := cs.lockSuccessor(key); next != nil {
+		return next.CheckLock(key)
+	}
+
+	cs.muLocks.RLock()
+	defer cs.muLocks.RUnlock()
+
+	h, exists := cs.locks[key]
+	if !exists {
+		return errors.Errorf("lock %s not found", cs.prefixKey(key))
+	}
+	if _, lost := h.current(); lost {
+		return LockLostError{Key: key}
+	}
+	return nil
+}
+
+// newLocker prepares the distributed lock for key, a lock that got lost can't be reused
+func (cs *ConsulStorage) newLocker(key string) (locker, error) {
+	return cs.kv(key).newLock(cs.prefixKey(key), cs.lockValue())
+}
+
+// deletesLockKeys reports whether lock keys are removed once their lock is released or its session is gone
+func (cs *ConsulStorage) deletesLockKeys() bool {
+	_, sessions := cs.defaultKV().(kvSessions)
+	return sessions && cs.LockSessionBehavior == consul.SessionBehaviorDelete
+}
+
+// deleteLockKey removes the key of the released lock of key unless another instance acquired it in between
+func (cs *ConsulStorage) deleteLockKey(key string) {
+	ctx, cancel := withTimeout(context.Background(), cs.WriteTimeout)
+	defer cancel()
+
+	kv, _, err := cs.kv(key).Get(cs.prefixKey(key), cs.queryOptions(ctx))
+	if err == nil && kv != nil && kv.Session == "" {
+		_, _, err = cs.kv(key).DeleteCAS(kv, cs.writeOptions(ctx))
+	}
+	if err != nil {
+		cs.logger.Debugf("unable to delete key of released lock %s: %v", key, err)
+	}
+}
+
+// watchLock reacquires the lock of key with a new session whenever it gets lost until Unlock is called,
+// if the lock is taken by someone else in between it is marked as lost
+func (cs *ConsulStorage) watchLock(key string, h *heldLock) {
+	h.mu.Lock()
+	stop, watched := h.stopWatch, h.watched
+	h.mu.Unlock()
+	defer close(watched)
+
+	// reacquiring is given up once the lock is released or handed off
+	abort := make(chan struct{})
+	go func() {
+		select {
+		case <-h.released:
+		case <-stop:
+		}
+		close(abort)
+	}()
+
+	for {
+		h.mu.Lock()
+		lock, lockActive, state := h.lock, h.active, h.state
+		h.mu.Unlock()
+
+		select {
+		case <-abort:
+			return
+		case <-lockActive:
+		}
+
+		h.logger.Warnf("lost Consul lock for %s, trying to reacquire it", key)
+		// ends the session of the lost lock, it fails if the session is gone already
+		_ = lock.Unlock()
+
+		lock, active, state, err := cs.reacquireLock(key, abort, state, h.logger)
+
+		h.mu.Lock()
+		select {
+		case <-h.released:
+			// Unlock released the lost lock in the meantime
+			h.mu.Unlock()
+			if lock != nil {
+				_ = lock.Unlock()
+			}
+			return
+		default:
+		}
+		if err != nil {
+			select {
+			case <-stop:
+				// the lock was handed off while reacquiring it, the next watcher tries again
+				h.mu.Unlock()
+				return
+			default:
+			}
+			h.lost = true
+			h.mu.Unlock()
+			locksLost.Add(1)
+			h.logger.Errorf("unable to reacquire Consul lock for %s: %v", key, err)
+			if cs.OnLockLost != nil {
+				cs.OnLockLost(key)
+			}
+			return
+		}
+		h.lock, h.active, h.state = lock, active, state
+		h.mu.Unlock()
+
+		h.logger.Infof("reacquired Consul lock for %s", key)
+		locksReacquired.Add(1)
+	}
+}
+
+// reacquireLock acquires the lock of key with a new session and returns the new state of its key, it retries
+// while Consul is unavailable but fails if the lock is held by another session or was held by one since it was
+// acquired in state
+func (cs *ConsulStorage) reacquireLock(key string, released <-chan struct{}, state lockState, logger *zap.SugaredLogger) (locker, <-chan struct{}, lockState, error) {
+	for {
+		err := cs.checkLockTaken(key, state)
+		if err != nil {
+			return nil, nil, lockState{}, err
+		}
+
+		lock, err := cs.newLocker(key)
+		if err == nil {
+			var lockActive <-chan struct{}
+			lockActive, err = lock.Lock(released)
+			if err == nil && lockActive != nil {
+				newState, err := cs.checkReacquired(key, state)
+				if err != nil {
+					_ = lock.Unlock()
+					return nil, nil, lockState{}, err
+				}
+				return lock, lockActive, newState, nil
+			}
+			if err == nil {
+				select {
+				case <-released:
+					return nil, nil, lockState{}, errors.Errorf("lock %s was released", cs.prefixKey(key))
+				default:
+				}
+				// the key is taken or still blocked by the lock-delay of the lost session
+				continue
+			}
+		}
+
+		logger.Debugf("unable to reacquire Consul lock for %s, retrying: %v", key, err)
+		select {
+		case <-released:
+			return nil, nil, lockState{}, err
+		case <-time.After(DefaultLockRetryInterval):
+		}
+	}
+}
+
+// checkLockTaken returns an error if the lock of key is held by another session or its key changed in a way
+// that shows another session held it since the lock was acquired in state
+func (cs *ConsulStorage) checkLockTaken(key string, state lockState) error {
+	kv, _, err := cs.kv(key).Get(cs.prefixKey(key), cs.queryOptions(context.Background()))
+	if err != nil {
+		// Consul is still unavailable, keep on retrying
+		return nil
+	}
+	switch {
+	case kv == nil:
+		// the key was deleted with the lost session, whether someone held the lock since is unknown
+		return errors.Errorf("lock %s was deleted", cs.prefixKey(key))
+	case kv.Session != "":
+		return errors.Errorf("lock %s was taken by another session", cs.prefixKey(key))
+	case state.lockIndex != 0 && kv.LockIndex != state.lockIndex:
+		return errors.Errorf("lock %s was held by another session in the meantime", cs.prefixKey(key))
+	case state.lockIndex == 0 && kv.ModifyIndex != state.modifyIndex:
+		// without a lock index any change of the key may have been another holder
+		return errors.Errorf("lock %s was modified in the meantime", cs.prefixKey(key))
+	}
+	return nil
+}
+
+// checkReacquired returns the state of the key of the reacquired lock of key, it fails if another session
+// acquired the lock between checkLockTaken and the acquisition
+func (cs *ConsulStorage) checkReacquired(key string, state lockState) (lockState, error) {
+	newState, err := cs.readLockState(key)
+	if err != nil {
+		return lockState{}, err
+	}
+	if state.lockIndex != 0 && newState.lockIndex != state.lockIndex+1 {
+		return lockState{}, errors.Errorf("lock %s was held by another session in the meantime", cs.prefixKey(key))
+	}
+	return newState, nil
+}
@@ -0,0 +1,124 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_LockReacquired(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	consulKey := cs.prefixKey("issue_cert_example.com")
+
+	require.NoError(t, cs.Lock(context.Background(), "issue_cert_example.com"))
+	session := fc.kv[consulKey].Session
+	require.NotEmpty(t, session)
+
+	// Consul lost all sessions, e.g. after a restart
+	fc.mu.Lock()
+	fc.invalidateSessions()
+	fc.mu.Unlock()
+
+	require.Eventually(t, func() bool {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		return fc.kv[consulKey].Session != "" && fc.kv[consulKey].Session != session
+	}, 5*time.Second, 10*time.Millisecond)
+
+	_, held := cs.GetLock("issue_cert_example.com")
+	assert.True(t, held)
+	assert.NoError(t, cs.CheckLock("issue_cert_example.com"))
+
+	require.NoError(t, cs.Unlock("issue_cert_example.com"))
+	assert.Empty(t, fc.kv[consulKey].Session)
+}
+
+func TestConsulStorage_LockLost(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.Timeout = 1
+	lost := make(chan string, 1)
+	cs.OnLockLost = func(key string) { lost <- key }
+	consulKey := cs.prefixKey("issue_cert_example.com")
+
+	require.NoError(t, cs.Lock(context.Background(), "issue_cert_example.com"))
+
+	// another instance takes the lock as soon as the session is gone
+	fc.mu.Lock()
+	fc.invalidateSessions()
+	fc.sessions["other"] = &consul.SessionEntry{ID: "other"}
+	fc.kv[consulKey].Session = "other"
+	fc.mu.Unlock()
+
+	select {
+	case key := <-lost:
+		assert.Equal(t, "issue_cert_example.com", key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock loss not reported")
+	}
+
+	_, held := cs.GetLock("issue_cert_example.com")
+	assert.False(t, held)
+	assert.Equal(t, LockLostError{Key: "issue_cert_example.com"}, cs.CheckLock("issue_cert_example.com"))
+
+	err := cs.Unlock("issue_cert_example.com")
+	assert.Equal(t, LockLostError{Key: "issue_cert_example.com"}, err)
+	assert.Equal(t, "other", fc.kv[consulKey].Session)
+
+	// the local lock is released nevertheless
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, cs.localLocks.lock(ctx, "issue_cert_example.com"))
+}
+
+func TestConsulStorage_LockHeldInBetween(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.Timeout = 1
+	lost := make(chan string, 1)
+	cs.OnLockLost = func(key string) { lost <- key }
+	consulKey := cs.prefixKey("issue_cert_example.com")
+
+	require.NoError(t, cs.Lock(context.Background(), "issue_cert_example.com"))
+
+	// another instance took and released the lock before it is reacquired
+	fc.mu.Lock()
+	fc.invalidateSessions()
+	fc.kv[consulKey].LockIndex++
+	fc.mu.Unlock()
+
+	select {
+	case key := <-lost:
+		assert.Equal(t, "issue_cert_example.com", key)
+	case <-time.After(5 * time.Second):
+		t.Fatal("lock loss not reported")
+	}
+	assert.Equal(t, LockLostError{Key: "issue_cert_example.com"}, cs.CheckLock("issue_cert_example.com"))
+
+	fc.mu.Lock()
+	assert.Empty(t, fc.kv[consulKey].Session)
+	fc.mu.Unlock()
+	assert.Equal(t, LockLostError{Key: "issue_cert_example.com"}, cs.Unlock("issue_cert_example.com"))
+}
+
+func TestConsulStorage_LockSessionBehaviorDelete(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.LockSessionBehavior = consul.SessionBehaviorDelete
+	consulKey := cs.prefixKey("issue_cert_example.com")
+
+	require.NoError(t, cs.Lock(context.Background(), "issue_cert_example.com"))
+	fc.mu.Lock()
+	session := fc.sessions[fc.kv[consulKey].Session]
+	fc.mu.Unlock()
+	require.NotNil(t, session)
+	assert.Equal(t, consul.SessionBehaviorDelete, session.Behavior)
+
+	// released locks don't leave their key behind
+	require.NoError(t, cs.Unlock("issue_cert_example.com"))
+	fc.mu.Lock()
+	_, exists := fc.kv[consulKey]
+	fc.mu.Unlock()
+	assert.False(t, exists)
+}
@@ -0,0 +1,97 @@
+package storageconsul
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pteich/errors"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Defaults of log sampling, like Caddy's own sampling
+const (
+	DefaultLogSampleInterval   = time.Second
+	DefaultLogSampleFirst      = 100
+	DefaultLogSampleThereafter = 100
+)
+
+// levelCore only passes entries enabled by level to its core
+type levelCore struct {
+	zapcore.Core
+	level zapcore.LevelEnabler
+}
+
+func (c *levelCore) Enabled(l zapcore.Level) bool {
+	return c.level.Enabled(l) && c.Core.Enabled(l)
+}
+
+func (c *levelCore) With(fields []zapcore.Field) zapcore.Core {
+	return &levelCore{Core: c.Core.With(fields), level: c.level}
+}
+
+func (c *levelCore) Check(ent zapcore.Entry, ce *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if !c.level.Enabled(ent.Level) {
+		return ce
+	}
+	return c.Core.Check(ent, ce)
+}
+
+// logLevel parses the configured log level, debug, info, warn or error
+func (cs *ConsulStorage) logLevel() (zapcore.Level, error) {
+	var level zapcore.Level
+	if err := level.UnmarshalText([]byte(strings.ToLower(cs.LogLevel))); err != nil {
+		return level, errors.Errorf("invalid log_level %s", cs.LogLevel)
+	}
+	return level, nil
+}
+
+// samplesLogs reports whether log sampling is configured
+func (cs *ConsulStorage) samplesLogs() bool {
+	return cs.LogSampleInterval > 0 || cs.LogSampleFirst > 0 || cs.LogSampleThereafter > 0
+}
+
+// moduleLogger applies the log level and sampling of the storage to logger. Entries more verbose than
+// what Caddy's logs accept are written to stderr, so debug logging of the storage can be enabled without
+// lowering the level of all other modules.
+func (cs *ConsulStorage) moduleLogger(logger *zap.Logger) (*zap.Logger, error) {
+	if cs.LogLevel == "" && !cs.samplesLogs() {
+		return logger, nil
+	}
+
+	level := zapcore.InfoLevel
+	if cs.LogLevel != "" {
+		var err error
+		if level, err = cs.logLevel(); err != nil {
+			return nil, err
+		}
+	}
+
+	return logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		wrapped := zapcore.Core(&levelCore{Core: core, level: level})
+		if cs.LogLevel != "" && !core.Enabled(level) {
+			encoderConfig := zap.NewProductionEncoderConfig()
+			encoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+			verbose := zapcore.NewCore(zapcore.NewJSONEncoder(encoderConfig), zapcore.Lock(os.Stderr), zap.LevelEnablerFunc(func(l zapcore.Level) bool {
+				return l >= level && !core.Enabled(l)
+			}))
+			wrapped = zapcore.NewTee(wrapped, verbose)
+		}
+
+		if cs.samplesLogs() {
+			interval, first, thereafter := time.Duration(cs.LogSampleInterval), cs.LogSampleFirst, cs.LogSampleThereafter
+			if interval <= 0 {
+				interval = DefaultLogSampleInterval
+			}
+			if first <= 0 {
+				first = DefaultLogSampleFirst
+			}
+			if thereafter <= 0 {
+				thereafter = DefaultLogSampleThereafter
+			}
+			wrapped = zapcore.NewSamplerWithOptions(wrapped, interval, first, thereafter)
+		}
+		return wrapped
+	})), nil
+}
@@ -0,0 +1,50 @@
+package storageconsul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestConsulStorage_ModuleLoggerLevel(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+
+	cs := New()
+	cs.LogLevel = "WARN"
+	logger, err := cs.moduleLogger(zap.New(core))
+	require.NoError(t, err)
+
+	logger.Info("dropped")
+	logger.Warn("kept")
+	require.Equal(t, 1, logs.Len())
+	assert.Equal(t, "kept", logs.All()[0].Message)
+}
+
+func TestConsulStorage_ModuleLoggerSampling(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+
+	cs := New()
+	cs.LogSampleFirst = 2
+	cs.LogSampleThereafter = 5
+	logger, err := cs.moduleLogger(zap.New(core))
+	require.NoError(t, err)
+
+	for i := 0; i < 12; i++ {
+		logger.Info("repeated")
+	}
+	// the first two and every fifth one after that
+	assert.Equal(t, 4, logs.Len())
+}
+
+func TestConsulStorage_ValidateLogLevel(t *testing.T) {
+	cs := New()
+	cs.LogLevel = "verbose"
+	assert.Error(t, cs.Validate())
+
+	_, err := cs.moduleLogger(zap.NewNop())
+	assert.Error(t, err)
+}
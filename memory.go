@@ -0,0 +1,372 @@
+package storageconsul
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// BackendMemory keeps values in memory, they are shared by all storages of the process using it but
+// lost on exit, so it is meant for tests and for trying out configurations without Consul
+const BackendMemory = "memory"
+
+// memoryStore implements kvBackend in memory with the semantics of Consul KV, including
+// Check-And-Set, blocking queries and locks
+type memoryStore struct {
+	mu    sync.Mutex
+	pairs map[string]*consul.KVPair
+	index uint64
+
+	// changed is closed and replaced on every write to wake up blocking queries
+	changed chan struct{}
+}
+
+var (
+	processMemoryStore     *memoryStore
+	processMemoryStoreOnce sync.Once
+)
+
+// sharedMemoryStore returns the memory store of the process, so values survive config reloads
+func sharedMemoryStore() *memoryStore {
+	processMemoryStoreOnce.Do(func() {
+		processMemoryStore = newMemoryStore()
+	})
+	return processMemoryStore
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{pairs: make(map[string]*consul.KVPair), index: 1, changed: make(chan struct{})}
+}
+
+// write applies a change to the pair of key under the next index
+func (ms *memoryStore) write(key string, change func(pair *consul.KVPair, exists bool) *consul.KVPair) {
+	existing, exists := ms.pairs[key]
+	ms.index++
+	if pair := change(existing, exists); pair != nil {
+		pair.ModifyIndex = ms.index
+		if exists {
+			pair.CreateIndex = existing.CreateIndex
+		} else {
+			pair.CreateIndex = ms.index
+		}
+		ms.pairs[key] = pair
+	} else {
+		delete(ms.pairs, key)
+	}
+
+	close(ms.changed)
+	ms.changed = make(chan struct{})
+}
+
+// copyPair returns a copy of pair so callers can't modify the stored one
+func copyPair(pair *consul.KVPair) *consul.KVPair {
+	c := *pair
+	c.Value = append([]byte(nil), pair.Value...)
+	return &c
+}
+
+func (ms *memoryStore) Get(key string, q *consul.QueryOptions) (*consul.KVPair, *consul.QueryMeta, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// blocking queries wait until the index moved past the given one or the wait time is over
+	if q != nil && q.WaitIndex > 0 {
+		wait := q.WaitTime
+		if wait <= 0 {
+			wait = 5 * time.Minute
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+
+	blocking:
+		for ms.index <= q.WaitIndex {
+			changed := ms.changed
+			ms.mu.Unlock()
+			select {
+			case <-changed:
+				ms.mu.Lock()
+			case <-timer.C:
+				ms.mu.Lock()
+				break blocking
+			case <-q.Context().Done():
+				ms.mu.Lock()
+				return nil, nil, q.Context().Err()
+			}
+		}
+	}
+
+	meta := &consul.QueryMeta{LastIndex: ms.index}
+	pair, exists := ms.pairs[key]
+	if !exists {
+		return nil, meta, nil
+	}
+	return copyPair(pair), meta, nil
+}
+
+// keys returns the sorted keys starting with prefix
+func (ms *memoryStore) keys(prefix string) []string {
+	var keys []string
+	for key := range ms.pairs {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (ms *memoryStore) List(prefix string, q *consul.QueryOptions) (consul.KVPairs, *consul.QueryMeta, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var pairs consul.KVPairs
+	for _, key := range ms.keys(prefix) {
+		pairs = append(pairs, copyPair(ms.pairs[key]))
+	}
+	return pairs, &consul.QueryMeta{LastIndex: ms.index}, nil
+}
+
+func (ms *memoryStore) Keys(prefix, separator string, q *consul.QueryOptions) ([]string, *consul.QueryMeta, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	var keys []string
+	for _, key := range ms.keys(prefix) {
+		// keys are folded at the separator like Consul does
+		if separator != "" {
+			if i := strings.Index(key[len(prefix):], separator); i >= 0 {
+				key = key[:len(prefix)+i+len(separator)]
+			}
+		}
+		if len(keys) == 0 || keys[len(keys)-1] != key {
+			keys = append(keys, key)
+		}
+	}
+	return keys, &consul.QueryMeta{LastIndex: ms.index}, nil
+}
+
+func (ms *memoryStore) Put(p *consul.KVPair, q *consul.WriteOptions) (*consul.WriteMeta, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.put(p)
+	return &consul.WriteMeta{}, nil
+}
+
+// put stores a copy of p, the session holding the key is kept
+func (ms *memoryStore) put(p *consul.KVPair) {
+	ms.write(p.Key, func(existing *consul.KVPair, exists bool) *consul.KVPair {
+		pair := &consul.KVPair{Key: p.Key, Value: append([]byte(nil), p.Value...), Flags: p.Flags}
+		if exists {
+			pair.Session, pair.LockIndex = existing.Session, existing.LockIndex
+		}
+		return pair
+	})
+}
+
+// casMatches reports whether a Check-And-Set with index applies to the pair of key
+func (ms *memoryStore) casMatches(key string, index uint64) bool {
+	pair, exists := ms.pairs[key]
+	if index == 0 {
+		return !exists
+	}
+	return exists && pair.ModifyIndex == index
+}
+
+func (ms *memoryStore) CAS(p *consul.KVPair, q *consul.WriteOptions) (bool, *consul.WriteMeta, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if !ms.casMatches(p.Key, p.ModifyIndex) {
+		return false, &consul.WriteMeta{}, nil
+	}
+	ms.put(p)
+	return true, &consul.WriteMeta{}, nil
+}
+
+func (ms *memoryStore) DeleteCAS(p *consul.KVPair, q *consul.WriteOptions) (bool, *consul.WriteMeta, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if !ms.casMatches(p.Key, p.ModifyIndex) {
+		return false, &consul.WriteMeta{}, nil
+	}
+	ms.write(p.Key, func(*consul.KVPair, bool) *consul.KVPair { return nil })
+	return true, &consul.WriteMeta{}, nil
+}
+
+func (ms *memoryStore) DeleteTree(prefix string, w *consul.WriteOptions) (*consul.WriteMeta, error) {
+	ms.deleteTree(prefix)
+	return &consul.WriteMeta{}, nil
+}
+
+// deleteTree removes all keys starting with prefix
+func (ms *memoryStore) deleteTree(prefix string) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	for _, key := range ms.keys(prefix) {
+		ms.write(key, func(*consul.KVPair, bool) *consul.KVPair { return nil })
+	}
+}
+
+func (ms *memoryStore) newLock(key string, value []byte) (locker, error) {
+	return &memoryLock{store: ms, key: key, value: value}, nil
+}
+
+func (ms *memoryStore) limitsKeys() bool {
+	return false
+}
+
+func (ms *memoryStore) fitsKey(string) bool {
+	return true
+}
+
+func (ms *memoryStore) close() {}
+
+// memoryLock is a lock in a memoryStore, like Consul locks it is held by a session stored with the key
+type memoryLock struct {
+	store *memoryStore
+	key   string
+	value []byte
+
+	mu      sync.Mutex
+	session string
+}
+
+// Lock tries once to acquire the lock, a nil channel is returned if it is held by someone else,
+// otherwise the returned channel is closed once the lock is released
+func (l *memoryLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.session != "" {
+		return nil, consul.ErrLockHeld
+	}
+
+	ms := l.store
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if pair, exists := ms.pairs[l.key]; exists && pair.Session != "" {
+		return nil, nil
+	}
+
+	session := "session-" + strconv.FormatUint(ms.index, 10)
+	ms.write(l.key, func(existing *consul.KVPair, exists bool) *consul.KVPair {
+		pair := &consul.KVPair{Key: l.key, Value: l.value, Flags: consul.LockFlagValue, Session: session, LockIndex: 1}
+		if exists {
+			pair.LockIndex = existing.LockIndex + 1
+		}
+		return pair
+	})
+	l.session = session
+
+	// the lock is held until the session is removed from the key
+	lost := make(chan struct{})
+	go func() {
+		defer close(lost)
+		var index uint64
+		for {
+			pair, meta, err := ms.Get(l.key, &consul.QueryOptions{WaitIndex: index})
+			if err != nil || pair == nil || pair.Session != session {
+				return
+			}
+			index = meta.LastIndex
+		}
+	}()
+
+	return lost, nil
+}
+
+// Unlock releases the lock
+func (l *memoryLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.session == "" {
+		return consul.ErrLockNotHeld
+	}
+
+	ms := l.store
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	session := l.session
+	l.session = ""
+	if pair, exists := ms.pairs[l.key]; exists && pair.Session == session {
+		ms.write(l.key, func(existing *consul.KVPair, _ bool) *consul.KVPair {
+			released := *existing
+			released.Session = ""
+			return &released
+		})
+	}
+	return nil
+}
+
+// Txn applies the KV operations of txn atomically, like Consul it applies none of them if one fails
+func (ms *memoryStore) Txn(txn consul.TxnOps, q *consul.QueryOptions) (bool, *consul.TxnResponse, *consul.QueryMeta, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	resp := &consul.TxnResponse{}
+	fail := func(i int, what string) {
+		resp.Errors = append(resp.Errors, &consul.TxnError{OpIndex: i, What: what})
+	}
+
+	// check all operations first, so a failing one leaves the store untouched
+	for i, op := range txn {
+		if op.KV == nil {
+			fail(i, "only KV operations are supported")
+			continue
+		}
+		switch op.KV.Verb {
+		case consul.KVSet, consul.KVDelete, consul.KVDeleteTree, consul.KVGet, consul.KVGetTree:
+		case consul.KVCAS, consul.KVDeleteCAS, consul.KVCheckIndex:
+			if !ms.casMatches(op.KV.Key, op.KV.Index) {
+				fail(i, "current modify index differs from the given one")
+			}
+		case consul.KVCheckNotExists:
+			if _, exists := ms.pairs[op.KV.Key]; exists {
+				fail(i, "key already exists")
+			}
+		default:
+			fail(i, "unsupported operation "+string(op.KV.Verb))
+		}
+	}
+	if len(resp.Errors) > 0 {
+		return false, resp, &consul.QueryMeta{LastIndex: ms.index}, nil
+	}
+
+	for _, op := range txn {
+		kv := op.KV
+		switch kv.Verb {
+		case consul.KVSet, consul.KVCAS:
+			ms.put(&consul.KVPair{Key: kv.Key, Value: kv.Value, Flags: kv.Flags})
+		case consul.KVDelete, consul.KVDeleteCAS:
+			ms.write(kv.Key, func(*consul.KVPair, bool) *consul.KVPair { return nil })
+		case consul.KVDeleteTree:
+			for _, key := range ms.keys(kv.Key) {
+				ms.write(key, func(*consul.KVPair, bool) *consul.KVPair { return nil })
+			}
+		case consul.KVGetTree:
+			for _, key := range ms.keys(kv.Key) {
+				resp.Results = append(resp.Results, &consul.TxnResult{KV: copyPair(ms.pairs[key])})
+			}
+			continue
+		}
+		if pair, exists := ms.pairs[kv.Key]; exists {
+			result := copyPair(pair)
+			if kv.Verb != consul.KVGet {
+				result.Value = nil
+			}
+			resp.Results = append(resp.Results, &consul.TxnResult{KV: result})
+		}
+	}
+
+	return true, resp, &consul.QueryMeta{LastIndex: ms.index}, nil
+}
@@ -0,0 +1,80 @@
+package storageconsul
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metrics are registered with the default registry Caddy exposes on its metrics endpoint
+var (
+	corruptedValues = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "storage_consul",
+		Name:      "corrupted_values_total",
+		Help:      "Number of loaded values whose checksum didn't match their contents.",
+	})
+
+	decryptFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "storage_consul",
+		Name:      "decrypt_failures_total",
+		Help:      "Number of loaded values that couldn't be decrypted.",
+	})
+
+	overwritesDetected = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "storage_consul",
+		Name:      "overwrites_detected_total",
+		Help:      "Number of stores that overwrote a value another writer changed since it was loaded.",
+	})
+
+	quotaRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "storage_consul",
+		Name:      "quota_rejections_total",
+		Help:      "Number of writes rejected because they would exceed the quota of their prefix by prefix.",
+	}, []string{"prefix"})
+
+	throttledRequests = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "storage_consul",
+		Name:      "throttled_requests_total",
+		Help:      "Number of requests Consul rejected because of its rate limits.",
+	})
+
+	lockWaitSeconds = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: "caddy",
+		Subsystem: "storage_consul",
+		Name:      "lock_wait_seconds",
+		Help:      "Time Lock waited until the lock was acquired.",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300},
+	})
+
+	lockTimeouts = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "storage_consul",
+		Name:      "lock_timeouts_total",
+		Help:      "Number of Lock calls that gave up because their context was done.",
+	})
+
+	largeValues = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "storage_consul",
+		Name:      "large_values_total",
+		Help:      "Number of stored values that approach Consul's maximum value size.",
+	})
+
+	integrityChecks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "storage_consul",
+		Name:      "integrity_checked_values_total",
+		Help:      "Number of values checked by integrity scans.",
+	})
+
+	integrityFailures = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: "caddy",
+		Subsystem: "storage_consul",
+		Name:      "integrity_failures",
+		Help:      "Number of values the last integrity scan failed to decrypt, decompress or verify.",
+	})
+)
@@ -3,17 +3,30 @@ package storageconsul
 import (
 	"os"
 	"strconv"
+	"strings"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/certmagic"
+	"github.com/pteich/errors"
+	"go.uber.org/zap"
+)
+
+// Interface guards
+var (
+	_ caddy.Provisioner      = (*ConsulStorage)(nil)
+	_ caddy.CleanerUpper     = (*ConsulStorage)(nil)
+	_ caddy.Validator        = (*ConsulStorage)(nil)
+	_ caddy.StorageConverter = (*ConsulStorage)(nil)
+	_ caddyfile.Unmarshaler  = (*ConsulStorage)(nil)
+	_ certmagic.Storage      = (*ConsulStorage)(nil)
 )
 
 func init() {
-	caddy.RegisterModule(ConsulStorage{})
+	caddy.RegisterModule(new(ConsulStorage))
 }
 
-func (ConsulStorage) CaddyModule() caddy.ModuleInfo {
+func (*ConsulStorage) CaddyModule() caddy.ModuleInfo {
 	return caddy.ModuleInfo{
 		ID: "caddy.storage.consul",
 		New: func() caddy.Module {
@@ -24,23 +37,249 @@ func (ConsulStorage) CaddyModule() caddy.ModuleInfo {
 
 // Provision is called by Caddy to prepare the module
 func (cs *ConsulStorage) Provision(ctx caddy.Context) error {
-	cs.logger = ctx.Logger(cs).Sugar()
-	cs.logger.Infof("TLS storage is using Consul at %s", cs.Address)
+	logger, err := cs.moduleLogger(ctx.Logger(cs))
+	if err != nil {
+		return err
+	}
+	if cs.Name != "" {
+		logger = logger.With(zap.String("instance", cs.Name))
+	}
+	cs.logger = logger.Sugar()
+
+	// the instance ID is stored with held locks to identify their owner
+	if id, err := caddy.InstanceID(); err == nil {
+		cs.instanceID = id.String()
+	}
 
-	// override default values from ENV
-	if aesKey := os.Getenv(EnvNameAESKey); aesKey != "" {
-		cs.AESKey = []byte(aesKey)
+	if err := cs.configure(); err != nil {
+		return err
 	}
 
-	if prefix := os.Getenv(EnvNamePrefix); prefix != "" {
-		cs.Prefix = prefix
+	// don't connect with a broken config, Caddy validates it only after Provision
+	if err := cs.Validate(); err != nil {
+		return err
 	}
 
-	if valueprefix := os.Getenv(EnvValuePrefix); valueprefix != "" {
-		cs.ValuePrefix = valueprefix
+	if err := cs.connectModule(ctx); err != nil {
+		return err
 	}
 
-	return cs.createConsulClient()
+	if cs.VerifyOnStart {
+		if err := cs.Verify(ctx); err != nil {
+			return err
+		}
+		cs.logger.Info("TLS storage verified")
+	}
+
+	// locks held for issuances of the previous config keep blocking this one until they are handed off
+	cs.adoptLocalLocks()
+
+	// make the storage available to the admin API
+	registerStorage(cs)
+
+	if cs.backupsEnabled() {
+		cs.stopBackups = make(chan struct{})
+		go cs.runBackups(cs.stopBackups)
+		cs.logger.Infof("TLS storage is backed up to %s every %s", cs.Backup.Bucket, cs.backupInterval())
+	}
+
+	if cs.lockGCEnabled() {
+		cs.stopLockGC = make(chan struct{})
+		go cs.runLockGC(cs.stopLockGC)
+	}
+
+	if cs.expiryEnabled() {
+		cs.stopExpiry = make(chan struct{})
+		go cs.runExpiry(cs.stopExpiry)
+	}
+
+	if cs.integrityScanEnabled() {
+		cs.stopScan = make(chan struct{})
+		go cs.runIntegrityScan(cs.stopScan)
+	}
+
+	if cs.serviceEnabled() {
+		if err := cs.registerService(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// connectModule connects to the configured backend, Consul connections of the consul app are reused
+func (cs *ConsulStorage) connectModule(ctx caddy.Context) error {
+	switch cs.Backend {
+	case BackendNomad:
+		cs.logger.Infof("TLS storage is using Nomad Variables at %s", firstNonEmpty(cs.Nomad.Address, cs.getenv("NOMAD_ADDR"), defaultNomadAddress))
+		return cs.Connect()
+	case BackendMemory:
+		cs.logger.Warn("TLS storage is kept in memory and lost on exit")
+		return cs.Connect()
+	}
+
+	// use the client of a named connection of the consul app if one is referenced
+	if cs.Connection != "" {
+		cs.logger.Infof("TLS storage is using Consul connection %s", cs.Connection)
+		for name, t := range cs.Tenants {
+			if t != nil && (t.Token != "" || t.TokenFile != "") {
+				return errors.Errorf("tenant %s has its own token which is not supported with a named connection", name)
+			}
+		}
+		client, err := appClient(ctx, cs.Connection)
+		if err != nil {
+			return err
+		}
+		cs.ConsulClient = client
+		return nil
+	}
+
+	// ENV is resolved again on every config reload
+	cs.logger.Infof("TLS storage is using Consul at %s", firstNonEmpty(cs.Address, cs.consulConfig().Address))
+	return cs.Connect()
+}
+
+// configure applies the overrides from ENV, validates the settings and resolves the prefixes
+func (cs *ConsulStorage) configure() error {
+	// apply values from ENV that aren't configured explicitly
+	cs.applyName()
+	sources := cs.applyEnv()
+	cs.logger.Infof("TLS storage settings: %s", strings.Join(sources, ", "))
+	if cs.TlsInsecure || cs.consulConfig().TLSConfig.InsecureSkipVerify {
+		cs.logger.Warn("TLS certificate verification of Consul is disabled, anyone on the network path can intercept the ACL token and the stored certificates, use tls_server_cert_pin or tls_ca_file instead of tls_insecure")
+	}
+
+	if err := validCompression(cs.Compression); err != nil {
+		return err
+	}
+	cs.addAccountsTenant()
+
+	switch cs.Backend {
+	case "", BackendConsul:
+	case BackendNomad, BackendMemory:
+		if cs.Connection != "" || len(cs.Tenants) > 0 {
+			return errors.Errorf("connections and tenants are not supported with the %s backend", cs.Backend)
+		}
+	default:
+		return errors.Errorf("unsupported backend %s", cs.Backend)
+	}
+
+	// resolve placeholders like {hostname} or {env.CLUSTER} in the prefix
+	prefix, err := resolvePrefix(cs.Prefix)
+	if err != nil {
+		return err
+	}
+	cs.Prefix = prefix
+
+	if cs.FallbackPrefix != "" {
+		fallbackPrefix, err := resolvePrefix(cs.FallbackPrefix)
+		if err != nil {
+			return err
+		}
+		cs.FallbackPrefix = fallbackPrefix
+	}
+
+	// tenants are configured like the storage itself, e.g. with {env.TENANT_TOKEN}
+	for name, t := range cs.Tenants {
+		if t == nil {
+			continue
+		}
+		if err := t.resolvePlaceholders(); err != nil {
+			return errors.Wrapf(err, "tenant %s", name)
+		}
+	}
+
+	return nil
+}
+
+// resolvePrefix replaces the placeholders in prefix, besides Caddy's global placeholders
+// like {env.*} and {system.hostname} the short form {hostname} is supported
+func resolvePrefix(prefix string) (string, error) {
+	resolved, err := resolvePlaceholders(prefix)
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to resolve placeholders in prefix %s", prefix)
+	}
+	return resolved, nil
+}
+
+// resolvePlaceholders replaces the placeholders in value like resolvePrefix does
+func resolvePlaceholders(value string) (string, error) {
+	repl := caddy.NewReplacer()
+	repl.Map(func(key string) (interface{}, bool) {
+		if key == "hostname" {
+			hostname, err := os.Hostname()
+			return hostname, err == nil
+		}
+		return nil, false
+	})
+
+	return repl.ReplaceOrErr(value, true, true)
+}
+
+// Cleanup is called by Caddy when the module is unloaded, e.g. on a config reload.
+// It hands off held locks to the storage of the new config if its connection settings
+// are unchanged and releases them and their sessions otherwise. It gives back the Consul
+// client whose idle connections are closed once no other instance uses it.
+func (cs *ConsulStorage) Cleanup() error {
+	unregisterStorage(cs)
+
+	if cs.stopBackups != nil {
+		close(cs.stopBackups)
+		cs.stopBackups = nil
+	}
+
+	if cs.stopLockGC != nil {
+		close(cs.stopLockGC)
+		cs.stopLockGC = nil
+	}
+
+	if cs.stopExpiry != nil {
+		close(cs.stopExpiry)
+		cs.stopExpiry = nil
+	}
+
+	if cs.stopScan != nil {
+		close(cs.stopScan)
+		cs.stopScan = nil
+	}
+	cs.stopDecryptAlerter()
+
+	// coalesced writes still need the Consul client
+	if cs.writes != nil {
+		cs.writes.wait()
+	}
+
+	cs.handOffLocks()
+	err := cs.releaseLocks()
+	if err != nil {
+		cs.logger.Errorf("unable to release locks on cleanup: %v", err)
+	}
+
+	if cs.serviceRegistered {
+		if deregisterErr := cs.deregisterService(); deregisterErr != nil {
+			cs.logger.Errorf("unable to deregister Consul service on cleanup: %v", deregisterErr)
+			if err == nil {
+				err = deregisterErr
+			}
+		}
+	}
+
+	cs.defaultKV().close()
+
+	if releaseErr := cs.releaseTenants(); releaseErr != nil {
+		cs.logger.Errorf("unable to release tenant Consul clients on cleanup: %v", releaseErr)
+		if err == nil {
+			err = releaseErr
+		}
+	}
+
+	if releaseErr := cs.releaseConsulClient(); releaseErr != nil {
+		cs.logger.Errorf("unable to release Consul client on cleanup: %v", releaseErr)
+		if err == nil {
+			err = releaseErr
+		}
+	}
+
+	return err
 }
 
 func (cs *ConsulStorage) CertMagicStorage() (certmagic.Storage, error) {
@@ -49,14 +288,106 @@ func (cs *ConsulStorage) CertMagicStorage() (certmagic.Storage, error) {
 
 // UnmarshalCaddyfile parses plugin settings from Caddyfile
 // storage consul {
+//     connection   "default"
+//     backend      "consul"
+//     nomad_address "http://127.0.0.1:4646"
+//     nomad_token  "nomad-access-token"
+//     nomad_namespace "default"
+//     nomad_region "global"
+//     backup_endpoint "https://s3.eu-central-1.amazonaws.com"
+//     backup_bucket "caddy-backups"
+//     backup_region "eu-central-1"
+//     backup_access_key "access-key"
+//     backup_secret_key "secret-key"
+//     backup_path "caddytls"
+//     backup_interval "24h"
+//     backup_keep 7
+//     service_name "caddy"
+//     service_id   "caddy-1"
+//     service_tag  "edge"
+//     service_address "10.0.0.10"
+//     service_port 443
+//     service_check_http "http://10.0.0.10:2019/config/"
+//     service_check_interval "10s"
+//     service_check_ttl "30s"
+//     service_deregister_after "1h"
+//     name         "eu"
 //     address      "127.0.0.1:8500"
+//     agent_address "10.0.0.2:8500"
+//     read_address "http://127.0.0.1:8500"
+//     ignore_env   "false"
 //     token        "consul-access-token"
+//     token_file   "/run/secrets/consul-token"
+//     username     "caddy"
+//     password     "basic-auth-password"
 //     timeout      10
 //     prefix       "caddytls"
 //     value_prefix "myprefix"
+//     fallback_prefix "caddytls-old"
+//     account_prefix "caddytls-accounts"
+//     account_token "account-access-token"
 //     aes_key      "consultls-1234567890-caddytls-32"
+//     previous_aes_key "consultls-0987654321-caddytls-32"
+//     reencrypt_on_load "true"
+//     allow_unencrypted_migration "false"
+//     legacy_value_format "false"
+//     require_bound_values "true"
+//     armor_values "true"
+//     value_envelope "json"
 //     tls_enabled  "false"
 //     tls_insecure "true"
+//     tls_ca_file  "/etc/consul/ca.pem"
+//     tls_server_name "consul.internal"
+//     tls_server_cert_pin "sha256/47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+//     spiffe_socket "unix:///run/spire/sockets/agent.sock"
+//     header       "X-Gateway-Key" "{env.GATEWAY_KEY}"
+//     proxy_url    "socks5://proxy.internal:1080"
+//     read_timeout  "500ms"
+//     write_timeout "2s"
+//     list_timeout  "10s"
+//     lock_timeout  "1m"
+//     lock_retry_interval "250ms"
+//     lock_max_retry_interval "5s"
+//     slow_lock_threshold "10s"
+//     consul_max_value_size 524288
+//     value_size_warning 80
+//     max_value_size 262144
+//     quota certificates 10000 104857600
+//     log_level "debug"
+//     log_sample_interval "1s"
+//     log_sample_first 100
+//     log_sample_thereafter 100
+//     lock_session_behavior "delete"
+//     lock_gc_interval "1h"
+//     lock_gc_max_age "24h"
+//     rate_limit    50
+//     rate_burst    100
+//     max_concurrent_requests 32
+//     throttle_retries 3
+//     disable_http2 "false"
+//     max_idle_conns 16
+//     idle_conn_timeout "90s"
+//     keep_alive "30s"
+//     hash_long_keys "true"
+//     max_key_length 512
+//     key_separator "/"
+//     flat_keys "false"
+//     layout "native"
+//     detect_overwrites "true"
+//     compression  "zstd"
+//     dedup_values "true"
+//     dedup_min_size 1024
+//     stat_cache_ttl "2s"
+//     relaxed_ocsp "true"
+//     challenge_token_ttl "1h"
+//     fair_locks   "true"
+//     recursive_delete "true"
+//     disable_locks "false"
+//     verify_on_start "true"
+//     cert_events  "true"
+//     integrity_scan_interval "24h"
+//     integrity_scan_sample 100
+//     decrypt_failure_webhook "https://alerts.example.com/caddy"
 // }
 func (cs *ConsulStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	for d.Next() {
@@ -75,10 +406,167 @@ func (cs *ConsulStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					cs.Address = parsedAddress.JoinHostPort(0)
 				}
 			}
+		case "agent_address":
+			if value != "" {
+				parsedAddress, err := caddy.ParseNetworkAddress(value)
+				if err == nil {
+					cs.AgentAddresses = append(cs.AgentAddresses, parsedAddress.JoinHostPort(0))
+				}
+			}
+		case "read_address":
+			if value != "" {
+				cs.ReadAddress = value
+			}
+		case "ignore_env":
+			if value != "" {
+				ignoreEnv, err := strconv.ParseBool(value)
+				if err == nil {
+					cs.IgnoreEnv = ignoreEnv
+				}
+			}
+		case "connection":
+			if value != "" {
+				cs.Connection = value
+			}
+		case "backend":
+			if value != "" {
+				cs.Backend = value
+			}
+		case "nomad_address":
+			if value != "" {
+				cs.Nomad.Address = value
+			}
+		case "nomad_token":
+			if value != "" {
+				cs.Nomad.Token = value
+			}
+		case "nomad_namespace":
+			if value != "" {
+				cs.Nomad.Namespace = value
+			}
+		case "nomad_region":
+			if value != "" {
+				cs.Nomad.Region = value
+			}
+		case "backup_endpoint":
+			if value != "" {
+				cs.Backup.Endpoint = value
+			}
+		case "backup_bucket":
+			if value != "" {
+				cs.Backup.Bucket = value
+			}
+		case "backup_region":
+			if value != "" {
+				cs.Backup.Region = value
+			}
+		case "backup_access_key":
+			if value != "" {
+				cs.Backup.AccessKey = value
+			}
+		case "backup_secret_key":
+			if value != "" {
+				cs.Backup.SecretKey = value
+			}
+		case "backup_path":
+			if value != "" {
+				cs.Backup.Path = value
+			}
+		case "backup_interval":
+			if value != "" {
+				intervalParse, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("invalid duration for %s: %v", key, err)
+				}
+				cs.Backup.Interval = caddy.Duration(intervalParse)
+			}
+		case "backup_keep":
+			if value != "" {
+				keepParse, err := strconv.Atoi(value)
+				if err != nil {
+					return d.Errf("invalid backup_keep: %v", err)
+				}
+				cs.Backup.Keep = keepParse
+			}
+		case "service_name":
+			if value != "" {
+				cs.Service.Name = value
+			}
+		case "service_id":
+			if value != "" {
+				cs.Service.ID = value
+			}
+		case "service_tag":
+			if value != "" {
+				cs.Service.Tags = append(cs.Service.Tags, value)
+			}
+		case "service_address":
+			if value != "" {
+				cs.Service.Address = value
+			}
+		case "service_port":
+			if value != "" {
+				portParse, err := strconv.Atoi(value)
+				if err != nil {
+					return d.Errf("invalid service_port: %v", err)
+				}
+				cs.Service.Port = portParse
+			}
+		case "service_check_http":
+			if value != "" {
+				cs.Service.CheckHTTP = value
+			}
+		case "service_check_interval", "service_check_ttl", "service_deregister_after":
+			if value != "" {
+				durationParse, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("invalid duration for %s: %v", key, err)
+				}
+				switch key {
+				case "service_check_interval":
+					cs.Service.CheckInterval = caddy.Duration(durationParse)
+				case "service_check_ttl":
+					cs.Service.CheckTTL = caddy.Duration(durationParse)
+				default:
+					cs.Service.DeregisterAfter = caddy.Duration(durationParse)
+				}
+			}
 		case "token":
 			if value != "" {
 				cs.Token = value
 			}
+		case "name":
+			if value != "" {
+				cs.Name = value
+			}
+		case "account_prefix":
+			if value != "" {
+				cs.AccountPrefix = value
+			}
+		case "account_token":
+			if value != "" {
+				cs.AccountToken = value
+			}
+		case "token_file":
+			if value != "" {
+				cs.TokenFile = value
+			}
+		case "token_file_interval":
+			if value != "" {
+				intervalParse, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("invalid duration for %s: %v", key, err)
+				}
+				cs.TokenFileInterval = caddy.Duration(intervalParse)
+			}
+		case "username":
+			if value != "" {
+				cs.Username = value
+			}
+		case "password":
+			if value != "" {
+				cs.Password = value
+			}
 		case "timeout":
 			if value != "" {
 				timeParse, err := strconv.Atoi(value)
@@ -90,6 +578,10 @@ func (cs *ConsulStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			if value != "" {
 				cs.Prefix = value
 			}
+		case "fallback_prefix":
+			if value != "" {
+				cs.FallbackPrefix = value
+			}
 		case "value_prefix":
 			if value != "" {
 				cs.ValuePrefix = value
@@ -98,6 +590,51 @@ func (cs *ConsulStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			if value != "" {
 				cs.AESKey = []byte(value)
 			}
+		case "previous_aes_key":
+			if value != "" {
+				cs.PreviousAESKeys = append(cs.PreviousAESKeys, []byte(value))
+			}
+		case "reencrypt_on_load":
+			if value != "" {
+				reencryptParse, err := strconv.ParseBool(value)
+				if err == nil {
+					cs.ReencryptOnLoad = reencryptParse
+				}
+			}
+		case "allow_unencrypted_migration":
+			if value != "" {
+				allowParse, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Errf("allow_unencrypted_migration must be a boolean: %v", err)
+				}
+				cs.AllowUnencryptedMigration = allowParse
+			}
+		case "legacy_value_format":
+			if value != "" {
+				legacyParse, err := strconv.ParseBool(value)
+				if err == nil {
+					cs.LegacyValueFormat = legacyParse
+				}
+			}
+		case "require_bound_values":
+			if value != "" {
+				requireParse, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Errf("require_bound_values must be a boolean: %v", err)
+				}
+				cs.RequireBoundValues = requireParse
+			}
+		case "value_envelope":
+			if value != "" {
+				cs.ValueEnvelope = value
+			}
+		case "armor_values":
+			if value != "" {
+				armorParse, err := strconv.ParseBool(value)
+				if err == nil {
+					cs.ArmorValues = armorParse
+				}
+			}
 		case "tls_enabled":
 			if value != "" {
 				tlsParse, err := strconv.ParseBool(value)
@@ -112,6 +649,348 @@ func (cs *ConsulStorage) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 					cs.TlsInsecure = tlsInsecureParse
 				}
 			}
+		case "tls_ca_file":
+			if value != "" {
+				cs.TlsCAFile = value
+			}
+		case "tls_ca_pem":
+			if value != "" {
+				cs.TlsCAPem = value
+			}
+		case "proxy_url":
+			if value != "" {
+				cs.ProxyURL = value
+			}
+		case "header":
+			if value != "" && d.NextArg() {
+				if cs.Headers == nil {
+					cs.Headers = make(map[string]string)
+				}
+				cs.Headers[value] = d.Val()
+			}
+		case "spiffe_socket":
+			if value != "" {
+				cs.SpiffeSocket = value
+			}
+		case "tls_server_cert_pin":
+			if value != "" {
+				cs.TlsServerCertPin = value
+			}
+		case "tls_server_name":
+			if value != "" {
+				cs.TlsServerName = value
+			}
+		case "read_timeout", "write_timeout", "list_timeout", "lock_timeout":
+			if value != "" {
+				timeoutParse, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("invalid duration for %s: %v", key, err)
+				}
+				switch key {
+				case "read_timeout":
+					cs.ReadTimeout = caddy.Duration(timeoutParse)
+				case "write_timeout":
+					cs.WriteTimeout = caddy.Duration(timeoutParse)
+				case "list_timeout":
+					cs.ListTimeout = caddy.Duration(timeoutParse)
+				case "lock_timeout":
+					cs.LockTimeout = caddy.Duration(timeoutParse)
+				}
+			}
+		case "lock_retry_interval", "lock_max_retry_interval":
+			if value != "" {
+				intervalParse, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("invalid duration for %s: %v", key, err)
+				}
+				if key == "lock_retry_interval" {
+					cs.LockRetryInterval = caddy.Duration(intervalParse)
+				} else {
+					cs.LockMaxRetryInterval = caddy.Duration(intervalParse)
+				}
+			}
+		case "lock_session_behavior":
+			if value != "" {
+				cs.LockSessionBehavior = value
+			}
+		case "lock_gc_interval", "lock_gc_max_age":
+			if value != "" {
+				durationParse, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("invalid duration for %s: %v", key, err)
+				}
+				if key == "lock_gc_interval" {
+					cs.LockGCInterval = caddy.Duration(durationParse)
+				} else {
+					cs.LockGCMaxAge = caddy.Duration(durationParse)
+				}
+			}
+		case "slow_lock_threshold":
+			if value != "" {
+				thresholdParse, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("invalid duration for %s: %v", key, err)
+				}
+				cs.SlowLockThreshold = caddy.Duration(thresholdParse)
+			}
+		case "max_value_size":
+			if value != "" {
+				sizeParse, err := strconv.Atoi(value)
+				if err != nil {
+					return d.Errf("invalid max_value_size: %v", err)
+				}
+				cs.MaxValueSize = sizeParse
+			}
+		case "quota":
+			if value != "" {
+				var maxKeys, maxBytes string
+				if !d.Args(&maxKeys, &maxBytes) {
+					return d.ArgErr()
+				}
+				keysParse, err := strconv.Atoi(maxKeys)
+				if err != nil {
+					return d.Errf("invalid max keys of quota %s: %v", value, err)
+				}
+				bytesParse, err := strconv.ParseInt(maxBytes, 10, 64)
+				if err != nil {
+					return d.Errf("invalid max bytes of quota %s: %v", value, err)
+				}
+				if cs.Quotas == nil {
+					cs.Quotas = make(map[string]*Quota)
+				}
+				cs.Quotas[value] = &Quota{MaxKeys: keysParse, MaxBytes: bytesParse}
+			}
+		case "consul_max_value_size", "value_size_warning":
+			if value != "" {
+				sizeParse, err := strconv.Atoi(value)
+				if err != nil {
+					return d.Errf("invalid %s: %v", key, err)
+				}
+				if key == "consul_max_value_size" {
+					cs.ConsulMaxValueSize = sizeParse
+				} else {
+					cs.ValueSizeWarning = sizeParse
+				}
+			}
+		case "log_level":
+			if value != "" {
+				cs.LogLevel = value
+			}
+		case "log_sample_interval":
+			if value != "" {
+				intervalParse, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("invalid duration for %s: %v", key, err)
+				}
+				cs.LogSampleInterval = caddy.Duration(intervalParse)
+			}
+		case "log_sample_first", "log_sample_thereafter":
+			if value != "" {
+				sampleParse, err := strconv.Atoi(value)
+				if err != nil {
+					return d.Errf("invalid %s: %v", key, err)
+				}
+				if key == "log_sample_first" {
+					cs.LogSampleFirst = sampleParse
+				} else {
+					cs.LogSampleThereafter = sampleParse
+				}
+			}
+		case "rate_limit":
+			if value != "" {
+				rateParse, err := strconv.ParseFloat(value, 64)
+				if err != nil {
+					return d.Errf("invalid rate_limit: %v", err)
+				}
+				cs.RateLimit = rateParse
+			}
+		case "rate_burst":
+			if value != "" {
+				burstParse, err := strconv.Atoi(value)
+				if err != nil {
+					return d.Errf("invalid rate_burst: %v", err)
+				}
+				cs.RateBurst = burstParse
+			}
+		case "max_concurrent_requests":
+			if value != "" {
+				maxParse, err := strconv.Atoi(value)
+				if err != nil {
+					return d.Errf("invalid max_concurrent_requests: %v", err)
+				}
+				cs.MaxConcurrentRequests = maxParse
+			}
+		case "throttle_retries":
+			if value != "" {
+				retriesParse, err := strconv.Atoi(value)
+				if err != nil {
+					return d.Errf("invalid throttle_retries: %v", err)
+				}
+				cs.ThrottleRetries = retriesParse
+			}
+		case "disable_http2":
+			if value != "" {
+				http2Parse, err := strconv.ParseBool(value)
+				if err == nil {
+					cs.DisableHTTP2 = http2Parse
+				}
+			}
+		case "max_idle_conns":
+			if value != "" {
+				idleParse, err := strconv.Atoi(value)
+				if err == nil {
+					cs.MaxIdleConns = idleParse
+				}
+			}
+		case "idle_conn_timeout", "keep_alive":
+			if value != "" {
+				durationParse, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("invalid duration for %s: %v", key, err)
+				}
+				if key == "idle_conn_timeout" {
+					cs.IdleConnTimeout = caddy.Duration(durationParse)
+				} else {
+					cs.KeepAlive = caddy.Duration(durationParse)
+				}
+			}
+		case "hash_long_keys":
+			if value != "" {
+				hashParse, err := strconv.ParseBool(value)
+				if err == nil {
+					cs.HashLongKeys = hashParse
+				}
+			}
+		case "key_separator":
+			if value != "" {
+				cs.KeySeparator = value
+			}
+		case "detect_overwrites":
+			if value != "" {
+				detectParse, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Errf("invalid detect_overwrites: %v", err)
+				}
+				cs.DetectOverwrites = detectParse
+			}
+		case "layout":
+			if value != "" {
+				cs.Layout = value
+			}
+		case "flat_keys":
+			if value != "" {
+				flatParse, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Errf("invalid flat_keys: %v", err)
+				}
+				cs.FlatKeys = flatParse
+			}
+		case "max_key_length":
+			if value != "" {
+				lengthParse, err := strconv.Atoi(value)
+				if err != nil {
+					return d.Errf("invalid max_key_length: %v", err)
+				}
+				cs.MaxKeyLength = lengthParse
+			}
+		case "compression":
+			if value != "" {
+				cs.Compression = value
+			}
+		case "dedup_values":
+			if value != "" {
+				dedupParse, err := strconv.ParseBool(value)
+				if err != nil {
+					return d.Errf("invalid dedup_values: %v", err)
+				}
+				cs.DedupValues = dedupParse
+			}
+		case "dedup_min_size":
+			if value != "" {
+				minSizeParse, err := strconv.Atoi(value)
+				if err != nil {
+					return d.Errf("invalid dedup_min_size: %v", err)
+				}
+				cs.DedupMinSize = minSizeParse
+			}
+		case "stat_cache_ttl":
+			if value != "" {
+				ttlParse, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("invalid duration for %s: %v", key, err)
+				}
+				cs.StatCacheTTL = caddy.Duration(ttlParse)
+			}
+		case "challenge_token_ttl":
+			if value != "" {
+				ttlParse, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("invalid duration for %s: %v", key, err)
+				}
+				cs.ChallengeTokenTTL = caddy.Duration(ttlParse)
+			}
+		case "relaxed_ocsp":
+			if value != "" {
+				relaxedParse, err := strconv.ParseBool(value)
+				if err == nil {
+					cs.RelaxedOCSP = relaxedParse
+				}
+			}
+		case "recursive_delete":
+			if value != "" {
+				recursiveParse, err := strconv.ParseBool(value)
+				if err == nil {
+					cs.RecursiveDelete = recursiveParse
+				}
+			}
+		case "fair_locks":
+			if value != "" {
+				fairLocksParse, err := strconv.ParseBool(value)
+				if err == nil {
+					cs.FairLocks = fairLocksParse
+				}
+			}
+		case "disable_locks":
+			if value != "" {
+				disableLocksParse, err := strconv.ParseBool(value)
+				if err == nil {
+					cs.DisableLocks = disableLocksParse
+				}
+			}
+		case "integrity_scan_interval":
+			if value != "" {
+				intervalParse, err := caddy.ParseDuration(value)
+				if err != nil {
+					return d.Errf("invalid duration for %s: %v", key, err)
+				}
+				cs.IntegrityScanInterval = caddy.Duration(intervalParse)
+			}
+		case "integrity_scan_sample":
+			if value != "" {
+				sampleParse, err := strconv.Atoi(value)
+				if err != nil {
+					return d.Errf("invalid integrity_scan_sample: %v", err)
+				}
+				cs.IntegrityScanSample = sampleParse
+			}
+		case "decrypt_failure_webhook":
+			if value != "" {
+				cs.DecryptFailureWebhook = value
+			}
+		case "cert_events":
+			if value != "" {
+				certEvents, err := strconv.ParseBool(value)
+				if err == nil {
+					cs.CertEvents = certEvents
+				}
+			}
+		case "verify_on_start":
+			if value != "" {
+				verifyParse, err := strconv.ParseBool(value)
+				if err == nil {
+					cs.VerifyOnStart = verifyParse
+				}
+			}
 		}
 	}
 	return nil
@@ -0,0 +1,64 @@
+package storageconsul
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_UnmarshalCaddyfileTimeouts(t *testing.T) {
+	cs := New()
+
+	d := caddyfile.NewTestDispenser(`consul {
+		read_timeout  500ms
+		write_timeout 2s
+		list_timeout  10s
+		lock_timeout  1m
+	}`)
+
+	err := cs.UnmarshalCaddyfile(d)
+	assert.NoError(t, err)
+
+	assert.Equal(t, caddy.Duration(500*time.Millisecond), cs.ReadTimeout)
+	assert.Equal(t, caddy.Duration(2*time.Second), cs.WriteTimeout)
+	assert.Equal(t, caddy.Duration(10*time.Second), cs.ListTimeout)
+	assert.Equal(t, caddy.Duration(time.Minute), cs.LockTimeout)
+}
+
+func TestConsulStorage_UnmarshalCaddyfileInvalidTimeout(t *testing.T) {
+	cs := New()
+
+	d := caddyfile.NewTestDispenser(`consul {
+		read_timeout soon
+	}`)
+
+	err := cs.UnmarshalCaddyfile(d)
+	assert.Error(t, err)
+}
+
+func TestResolvePrefix(t *testing.T) {
+	os.Setenv("CADDY_TLSCONSUL_TEST_CLUSTER", "blue")
+	defer os.Unsetenv("CADDY_TLSCONSUL_TEST_CLUSTER")
+
+	hostname, err := os.Hostname()
+	require.NoError(t, err)
+
+	prefix, err := resolvePrefix("caddytls/{env.CADDY_TLSCONSUL_TEST_CLUSTER}/{hostname}")
+	assert.NoError(t, err)
+	assert.Equal(t, "caddytls/blue/"+hostname, prefix)
+
+	prefix, err = resolvePrefix("caddytls")
+	assert.NoError(t, err)
+	assert.Equal(t, "caddytls", prefix)
+
+	_, err = resolvePrefix("caddytls/{env.CADDY_TLSCONSUL_TEST_UNSET}")
+	assert.Error(t, err)
+
+	_, err = resolvePrefix("caddytls/{unknown}")
+	assert.Error(t, err)
+}
@@ -0,0 +1,505 @@
+package storageconsul
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+const (
+	// defaultNomadAddress is the address of the local Nomad agent
+	defaultNomadAddress = "http://127.0.0.1:4646"
+
+	// maxNomadPathLength is the length of variable paths above which Nomad rejects them,
+	// longer keys are stored under their hash
+	maxNomadPathLength = 128
+
+	// nomadLockTTL is the TTL of Nomad variable locks, they are renewed at half of it
+	nomadLockTTL = 15 * time.Second
+)
+
+// NomadConfig describes how to reach Nomad's Variables API if the nomad backend is used,
+// empty fields fall back to NOMAD_ADDR, NOMAD_TOKEN, NOMAD_NAMESPACE and NOMAD_REGION
+type NomadConfig struct {
+	Address   string `json:"address"`
+	Token     string `json:"token"`
+	Namespace string `json:"namespace"`
+	Region    string `json:"region"`
+}
+
+// nomadStore implements kvBackend on top of Nomad Variables, the encrypted value and the flags of a key
+// are kept as items of a variable whose path is the escaped Consul key
+type nomadStore struct {
+	address   string
+	token     string
+	namespace string
+	region    string
+	client    *http.Client
+
+	// writeTimeout limits renewing and releasing locks like the WriteTimeout of the storage
+	writeTimeout caddy.Duration
+}
+
+// nomadVariable is a variable as sent to and returned by Nomad's Variables API
+type nomadVariable struct {
+	Namespace   string             `json:",omitempty"`
+	Path        string             `json:",omitempty"`
+	Items       map[string]string  `json:",omitempty"`
+	CreateIndex uint64             `json:",omitempty"`
+	ModifyIndex uint64             `json:",omitempty"`
+	Lock        *nomadVariableLock `json:",omitempty"`
+}
+
+// nomadVariableLock is the lock held on a variable
+type nomadVariableLock struct {
+	ID        string `json:",omitempty"`
+	TTL       string `json:",omitempty"`
+	LockDelay string `json:",omitempty"`
+}
+
+// connectNomad creates the Nomad backend using the Nomad settings and the HTTP settings of the connection
+func (cs *ConsulStorage) connectNomad() error {
+	store, err := newNomadStore(cs.Nomad, cs.ConnectionConfig)
+	if err != nil {
+		return err
+	}
+	store.writeTimeout = cs.WriteTimeout
+
+	cs.backend = store
+	return nil
+}
+
+// newNomadStore connects to Nomad with cfg, the TLS and transport settings of cc are applied to the connection
+func newNomadStore(cfg NomadConfig, cc ConnectionConfig) (*nomadStore, error) {
+	ns := &nomadStore{
+		address:   firstNonEmpty(cfg.Address, cc.getenv("NOMAD_ADDR"), defaultNomadAddress),
+		token:     firstNonEmpty(cfg.Token, cc.getenv("NOMAD_TOKEN")),
+		namespace: firstNonEmpty(cfg.Namespace, cc.getenv("NOMAD_NAMESPACE")),
+		region:    firstNonEmpty(cfg.Region, cc.getenv("NOMAD_REGION")),
+	}
+	ns.address = strings.TrimSuffix(ns.address, "/")
+	if !strings.Contains(ns.address, "://") {
+		ns.address = "http://" + ns.address
+	}
+
+	// the Consul API client builds the transport and TLS configuration for us
+	consulCfg := consul.DefaultConfig()
+	consulCfg.TLSConfig = consul.TLSConfig{
+		Address:            cc.TlsServerName,
+		CAFile:             cc.TlsCAFile,
+		CAPem:              []byte(cc.TlsCAPem),
+		InsecureSkipVerify: cc.TlsInsecure,
+	}
+	cc.tuneTransport(consulCfg.Transport)
+
+	httpClient, err := cc.httpClient(consulCfg)
+	if err != nil {
+		return nil, err
+	}
+	httpClient.Transport = cc.wrapTransport(httpClient.Transport)
+	if httpClient.Transport, err = cc.withHeaders(httpClient.Transport); err != nil {
+		return nil, err
+	}
+	ns.client = httpClient
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cc.Timeout)*time.Second)
+	defer cancel()
+	if _, _, err := ns.do(ctx, http.MethodGet, "status/leader", nil, nil, nil); err != nil {
+		return nil, errors.Wrap(err, "unable to ping Nomad")
+	}
+
+	return ns, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// do sends a request to the Nomad API and decodes the response into out, a not found or conflict
+// response is returned as status without an error
+func (ns *nomadStore) do(ctx context.Context, method, endpoint string, query url.Values, in, out interface{}) (int, http.Header, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	if ns.namespace != "" {
+		query.Set("namespace", ns.namespace)
+	}
+	if ns.region != "" {
+		query.Set("region", ns.region)
+	}
+
+	var body bytes.Buffer
+	if in != nil {
+		if err := json.NewEncoder(&body).Encode(in); err != nil {
+			return 0, nil, errors.Wrap(err, "unable to marshal")
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, ns.address+"/v1/"+endpoint+"?"+query.Encode(), &body)
+	if err != nil {
+		return 0, nil, err
+	}
+	if ns.token != "" {
+		req.Header.Set("X-Nomad-Token", ns.token)
+	}
+
+	resp, err := ns.client.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusConflict:
+		return resp.StatusCode, resp.Header, nil
+	case resp.StatusCode >= 300:
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header, errors.Errorf("unexpected response code: %d (%s)", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, resp.Header, errors.Wrap(err, "unable to unmarshal result")
+		}
+	}
+	return resp.StatusCode, resp.Header, nil
+}
+
+// nomadIndex returns the Raft index Nomad answered a request at
+func nomadIndex(header http.Header) uint64 {
+	index, _ := strconv.ParseUint(header.Get("X-Nomad-Index"), 10, 64)
+	return index
+}
+
+// nomadPath escapes a Consul key to the characters Nomad allows in variable paths,
+// all others are written as ~ followed by their hex code
+func nomadPath(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c == '/' || c == '-' || c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') {
+			b.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&b, "~%02x", c)
+	}
+	return b.String()
+}
+
+// keyFromNomadPath reverses nomadPath
+func keyFromNomadPath(variablePath string) string {
+	var b strings.Builder
+	for i := 0; i < len(variablePath); i++ {
+		if variablePath[i] == '~' && i+2 < len(variablePath) {
+			if c, err := strconv.ParseUint(variablePath[i+1:i+3], 16, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 2
+				continue
+			}
+		}
+		b.WriteByte(variablePath[i])
+	}
+	return b.String()
+}
+
+// pair converts a variable to the KV pair of key
+func (ns *nomadStore) pair(key string, v *nomadVariable) (*consul.KVPair, error) {
+	value, err := base64.StdEncoding.DecodeString(v.Items["value"])
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid value in Nomad variable %s", v.Path)
+	}
+	flags, _ := strconv.ParseUint(v.Items["flags"], 10, 64)
+
+	pair := &consul.KVPair{
+		Key:         key,
+		Value:       value,
+		Flags:       flags,
+		CreateIndex: v.CreateIndex,
+		ModifyIndex: v.ModifyIndex,
+	}
+	if v.Lock != nil {
+		pair.Session = v.Lock.ID
+	}
+	return pair, nil
+}
+
+// variable converts a KV pair to a variable
+func (ns *nomadStore) variable(p *consul.KVPair) *nomadVariable {
+	items := map[string]string{"value": base64.StdEncoding.EncodeToString(p.Value)}
+	if p.Flags != 0 {
+		items["flags"] = strconv.FormatUint(p.Flags, 10)
+	}
+	return &nomadVariable{Namespace: ns.namespace, Path: nomadPath(p.Key), Items: items}
+}
+
+func (ns *nomadStore) Get(key string, q *consul.QueryOptions) (*consul.KVPair, *consul.QueryMeta, error) {
+	query := url.Values{}
+	if q != nil && q.WaitIndex > 0 {
+		query.Set("index", strconv.FormatUint(q.WaitIndex, 10))
+		if q.WaitTime > 0 {
+			query.Set("wait", fmt.Sprintf("%dms", q.WaitTime.Milliseconds()))
+		}
+	}
+
+	v := &nomadVariable{}
+	status, header, err := ns.do(q.Context(), http.MethodGet, "var/"+nomadPath(key), query, nil, v)
+	meta := &consul.QueryMeta{LastIndex: nomadIndex(header)}
+	if err != nil || status == http.StatusNotFound {
+		return nil, meta, err
+	}
+
+	pair, err := ns.pair(key, v)
+	return pair, meta, err
+}
+
+// listPaths returns the paths of all variables starting with prefix, Nomad pages large results
+func (ns *nomadStore) listPaths(ctx context.Context, prefix string) ([]string, uint64, error) {
+	var paths []string
+	query := url.Values{"prefix": {nomadPath(prefix)}}
+	for {
+		var page []*nomadVariable
+		_, header, err := ns.do(ctx, http.MethodGet, "vars", query, nil, &page)
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, v := range page {
+			paths = append(paths, v.Path)
+		}
+
+		nextToken := header.Get("X-Nomad-NextToken")
+		if nextToken == "" {
+			return paths, nomadIndex(header), nil
+		}
+		query.Set("next_token", nextToken)
+	}
+}
+
+// List reads all variables starting with prefix, Nomad only lists metadata so each value is read separately
+func (ns *nomadStore) List(prefix string, q *consul.QueryOptions) (consul.KVPairs, *consul.QueryMeta, error) {
+	paths, index, err := ns.listPaths(q.Context(), prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	opts := (&consul.QueryOptions{}).WithContext(q.Context())
+	var pairs consul.KVPairs
+	for _, p := range paths {
+		pair, _, err := ns.Get(keyFromNomadPath(p), opts)
+		if err != nil {
+			return nil, nil, err
+		}
+		// deleted in the meantime
+		if pair != nil {
+			pairs = append(pairs, pair)
+		}
+	}
+	return pairs, &consul.QueryMeta{LastIndex: index}, nil
+}
+
+func (ns *nomadStore) Keys(prefix, separator string, q *consul.QueryOptions) ([]string, *consul.QueryMeta, error) {
+	paths, index, err := ns.listPaths(q.Context(), prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	found := make(map[string]bool)
+	for _, p := range paths {
+		key := keyFromNomadPath(p)
+		if separator != "" {
+			if i := strings.Index(key[len(prefix):], separator); i >= 0 {
+				key = key[:len(prefix)+i+len(separator)]
+			}
+		}
+		found[key] = true
+	}
+
+	keys := make([]string, 0, len(found))
+	for key := range found {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys, &consul.QueryMeta{LastIndex: index}, nil
+}
+
+func (ns *nomadStore) Put(p *consul.KVPair, q *consul.WriteOptions) (*consul.WriteMeta, error) {
+	_, _, err := ns.do(q.Context(), http.MethodPut, "var/"+nomadPath(p.Key), nil, ns.variable(p), nil)
+	return &consul.WriteMeta{}, err
+}
+
+func (ns *nomadStore) CAS(p *consul.KVPair, q *consul.WriteOptions) (bool, *consul.WriteMeta, error) {
+	query := url.Values{"cas": {strconv.FormatUint(p.ModifyIndex, 10)}}
+	status, _, err := ns.do(q.Context(), http.MethodPut, "var/"+nomadPath(p.Key), query, ns.variable(p), nil)
+	return err == nil && status != http.StatusConflict, &consul.WriteMeta{}, err
+}
+
+func (ns *nomadStore) DeleteCAS(p *consul.KVPair, q *consul.WriteOptions) (bool, *consul.WriteMeta, error) {
+	query := url.Values{"cas": {strconv.FormatUint(p.ModifyIndex, 10)}}
+	status, _, err := ns.do(q.Context(), http.MethodDelete, "var/"+nomadPath(p.Key), query, nil, nil)
+	return err == nil && status != http.StatusConflict, &consul.WriteMeta{}, err
+}
+
+// DeleteTree deletes all variables starting with prefix one by one, Nomad can't delete them at once
+func (ns *nomadStore) DeleteTree(prefix string, w *consul.WriteOptions) (*consul.WriteMeta, error) {
+	paths, _, err := ns.listPaths(w.Context(), prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		if _, _, err := ns.do(w.Context(), http.MethodDelete, "var/"+p, nil, nil, nil); err != nil {
+			return nil, err
+		}
+	}
+	return &consul.WriteMeta{}, nil
+}
+
+// close closes the idle connections to Nomad
+func (ns *nomadStore) close() {
+	ns.client.CloseIdleConnections()
+}
+
+// nomadLock is a lock on a Nomad variable, it mirrors the behavior of Consul locks
+type nomadLock struct {
+	store *nomadStore
+	path  string
+	key   string
+	value []byte
+
+	mu        sync.Mutex
+	id        string
+	stopRenew chan struct{}
+}
+
+// newLock returns the lock of the variable for the Consul key key
+func (ns *nomadStore) newLock(key string, value []byte) (locker, error) {
+	return &nomadLock{store: ns, path: nomadPath(key), key: key, value: value}, nil
+}
+
+// limitsKeys reports true as Nomad limits the length of variable paths
+func (ns *nomadStore) limitsKeys() bool {
+	return true
+}
+
+// fitsKey reports whether the variable path of key is short enough for Nomad
+func (ns *nomadStore) fitsKey(key string) bool {
+	return len(nomadPath(key)) <= maxNomadPathLength
+}
+
+// Lock tries once to acquire the lock, a nil channel is returned if it is held by someone else,
+// otherwise the returned channel is closed once the lock is lost
+func (l *nomadLock) Lock(stopCh <-chan struct{}) (<-chan struct{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.id != "" {
+		return nil, consul.ErrLockHeld
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopCh:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	v := l.store.variable(&consul.KVPair{Key: l.key, Value: l.value, Flags: consul.LockFlagValue})
+	v.Lock = &nomadVariableLock{TTL: nomadLockTTL.String(), LockDelay: nomadLockTTL.String()}
+	out := &nomadVariable{}
+	status, _, err := l.store.do(ctx, http.MethodPut, "var/"+l.path, url.Values{"lock-acquire": {""}}, v, out)
+	if err != nil {
+		select {
+		case <-stopCh:
+			return nil, nil
+		default:
+		}
+		return nil, errors.Wrap(err, "failed to acquire lock")
+	}
+	if status == http.StatusConflict {
+		return nil, nil
+	}
+	if out.Lock == nil || out.Lock.ID == "" {
+		return nil, errors.New("failed to acquire lock: no lock ID returned")
+	}
+
+	l.id = out.Lock.ID
+	l.stopRenew = make(chan struct{})
+	lost := make(chan struct{})
+	go l.renew(l.id, l.stopRenew, lost)
+
+	return lost, nil
+}
+
+// renew renews the lock with id until stop is closed, lost is closed once the lock can't be renewed
+// anymore or the lock is released
+func (l *nomadLock) renew(id string, stop <-chan struct{}, lost chan<- struct{}) {
+	defer close(lost)
+
+	renewed := time.Now()
+	interval := nomadLockTTL / 2
+	for {
+		select {
+		case <-stop:
+			return
+		case <-time.After(interval):
+		}
+
+		v := &nomadVariable{Namespace: l.store.namespace, Path: l.path, Lock: &nomadVariableLock{ID: id}}
+		ctx, cancel := withTimeout(context.Background(), l.store.writeTimeout)
+		status, _, err := l.store.do(ctx, http.MethodPut, "var/"+l.path, url.Values{"lock-renew": {""}}, v, nil)
+		cancel()
+		switch {
+		case err == nil && status != http.StatusConflict && status != http.StatusNotFound:
+			renewed, interval = time.Now(), nomadLockTTL/2
+		case err == nil || time.Since(renewed) > nomadLockTTL:
+			// the lock expired or was taken over
+			return
+		default:
+			// ride out short outages, the lock is kept until its TTL is over
+			interval = DefaultLockRetryInterval
+		}
+	}
+}
+
+// Unlock releases the lock
+func (l *nomadLock) Unlock() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.id == "" {
+		return consul.ErrLockNotHeld
+	}
+
+	id := l.id
+	l.id = ""
+	close(l.stopRenew)
+
+	ctx, cancel := withTimeout(context.Background(), l.store.writeTimeout)
+	defer cancel()
+	v := &nomadVariable{Namespace: l.store.namespace, Path: l.path, Lock: &nomadVariableLock{ID: id}}
+	if _, _, err := l.store.do(ctx, http.MethodPut, "var/"+l.path, url.Values{"lock-release": {""}}, v, nil); err != nil {
+		return errors.Wrap(err, "failed to release lock")
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package storageconsul
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// validNomadPath are the variable paths Nomad accepts
+var validNomadPath = regexp.MustCompile("^[a-zA-Z0-9-_~/]{1,128}$")
+
+// fakeNomad is a minimal in-memory implementation of Nomad's Variables API for unit tests
+type fakeNomad struct {
+	*httptest.Server
+	mu    sync.Mutex
+	vars  map[string]*nomadVariable
+	index uint64
+}
+
+func newFakeNomad(t *testing.T) *fakeNomad {
+	fn := &fakeNomad{vars: make(map[string]*nomadVariable), index: 1}
+	fn.Server = httptest.NewServer(http.HandlerFunc(fn.handle))
+	t.Cleanup(fn.Close)
+	return fn
+}
+
+func (fn *fakeNomad) handle(w http.ResponseWriter, r *http.Request) {
+	fn.mu.Lock()
+	defer fn.mu.Unlock()
+
+	w.Header().Set("X-Nomad-Index", strconv.FormatUint(fn.index, 10))
+	query := r.URL.Query()
+
+	switch {
+	case r.URL.Path == "/v1/status/leader":
+		w.Write([]byte(`"127.0.0.1:4647"`))
+
+	case r.URL.Path == "/v1/vars":
+		// pages of two variables to cover the next token
+		var paths []string
+		for p := range fn.vars {
+			if strings.HasPrefix(p, query.Get("prefix")) && p > query.Get("next_token") {
+				paths = append(paths, p)
+			}
+		}
+		sort.Strings(paths)
+		if len(paths) > 2 {
+			w.Header().Set("X-Nomad-NextToken", paths[1])
+			paths = paths[:2]
+		}
+		page := []*nomadVariable{}
+		for _, p := range paths {
+			page = append(page, &nomadVariable{Path: p, ModifyIndex: fn.vars[p].ModifyIndex})
+		}
+		json.NewEncoder(w).Encode(page)
+
+	case strings.HasPrefix(r.URL.Path, "/v1/var/"):
+		p := strings.TrimPrefix(r.URL.Path, "/v1/var/")
+		if !validNomadPath.MatchString(p) {
+			http.Error(w, "invalid path", http.StatusBadRequest)
+			return
+		}
+		fn.handleVar(w, r, p)
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (fn *fakeNomad) handleVar(w http.ResponseWriter, r *http.Request, p string) {
+	query := r.URL.Query()
+	existing, exists := fn.vars[p]
+
+	if cas := query.Get("cas"); cas != "" {
+		index, _ := strconv.ParseUint(cas, 10, 64)
+		if (index == 0 && exists) || (index != 0 && (!exists || existing.ModifyIndex != index)) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !exists {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(existing)
+
+	case http.MethodPut:
+		v := &nomadVariable{}
+		json.NewDecoder(r.Body).Decode(v)
+
+		_, acquire := query["lock-acquire"]
+		_, renew := query["lock-renew"]
+		_, release := query["lock-release"]
+		switch {
+		case acquire:
+			if exists && existing.Lock != nil {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			fn.index++
+			v.Lock.ID = "lock-" + strconv.FormatUint(fn.index, 10)
+		case renew, release:
+			if !exists || existing.Lock == nil || existing.Lock.ID != v.Lock.ID {
+				w.WriteHeader(http.StatusConflict)
+				return
+			}
+			if renew {
+				return
+			}
+			v.Lock = nil
+		}
+
+		fn.index++
+		v.Path, v.ModifyIndex, v.CreateIndex = p, fn.index, fn.index
+		if exists {
+			v.CreateIndex = existing.CreateIndex
+			if v.Items == nil {
+				v.Items = existing.Items
+			}
+		}
+		fn.vars[p] = v
+		json.NewEncoder(w).Encode(v)
+
+	case http.MethodDelete:
+		fn.index++
+		delete(fn.vars, p)
+	}
+}
+
+// newFakeNomadStorage returns a ConsulStorage using the Nomad backend of a fresh fakeNomad
+func newFakeNomadStorage(t *testing.T, fn *fakeNomad) *ConsulStorage {
+	cs, err := NewWithOptions(WithNomad(NomadConfig{Address: fn.URL}))
+	require.NoError(t, err)
+	t.Cleanup(func() { cs.Cleanup() })
+	return cs
+}
+
+func TestNomadPath(t *testing.T) {
+	key := "caddytls/certificates/acme-v02.api.letsencrypt.org-directory/*.example.com/~key"
+	assert.Regexp(t, validNomadPath, nomadPath(key))
+	assert.Equal(t, key, keyFromNomadPath(nomadPath(key)))
+}
+
+func TestConsulStorage_Nomad(t *testing.T) {
+	fn := newFakeNomad(t)
+	cs := newFakeNomadStorage(t, fn)
+
+	long := "certificates/acme-v02.api.letsencrypt.org-directory/" + strings.Repeat("sub.", 20) + "example.com/example.com.crt"
+	for _, key := range []string{"certificates/a.example.com", "certificates/b.example.com", "certificates/c.example.com", long} {
+		require.NoError(t, cs.Store(key, []byte("value of "+key)))
+	}
+
+	value, err := cs.Load("certificates/a.example.com")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value of certificates/a.example.com"), value)
+
+	value, err = cs.Load(long)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("value of "+long), value)
+
+	keys, err := cs.List("certificates", true)
+	require.NoError(t, err)
+	sort.Strings(keys)
+	assert.Equal(t, []string{"certificates/a.example.com", long, "certificates/b.example.com", "certificates/c.example.com"}, keys)
+
+	require.NoError(t, cs.Delete("certificates/a.example.com"))
+	assert.False(t, cs.Exists("certificates/a.example.com"))
+	assert.True(t, cs.Exists("certificates/b.example.com"))
+
+	// values are encrypted like in Consul
+	for _, v := range fn.vars {
+		assert.NotContains(t, v.Items["value"], "value of")
+	}
+}
+
+func TestConsulStorage_NomadLock(t *testing.T) {
+	fn := newFakeNomad(t)
+	cs := newFakeNomadStorage(t, fn)
+	cs2 := newFakeNomadStorage(t, fn)
+
+	require.NoError(t, cs.Lock(context.Background(), "issue_cert_example.com"))
+	assert.NoError(t, cs.CheckLock("issue_cert_example.com"))
+	owner, err := cs2.LockOwner(context.Background(), "issue_cert_example.com")
+	require.NoError(t, err)
+	assert.NotZero(t, owner.PID)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.Error(t, cs2.Lock(ctx, "issue_cert_example.com"))
+
+	require.NoError(t, cs.Unlock("issue_cert_example.com"))
+	require.NoError(t, cs2.Lock(context.Background(), "issue_cert_example.com"))
+	require.NoError(t, cs2.Unlock("issue_cert_example.com"))
+}
+
+func TestConsulStorage_NomadUnlockTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-hang
+	}))
+	defer srv.Close()
+	defer close(hang)
+
+	store := &nomadStore{address: srv.URL, client: srv.Client(), writeTimeout: caddy.Duration(50 * time.Millisecond)}
+	l := &nomadLock{store: store, path: "caddytls/issue_cert_example.com", id: "lock-1", stopRenew: make(chan struct{})}
+
+	// a hanging Nomad doesn't block releasing the lock forever
+	done := make(chan error, 1)
+	go func() { done <- l.Unlock() }()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Unlock didn't time out")
+	}
+}
@@ -0,0 +1,50 @@
+package storageconsul
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"go.uber.org/zap"
+)
+
+// operationIDKey is the context key of operation IDs
+type operationIDKey struct{}
+
+// WithOperationID returns a context whose storage operations log id as their operation ID, so log lines of
+// the storage can be correlated with those of the caller
+func WithOperationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, operationIDKey{}, id)
+}
+
+// OperationID returns the operation ID of ctx, empty if it has none
+func OperationID(ctx context.Context) string {
+	id, _ := ctx.Value(operationIDKey{}).(string)
+	return id
+}
+
+// newOperationID returns a random operation ID
+func newOperationID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// startOperation returns ctx with an operation ID, a new one unless ctx carries one already,
+// and a logger adding it to every line
+func (cs *ConsulStorage) startOperation(ctx context.Context) (context.Context, *zap.SugaredLogger) {
+	if OperationID(ctx) == "" {
+		ctx = WithOperationID(ctx, newOperationID())
+	}
+	return ctx, cs.log(ctx)
+}
+
+// log returns the logger of the operation of ctx
+func (cs *ConsulStorage) log(ctx context.Context) *zap.SugaredLogger {
+	if id := OperationID(ctx); id != "" {
+		return cs.logger.With("operation_id", id)
+	}
+	return cs.logger
+}
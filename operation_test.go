@@ -0,0 +1,40 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestConsulStorage_OperationID(t *testing.T) {
+	core, logs := observer.New(zapcore.DebugLevel)
+	cs, err := NewWithOptions(WithMemoryBackend(), WithLogger(zap.New(core)))
+	require.NoError(t, err)
+
+	ctx := WithOperationID(context.Background(), "request-42")
+	require.NoError(t, cs.StoreContext(ctx, "certificates/example.com", []byte("value")))
+	_, err = cs.LoadContext(ctx, "certificates/example.com")
+	require.NoError(t, err)
+
+	require.NotZero(t, logs.Len())
+	for _, entry := range logs.TakeAll() {
+		assert.Equal(t, "request-42", entry.ContextMap()["operation_id"], entry.Message)
+	}
+
+	// without an ID in the context all lines of an operation share a new one
+	require.NoError(t, cs.Lock(context.Background(), "issue_cert_example.com"))
+	require.NoError(t, cs.Unlock("issue_cert_example.com"))
+
+	entries := logs.TakeAll()
+	require.NotEmpty(t, entries)
+	id := entries[0].ContextMap()["operation_id"]
+	assert.NotEmpty(t, id)
+	for _, entry := range entries {
+		assert.Equal(t, id, entry.ContextMap()["operation_id"], entry.Message)
+	}
+}
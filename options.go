@@ -0,0 +1,364 @@
+package storageconsul
+
+import (
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+	"go.uber.org/zap"
+)
+
+// Option configures a ConsulStorage created with NewWithOptions
+type Option func(cs *ConsulStorage) error
+
+// NewWithOptions returns a ConsulStorage that is configured by opts and connected to Consul.
+// In contrast to Caddy's provisioning no environment variables of this plugin are taken into account,
+// so it can be used cleanly with CertMagic in standalone Go programs.
+func NewWithOptions(opts ...Option) (*ConsulStorage, error) {
+	cs, err := newWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cs.Connect(); err != nil {
+		return nil, err
+	}
+
+	return cs, nil
+}
+
+// NewWithClient returns a ConsulStorage configured by opts that uses the existing client instead of
+// creating its own connection pool. Connection related options have no effect then.
+func NewWithClient(client *consul.Client, opts ...Option) (*ConsulStorage, error) {
+	if client == nil {
+		return nil, errors.New("Consul client must not be nil")
+	}
+
+	cs, err := newWithOptions(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.ConsulClient = client
+	return cs, nil
+}
+
+func newWithOptions(opts []Option) (*ConsulStorage, error) {
+	cs := New()
+
+	for _, opt := range opts {
+		if err := opt(cs); err != nil {
+			return nil, err
+		}
+	}
+
+	return cs, nil
+}
+
+// WithAddress sets the address of the Consul agent
+func WithAddress(address string) Option {
+	return func(cs *ConsulStorage) error {
+		cs.Address = address
+		return nil
+	}
+}
+
+// WithNomad stores values in Nomad Variables reached with cfg instead of Consul KV
+func WithNomad(cfg NomadConfig) Option {
+	return func(cs *ConsulStorage) error {
+		cs.Backend = BackendNomad
+		cs.Nomad = cfg
+		return nil
+	}
+}
+
+// WithMemoryBackend keeps values in memory instead of Consul KV, e.g. for tests
+func WithMemoryBackend() Option {
+	return func(cs *ConsulStorage) error {
+		cs.Backend = BackendMemory
+		return nil
+	}
+}
+
+// WithToken sets the Consul ACL token
+func WithToken(token string) Option {
+	return func(cs *ConsulStorage) error {
+		cs.Token = token
+		return nil
+	}
+}
+
+// WithTokenFile reads the Consul ACL token from path and rereads it every interval
+func WithTokenFile(path string, interval time.Duration) Option {
+	return func(cs *ConsulStorage) error {
+		cs.TokenFile = path
+		cs.TokenFileInterval = caddy.Duration(interval)
+		return nil
+	}
+}
+
+// WithPrefix sets the prefix of all keys in Consul KV
+func WithPrefix(prefix string) Option {
+	return func(cs *ConsulStorage) error {
+		if prefix == "" {
+			return errors.New("prefix must not be empty")
+		}
+		cs.Prefix = prefix
+		return nil
+	}
+}
+
+// WithAccountPrefix keeps ACME accounts under prefix and accesses them with token, an empty token uses the
+// token of the storage
+func WithAccountPrefix(prefix, token string) Option {
+	return func(cs *ConsulStorage) error {
+		if prefix == "" {
+			return errors.New("account prefix must not be empty")
+		}
+		cs.AccountPrefix = prefix
+		cs.AccountToken = token
+		return nil
+	}
+}
+
+// WithValuePrefix sets the prefix that is used to validate stored values
+func WithValuePrefix(valuePrefix string) Option {
+	return func(cs *ConsulStorage) error {
+		cs.ValuePrefix = valuePrefix
+		return nil
+	}
+}
+
+// WithAESKey sets the key to encrypt values with, an empty key disables encryption
+func WithAESKey(key []byte) Option {
+	return func(cs *ConsulStorage) error {
+		switch len(key) {
+		case 0, 16, 24, 32:
+			cs.AESKey = key
+			return nil
+		default:
+			return errors.Errorf("AES key must be 16, 24 or 32 bytes long, got %d", len(key))
+		}
+	}
+}
+
+// WithPreviousAESKeys sets the keys values were encrypted with before the AES key was rotated
+func WithPreviousAESKeys(keys ...[]byte) Option {
+	return func(cs *ConsulStorage) error {
+		for _, key := range keys {
+			switch len(key) {
+			case 16, 24, 32:
+			default:
+				return errors.Errorf("AES key must be 16, 24 or 32 bytes long, got %d", len(key))
+			}
+		}
+		cs.PreviousAESKeys = keys
+		return nil
+	}
+}
+
+// WithUnencryptedMigration reads unencrypted values of keys that should be encrypted and encrypts them on Load
+func WithUnencryptedMigration() Option {
+	return func(cs *ConsulStorage) error {
+		cs.AllowUnencryptedMigration = true
+		return nil
+	}
+}
+
+// WithReencryptOnLoad sets whether values encrypted with a previous key are rewritten when loaded
+func WithReencryptOnLoad(reencrypt bool) Option {
+	return func(cs *ConsulStorage) error {
+		cs.ReencryptOnLoad = reencrypt
+		return nil
+	}
+}
+
+// WithLogger sets the logger of the storage
+func WithLogger(logger *zap.Logger) Option {
+	return func(cs *ConsulStorage) error {
+		if logger == nil {
+			return errors.New("logger must not be nil")
+		}
+		cs.logger = logger.Sugar()
+		return nil
+	}
+}
+
+// WithTLS enables HTTPS for Consul connections and optionally skips verification of the server certificate
+func WithTLS(insecure bool) Option {
+	return func(cs *ConsulStorage) error {
+		cs.TlsEnabled = true
+		cs.TlsInsecure = insecure
+		return nil
+	}
+}
+
+// WithTimeout sets the timeout to establish connections to Consul, it is rounded up to full seconds
+func WithTimeout(timeout time.Duration) Option {
+	return func(cs *ConsulStorage) error {
+		cs.Timeout = int(math.Ceil(timeout.Seconds()))
+		return nil
+	}
+}
+
+// WithOperationTimeouts limits the duration of reads, writes, lists and waiting for locks,
+// a zero value means no limit
+func WithOperationTimeouts(read, write, list, lock time.Duration) Option {
+	return func(cs *ConsulStorage) error {
+		cs.ReadTimeout = caddy.Duration(read)
+		cs.WriteTimeout = caddy.Duration(write)
+		cs.ListTimeout = caddy.Duration(list)
+		cs.LockTimeout = caddy.Duration(lock)
+		return nil
+	}
+}
+
+// WithStatCacheTTL caches the results of Exists and Stat for ttl
+func WithStatCacheTTL(ttl time.Duration) Option {
+	return func(cs *ConsulStorage) error {
+		cs.StatCacheTTL = caddy.Duration(ttl)
+		return nil
+	}
+}
+
+// WithRateLimit limits the requests per second toward Consul with bursts of up to burst requests
+func WithRateLimit(rate float64, burst int) Option {
+	return func(cs *ConsulStorage) error {
+		cs.RateLimit = rate
+		cs.RateBurst = burst
+		return nil
+	}
+}
+
+// WithMaxConcurrentRequests bounds the number of in-flight requests toward Consul
+func WithMaxConcurrentRequests(max int) Option {
+	return func(cs *ConsulStorage) error {
+		cs.MaxConcurrentRequests = max
+		return nil
+	}
+}
+
+// WithThrottleRetries retries requests rejected by Consul's rate limits up to retries times, -1 disables retries
+func WithThrottleRetries(retries int) Option {
+	return func(cs *ConsulStorage) error {
+		cs.ThrottleRetries = retries
+		return nil
+	}
+}
+
+// WithHTTPClient sends all Consul requests through client
+func WithHTTPClient(client *http.Client) Option {
+	return func(cs *ConsulStorage) error {
+		cs.HTTPClient = client
+		return nil
+	}
+}
+
+// WithTransport sends all Consul requests through transport
+func WithTransport(transport http.RoundTripper) Option {
+	return func(cs *ConsulStorage) error {
+		cs.Transport = transport
+		return nil
+	}
+}
+
+// WithLockLostHandler calls handler with the key of a held lock that another instance took over
+func WithLockLostHandler(handler func(key string)) Option {
+	return func(cs *ConsulStorage) error {
+		cs.OnLockLost = handler
+		return nil
+	}
+}
+
+// WithDecryptFailureHandler calls handler with the key and the error of a loaded value that can't be decrypted
+func WithDecryptFailureHandler(handler func(key string, err error)) Option {
+	return func(cs *ConsulStorage) error {
+		cs.OnDecryptFailure = handler
+		return nil
+	}
+}
+
+// WithLockRetryInterval sets the initial and the maximum pause between attempts to acquire a contended lock
+func WithLockRetryInterval(interval, max time.Duration) Option {
+	return func(cs *ConsulStorage) error {
+		cs.LockRetryInterval = caddy.Duration(interval)
+		cs.LockMaxRetryInterval = caddy.Duration(max)
+		return nil
+	}
+}
+
+// WithLockSessionBehavior sets the behavior of lock sessions, with consul.SessionBehaviorDelete lock
+// keys are removed once the lock is released or its session is invalidated
+func WithLockSessionBehavior(behavior string) Option {
+	return func(cs *ConsulStorage) error {
+		cs.LockSessionBehavior = behavior
+		return nil
+	}
+}
+
+// WithSlowLockThreshold logs a warning if Lock waited longer than threshold, a negative value disables it
+func WithSlowLockThreshold(threshold time.Duration) Option {
+	return func(cs *ConsulStorage) error {
+		cs.SlowLockThreshold = caddy.Duration(threshold)
+		return nil
+	}
+}
+
+// WithVerifyOnStart checks during Provision that values and locks can be written
+func WithVerifyOnStart() Option {
+	return func(cs *ConsulStorage) error {
+		cs.VerifyOnStart = true
+		return nil
+	}
+}
+
+// WithRecursiveDelete makes Delete of a directory delete all of its keys
+func WithRecursiveDelete() Option {
+	return func(cs *ConsulStorage) error {
+		cs.RecursiveDelete = true
+		return nil
+	}
+}
+
+// WithFairLocks hands out contended locks roughly in the order they were asked for
+func WithFairLocks() Option {
+	return func(cs *ConsulStorage) error {
+		cs.FairLocks = true
+		return nil
+	}
+}
+
+// WithDisableLocks makes locking purely in-process, only use it with a single instance
+func WithDisableLocks() Option {
+	return func(cs *ConsulStorage) error {
+		cs.DisableLocks = true
+		return nil
+	}
+}
+
+// WithLegacyValueFormat writes values without the versioned format header for older plugin versions
+func WithLegacyValueFormat() Option {
+	return func(cs *ConsulStorage) error {
+		cs.LegacyValueFormat = true
+		return nil
+	}
+}
+
+// WithArmorValues stores values base64 encoded as PEM block
+func WithArmorValues() Option {
+	return func(cs *ConsulStorage) error {
+		cs.ArmorValues = true
+		return nil
+	}
+}
+
+// WithJSONEnvelope stores values as self-describing JSON documents
+func WithJSONEnvelope() Option {
+	return func(cs *ConsulStorage) error {
+		cs.ValueEnvelope = EnvelopeJSON
+		return nil
+	}
+}
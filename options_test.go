@@ -0,0 +1,57 @@
+package storageconsul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestNewWithOptions(t *testing.T) {
+	srv := newTestAgent(t)
+	aesKey := []byte("0123456789abcdef0123456789abcdef")
+
+	cs, err := NewWithOptions(
+		WithAddress(srv.Listener.Addr().String()),
+		WithToken("token"),
+		WithPrefix("myprefix"),
+		WithAESKey(aesKey),
+		WithLogger(zap.NewNop()),
+		WithTimeout(1500*time.Millisecond),
+		WithOperationTimeouts(time.Second, 2*time.Second, 3*time.Second, 4*time.Second),
+	)
+	require.NoError(t, err)
+	defer cs.Cleanup()
+
+	assert.NotNil(t, cs.ConsulClient)
+	assert.Equal(t, "token", cs.Token)
+	assert.Equal(t, "myprefix", cs.Prefix)
+	assert.Equal(t, aesKey, cs.AESKey)
+	assert.Equal(t, 2, cs.Timeout)
+	assert.Equal(t, caddy.Duration(time.Second), cs.ReadTimeout)
+	assert.Equal(t, caddy.Duration(4*time.Second), cs.LockTimeout)
+}
+
+func TestNewWithOptions_InvalidAESKey(t *testing.T) {
+	_, err := NewWithOptions(WithAESKey([]byte("short")))
+	assert.Error(t, err)
+}
+
+func TestNewWithClient(t *testing.T) {
+	client, err := consul.NewClient(consul.DefaultConfig())
+	require.NoError(t, err)
+
+	cs, err := NewWithClient(client, WithPrefix("myprefix"))
+	require.NoError(t, err)
+
+	assert.Same(t, client, cs.ConsulClient)
+	assert.Equal(t, "myprefix", cs.Prefix)
+	assert.NoError(t, cs.Cleanup())
+
+	_, err = NewWithClient(nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,38 @@
+package storageconsul
+
+import (
+	"context"
+
+	consul "github.com/hashicorp/consul/api"
+)
+
+// storeDetecting writes kv of key and reports if the key was modified by another writer since this instance
+// last loaded or stored it. The value is written anyway, so certmagic behaves as without detection.
+func (cs *ConsulStorage) storeDetecting(ctx context.Context, key string, kv *consul.KVPair) error {
+	if index := cs.seenIndexes.get(key); index > 0 {
+		newIndex, err := cs.putIndexed(ctx, key, kv, true, index)
+		if err == nil {
+			cs.seenIndexes.set(key, newIndex)
+			return nil
+		}
+		if _, conflict := err.(CASConflictError); !conflict {
+			return err
+		}
+		cs.overwriteDetected(ctx, key, index)
+	}
+
+	newIndex, err := cs.putIndexed(ctx, key, kv, false, 0)
+	if err != nil {
+		return err
+	}
+	cs.seenIndexes.set(key, newIndex)
+	return nil
+}
+
+// overwriteDetected reports that a store of key overwrites a change of another writer after index
+func (cs *ConsulStorage) overwriteDetected(ctx context.Context, key string, index uint64) {
+	overwritesDetected.Inc()
+	overwritesDebugVar.Add(1)
+	cs.log(ctx).Warnf("%s was modified by another writer since this instance saw it at index %d and is overwritten, "+
+		"check for split-brain or instances issuing the same certificate", key, index)
+}
@@ -0,0 +1,37 @@
+package storageconsul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_DetectOverwrites(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+	cs.DetectOverwrites = true
+	other, _ := newFakeConsulStorage(t)
+	other.ConsulClient = cs.ConsulClient
+
+	key := "certificates/acme/example.com/example.com.crt"
+	before := overwritesDebugVar.Value()
+
+	require.NoError(t, cs.Store(key, []byte("v1")))
+	require.NoError(t, cs.Store(key, []byte("v2")))
+	_, err := cs.Load(key)
+	require.NoError(t, err)
+	require.NoError(t, cs.Store(key, []byte("v3")))
+	assert.Equal(t, before, overwritesDebugVar.Value())
+
+	// another writer changes the key, the next store still overwrites it but is reported
+	require.NoError(t, other.Store(key, []byte("other")))
+	require.NoError(t, cs.Store(key, []byte("v4")))
+	assert.Equal(t, before+1, overwritesDebugVar.Value())
+
+	value, err := other.Load(key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("v4"), value)
+
+	require.NoError(t, cs.Store(key, []byte("v5")))
+	assert.Equal(t, before+1, overwritesDebugVar.Value())
+}
@@ -0,0 +1,68 @@
+package storageconsul
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseCertPin(t *testing.T) {
+	sum := sha256.Sum256([]byte("key"))
+	pin := base64.StdEncoding.EncodeToString(sum[:])
+
+	for _, p := range []string{pin, "sha256/" + pin, "sha256//" + pin} {
+		hash, err := parseCertPin(p)
+		require.NoError(t, err)
+		assert.Equal(t, sum[:], hash)
+	}
+
+	_, err := parseCertPin("sha256/abc")
+	assert.Error(t, err)
+}
+
+func TestConnectionConfig_CertPin(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"Config":{"NodeName":"test"}}`))
+	}))
+	defer srv.Close()
+
+	sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	cc := ConnectionConfig{
+		Address:          srv.Listener.Addr().String(),
+		TlsEnabled:       true,
+		TlsServerCertPin: "sha256/" + base64.StdEncoding.EncodeToString(sum[:]),
+		Timeout:          DefaultTimeout,
+	}
+
+	// the self-signed certificate is accepted because of the pin
+	sc, err := cc.newClient()
+	require.NoError(t, err)
+	sc.Destruct()
+
+	other := sha256.Sum256([]byte("other"))
+	cc.TlsServerCertPin = base64.StdEncoding.EncodeToString(other[:])
+	_, err = cc.newClient()
+	assert.Error(t, err)
+}
+
+func TestPinCertificate_LeafOnly(t *testing.T) {
+	pinned := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("pinned")}
+	attacker := &x509.Certificate{RawSubjectPublicKeyInfo: []byte("attacker")}
+
+	sum := sha256.Sum256(pinned.RawSubjectPublicKeyInfo)
+	tlsConfig := &tls.Config{}
+	require.NoError(t, pinCertificate(tlsConfig, base64.StdEncoding.EncodeToString(sum[:])))
+
+	assert.NoError(t, tlsConfig.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{pinned}}))
+
+	// the pinned certificate appended to an untrusted leaf is rejected
+	assert.Error(t, tlsConfig.VerifyConnection(tls.ConnectionState{PeerCertificates: []*x509.Certificate{attacker, pinned}}))
+	assert.Error(t, tlsConfig.VerifyConnection(tls.ConnectionState{}))
+}
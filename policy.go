@@ -0,0 +1,98 @@
+package storageconsul
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/caddyserver/caddy/v2"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// KeyPolicy relaxes the guarantees for a class of keys selected by their key prefixes,
+// for data that is public and frequently rewritten like OCSP staples
+type KeyPolicy struct {
+	KeyPrefixes []string `json:"key_prefixes"`
+
+	// StaleReads allows any Consul server to answer reads instead of only the leader
+	StaleReads bool `json:"stale_reads"`
+
+	// Unencrypted stores values without encryption
+	Unencrypted bool `json:"unencrypted"`
+
+	// LocalLocks makes locks in-process only
+	LocalLocks bool `json:"local_locks"`
+
+	// CoalesceWindow delays writes by up to the window and only writes the last value stored within it,
+	// Store returns once that value is written
+	CoalesceWindow caddy.Duration `json:"coalesce_window"`
+
+	// CompareAndSet only stores a key if it wasn't modified since this instance last loaded or stored it,
+	// e.g. certmagic's metadata, so an update of another instance isn't overwritten unnoticed
+	CompareAndSet bool `json:"compare_and_set"`
+
+	// ConsistentWrite reads every write back from the leader before Store returns, e.g. for private and
+	// account keys that must never be lost, at the cost of a read per write
+	ConsistentWrite bool `json:"consistent_write"`
+
+	// TTL expires keys this long after they were last stored, they can't be loaded anymore and are deleted
+	// within a minute
+	TTL caddy.Duration `json:"ttl"`
+}
+
+// ocspPolicy is used for OCSP staples with RelaxedOCSP
+var ocspPolicy = &KeyPolicy{
+	KeyPrefixes: []string{"ocsp"},
+	StaleReads:  true,
+	Unencrypted: true,
+	LocalLocks:  true,
+}
+
+// policy returns the policy of the longest key prefix that matches key or nil if none applies
+func (cs *ConsulStorage) policy(key string) *KeyPolicy {
+	var policy *KeyPolicy
+	longest := -1
+	for _, p := range cs.KeyPolicies {
+		if length, ok := matchKeyPrefixes(p.KeyPrefixes, key); ok && length > longest {
+			policy, longest = p, length
+		}
+	}
+
+	if policy == nil && cs.RelaxedOCSP {
+		if _, ok := matchKeyPrefixes(ocspPolicy.KeyPrefixes, key); ok {
+			policy = ocspPolicy
+		}
+	}
+
+	return policy
+}
+
+// readOptions returns the options for reads of key bound to ctx
+func (cs *ConsulStorage) readOptions(ctx context.Context, key string) *consul.QueryOptions {
+	if p := cs.policy(key); p != nil && p.StaleReads {
+		return (&consul.QueryOptions{AllowStale: true}).WithContext(ctx)
+	}
+	return cs.queryOptions(ctx)
+}
+
+// encodeStorageData encodes data of key for storing, encrypted unless the policy of key says otherwise
+func (cs *ConsulStorage) encodeStorageData(key string, data *StorageData) ([]byte, error) {
+	if p := cs.policy(key); p == nil || !p.Unencrypted {
+		return cs.encryptStorageData([]byte(cs.boundKey(key)), data)
+	}
+
+	bytes, err := json.Marshal(data)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to marshal")
+	}
+	return cs.wrapValue(data, append([]byte(cs.ValuePrefix), bytes...), false), nil
+}
+
+// localLocksOnly reports whether locks of key are in-process only
+func (cs *ConsulStorage) localLocksOnly(key string) bool {
+	if cs.DisableLocks {
+		return true
+	}
+	p := cs.policy(key)
+	return p != nil && p.LocalLocks
+}
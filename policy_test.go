@@ -0,0 +1,57 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_RelaxedOCSP(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.RelaxedOCSP = true
+
+	staple := "ocsp/example.com-1234abcd"
+	require.NoError(t, cs.Store(staple, []byte("staple")))
+	require.NoError(t, cs.Store("certificates/example.com/example.com.key", []byte("key")))
+
+	// staples are stored unencrypted and stay that way when loaded
+	_, err := cs.unmarshalStorageData(valuePayload(fc.kv[cs.prefixKey(staple)].Value))
+	assert.NoError(t, err)
+
+	value, err := cs.Load(staple)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("staple"), value)
+	_, err = cs.unmarshalStorageData(valuePayload(fc.kv[cs.prefixKey(staple)].Value))
+	assert.NoError(t, err)
+	assert.Contains(t, fc.reads[cs.prefixKey(staple)], "stale")
+
+	// other keys keep the strict defaults
+	value, err = cs.Load("certificates/example.com/example.com.key")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("key"), value)
+	_, err = cs.unmarshalStorageData(valuePayload(fc.kv[cs.prefixKey("certificates/example.com/example.com.key")].Value))
+	assert.Error(t, err)
+	assert.Contains(t, fc.reads[cs.prefixKey("certificates/example.com/example.com.key")], "consistent")
+
+	// staples are locked in-process only, the fake has no sessions
+	require.NoError(t, cs.Lock(context.Background(), staple))
+	require.NoError(t, cs.Unlock(staple))
+}
+
+func TestConsulStorage_Policy(t *testing.T) {
+	cs := New()
+	cs.KeyPolicies = map[string]*KeyPolicy{
+		"acme":    {KeyPrefixes: []string{"acme"}, StaleReads: true},
+		"account": {KeyPrefixes: []string{"acme/ca.example.com/users"}, LocalLocks: true},
+	}
+
+	assert.Equal(t, cs.KeyPolicies["acme"], cs.policy("acme/ca.example.com/sites"))
+	assert.Equal(t, cs.KeyPolicies["account"], cs.policy("acme/ca.example.com/users/admin"))
+	assert.Nil(t, cs.policy("acmeish/key"))
+	assert.Nil(t, cs.policy("ocsp/staple"))
+
+	cs.RelaxedOCSP = true
+	assert.Equal(t, ocspPolicy, cs.policy("ocsp/staple"))
+}
@@ -0,0 +1,34 @@
+package storageconsul
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/pteich/errors"
+)
+
+// parseProxyURL parses the URL of an HTTP, HTTPS or SOCKS5 proxy
+func parseProxyURL(proxyURL string) (*url.URL, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Host == "" {
+		return nil, errors.Errorf("invalid proxy_url %s", proxyURL)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return u, nil
+	}
+	return nil, errors.Errorf("proxy_url %s must use http, https or socks5", proxyURL)
+}
+
+// proxy returns the proxy function of the transport to Consul, an explicit proxy_url takes precedence over
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY, which are only honored if the environment isn't ignored
+func (cc ConnectionConfig) proxy() func(*http.Request) (*url.URL, error) {
+	if cc.ProxyURL != "" {
+		u, err := parseProxyURL(cc.ProxyURL)
+		return func(*http.Request) (*url.URL, error) { return u, err }
+	}
+	if cc.IgnoreEnv {
+		return nil
+	}
+	return http.ProxyFromEnvironment
+}
@@ -0,0 +1,183 @@
+package storageconsul
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// quotaRefreshInterval is how long the usage of a prefix listed from Consul is used before it is listed again,
+// writes of this instance are counted in the meantime
+const quotaRefreshInterval = time.Minute
+
+// Quota limits the keys and the bytes stored below a top-level prefix, zero means unlimited
+type Quota struct {
+	MaxKeys  int   `json:"max_keys"`
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// QuotaExceededError is returned for writes that would exceed the quota of their top-level prefix, they are
+// rejected before anything is sent to Consul
+type QuotaExceededError struct {
+	Key      string
+	Prefix   string
+	Keys     int
+	Bytes    int64
+	MaxKeys  int
+	MaxBytes int64
+}
+
+func (e QuotaExceededError) Error() string {
+	return fmt.Sprintf("storing %s exceeds the quota of %s: %d of %d keys and %d of %d bytes are used",
+		e.Key, e.Prefix, e.Keys, e.MaxKeys, e.Bytes, e.MaxBytes)
+}
+
+// prefixUsage is the stored size of every Consul key below a prefix
+type prefixUsage struct {
+	listed time.Time
+	sizes  map[string]int
+	bytes  int64
+}
+
+// quotaUsage tracks the usage of the prefixes with a quota
+type quotaUsage struct {
+	mu       sync.Mutex
+	prefixes map[string]*prefixUsage
+}
+
+func newQuotaUsage() *quotaUsage {
+	return &quotaUsage{prefixes: make(map[string]*prefixUsage)}
+}
+
+// forget drops the usage of prefix, so it is listed again before the next write
+func (qu *quotaUsage) forget(prefix string) {
+	qu.mu.Lock()
+	defer qu.mu.Unlock()
+	delete(qu.prefixes, prefix)
+}
+
+// forgetQuotas drops the usage of the prefixes of keys after a write of them failed
+func (cs *ConsulStorage) forgetQuotas(keys []string) {
+	for _, key := range keys {
+		cs.quotaUsage.forget(quotaPrefix(key))
+	}
+}
+
+// quotaPrefix returns the top-level prefix of key its quota applies to
+func quotaPrefix(key string) string {
+	return strings.SplitN(key, "/", 2)[0]
+}
+
+// quota returns the top-level prefix of key and its quota, nil if it has none
+func (cs *ConsulStorage) quota(key string) (string, *Quota) {
+	prefix := quotaPrefix(key)
+	return prefix, cs.Quotas[prefix]
+}
+
+// listUsage lists the stored size of every Consul key below prefix. Keys are only listed without their values
+// unless the quota limits the bytes, Consul keeps no size apart from the value. Values stored under hashed keys
+// are read from the hashed keys directory to count the ones whose original key is below prefix.
+func (cs *ConsulStorage) listUsage(ctx context.Context, prefix string, quota *Quota) (*prefixUsage, error) {
+	kv := cs.kv(prefix)
+	consulPrefix := cs.rawPrefixKey(prefix) + "/"
+	usage := &prefixUsage{listed: time.Now(), sizes: make(map[string]int)}
+
+	if quota.MaxBytes > 0 {
+		pairs, _, err := kv.List(consulPrefix, cs.queryOptions(ctx))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to list keys at %s", consulPrefix)
+		}
+		for _, pair := range pairs {
+			usage.add(pair.Key, len(pair.Value))
+		}
+	} else {
+		keys, _, err := kv.Keys(consulPrefix, "", cs.queryOptions(ctx))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to list keys at %s", consulPrefix)
+		}
+		for _, key := range keys {
+			usage.add(key, 0)
+		}
+	}
+
+	if cs.hashesLongKeys() {
+		nsPrefix := cs.keyPrefix(prefix)
+		hashedPrefix := path.Join(nsPrefix, hashedKeysDir) + "/"
+		pairs, _, err := kv.List(hashedPrefix, cs.queryOptions(ctx))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to list keys at %s", hashedPrefix)
+		}
+		for _, pair := range pairs {
+			if key, ok := cs.originalKey(nsPrefix, pair); ok && quotaPrefix(key) == prefix {
+				usage.add(pair.Key, len(pair.Value))
+			}
+		}
+	}
+
+	return usage, nil
+}
+
+// add counts a Consul key with the size of its value
+func (pu *prefixUsage) add(consulKey string, size int) {
+	pu.bytes += int64(size - pu.sizes[consulKey])
+	pu.sizes[consulKey] = size
+}
+
+// reserveQuota checks that storing kv for key stays within the quota of its prefix and counts it, a write
+// that doesn't grow the usage is always allowed. If the write fails the usage has to be forgotten.
+func (cs *ConsulStorage) reserveQuota(ctx context.Context, key string, kv *consul.KVPair) error {
+	prefix, quota := cs.quota(key)
+	if quota == nil {
+		return nil
+	}
+
+	cs.quotaUsage.mu.Lock()
+	usage, ok := cs.quotaUsage.prefixes[prefix]
+	cs.quotaUsage.mu.Unlock()
+	if !ok || time.Since(usage.listed) > quotaRefreshInterval {
+		listed, err := cs.listUsage(ctx, prefix, quota)
+		if err != nil {
+			return err
+		}
+		cs.quotaUsage.mu.Lock()
+		cs.quotaUsage.prefixes[prefix] = listed
+		cs.quotaUsage.mu.Unlock()
+		usage = listed
+	}
+
+	cs.quotaUsage.mu.Lock()
+	defer cs.quotaUsage.mu.Unlock()
+
+	old, exists := usage.sizes[kv.Key]
+	keys, bytes := len(usage.sizes), usage.bytes-int64(old)+int64(len(kv.Value))
+	if !exists {
+		keys++
+	}
+	if (quota.MaxKeys > 0 && !exists && keys > quota.MaxKeys) || (quota.MaxBytes > 0 && len(kv.Value) > old && bytes > quota.MaxBytes) {
+		err := QuotaExceededError{Key: key, Prefix: prefix, Keys: len(usage.sizes), Bytes: usage.bytes, MaxKeys: quota.MaxKeys, MaxBytes: quota.MaxBytes}
+		cs.quotaExceeded(ctx, err)
+		return err
+	}
+
+	usage.sizes[kv.Key] = len(kv.Value)
+	usage.bytes = bytes
+	return nil
+}
+
+// quotaExceeded reports a write rejected by a quota, as a runaway of on-demand TLS would otherwise only show
+// up as failing certificate issuance
+func (cs *ConsulStorage) quotaExceeded(ctx context.Context, err QuotaExceededError) {
+	quotaRejections.WithLabelValues(err.Prefix).Inc()
+	quotaRejectionsDebugVar.Add(1)
+	cs.log(ctx).Warnf("rejected write: %v", err)
+
+	if cs.OnQuotaExceeded != nil {
+		cs.OnQuotaExceeded(err)
+	}
+}
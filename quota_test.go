@@ -0,0 +1,117 @@
+package storageconsul
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_Quota(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+	cs.Quotas = map[string]*Quota{"certificates": {MaxKeys: 2}}
+
+	var rejected []QuotaExceededError
+	cs.OnQuotaExceeded = func(err QuotaExceededError) { rejected = append(rejected, err) }
+	before := quotaRejectionsDebugVar.Value()
+
+	require.NoError(t, cs.Store("certificates/acme/a.example.com/a.example.com.crt", []byte("a")))
+	require.NoError(t, cs.Store("certificates/acme/b.example.com/b.example.com.crt", []byte("b")))
+
+	err := cs.Store("certificates/acme/c.example.com/c.example.com.crt", []byte("c"))
+	var quotaErr QuotaExceededError
+	require.ErrorAs(t, err, &quotaErr)
+	assert.Equal(t, "certificates", quotaErr.Prefix)
+	assert.Equal(t, 2, quotaErr.Keys)
+	assert.False(t, cs.Exists("certificates/acme/c.example.com/c.example.com.crt"))
+	assert.Len(t, rejected, 1)
+	assert.Equal(t, before+1, quotaRejectionsDebugVar.Value())
+
+	// existing keys can still be updated, other prefixes aren't limited
+	require.NoError(t, cs.Store("certificates/acme/a.example.com/a.example.com.crt", []byte("renewed")))
+	require.NoError(t, cs.Store("ocsp/a.example.com", []byte("staple")))
+
+	// deleting frees the quota
+	require.NoError(t, cs.Delete("certificates/acme/b.example.com/b.example.com.crt"))
+	require.NoError(t, cs.Store("certificates/acme/c.example.com/c.example.com.crt", []byte("c")))
+}
+
+func TestConsulStorage_QuotaBytes(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	key := "certificates/acme/a.example.com/a.example.com.crt"
+	require.NoError(t, cs.Store(key, []byte("a")))
+	stored := int64(len(fc.kv[cs.prefixKey(key)].Value))
+
+	// the usage already stored is listed from Consul
+	cs.Quotas = map[string]*Quota{"certificates": {MaxBytes: stored + 10}}
+	err := cs.Store("certificates/acme/b.example.com/b.example.com.crt", []byte("b"))
+	var quotaErr QuotaExceededError
+	require.ErrorAs(t, err, &quotaErr)
+	assert.Equal(t, stored, quotaErr.Bytes)
+
+	require.NoError(t, cs.Store(key, []byte("b")))
+}
+
+func TestConsulStorage_QuotaBundleAndTxn(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+	cs.Quotas = map[string]*Quota{"certificates": {MaxKeys: 2}}
+	ctx := context.Background()
+
+	require.NoError(t, cs.StoreBundle(ctx, map[string][]byte{
+		"certificates/acme/a.example.com/a.example.com.crt": []byte("a"),
+		"certificates/acme/a.example.com/a.example.com.key": []byte("a"),
+	}))
+
+	var quotaErr QuotaExceededError
+	err := cs.StoreBundle(ctx, map[string][]byte{"certificates/acme/b.example.com/b.example.com.crt": []byte("b")})
+	require.ErrorAs(t, err, &quotaErr)
+	assert.False(t, cs.Exists("certificates/acme/b.example.com/b.example.com.crt"))
+
+	err = cs.Txn(ctx, func(tx StorageTx) error {
+		return tx.Store("certificates/acme/b.example.com/b.example.com.crt", []byte("b"))
+	})
+	require.ErrorAs(t, err, &quotaErr)
+	assert.False(t, cs.Exists("certificates/acme/b.example.com/b.example.com.crt"))
+
+	// a transaction that deletes as many keys as it creates stays within the quota once it committed
+	require.NoError(t, cs.Txn(ctx, func(tx StorageTx) error {
+		return tx.Delete("certificates/acme/a.example.com/a.example.com.key")
+	}))
+	require.NoError(t, cs.Txn(ctx, func(tx StorageTx) error {
+		return tx.Store("certificates/acme/b.example.com/b.example.com.crt", []byte("b"))
+	}))
+}
+
+func TestConsulStorage_QuotaHashedKeys(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+	cs.HashLongKeys = true
+	cs.MaxKeyLength = 64
+
+	longKey := "certificates/" + strings.Repeat("sub.", 20) + "example.com/example.com.crt"
+	require.NoError(t, cs.Store(longKey, []byte("long")))
+	require.NoError(t, cs.Store("ocsp/"+strings.Repeat("sub.", 20)+"example.com", []byte("staple")))
+
+	// the hashed key counts toward certificates, the hashed ocsp staple doesn't
+	cs.Quotas = map[string]*Quota{"certificates": {MaxKeys: 1}}
+	err := cs.Store("certificates/acme/a.example.com/a.example.com.crt", []byte("a"))
+	var quotaErr QuotaExceededError
+	require.ErrorAs(t, err, &quotaErr)
+	assert.Equal(t, 1, quotaErr.Keys)
+}
+
+func TestConsulStorage_UnmarshalCaddyfileQuota(t *testing.T) {
+	cs := New()
+	d := caddyfile.NewTestDispenser(`consul {
+		quota certificates 10000 104857600
+	}`)
+	require.NoError(t, cs.UnmarshalCaddyfile(d))
+	assert.Equal(t, &Quota{MaxKeys: 10000, MaxBytes: 104857600}, cs.Quotas["certificates"])
+
+	d = caddyfile.NewTestDispenser(`consul {
+		quota certificates many 1
+	}`)
+	assert.Error(t, New().UnmarshalCaddyfile(d))
+}
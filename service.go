@@ -0,0 +1,168 @@
+package storageconsul
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+	"go.uber.org/zap"
+)
+
+// Defaults of the service registration
+const (
+	DefaultServiceCheckTTL      = 30 * time.Second
+	DefaultServiceCheckInterval = 10 * time.Second
+)
+
+// servicePool holds the services registered by the modules of the process by service ID, a service stays
+// registered while the old and the new config overlap during a reload and is deregistered with the last user
+var servicePool = caddy.NewUsagePool()
+
+// ServiceConfig registers the Caddy instance as a Consul service with a health check if a Name is set. With
+// CheckHTTP the agent checks the URL every CheckInterval, otherwise the storage keeps a TTL check passing.
+type ServiceConfig struct {
+	Name    string   `json:"name"`
+	ID      string   `json:"id"`
+	Tags    []string `json:"tags"`
+	Address string   `json:"address"`
+	Port    int      `json:"port"`
+
+	CheckHTTP       string         `json:"check_http"`
+	CheckInterval   caddy.Duration `json:"check_interval"`
+	CheckTTL        caddy.Duration `json:"check_ttl"`
+	DeregisterAfter caddy.Duration `json:"deregister_after"`
+}
+
+// registeredService is a service registered with the Consul agent that is shared using servicePool
+type registeredService struct {
+	agent  *consul.Agent
+	id     string
+	logger *zap.SugaredLogger
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// Destruct implements caddy.Destructor and deregisters the service once the last user is cleaned up
+func (rs *registeredService) Destruct() error {
+	close(rs.stop)
+	rs.wg.Wait()
+	if err := rs.agent.ServiceDeregister(rs.id); err != nil {
+		return errors.Wrapf(err, "unable to deregister service %s", rs.id)
+	}
+	rs.logger.Infof("deregistered Consul service %s", rs.id)
+	return nil
+}
+
+// serviceEnabled reports whether the instance is registered as Consul service
+func (cs *ConsulStorage) serviceEnabled() bool {
+	return cs.Service.Name != ""
+}
+
+// serviceID returns the ID of the service, the name and the hostname by default
+func (cs *ConsulStorage) serviceID() string {
+	if cs.Service.ID != "" {
+		return cs.Service.ID
+	}
+	hostname, _ := os.Hostname()
+	return cs.Service.Name + "-" + hostname
+}
+
+func (cs *ConsulStorage) serviceCheckTTL() time.Duration {
+	if cs.Service.CheckTTL > 0 {
+		return time.Duration(cs.Service.CheckTTL)
+	}
+	return DefaultServiceCheckTTL
+}
+
+// serviceRegistration returns the registration of the service with its health check
+func (cs *ConsulStorage) serviceRegistration() *consul.AgentServiceRegistration {
+	s := cs.Service
+	id := cs.serviceID()
+	check := &consul.AgentServiceCheck{CheckID: "service:" + id, Name: "Caddy"}
+	if s.CheckHTTP != "" {
+		interval := DefaultServiceCheckInterval
+		if s.CheckInterval > 0 {
+			interval = time.Duration(s.CheckInterval)
+		}
+		check.HTTP, check.Interval = s.CheckHTTP, interval.String()
+	} else {
+		check.TTL = cs.serviceCheckTTL().String()
+	}
+	if s.DeregisterAfter > 0 {
+		check.DeregisterCriticalServiceAfter = time.Duration(s.DeregisterAfter).String()
+	}
+
+	return &consul.AgentServiceRegistration{
+		ID:      id,
+		Name:    s.Name,
+		Tags:    s.Tags,
+		Address: s.Address,
+		Port:    s.Port,
+		Check:   check,
+	}
+}
+
+// registerService registers the instance as Consul service, a service that is registered already by the
+// module of the previous config is updated with the new settings
+func (cs *ConsulStorage) registerService() error {
+	reg := cs.serviceRegistration()
+	agent := cs.ConsulClient.Agent()
+
+	val, loaded, err := servicePool.LoadOrNew(reg.ID, func() (caddy.Destructor, error) {
+		if err := agent.ServiceRegister(reg); err != nil {
+			return nil, errors.Wrapf(err, "unable to register service %s", reg.ID)
+		}
+		rs := &registeredService{agent: agent, id: reg.ID, logger: cs.logger, stop: make(chan struct{})}
+		if reg.Check.TTL != "" {
+			rs.wg.Add(1)
+			go rs.keepPassing(reg.Check.CheckID, cs.serviceCheckTTL())
+		}
+		return rs, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if loaded {
+		if err := val.(*registeredService).agent.ServiceRegister(reg); err != nil {
+			servicePool.Delete(reg.ID)
+			return errors.Wrapf(err, "unable to update service %s", reg.ID)
+		}
+	}
+	cs.serviceRegistered = true
+	cs.logger.Infof("registered Consul service %s as %s", reg.Name, reg.ID)
+	return nil
+}
+
+// deregisterService gives back the registration of registerService, a storage whose Provision failed before
+// registering leaves the service of the running config alone
+func (cs *ConsulStorage) deregisterService() error {
+	if !cs.serviceRegistered {
+		return nil
+	}
+	cs.serviceRegistered = false
+	_, err := servicePool.Delete(cs.serviceID())
+	return err
+}
+
+// keepPassing updates the TTL check twice per TTL until the service is deregistered
+func (rs *registeredService) keepPassing(checkID string, ttl time.Duration) {
+	defer rs.wg.Done()
+	ticker := time.NewTicker(ttl / 2)
+	defer ticker.Stop()
+
+	for {
+		if err := rs.agent.UpdateTTL(checkID, "Caddy is running", consul.HealthPassing); err != nil {
+			rs.logger.Warnf("unable to update check of service %s: %v", rs.id, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-rs.stop:
+			return
+		}
+	}
+}
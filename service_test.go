@@ -0,0 +1,77 @@
+package storageconsul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_RegisterService(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.Service = ServiceConfig{Name: "caddy", ID: "caddy-test", Tags: []string{"edge"}, Port: 443, DeregisterAfter: caddy.Duration(time.Hour)}
+
+	require.NoError(t, cs.registerService())
+	fc.mu.Lock()
+	reg := fc.services["caddy-test"]
+	require.NotNil(t, reg)
+	assert.Equal(t, "caddy", reg.Name)
+	assert.Equal(t, []string{"edge"}, reg.Tags)
+	assert.Equal(t, 443, reg.Port)
+	assert.Equal(t, "30s", reg.Check.TTL)
+	assert.Equal(t, "1h0m0s", reg.Check.DeregisterCriticalServiceAfter)
+	fc.mu.Unlock()
+
+	// the TTL check is passed right away
+	assert.Eventually(t, func() bool {
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		return fc.checks["service:caddy-test"] == consul.HealthPassing
+	}, time.Second, 10*time.Millisecond)
+
+	// a config whose Provision failed before registering doesn't deregister the running service
+	failed := New()
+	failed.ConsulClient = cs.ConsulClient
+	failed.logger = cs.logger
+	failed.Service = cs.Service
+	require.NoError(t, failed.Cleanup())
+	fc.mu.Lock()
+	require.Contains(t, fc.services, "caddy-test")
+	fc.mu.Unlock()
+
+	// the module of a reloaded config updates the registration and keeps it until both are cleaned up
+	reloaded := New()
+	reloaded.ConsulClient = cs.ConsulClient
+	reloaded.logger = cs.logger
+	reloaded.Service = cs.Service
+	reloaded.Service.Port = 8443
+	require.NoError(t, reloaded.registerService())
+	require.NoError(t, cs.deregisterService())
+	fc.mu.Lock()
+	require.Contains(t, fc.services, "caddy-test")
+	assert.Equal(t, 8443, fc.services["caddy-test"].Port)
+	fc.mu.Unlock()
+
+	require.NoError(t, reloaded.deregisterService())
+	fc.mu.Lock()
+	assert.Empty(t, fc.services)
+	assert.Empty(t, fc.checks)
+	fc.mu.Unlock()
+}
+
+func TestConsulStorage_ServiceRegistration(t *testing.T) {
+	cs := New()
+	cs.Service = ServiceConfig{Name: "caddy", CheckHTTP: "http://127.0.0.1:2019/config/"}
+
+	reg := cs.serviceRegistration()
+	assert.Contains(t, reg.ID, "caddy-")
+	assert.Equal(t, "http://127.0.0.1:2019/config/", reg.Check.HTTP)
+	assert.Equal(t, "10s", reg.Check.Interval)
+	assert.Empty(t, reg.Check.TTL)
+
+	cs.Service.CheckTTL = caddy.Duration(time.Minute)
+	assert.Error(t, cs.Validate())
+}
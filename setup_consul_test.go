@@ -0,0 +1,56 @@
+// +build consul
+
+package storageconsul
+
+import (
+	"os/exec"
+	"sync"
+	"testing"
+
+	"github.com/hashicorp/consul/sdk/testutil"
+	"github.com/hashicorp/go-uuid"
+	"github.com/stretchr/testify/require"
+)
+
+// consulServers holds the Consul test server of every running test
+var consulServers sync.Map
+
+// setupConsulEnv returns a storage connected to a Consul test server, run the tests with the consul build tag
+// and the consul binary on the PATH. Storages of the same test share their server like instances connected to
+// the same Consul.
+func setupConsulEnv(t *testing.T) *ConsulStorage {
+	srv := consulServer(t)
+
+	cs, err := NewWithOptions(WithAddress(srv.HTTPAddr), WithToken(srv.Config.ACL.Tokens.Master), WithPrefix(TestPrefix))
+	require.NoError(t, err)
+	t.Cleanup(func() { cs.Cleanup() })
+	return cs
+}
+
+// consulServer returns the Consul test server of t and starts it if there is none yet
+func consulServer(t *testing.T) *testutil.TestServer {
+	if srv, ok := consulServers.Load(t); ok {
+		return srv.(*testutil.TestServer)
+	}
+	if _, err := exec.LookPath("consul"); err != nil {
+		t.Skip("consul not found on the PATH")
+	}
+
+	token, err := uuid.GenerateUUID()
+	require.NoError(t, err)
+	srv, err := testutil.NewTestServerConfigT(t, func(c *testutil.TestServerConfig) {
+		c.ACL.Enabled = true
+		c.ACL.DefaultPolicy = "deny"
+		c.ACL.Tokens.Master = token
+		c.PrimaryDatacenter = "dc1"
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		consulServers.Delete(t)
+		srv.Stop()
+	})
+	srv.WaitForLeader(t)
+
+	consulServers.Store(t, srv)
+	return srv
+}
@@ -0,0 +1,20 @@
+// +build !consul
+
+package storageconsul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// setupConsulEnv returns a storage using the memory backend, so the storage tests run without a Consul
+// server, storages of the same test share their data like instances connected to the same Consul
+func setupConsulEnv(t *testing.T) *ConsulStorage {
+	cs, err := NewWithOptions(WithMemoryBackend(), WithPrefix(TestPrefix))
+	require.NoError(t, err)
+	t.Cleanup(func() { cs.Cleanup() })
+
+	sharedMemoryStore().deleteTree(TestPrefix)
+	return cs
+}
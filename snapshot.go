@@ -0,0 +1,100 @@
+package storageconsul
+
+import (
+	"context"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// snapshotAttempts is the number of times a snapshot is read again when the storage changed while reading it
+const snapshotAttempts = 5
+
+// snapshotPairs returns the raw KV pairs of all namespaces as of a single point in time, so an archive taken
+// while certificates are renewed doesn't mix old and new keys of a bundle. If all namespaces are accessed with
+// the same client the pairs are read in one transaction at a single Raft index, otherwise the namespaces are
+// listed one by one and read again until none of their indexes changed in between.
+func (cs *ConsulStorage) snapshotPairs(ctx context.Context) (consul.KVPairs, error) {
+	namespaces := cs.namespaces()
+	if txn, ok := cs.snapshotTxn(namespaces); ok {
+		return cs.txnSnapshot(ctx, txn, namespaces)
+	}
+
+	for attempt := 1; attempt <= snapshotAttempts; attempt++ {
+		pairs, indexes, err := cs.listSnapshot(ctx, namespaces)
+		if err != nil {
+			return nil, err
+		}
+
+		changed := false
+		for i, ns := range namespaces {
+			_, meta, err := ns.kv.Keys(ns.prefix+"/", "", cs.queryOptions(ctx))
+			if err != nil {
+				return nil, errors.Wrapf(err, "unable to check index of %s", ns.prefix)
+			}
+			if meta.LastIndex != indexes[i] {
+				changed = true
+				break
+			}
+		}
+		if !changed {
+			return pairs, nil
+		}
+		cs.log(ctx).Debugf("storage changed while reading snapshot, attempt %d of %d", attempt, snapshotAttempts)
+	}
+
+	return nil, errors.Errorf("storage kept changing while reading snapshot, gave up after %d attempts", snapshotAttempts)
+}
+
+// snapshotTxn returns the transaction API to read all namespaces with, if they share the same client and
+// fit into one transaction
+func (cs *ConsulStorage) snapshotTxn(namespaces []namespace) (kvTxn, bool) {
+	if len(namespaces) > maxTxnOps {
+		return nil, false
+	}
+	for _, ns := range namespaces {
+		if ns.tenant != nil && ns.tenant.client != nil {
+			return nil, false
+		}
+	}
+	return cs.txn(cs.Prefix)
+}
+
+// txnSnapshot reads the pairs of all namespaces in one read-only transaction
+func (cs *ConsulStorage) txnSnapshot(ctx context.Context, txn kvTxn, namespaces []namespace) (consul.KVPairs, error) {
+	ops := make(consul.TxnOps, 0, len(namespaces))
+	for _, ns := range namespaces {
+		ops = append(ops, &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVGetTree, Key: ns.prefix + "/"}})
+	}
+
+	committed, resp, _, err := txn.Txn(ops, cs.queryOptions(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to read snapshot")
+	}
+	if !committed {
+		return nil, errors.New("unable to read snapshot, transaction rolled back")
+	}
+
+	pairs := make(consul.KVPairs, 0, len(resp.Results))
+	for _, result := range resp.Results {
+		if result.KV != nil {
+			pairs = append(pairs, result.KV)
+		}
+	}
+	return pairs, nil
+}
+
+// listSnapshot lists the pairs of all namespaces and returns them with the index of every namespace
+func (cs *ConsulStorage) listSnapshot(ctx context.Context, namespaces []namespace) (consul.KVPairs, []uint64, error) {
+	var pairs consul.KVPairs
+	indexes := make([]uint64, len(namespaces))
+	for i, ns := range namespaces {
+		nsPairs, meta, err := ns.kv.List(ns.prefix+"/", cs.queryOptions(ctx))
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "unable to list data at %s", ns.prefix)
+		}
+		pairs = append(pairs, nsPairs...)
+		indexes[i] = meta.LastIndex
+	}
+	return pairs, indexes, nil
+}
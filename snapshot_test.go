@@ -0,0 +1,53 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// changingBackend writes to the store while it is listed like a renewal running during a snapshot, it hides
+// the transactions of the store
+type changingBackend struct {
+	kvBackend
+	changes int
+}
+
+func (cb *changingBackend) List(prefix string, q *consul.QueryOptions) (consul.KVPairs, *consul.QueryMeta, error) {
+	pairs, meta, err := cb.kvBackend.List(prefix, q)
+	if cb.changes > 0 {
+		cb.changes--
+		cb.kvBackend.Put(&consul.KVPair{Key: prefix + "renewed", Value: []byte("new")}, nil)
+	}
+	return pairs, meta, err
+}
+
+func TestConsulStorage_SnapshotTxn(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	require.NoError(t, cs.Store("certificates/example.com/example.com.crt", []byte("crt")))
+	require.NoError(t, cs.Store("certificates/example.com/example.com.key", []byte("key")))
+
+	pairs, err := cs.snapshotPairs(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, pairs, 2)
+	assert.Equal(t, 1, fc.txns)
+}
+
+func TestConsulStorage_SnapshotList(t *testing.T) {
+	cs := New()
+	backend := &changingBackend{kvBackend: newMemoryStore(), changes: 2}
+	cs.backend = backend
+	backend.Put(&consul.KVPair{Key: cs.Prefix + "/certificates/example.com/example.com.crt", Value: []byte("crt")}, nil)
+
+	// the first two reads are torn by writes and read again
+	pairs, err := cs.snapshotPairs(context.Background())
+	require.NoError(t, err)
+	assert.Len(t, pairs, 2)
+
+	backend.changes = snapshotAttempts
+	_, err = cs.snapshotPairs(context.Background())
+	assert.Error(t, err)
+}
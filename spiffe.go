@@ -0,0 +1,237 @@
+package storageconsul
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pteich/errors"
+	"golang.org/x/net/http2"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// spiffeHeader is the metadata the SPIFFE Workload API requires on every call
+const spiffeHeader = "workload.spiffe.io"
+
+// spiffeRetryInterval is the pause before the stream of SVIDs is opened again after it broke
+const spiffeRetryInterval = time.Second
+
+// svidSource streams X.509 SVIDs from a SPIFFE Workload API, e.g. the SPIRE agent, and always holds the
+// latest one as client certificate, so rotated short-lived certificates are picked up automatically
+type svidSource struct {
+	client *http.Client
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	err  error
+}
+
+// newSVIDSource connects to the Workload API at socket, a path or unix:// URL, and waits up to timeout
+// for the first SVID
+func newSVIDSource(socket string, timeout time.Duration) (*svidSource, error) {
+	socket = strings.TrimPrefix(socket, "unix://")
+	transport := &http2.Transport{
+		// the Workload API speaks gRPC over plain HTTP/2 on a unix socket
+		AllowHTTP: true,
+		DialTLS: func(_, _ string, _ *tls.Config) (net.Conn, error) {
+			return net.Dial("unix", socket)
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &svidSource{client: &http.Client{Transport: transport}, cancel: cancel, done: make(chan struct{})}
+	ready := make(chan struct{})
+	go s.run(ctx, ready)
+
+	select {
+	case <-ready:
+		return s, nil
+	case <-time.After(timeout):
+		s.close()
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		if s.err != nil {
+			return nil, errors.Wrapf(s.err, "no SVID from the SPIFFE Workload API at %s", socket)
+		}
+		return nil, errors.Errorf("no SVID from the SPIFFE Workload API at %s within %s", socket, timeout)
+	}
+}
+
+// run keeps a stream of SVIDs open until ctx is done, ready is closed once the first SVID arrived
+func (s *svidSource) run(ctx context.Context, ready chan struct{}) {
+	defer close(s.done)
+	var once sync.Once
+	for {
+		err := s.stream(ctx, func() { once.Do(func() { close(ready) }) })
+		if ctx.Err() != nil {
+			return
+		}
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+
+		select {
+		case <-time.After(spiffeRetryInterval):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// stream calls FetchX509SVID and updates the certificate with every response until the stream ends
+func (s *svidSource) stream(ctx context.Context, updated func()) error {
+	// the request is an empty X509SVIDRequest message
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://localhost/SpiffeWorkloadAPI/FetchX509SVID", bytes.NewReader(make([]byte, 5)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/grpc")
+	req.Header.Set("TE", "trailers")
+	req.Header.Set(spiffeHeader, "true")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "unable to call the SPIFFE Workload API")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("SPIFFE Workload API returned %s", resp.Status)
+	}
+
+	for {
+		msg, err := readGRPCMessage(resp.Body)
+		if err != nil {
+			if err == io.EOF {
+				return errors.Errorf("SPIFFE Workload API closed the stream: %s %s", resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message"))
+			}
+			return errors.Wrap(err, "unable to read from the SPIFFE Workload API")
+		}
+
+		cert, err := parseX509SVIDResponse(msg)
+		if err != nil {
+			return err
+		}
+		s.mu.Lock()
+		s.cert, s.err = cert, nil
+		s.mu.Unlock()
+		updated()
+	}
+}
+
+// clientCertificate implements tls.Config.GetClientCertificate with the latest SVID
+func (s *svidSource) clientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.cert == nil {
+		return nil, errors.New("no SVID available")
+	}
+	return s.cert, nil
+}
+
+// close stops streaming SVIDs
+func (s *svidSource) close() {
+	s.cancel()
+	<-s.done
+}
+
+// readGRPCMessage reads one length-prefixed message of a gRPC stream
+func readGRPCMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	if prefix[0] != 0 {
+		return nil, errors.New("compressed gRPC messages are not supported")
+	}
+	msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// parseX509SVIDResponse returns the first, default SVID of an X509SVIDResponse as TLS certificate
+func parseX509SVIDResponse(msg []byte) (*tls.Certificate, error) {
+	var svid []byte
+	err := consumeFields(msg, func(num protowire.Number, value []byte) {
+		// field 1 holds the SVIDs
+		if num == 1 && svid == nil {
+			svid = value
+		}
+	})
+	if err != nil || svid == nil {
+		return nil, errors.New("invalid X509SVIDResponse from the SPIFFE Workload API")
+	}
+
+	var chain, key []byte
+	err = consumeFields(svid, func(num protowire.Number, value []byte) {
+		switch num {
+		case 2:
+			chain = value
+		case 3:
+			key = value
+		}
+	})
+	if err != nil {
+		return nil, errors.New("invalid X509SVID from the SPIFFE Workload API")
+	}
+
+	certs, err := x509.ParseCertificates(chain)
+	if err != nil || len(certs) == 0 {
+		return nil, errors.New("invalid certificate chain in SVID")
+	}
+	privateKey, err := x509.ParsePKCS8PrivateKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid private key in SVID")
+	}
+
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key in SVID")
+	}
+
+	cert := &tls.Certificate{PrivateKey: signer, Leaf: certs[0]}
+	for _, c := range certs {
+		cert.Certificate = append(cert.Certificate, c.Raw)
+	}
+	return cert, nil
+}
+
+// consumeFields calls field with the number and value of every length-delimited field of the protobuf
+// message msg and skips all others
+func consumeFields(msg []byte, field func(num protowire.Number, value []byte)) error {
+	for len(msg) > 0 {
+		num, typ, n := protowire.ConsumeTag(msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+
+		if typ == protowire.BytesType {
+			value, n := protowire.ConsumeBytes(msg)
+			if n < 0 {
+				return protowire.ParseError(n)
+			}
+			field(num, value)
+			msg = msg[n:]
+			continue
+		}
+		n = protowire.ConsumeFieldValue(num, typ, msg)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		msg = msg[n:]
+	}
+	return nil
+}
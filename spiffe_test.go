@@ -0,0 +1,147 @@
+package storageconsul
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// newSVIDResponse returns an X509SVIDResponse with a new key and self-signed certificate for spiffeID
+func newSVIDResponse(t *testing.T, spiffeID string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	id, err := url.Parse(spiffeID)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		URIs:         []*url.URL{id},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	var svid []byte
+	svid = protowire.AppendTag(svid, 1, protowire.BytesType)
+	svid = protowire.AppendString(svid, spiffeID)
+	svid = protowire.AppendTag(svid, 2, protowire.BytesType)
+	svid = protowire.AppendBytes(svid, cert)
+	svid = protowire.AppendTag(svid, 3, protowire.BytesType)
+	svid = protowire.AppendBytes(svid, pkcs8)
+
+	var resp []byte
+	resp = protowire.AppendTag(resp, 1, protowire.BytesType)
+	return protowire.AppendBytes(resp, svid)
+}
+
+// startWorkloadAPI serves a fake SPIFFE Workload API on a unix socket that streams the responses sent to svids
+func startWorkloadAPI(t *testing.T, svids <-chan []byte) string {
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	l, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/SpiffeWorkloadAPI/FetchX509SVID" || r.Header.Get(spiffeHeader) != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/grpc")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case msg := <-svids:
+				prefix := make([]byte, 5)
+				binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+				w.Write(append(prefix, msg...))
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+	srv := &http.Server{Handler: h2c.NewHandler(handler, &http2.Server{})}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+
+	return "unix://" + socket
+}
+
+func TestSVIDSource(t *testing.T) {
+	svids := make(chan []byte, 1)
+	socket := startWorkloadAPI(t, svids)
+
+	svids <- newSVIDResponse(t, "spiffe://example.org/caddy")
+	source, err := newSVIDSource(socket, 5*time.Second)
+	require.NoError(t, err)
+	defer source.close()
+
+	cert, err := source.clientCertificate(nil)
+	require.NoError(t, err)
+	first := cert.Leaf.SerialNumber
+
+	// rotated SVIDs replace the certificate
+	svids <- newSVIDResponse(t, "spiffe://example.org/caddy")
+	require.Eventually(t, func() bool {
+		cert, err := source.clientCertificate(nil)
+		return err == nil && cert.Leaf.SerialNumber.Cmp(first) != 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSVIDSource_Timeout(t *testing.T) {
+	socket := startWorkloadAPI(t, make(chan []byte))
+	_, err := newSVIDSource(socket, 100*time.Millisecond)
+	assert.Error(t, err)
+}
+
+func TestConnectionConfig_Spiffe(t *testing.T) {
+	svids := make(chan []byte, 1)
+	svids <- newSVIDResponse(t, "spiffe://example.org/caddy")
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.PeerCertificates) == 0 || r.TLS.PeerCertificates[0].URIs[0].String() != "spiffe://example.org/caddy" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(`{"Config":{"NodeName":"test"}}`))
+	}))
+	srv.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	srv.StartTLS()
+	defer srv.Close()
+
+	sum := sha256.Sum256(srv.Certificate().RawSubjectPublicKeyInfo)
+	cc := ConnectionConfig{
+		Address:          srv.Listener.Addr().String(),
+		TlsEnabled:       true,
+		TlsServerCertPin: base64.StdEncoding.EncodeToString(sum[:]),
+		SpiffeSocket:     startWorkloadAPI(t, svids),
+		Timeout:          DefaultTimeout,
+	}
+
+	// Consul only answers the ping with the SVID as client certificate
+	sc, err := cc.newClient()
+	require.NoError(t, err)
+	sc.Destruct()
+}
@@ -0,0 +1,92 @@
+package storageconsul
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// statCacheSweepSize is the number of entries above which expired entries are removed on insert
+const statCacheSweepSize = 1024
+
+// statCache remembers recent Exists and Stat results for a short time
+type statCache struct {
+	mu      sync.Mutex
+	entries map[string]statEntry
+}
+
+type statEntry struct {
+	exists  bool
+	info    *certmagic.KeyInfo
+	expires time.Time
+}
+
+func newStatCache() *statCache {
+	return &statCache{entries: make(map[string]statEntry)}
+}
+
+// get returns the cached entry of key if there is one that didn't expire yet
+func (sc *statCache) get(key string) (statEntry, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	entry, ok := sc.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return statEntry{}, false
+	}
+	return entry, true
+}
+
+// set caches whether key exists and its info if known for ttl
+func (sc *statCache) set(key string, exists bool, info *certmagic.KeyInfo, ttl time.Duration) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	now := time.Now()
+	if len(sc.entries) >= statCacheSweepSize {
+		for k, entry := range sc.entries {
+			if now.After(entry.expires) {
+				delete(sc.entries, k)
+			}
+		}
+	}
+
+	sc.entries[key] = statEntry{exists: exists, info: info, expires: now.Add(ttl)}
+}
+
+// invalidate removes key after it was written or deleted
+func (sc *statCache) invalidate(key string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	delete(sc.entries, key)
+}
+
+// invalidatePrefix removes all keys below prefix after they were deleted
+func (sc *statCache) invalidatePrefix(prefix string) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	for key := range sc.entries {
+		if strings.HasPrefix(key, prefix) {
+			delete(sc.entries, key)
+		}
+	}
+}
+
+// cachedStat returns the statCache if caching is enabled
+func (cs *ConsulStorage) cachedStat() *statCache {
+	if cs.StatCacheTTL <= 0 || cs.statCache == nil {
+		return nil
+	}
+	return cs.statCache
+}
+
+// invalidateStat drops the cached Exists and Stat results of key
+func (cs *ConsulStorage) invalidateStat(key string) {
+	if cache := cs.cachedStat(); cache != nil {
+		cache.invalidate(key)
+	}
+}
@@ -0,0 +1,55 @@
+package storageconsul
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_StatCache(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.StatCacheTTL = caddy.Duration(time.Minute)
+
+	key := "certificates/example.com/example.com.crt"
+	assert.False(t, cs.Exists(key))
+
+	// a write of another instance isn't seen until the entry expires
+	other := New()
+	other.ConsulClient = cs.ConsulClient
+	require.NoError(t, other.Store(key, []byte("crt")))
+	assert.False(t, cs.Exists(key))
+	_, err := cs.Stat(key)
+	assert.Error(t, err)
+
+	// local writes invalidate the cache
+	require.NoError(t, cs.Store(key, []byte("crt data")))
+	assert.True(t, cs.Exists(key))
+	info, err := cs.Stat(key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), info.Size)
+
+	// the info is cached as well
+	delete(fc.kv, cs.prefixKey(key))
+	info, err = cs.Stat(key)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), info.Size)
+
+	require.NoError(t, other.Store(key, []byte("crt")))
+	require.NoError(t, cs.Delete(key))
+	assert.False(t, cs.Exists(key))
+}
+
+func TestStatCache_Expires(t *testing.T) {
+	sc := newStatCache()
+
+	sc.set("key", true, nil, time.Millisecond)
+	_, ok := sc.get("key")
+	assert.True(t, ok)
+
+	time.Sleep(5 * time.Millisecond)
+	_, ok = sc.get("key")
+	assert.False(t, ok)
+}
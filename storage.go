@@ -2,12 +2,12 @@ package storageconsul
 
 import (
 	"context"
-	"net"
 	"path"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/certmagic"
 	consul "github.com/hashicorp/consul/api"
 	"github.com/pteich/errors"
@@ -22,82 +22,383 @@ type ConsulStorage struct {
 	ConsulClient *consul.Client
 	logger       *zap.SugaredLogger
 	muLocks      sync.RWMutex
-	locks        map[string]*consul.Lock
+	locks        map[string]*heldLock
+	localLocks   *localLocker
+	successor    *ConsulStorage
+	backend      kvBackend
+	statCache    *statCache
+	writes       *writeCoalescer
+	seenIndexes  *keyIndexes
+	quotaUsage   *quotaUsage
+	sharedClient *sharedClient
+	muAlerts     sync.Mutex
+	alerts       *decryptAlerter
+	instanceID   string
+	stopBackups  chan struct{}
+	stopLockGC   chan struct{}
+	stopExpiry   chan struct{}
+	stopScan     chan struct{}
+
+	// serviceRegistered is set once registerService holds a reference to the service in servicePool
+	serviceRegistered bool
+
+	// ConnectionConfig holds the settings to connect to Consul,
+	// they are ignored if a named Connection of the consul app is used
+	ConnectionConfig
+
+	// Name tells apart several storages of one process, e.g. of different sites. A named storage only reads
+	// environment variables suffixed with its upper-cased name, like CONSUL_HTTP_ADDR_EU for eu, logs its
+	// name and is picked in the admin API with ?instance=<name>.
+	Name string `json:"name"`
+
+	// Connection references a connection defined in the consul app by name
+	Connection string `json:"connection"`
+
+	// Backend selects where values are stored, "consul" for Consul KV (the default) or "nomad"
+	// for Nomad Variables reached with the Nomad settings and the HTTP settings of ConnectionConfig
+	Backend string      `json:"backend"`
+	Nomad   NomadConfig `json:"nomad"`
 
-	Address     string `json:"address"`
-	Token       string `json:"token"`
-	Timeout     int    `json:"timeout"`
 	Prefix      string `json:"prefix"`
 	ValuePrefix string `json:"value_prefix"`
 	AESKey      []byte `json:"aes_key"`
-	TlsEnabled  bool   `json:"tls_enabled"`
-	TlsInsecure bool   `json:"tls_insecure"`
+
+	// PreviousAESKeys are tried if a value can't be decrypted with AESKey after the key was rotated,
+	// with ReencryptOnLoad such values are rewritten with AESKey when they are loaded
+	PreviousAESKeys [][]byte `json:"previous_aes_keys"`
+	ReencryptOnLoad bool     `json:"reencrypt_on_load"`
+
+	// AllowUnencryptedMigration reads unencrypted values of keys that should be encrypted and encrypts them on
+	// Load. It is meant for the move to an AES key only, as anyone with write access to Consul could inject
+	// values that would be trusted afterwards.
+	AllowUnencryptedMigration bool `json:"allow_unencrypted_migration"`
+
+	// LegacyValueFormat writes values without the versioned format header, so instances running older
+	// versions of the plugin can still read them during a rolling upgrade
+	LegacyValueFormat bool `json:"legacy_value_format"`
+
+	// RequireBoundValues rejects encrypted values that aren't bound to their key instead of migrating them, it
+	// should be enabled once all values were rewritten so values copied from another key aren't accepted
+	RequireBoundValues bool `json:"require_bound_values"`
+
+	// ArmorValues stores values base64 encoded as PEM block so they can be copied from the Consul CLI and
+	// diffed, values in either mode are read regardless of the setting
+	ArmorValues bool `json:"armor_values"`
+
+	// ValueEnvelope is "binary" (the default) to store values as format header and payload or "json" to store
+	// them as JSON document with the version, the payload, its checksum, the modification time and size
+	ValueEnvelope string `json:"value_envelope"`
+
+	// FallbackPrefix is an old prefix that is read from if a key is not found below Prefix,
+	// writes only go to Prefix so the data moves over while it is renewed
+	FallbackPrefix string `json:"fallback_prefix"`
+
+	// ReadTimeout, WriteTimeout, ListTimeout and LockTimeout limit the duration of the
+	// single operations, a zero value means no limit besides the one of the caller
+	ReadTimeout  caddy.Duration `json:"read_timeout"`
+	WriteTimeout caddy.Duration `json:"write_timeout"`
+	ListTimeout  caddy.Duration `json:"list_timeout"`
+	LockTimeout  caddy.Duration `json:"lock_timeout"`
+
+	// HashLongKeys stores keys whose Consul key would be longer than MaxKeyLength under their hash,
+	// the original key is kept in the stored value
+	HashLongKeys bool `json:"hash_long_keys"`
+	MaxKeyLength int  `json:"max_key_length"`
+
+	// KeySeparator joins the segments of keys below the prefix instead of "/", e.g. "." stores
+	// certificates/example.com as certificates.example%2Ecom
+	KeySeparator string `json:"key_separator"`
+
+	// FlatKeys stores all keys under the hash of their full path, so there is no hierarchy below the prefix
+	FlatKeys bool `json:"flat_keys"`
+
+	// DetectOverwrites warns when a store overwrites a value that another writer changed since this instance
+	// loaded or stored it, which points to split-brain or several instances issuing the same certificate
+	DetectOverwrites bool `json:"detect_overwrites"`
+
+	// Layout is the layout of the stored values, "native" (the default), "raw" to read and write bare values
+	// like other storage plugins or "mixed" to write native values but read raw values as well
+	Layout string `json:"layout"`
+
+	// Compression compresses stored values, "zstd" uses a dictionary trained on certificate data
+	Compression string `json:"compression"`
+
+	// DedupValues stores values of at least DedupMinSize bytes once under their content hash,
+	// keys with identical values only reference it
+	DedupValues  bool `json:"dedup_values"`
+	DedupMinSize int  `json:"dedup_min_size"`
+
+	// Tenants keeps the keys of each tenant under a separate prefix accessed with a separate token,
+	// the tenant of a key is selected by its key prefixes
+	Tenants map[string]*Tenant `json:"tenants"`
+
+	// AccountPrefix keeps ACME accounts and their private keys under a separate prefix accessed with the
+	// AccountToken, so instances that only serve certificates don't need a token that can read them
+	AccountPrefix string `json:"account_prefix"`
+	AccountToken  string `json:"account_token"`
+
+	// StatCacheTTL caches the results of Exists and Stat for a short time to absorb bursts of
+	// lookups, local writes invalidate the cache of their key, zero disables the cache
+	StatCacheTTL caddy.Duration `json:"stat_cache_ttl"`
+
+	// KeyPolicies relax consistency, encryption and locking for classes of keys, RelaxedOCSP
+	// applies all of them to OCSP staples
+	KeyPolicies map[string]*KeyPolicy `json:"key_policies"`
+	RelaxedOCSP bool                  `json:"relaxed_ocsp"`
+
+	// RecursiveDelete makes Delete of a key that doesn't exist delete all keys below it as a directory,
+	// directories directly below the prefix like certificates are never deleted as a whole
+	RecursiveDelete bool `json:"recursive_delete"`
+
+	// FairLocks queues up instances waiting for a lock so it is handed out roughly in the order it was
+	// asked for, instead of to whichever instance retries first
+	FairLocks bool `json:"fair_locks"`
+
+	// DisableLocks makes Lock and Unlock purely in-process, only use it with a single Caddy instance
+	DisableLocks bool `json:"disable_locks"`
+
+	// VerifyOnStart stores, loads and deletes a test key and acquires a lock during Provision, so
+	// Caddy doesn't start with a storage that doesn't work
+	VerifyOnStart bool `json:"verify_on_start"`
+
+	// LockRetryInterval is the initial pause between attempts to acquire a contended lock, it grows with
+	// every attempt up to LockMaxRetryInterval, zero values use the defaults
+	LockRetryInterval    caddy.Duration `json:"lock_retry_interval"`
+	LockMaxRetryInterval caddy.Duration `json:"lock_max_retry_interval"`
+
+	// LockSessionBehavior is the behavior of lock sessions once they are invalidated, with "delete"
+	// lock keys are removed instead of released so they don't pile up, the default is "release"
+	LockSessionBehavior string `json:"lock_session_behavior"`
+
+	// LockGCInterval is the interval in which lock keys left behind by released locks and crashed instances
+	// are deleted, zero disables the collection. LockGCMaxAge additionally frees locks held for longer.
+	LockGCInterval caddy.Duration `json:"lock_gc_interval"`
+	LockGCMaxAge   caddy.Duration `json:"lock_gc_max_age"`
+
+	// SlowLockThreshold is the time waiting for a lock after which a warning is logged,
+	// zero uses the default and a negative value disables the warning
+	SlowLockThreshold caddy.Duration `json:"slow_lock_threshold"`
+
+	// ConsulMaxValueSize is the kv_max_value_size of the Consul cluster, 512 KiB by default. Stored values
+	// above ValueSizeWarning percent of it are logged, the default is 80 and a negative value disables it.
+	ConsulMaxValueSize int `json:"consul_max_value_size"`
+	ValueSizeWarning   int `json:"value_size_warning"`
+
+	// MaxValueSize rejects writes of values larger than this many bytes with a ValueTooLargeError
+	// before they reach Consul, zero means no limit
+	MaxValueSize int `json:"max_value_size"`
+
+	// LogLevel is the level of the storage's logger independent of Caddy's logs, entries more verbose than
+	// Caddy's logs accept are written to stderr
+	LogLevel string `json:"log_level"`
+
+	// LogSampleInterval, LogSampleFirst and LogSampleThereafter sample the storage's log entries, of each
+	// message the first entries per interval are logged and every thereafter-th one after that
+	LogSampleInterval   caddy.Duration `json:"log_sample_interval"`
+	LogSampleFirst      int            `json:"log_sample_first"`
+	LogSampleThereafter int            `json:"log_sample_thereafter"`
+
+	// CertEvents fires the Consul user events caddy-cert-updated and caddy-cert-deleted with the domain as
+	// payload whenever a certificate is stored or deleted
+	CertEvents bool `json:"cert_events"`
+
+	// IntegrityScanInterval is the interval in which stored values are checked to decrypt and match their
+	// checksum, zero disables the scan. IntegrityScanSample limits a scan to that many random values.
+	IntegrityScanInterval caddy.Duration `json:"integrity_scan_interval"`
+	IntegrityScanSample   int            `json:"integrity_scan_sample"`
+
+	// OnLockLost is called with the key of a held lock that another instance took over, the work
+	// guarded by the lock should be aborted as it may be done twice
+	OnLockLost func(key string) `json:"-"`
+
+	// OnDecryptFailure is called with the key and the error of a loaded value that can't be decrypted
+	OnDecryptFailure func(key string, err error) `json:"-"`
+
+	// DecryptFailureWebhook is an URL a DecryptFailure is posted to whenever a loaded value can't be decrypted
+	DecryptFailureWebhook string `json:"decrypt_failure_webhook"`
+
+	// ChallengeTokenTTL expires ACME challenge tokens this long after they were stored, so tokens left behind
+	// by an issuance are deleted even if certmagic doesn't clean them up
+	ChallengeTokenTTL caddy.Duration `json:"challenge_token_ttl"`
+
+	// Quotas limits the keys and bytes stored below top-level prefixes like certificates, writes exceeding
+	// them fail with a QuotaExceededError
+	Quotas map[string]*Quota `json:"quotas"`
+
+	// OnQuotaExceeded is called with every write rejected by a quota
+	OnQuotaExceeded func(err QuotaExceededError) `json:"-"`
+
+	// Backup configures scheduled encrypted backups to an S3-compatible object storage
+	Backup BackupConfig `json:"backup"`
+
+	// Service registers the Caddy instance as a Consul service on Provision and deregisters it on Cleanup
+	Service ServiceConfig `json:"service"`
 }
 
 // New connects to Consul and returns a ConsulStorage
 func New() *ConsulStorage {
 	// create ConsulStorage and pre-set values
 	s := ConsulStorage{
-		locks:       make(map[string]*consul.Lock),
-		AESKey:      []byte(DefaultAESKey),
-		ValuePrefix: DefaultValuePrefix,
-		Prefix:      DefaultPrefix,
-		Timeout:     DefaultTimeout,
+		locks:           make(map[string]*heldLock),
+		localLocks:      newLocalLocker(),
+		statCache:       newStatCache(),
+		writes:          newWriteCoalescer(),
+		seenIndexes:     newKeyIndexes(),
+		quotaUsage:      newQuotaUsage(),
+		AESKey:          []byte(DefaultAESKey),
+		ReencryptOnLoad: true,
+		ValuePrefix:     DefaultValuePrefix,
+		Prefix:          DefaultPrefix,
+		logger:          zap.NewNop().Sugar(),
+		ConnectionConfig: ConnectionConfig{
+			Timeout: DefaultTimeout,
+		},
 	}
 
 	return &s
 }
 
+// prefixKey returns the Consul KV key for key
 func (cs *ConsulStorage) prefixKey(key string) string {
-	return path.Join(cs.Prefix, key)
+	if cs.isHashedKey(key) {
+		return cs.hashedKey(key)
+	}
+	return cs.rawPrefixKey(key)
 }
 
-// Lock acquires a distributed lock for the given key or blocks until it gets one
-func (cs *ConsulStorage) Lock(ctx context.Context, key string) error {
-	cs.logger.Debugf("trying lock for %s", key)
+// rawPrefixKey returns the Consul KV key for key without hashing long keys
+func (cs *ConsulStorage) rawPrefixKey(key string) string {
+	return path.Join(cs.keyPrefix(key), cs.encodeKey(key))
+}
+
+// storageKey returns the storage key for a Consul KV key below prefix
+func (cs *ConsulStorage) storageKey(prefix, consulKey string) string {
+	return cs.decodeKey(strings.TrimPrefix(consulKey, prefix+"/"))
+}
+
+// Lock acquires a distributed lock for the given key or blocks until it gets one.
+// Goroutines of the same process first wait for a local lock so that only one
+// of them at a time holds a Consul session for a key. It returns a LockTimeoutError
+// once ctx is done or the LockTimeout passed.
+func (cs *ConsulStorage) Lock(ctx context.Context, key string) (err error) {
+	// every spelling of a domain has to wait for the same lock
+	key = normalizeKey(key)
+	ctx, log := cs.startOperation(ctx)
+	log.Debugf("trying lock for %s", key)
+
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, cs.LockTimeout)
+	defer cancel()
 
-	if _, isLocked := cs.GetLock(key); isLocked {
+	start := time.Now()
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			err = LockTimeoutError{Key: key, Waited: time.Since(start), Err: ctx.Err()}
+		}
+		cs.observeLockWait(ctx, key, time.Since(start), err)
+	}()
+
+	if err := cs.localLocks.lock(ctx, key); err != nil {
+		return errors.Wrapf(err, "unable to obtain local lock for %s", cs.prefixKey(key))
+	}
+
+	if cs.localLocksOnly(key) {
 		return nil
 	}
 
 	// prepare the distributed lock
-	cs.logger.Debugf("creating Consul lock for %s", key)
-	lock, err := cs.ConsulClient.LockOpts(&consul.LockOptions{
-		Key:          cs.prefixKey(key),
-		LockWaitTime: time.Duration(cs.Timeout) * time.Second,
-		LockTryOnce:  true,
-	})
+	log.Debugf("creating Consul lock for %s", key)
+	lock, err := cs.newLocker(key)
 	if err != nil {
+		cs.localLocks.unlock(key)
 		return errors.Wrapf(err, "could not create lock for %s", cs.prefixKey(key))
 	}
 
-	// acquire the lock and return a channel that is closed upon lost
-	lockActive, err := lock.Lock(ctx.Done())
-	if err != nil {
-		return errors.Wrapf(err, "unable to lock %s", cs.prefixKey(key))
+	// with fair locks waiters queue up and only the first one in the queue tries to get the lock
+	var ticket *lockTicket
+	if cs.FairLocks {
+		ticket, err = cs.enqueueLock(ctx, key)
+		if err != nil {
+			cs.localLocks.unlock(key)
+			return err
+		}
+		defer cs.dequeueLock(key, ticket)
 	}
 
-	// auto-unlock and clean list of locks in case of lost
-	go func() {
-		<-lockActive
-		cs.Unlock(key)
-	}()
+	// acquire the lock and return a channel that is closed upon lost,
+	// a nil channel means the lock is still taken so we retry until ctx is done
+	var lockActive <-chan struct{}
+	backoff := cs.newLockBackoff()
+	for {
+		turn, err := cs.lockTurn(ctx, key, ticket)
+		if err != nil {
+			log.Warnf("unable to check lock queue of %s: %v", key, err)
+			// fall back to unordered acquisition rather than waiting for a broken queue
+			turn = true
+		}
+
+		if turn {
+			lockActive, err = lock.Lock(ctx.Done())
+			if err != nil {
+				cs.localLocks.unlock(key)
+				return errors.Wrapf(err, "unable to lock %s", cs.prefixKey(key))
+			}
+			if lockActive != nil {
+				break
+			}
+			log.Debugf("Consul lock for %s is taken, retrying", key)
+		} else {
+			log.Debugf("waiting in queue for Consul lock of %s", key)
+		}
+
+		lockRetries.Add(1)
+		select {
+		case <-ctx.Done():
+			cs.localLocks.unlock(key)
+			return errors.Wrapf(ctx.Err(), "unable to lock %s", cs.prefixKey(key))
+		case <-time.After(backoff.wait()):
+		}
+	}
+
+	// a lost lock is only reacquired if its key is as this acquisition left it
+	state, err := cs.readLockState(key)
+	if err != nil {
+		log.Warnf("unable to read the state of lock %s, it won't be reacquired if lost: %v", key, err)
+	}
 
 	// save the lock
+	h := newHeldLock(lock, lockActive, state, log)
 	cs.muLocks.Lock()
-	cs.locks[key] = lock
+	cs.locks[key] = h
 	cs.muLocks.Unlock()
+	heldLocks.Add(1)
+
+	// reacquire the lock in case of lost, the local lock is kept until Unlock is called
+	go cs.watchLock(key, h)
 
 	return nil
 }
 
+// GetLock returns the Consul lock for key if this instance holds it, with the Nomad backend
+// there are no Consul locks and CheckLock has to be used instead
 func (cs *ConsulStorage) GetLock(key string) (*consul.Lock, bool) {
+	key = normalizeKey(key)
+	if next := cs.lockSuccessor(key); next != nil {
+		return next.GetLock(key)
+	}
+
 	cs.muLocks.RLock()
 	defer cs.muLocks.RUnlock()
 
 	// if we already hold the lock, return early
-	if lock, exists := cs.locks[key]; exists {
-		return lock, true
+	if h, exists := cs.locks[key]; exists {
+		if lock, lost := h.current(); !lost {
+			consulLock, ok := lock.(*consul.Lock)
+			return consulLock, ok
+		}
 	}
 
 	return nil, false
@@ -105,120 +406,433 @@ func (cs *ConsulStorage) GetLock(key string) (*consul.Lock, bool) {
 
 // Unlock releases a specific lock
 func (cs *ConsulStorage) Unlock(key string) error {
-	cs.muLocks.Lock()
-	defer cs.muLocks.Unlock()
+	key = normalizeKey(key)
+	// locks taken before a config reload are released by the storage of the new config
+	if next := cs.lockSuccessor(key); next != nil {
+		return next.Unlock(key)
+	}
+
+	// the local lock is always released, even if the Consul lock got lost in between
+	defer cs.localLocks.unlock(key)
+
+	if cs.localLocksOnly(key) {
+		return nil
+	}
 
 	// check if we own it and unlock
-	lock, exists := cs.GetLock(key)
+	cs.muLocks.Lock()
+	h, exists := cs.locks[key]
+	delete(cs.locks, key)
+	if exists {
+		close(h.released)
+	}
+	cs.muLocks.Unlock()
 	if !exists {
 		return errors.Errorf("lock %s not found", cs.prefixKey(key))
 	}
+	heldLocks.Add(-1)
+	lock, lost := h.current()
+	if lost {
+		return LockLostError{Key: key}
+	}
 
 	err := lock.Unlock()
-	if err != nil {
+	if err == consul.ErrLockNotHeld {
+		// the lock got lost and is being reacquired right now
+		return LockLostError{Key: key}
+	} else if err != nil {
 		return errors.Wrapf(err, "unable to unlock %s", cs.prefixKey(key))
 	}
 
-	delete(cs.locks, key)
+	if cs.deletesLockKeys() {
+		cs.deleteLockKey(key)
+	}
+
+	return nil
+}
+
+// releaseLocks unlocks all Consul locks held by this instance which also destroys their sessions
+func (cs *ConsulStorage) releaseLocks() error {
+	cs.muLocks.Lock()
+	locks := cs.locks
+	cs.locks = make(map[string]*heldLock)
+	for _, h := range locks {
+		close(h.released)
+	}
+	cs.muLocks.Unlock()
+	heldLocks.Add(-int64(len(locks)))
+
+	var errs []error
+	for key, h := range locks {
+		h.logger.Debugf("releasing Consul lock for %s", key)
+		lock, lost := h.current()
+		if lost {
+			continue
+		}
+		if err := lock.Unlock(); err != nil && err != consul.ErrLockNotHeld {
+			errs = append(errs, errors.Wrapf(err, "unable to unlock %s", cs.prefixKey(key)))
+		} else if err == nil && cs.deletesLockKeys() {
+			cs.deleteLockKey(key)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Errorf("unable to release %d locks: %v", len(errs), errs)
+	}
+
 	return nil
 }
 
+// withTimeout derives a context from ctx that is canceled after timeout, if there is one
+func withTimeout(ctx context.Context, timeout caddy.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, time.Duration(timeout))
+}
+
+// queryOptions returns the options for consistent reads bound to ctx
+func (cs *ConsulStorage) queryOptions(ctx context.Context) *consul.QueryOptions {
+	return (&consul.QueryOptions{RequireConsistent: true}).WithContext(ctx)
+}
+
+// writeOptions returns the options for writes bound to ctx
+func (cs *ConsulStorage) writeOptions(ctx context.Context) *consul.WriteOptions {
+	return (&consul.WriteOptions{}).WithContext(ctx)
+}
+
 // Store saves encrypted data value for a key in Consul KV
-func (cs ConsulStorage) Store(key string, value []byte) error {
-	kv := &consul.KVPair{Key: cs.prefixKey(key)}
+func (cs *ConsulStorage) Store(key string, value []byte) error {
+	return cs.StoreContext(context.Background(), key, value)
+}
+
+// StoreContext saves encrypted data value for a key in Consul KV and aborts once ctx is done
+func (cs *ConsulStorage) StoreContext(ctx context.Context, key string, value []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	if cs.comparesAndSets(key) {
+		return cs.storeComparing(ctx, key, value)
+	}
+
+	// bursts of writes to keys like OCSP staples only write their last value
+	if window := cs.coalesceWindow(key); window > 0 {
+		return cs.writes.store(ctx, key, value, window, cs.storeValue)
+	}
+	return cs.storeValue(ctx, key, value)
+}
+
+// storeValue encodes and writes value for key
+func (cs *ConsulStorage) storeValue(ctx context.Context, key string, value []byte) error {
+	ctx, cancel := withTimeout(ctx, cs.WriteTimeout)
+	defer cancel()
+	defer cs.invalidateStat(key)
+
+	ctx, log := cs.startOperation(ctx)
+	log.Debugf("storing data in Consul for %s", key)
+
+	kv, err := cs.encodePair(ctx, key, value)
+	if err != nil {
+		return err
+	}
+
+	if err := cs.reserveQuota(ctx, key, kv); err != nil {
+		return err
+	}
+
+	if cs.DetectOverwrites {
+		err = cs.storeDetecting(ctx, key, kv)
+	} else if _, err = cs.kv(key).Put(kv, cs.writeOptions(ctx)); err != nil {
+		err = errors.Wrapf(err, "unable to store data for %s", cs.prefixKey(key))
+	}
+	if err != nil {
+		cs.quotaUsage.forget(quotaPrefix(key))
+		return err
+	}
+	if cs.writesConsistently(key) {
+		if err := cs.confirmWrite(ctx, key, kv); err != nil {
+			return err
+		}
+	}
+
+	cs.fireCertEvent(ctx, CertUpdatedEvent, key)
+	return nil
+}
+
+// encodePair returns the KV pair to store value of key with, large values are stored as blobs right away
+func (cs *ConsulStorage) encodePair(ctx context.Context, key string, value []byte) (*consul.KVPair, error) {
+	if err := cs.checkMaxValueSize(key, value); err != nil {
+		return nil, err
+	}
+	if cs.writesRawValues() {
+		return cs.encodeRawPair(key, value), nil
+	}
 
 	// prepare the stored data
 	consulData := &StorageData{
 		Value:    value,
 		Modified: time.Now(),
+		Checksum: checksum(value),
 	}
-
-	encryptedValue, err := cs.EncryptStorageData(consulData)
-	if err != nil {
-		return errors.Wrapf(err, "unable to encode data for %s", cs.prefixKey(key))
+	if cs.isHashedKey(key) {
+		consulData.Key = key
 	}
 
-	kv.Value = encryptedValue
+	// large values are stored once under their content hash and only referenced here
+	if cs.dedupsValue(value) {
+		hash, err := cs.storeBlob(ctx, key, value)
+		if err != nil {
+			return nil, err
+		}
+		consulData.Value, consulData.Blob = nil, hash
+	} else if err := cs.compressData(consulData); err != nil {
+		return nil, errors.Wrapf(err, "unable to compress data for %s", cs.prefixKey(key))
+	}
 
-	if _, err = cs.ConsulClient.KV().Put(kv, nil); err != nil {
-		return errors.Wrapf(err, "unable to store data for %s", cs.prefixKey(key))
+	encryptedValue, err := cs.encodeStorageData(key, consulData)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to encode data for %s", cs.prefixKey(key))
 	}
 
-	return nil
+	cs.checkValueSize(ctx, cs.prefixKey(key), len(encryptedValue))
+	return &consul.KVPair{Key: cs.prefixKey(key), Value: encryptedValue, Flags: cs.valueFlags(key, consulData)}, nil
 }
 
 // Load retrieves the value for a key from Consul KV
-func (cs ConsulStorage) Load(key string) ([]byte, error) {
-	cs.logger.Debugf("loading data from Consul for %s", key)
+func (cs *ConsulStorage) Load(key string) ([]byte, error) {
+	return cs.LoadContext(context.Background(), key)
+}
+
+// LoadContext retrieves the value for a key from Consul KV and aborts once ctx is done
+func (cs *ConsulStorage) LoadContext(ctx context.Context, key string) ([]byte, error) {
+	ctx, cancel := withTimeout(ctx, cs.ReadTimeout)
+	defer cancel()
+	ctx, _ = cs.startOperation(ctx)
 
-	kv, _, err := cs.ConsulClient.KV().Get(cs.prefixKey(key), &consul.QueryOptions{RequireConsistent: true})
+	contents, err := cs.loadStorageData(ctx, key)
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to obtain data for %s", cs.prefixKey(key))
-	} else if kv == nil {
-		return nil, certmagic.ErrNotExist(errors.Errorf("key %s does not exist", cs.prefixKey(key)))
+		return nil, err
 	}
 
-	contents, err := cs.DecryptStorageData(kv.Value)
+	return contents.Value, nil
+}
+
+// loadStorageData retrieves and decrypts the stored data for a key from Consul KV
+func (cs *ConsulStorage) loadStorageData(ctx context.Context, key string) (*StorageData, error) {
+	contents, index, err := cs.loadIndexed(ctx, key)
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to decrypt data for %s", cs.prefixKey(key))
+		return nil, err
 	}
 
-	return contents.Value, nil
+	// the next store of the key is expected to happen at the index loaded now
+	if cs.comparesAndSets(key) || cs.DetectOverwrites {
+		cs.seenIndexes.set(key, index)
+	}
+	return contents, nil
+}
+
+// decodePair decodes the stored data of key from its KV pair
+func (cs *ConsulStorage) decodePair(ctx context.Context, key string, kv *consul.KVPair) (*StorageData, error) {
+	contents, format, err := cs.decodeStorageData(cs.boundKey(key), kv.Value)
+	if err != nil {
+		cs.decryptFailed(ctx, key, err)
+		return nil, errors.Wrapf(err, "unable to decrypt data for %s", kv.Key)
+	}
+
+	if err := decompressData(contents); err != nil {
+		return nil, errors.Wrapf(err, "unable to decompress data for %s", kv.Key)
+	}
+
+	if contents.Blob != "" {
+		if err := cs.loadBlob(ctx, key, contents); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := verifyChecksum(key, contents); err != nil {
+		cs.log(ctx).Errorf("%v", err)
+		return nil, err
+	}
+
+	// transparently upgrade values written by older versions or with a rotated key
+	if cs.migratesFormat(key, format) {
+		cs.log(ctx).Infof("migrating %s from legacy %s format", kv.Key, format)
+		index, err := cs.migrateValue(ctx, key, kv, contents)
+		if err != nil {
+			cs.log(ctx).Warnf("unable to migrate %s: %v", kv.Key, err)
+		} else {
+			// callers compare and set against the index of the migrated value
+			kv.ModifyIndex = index
+		}
+	}
+
+	return contents, nil
 }
 
 // Delete a key from Consul KV
-func (cs ConsulStorage) Delete(key string) error {
-	cs.logger.Debugf("deleting key %s from Consul", key)
+func (cs *ConsulStorage) Delete(key string) error {
+	return cs.DeleteContext(context.Background(), key)
+}
 
-	// first obtain existing keypair
-	kv, _, err := cs.ConsulClient.KV().Get(cs.prefixKey(key), &consul.QueryOptions{RequireConsistent: true})
-	if err != nil {
-		return errors.Wrapf(err, "unable to obtain data for %s", cs.prefixKey(key))
-	} else if kv == nil {
-		return certmagic.ErrNotExist(err)
+// DeleteContext deletes a key from Consul KV and aborts once ctx is done
+func (cs *ConsulStorage) DeleteContext(ctx context.Context, key string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, cs.WriteTimeout)
+	defer cancel()
+
+	defer cs.invalidateStat(key)
+
+	ctx, log := cs.startOperation(ctx)
+	log.Debugf("deleting key %s from Consul", key)
+
+	// delete the key from the fallback prefix too, so it doesn't show up again
+	deleted := false
+	for _, consulKey := range cs.consulKeys(key) {
+		// first obtain existing keypair
+		kv, _, err := cs.kv(key).Get(consulKey, cs.queryOptions(ctx))
+		if err != nil {
+			return errors.Wrapf(err, "unable to obtain data for %s", consulKey)
+		} else if kv == nil {
+			continue
+		}
+
+		// no do a Check-And-Set operation to verify we really deleted the key
+		if success, _, err := cs.kv(key).DeleteCAS(kv, cs.writeOptions(ctx)); err != nil {
+			return errors.Wrapf(err, "unable to delete data for %s", consulKey)
+		} else if !success {
+			return errors.Errorf("failed to lock data delete for %s", consulKey)
+		}
+		deleted = true
+	}
+
+	// a key that doesn't exist may be a directory that is deleted with all of its keys
+	if !deleted && cs.RecursiveDelete {
+		var err error
+		deleted, err = cs.deleteTree(ctx, key)
+		if err != nil {
+			return err
+		}
 	}
 
-	// no do a Check-And-Set operation to verify we really deleted the key
-	if success, _, err := cs.ConsulClient.KV().DeleteCAS(kv, nil); err != nil {
-		return errors.Wrapf(err, "unable to delete data for %s", cs.prefixKey(key))
-	} else if !success {
-		return errors.Errorf("failed to lock data delete for %s", cs.prefixKey(key))
+	if !deleted {
+		return certmagic.ErrNotExist(errors.Errorf("key %s does not exist", cs.prefixKey(key)))
+	}
+	if cs.comparesAndSets(key) || cs.DetectOverwrites {
+		cs.seenIndexes.set(key, 0)
 	}
+	cs.quotaUsage.forget(quotaPrefix(key))
+	cs.fireCertEvent(ctx, CertDeletedEvent, key)
 
 	return nil
 }
 
 // Exists checks if a key exists
-func (cs ConsulStorage) Exists(key string) bool {
-	kv, _, err := cs.ConsulClient.KV().Get(cs.prefixKey(key), &consul.QueryOptions{RequireConsistent: true})
-	if kv != nil && err == nil {
-		return true
+func (cs *ConsulStorage) Exists(key string) bool {
+	return cs.ExistsContext(context.Background(), key)
+}
+
+// ExistsContext checks if a key exists and aborts once ctx is done
+func (cs *ConsulStorage) ExistsContext(ctx context.Context, key string) bool {
+	if validateKey(key) != nil {
+		return false
+	}
+
+	ctx, cancel := withTimeout(ctx, cs.ReadTimeout)
+	defer cancel()
+
+	cache := cs.cachedStat()
+	if cache != nil {
+		entry, ok := cache.get(key)
+		countStatCache(ok)
+		if ok {
+			return entry.exists
+		}
+	}
+
+	kv, err := cs.getPair(ctx, key)
+	if err != nil {
+		return false
+	}
+
+	if cache != nil {
+		cache.set(key, kv != nil, nil, time.Duration(cs.StatCacheTTL))
 	}
-	return false
+	return kv != nil
 }
 
 // List returns a list with all keys under a given prefix
-func (cs ConsulStorage) List(prefix string, recursive bool) ([]string, error) {
-	var keysFound []string
+func (cs *ConsulStorage) List(prefix string, recursive bool) ([]string, error) {
+	return cs.ListContext(context.Background(), prefix, recursive)
+}
 
-	// get a list of all keys at prefix
-	keys, _, err := cs.ConsulClient.KV().Keys(cs.prefixKey(prefix), "", &consul.QueryOptions{RequireConsistent: true})
-	if err != nil {
-		return keysFound, err
+// ListContext returns a list with all keys under a given prefix and aborts once ctx is done
+func (cs *ConsulStorage) ListContext(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	keys, err := cs.listKeys(ctx, prefix, recursive)
+	if err == nil && len(keys) == 0 {
+		return keys, certmagic.ErrNotExist(errors.Errorf("no keys at %s", prefix))
 	}
+	return keys, err
+}
 
-	if len(keys) == 0 {
-		return keysFound, certmagic.ErrNotExist(errors.Errorf("no keys at %s", prefix))
+// listKeys returns the keys under prefix like ListContext, but without an error if there are none
+func (cs *ConsulStorage) listKeys(ctx context.Context, prefix string, recursive bool) ([]string, error) {
+	if prefix != "" {
+		if err := validateKey(prefix); err != nil {
+			return nil, err
+		}
 	}
 
-	// remove default prefix from keys
-	for _, key := range keys {
-		if strings.HasPrefix(key, cs.prefixKey(prefix)) {
-			key = strings.TrimPrefix(key, cs.Prefix+"/")
+	ctx, cancel := withTimeout(ctx, cs.ListTimeout)
+	defer cancel()
+
+	var keysFound []string
+	seen := make(map[string]bool)
+	add := func(key string) {
+		// keys may exist below the prefix and the fallback prefix
+		if !seen[key] {
+			seen[key] = true
 			keysFound = append(keysFound, key)
 		}
 	}
 
+	// get a list of all keys at prefix from all namespaces it may span
+	for _, ns := range cs.namespaces() {
+		if !cs.listsNamespace(ns, prefix) {
+			continue
+		}
+
+		nsPrefix := path.Join(ns.prefix, cs.encodeKey(prefix))
+		keys, _, err := ns.kv.Keys(nsPrefix, "", cs.queryOptions(ctx))
+		if err != nil {
+			return keysFound, err
+		}
+
+		// remove namespace prefix from keys and drop keys that belong to another namespace
+		for _, key := range keys {
+			if !strings.HasPrefix(key, nsPrefix) || cs.inHashedKeysDir(ns.prefix, key) || cs.inBlobsDir(ns.prefix, key) || cs.inLockQueueDir(ns.prefix, key) {
+				continue
+			}
+			if found := cs.storageKey(ns.prefix, key); cs.tenant(found) == ns.tenant {
+				add(found)
+			}
+		}
+
+		// long keys are stored under their hash, so their original keys have to be matched separately
+		if cs.hashesLongKeys() {
+			hashedKeys, err := cs.listHashedKeys(ctx, ns, prefix)
+			if err != nil {
+				return nil, err
+			}
+			for _, key := range hashedKeys {
+				add(key)
+			}
+		}
+	}
+
 	// if recursive wanted, just return all keys
 	if recursive {
 		return keysFound, nil
@@ -240,56 +854,43 @@ func (cs ConsulStorage) List(prefix string, recursive bool) ([]string, error) {
 }
 
 // Stat returns statistic data of a key
-func (cs ConsulStorage) Stat(key string) (certmagic.KeyInfo, error) {
-	kv, _, err := cs.ConsulClient.KV().Get(cs.prefixKey(key), &consul.QueryOptions{RequireConsistent: true})
-	if err != nil {
-		return certmagic.KeyInfo{}, errors.Errorf("unable to obtain data for %s", cs.prefixKey(key))
-	} else if kv == nil {
-		return certmagic.KeyInfo{}, certmagic.ErrNotExist(errors.Errorf("key %s does not exist", cs.prefixKey(key)))
+func (cs *ConsulStorage) Stat(key string) (certmagic.KeyInfo, error) {
+	return cs.StatContext(context.Background(), key)
+}
+
+// StatContext returns statistic data of a key and aborts once ctx is done
+func (cs *ConsulStorage) StatContext(ctx context.Context, key string) (certmagic.KeyInfo, error) {
+	ctx, cancel := withTimeout(ctx, cs.ReadTimeout)
+	defer cancel()
+
+	cache := cs.cachedStat()
+	if cache != nil {
+		entry, ok := cache.get(key)
+		countStatCache(ok && (entry.info != nil || !entry.exists))
+		if ok && entry.info != nil {
+			return *entry.info, nil
+		} else if ok && !entry.exists {
+			return certmagic.KeyInfo{}, certmagic.ErrNotExist(errors.Errorf("key %s does not exist", cs.prefixKey(key)))
+		}
 	}
 
-	contents, err := cs.DecryptStorageData(kv.Value)
+	contents, err := cs.loadStorageData(ctx, key)
 	if err != nil {
-		return certmagic.KeyInfo{}, errors.Errorf("unable to decrypt data for %s", cs.prefixKey(key))
+		if _, notExist := err.(certmagic.ErrNotExist); notExist && cache != nil {
+			cache.set(key, false, nil, time.Duration(cs.StatCacheTTL))
+		}
+		return certmagic.KeyInfo{}, err
 	}
 
-	return certmagic.KeyInfo{
+	info := certmagic.KeyInfo{
 		Key:        key,
 		Modified:   contents.Modified,
 		Size:       int64(len(contents.Value)),
 		IsTerminal: false,
-	}, nil
-}
-
-func (cs *ConsulStorage) createConsulClient() error {
-	// get the default config
-	consulCfg := consul.DefaultConfig()
-	if cs.Address != "" {
-		consulCfg.Address = cs.Address
-	}
-	if cs.Token != "" {
-		consulCfg.Token = cs.Token
 	}
-	if cs.TlsEnabled {
-		consulCfg.Scheme = "https"
+	if cache != nil {
+		cache.set(key, true, &info, time.Duration(cs.StatCacheTTL))
 	}
-	consulCfg.TLSConfig.InsecureSkipVerify = cs.TlsInsecure
-
-	// set a dial context to prevent default keepalive
-	consulCfg.Transport.DialContext = (&net.Dialer{
-		Timeout:   time.Duration(cs.Timeout) * time.Second,
-		KeepAlive: time.Duration(cs.Timeout) * time.Second,
-	}).DialContext
 
-	// create the Consul API client
-	consulClient, err := consul.NewClient(consulCfg)
-	if err != nil {
-		return errors.Wrap(err, "unable to create Consul client")
-	}
-	if _, err := consulClient.Agent().NodeName(); err != nil {
-		return errors.Wrap(err, "unable to ping Consul")
-	}
-
-	cs.ConsulClient = consulClient
-	return nil
+	return info, nil
 }
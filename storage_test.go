@@ -1,35 +1,18 @@
-// +build consul
-
 package storageconsul
 
 import (
-	"github.com/caddyserver/certmagic"
-	consul "github.com/hashicorp/consul/api"
-	"github.com/stretchr/testify/assert"
-	"os"
+	"context"
 	"path"
 	"testing"
 	"time"
-)
 
-var consulClient *consul.Client
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/assert"
+)
 
+// TestPrefix is the prefix the tests below work in, setupConsulEnv clears it before each test
 const TestPrefix = "consultlstest"
 
-// these tests needs a running Consul server
-func setupConsulEnv(t *testing.T) *ConsulStorage {
-
-	os.Setenv(EnvNamePrefix, TestPrefix)
-	os.Setenv(consul.HTTPTokenEnvName, "2f9e03f8-714b-5e4d-65ea-c983d6b172c4")
-
-	cs, err := New()
-	assert.NoError(t, err)
-
-	_, err = cs.ConsulClient.KV().DeleteTree(TestPrefix, nil)
-	assert.NoError(t, err)
-	return cs
-}
-
 func TestConsulStorage_Store(t *testing.T) {
 	cs := setupConsulEnv(t)
 
@@ -138,7 +121,7 @@ func TestConsulStorage_LockUnlock(t *testing.T) {
 	cs := setupConsulEnv(t)
 	lockKey := path.Join("acme", "example.com", "sites", "example.com", "lock")
 
-	err := cs.Lock(lockKey)
+	err := cs.Lock(context.Background(), lockKey)
 	assert.NoError(t, err)
 
 	err = cs.Unlock(lockKey)
@@ -150,15 +133,14 @@ func TestConsulStorage_TwoLocks(t *testing.T) {
 	cs2 := setupConsulEnv(t)
 	lockKey := path.Join("acme", "example.com", "sites", "example.com", "lock")
 
-	err := cs.Lock(lockKey)
+	err := cs.Lock(context.Background(), lockKey)
 	assert.NoError(t, err)
 
-	go time.AfterFunc(5*time.Second, func() {
-		err = cs.Unlock(lockKey)
-		assert.NoError(t, err)
+	time.AfterFunc(time.Second, func() {
+		assert.NoError(t, cs.Unlock(lockKey))
 	})
 
-	err = cs2.Lock(lockKey)
+	err = cs2.Lock(context.Background(), lockKey)
 	assert.NoError(t, err)
 
 	err = cs2.Unlock(lockKey)
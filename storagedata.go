@@ -8,4 +8,16 @@ import (
 type StorageData struct {
 	Value    []byte    `json:"value"`
 	Modified time.Time `json:"modified"`
+
+	// Checksum is the hex encoded SHA-256 of Value to detect corrupted values
+	Checksum string `json:"checksum,omitempty"`
+
+	// Compression is the algorithm Value is compressed with, empty for uncompressed values
+	Compression string `json:"compression,omitempty"`
+
+	// Blob is the content hash of a deduplicated value that is stored separately
+	Blob string `json:"blob,omitempty"`
+
+	// Key is the original key of values stored under a hashed key
+	Key string `json:"key,omitempty"`
 }
@@ -0,0 +1,236 @@
+package storageconsul
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/caddyserver/certmagic"
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// StorageTx groups the storage operations of a transaction started with Txn
+type StorageTx interface {
+	// Load returns the value of key as it was when it was first loaded in the transaction or as stored or
+	// deleted by the transaction. The transaction only commits if the key wasn't modified in the meantime.
+	Load(key string) ([]byte, error)
+	// Store stores value for key when the transaction commits
+	Store(key string, value []byte) error
+	// Delete deletes key when the transaction commits
+	Delete(key string) error
+}
+
+// TxnConflictError is returned by Txn if a key loaded in the transaction was modified before it committed
+type TxnConflictError struct {
+	Key string
+}
+
+func (e TxnConflictError) Error() string {
+	return fmt.Sprintf("transaction conflicts with a concurrent change of %s", e.Key)
+}
+
+// txnWrite is a pending Store or Delete of a transaction
+type txnWrite struct {
+	value   []byte
+	deleted bool
+}
+
+// txnRead is a key loaded in a transaction with the Consul key and modify index it was read at, zero if it
+// didn't exist
+type txnRead struct {
+	consulKey string
+	index     uint64
+	value     []byte
+}
+
+// storageTx implements StorageTx
+type storageTx struct {
+	cs     *ConsulStorage
+	ctx    context.Context
+	reads  map[string]*txnRead
+	writes map[string]*txnWrite
+}
+
+// Txn runs fn and applies the Store and Delete calls it made in one Consul transaction, so either all of them
+// are applied or none. Nothing is written if fn returns an error. Keys loaded within fn must not have changed
+// until the transaction commits, otherwise it fails with a TxnConflictError and fn may be run again. All keys
+// have to belong to the same tenant and one transaction holds up to 64 operations, counting loaded keys and
+// keys that are also stored below the FallbackPrefix. Backends without transactions like Nomad fail.
+func (cs *ConsulStorage) Txn(ctx context.Context, fn func(tx StorageTx) error) error {
+	ctx, cancel := withTimeout(ctx, cs.WriteTimeout)
+	defer cancel()
+	ctx, log := cs.startOperation(ctx)
+
+	tx := &storageTx{cs: cs, ctx: ctx, reads: make(map[string]*txnRead), writes: make(map[string]*txnWrite)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.writes) == 0 {
+		return nil
+	}
+
+	keys := tx.keys()
+	if _, ok := cs.txn(keys[0]); !ok {
+		return errors.New("the backend doesn't support transactions")
+	}
+	for _, key := range keys[1:] {
+		if cs.keyPrefix(key) != cs.keyPrefix(keys[0]) {
+			return errors.Errorf("keys %s and %s of the transaction belong to different tenants", keys[0], key)
+		}
+	}
+
+	// the usage reserved for stores is listed again unless the transaction commits, deletes free their quota
+	committed := false
+	defer func() {
+		for key, w := range tx.writes {
+			if !committed || w.deleted {
+				cs.quotaUsage.forget(quotaPrefix(key))
+			}
+		}
+	}()
+
+	ops, checked, err := tx.ops(keys)
+	if err != nil {
+		return err
+	}
+	if len(ops) > maxTxnOps {
+		return errors.Errorf("transaction of %d operations exceeds the limit of %d", len(ops), maxTxnOps)
+	}
+
+	defer func() {
+		for key := range tx.writes {
+			cs.invalidateStat(key)
+		}
+	}()
+
+	log.Debugf("committing transaction of %d keys", len(tx.writes))
+	if resp, err := cs.runTxn(ctx, keys[0], ops); err != nil {
+		if resp != nil {
+			for _, txnErr := range resp.Errors {
+				if key, ok := checked[txnErr.OpIndex]; ok {
+					return TxnConflictError{Key: key}
+				}
+			}
+		}
+		return err
+	}
+	committed = true
+
+	for _, key := range keys {
+		if w, ok := tx.writes[key]; ok && w.deleted {
+			cs.fireCertEvent(ctx, CertDeletedEvent, key)
+		} else if ok {
+			cs.fireCertEvent(ctx, CertUpdatedEvent, key)
+		}
+	}
+	return nil
+}
+
+// keys returns the keys loaded or written in the transaction in order
+func (tx *storageTx) keys() []string {
+	keys := make([]string, 0, len(tx.reads)+len(tx.writes))
+	for key := range tx.reads {
+		keys = append(keys, key)
+	}
+	for key := range tx.writes {
+		if _, read := tx.reads[key]; !read {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// ops returns the operations of the transaction, checks of the loaded keys first, and the keys checked by
+// the index of their operation
+func (tx *storageTx) ops(keys []string) (consul.TxnOps, map[int]string, error) {
+	var ops consul.TxnOps
+	checked := make(map[int]string)
+	for _, key := range keys {
+		read, ok := tx.reads[key]
+		if !ok {
+			continue
+		}
+		checked[len(ops)] = key
+		if read.index == 0 {
+			ops = append(ops, &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVCheckNotExists, Key: read.consulKey}})
+		} else {
+			ops = append(ops, &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVCheckIndex, Key: read.consulKey, Index: read.index}})
+		}
+	}
+
+	for _, key := range keys {
+		w, ok := tx.writes[key]
+		switch {
+		case !ok:
+		case w.deleted:
+			for _, consulKey := range tx.cs.consulKeys(key) {
+				ops = append(ops, &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVDelete, Key: consulKey}})
+			}
+		default:
+			kv, err := tx.cs.encodePair(tx.ctx, key, w.value)
+			if err != nil {
+				return nil, nil, err
+			}
+			if err := tx.cs.reserveQuota(tx.ctx, key, kv); err != nil {
+				return nil, nil, err
+			}
+			ops = append(ops, &consul.TxnOp{KV: &consul.KVTxnOp{Verb: consul.KVSet, Key: kv.Key, Value: kv.Value, Flags: kv.Flags}})
+		}
+	}
+	return ops, checked, nil
+}
+
+func (tx *storageTx) Load(key string) ([]byte, error) {
+	if err := validateKey(key); err != nil {
+		return nil, err
+	}
+	if w, ok := tx.writes[key]; ok {
+		if w.deleted {
+			return nil, certmagic.ErrNotExist(errors.Errorf("key %s was deleted in the transaction", key))
+		}
+		return w.value, nil
+	}
+
+	read, ok := tx.reads[key]
+	if !ok {
+		kv, err := tx.cs.getPair(tx.ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		read = &txnRead{consulKey: tx.cs.prefixKey(key)}
+		if kv != nil {
+			contents, err := tx.cs.decodePair(tx.ctx, key, kv)
+			if err != nil {
+				return nil, err
+			}
+			read.consulKey, read.index, read.value = kv.Key, kv.ModifyIndex, contents.Value
+		}
+		tx.reads[key] = read
+	}
+
+	if read.index == 0 {
+		return nil, certmagic.ErrNotExist(errors.Errorf("key %s does not exist", tx.cs.prefixKey(key)))
+	}
+	return read.value, nil
+}
+
+func (tx *storageTx) Store(key string, value []byte) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	if err := tx.cs.checkMaxValueSize(key, value); err != nil {
+		return err
+	}
+	tx.writes[key] = &txnWrite{value: value}
+	return nil
+}
+
+func (tx *storageTx) Delete(key string) error {
+	if err := validateKey(key); err != nil {
+		return err
+	}
+	tx.writes[key] = &txnWrite{deleted: true}
+	return nil
+}
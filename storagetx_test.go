@@ -0,0 +1,96 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pteich/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_Txn(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	require.NoError(t, cs.Store("acme/old", []byte("old")))
+
+	err := cs.Txn(context.Background(), func(tx StorageTx) error {
+		value, err := tx.Load("acme/old")
+		if err != nil {
+			return err
+		}
+		if err := tx.Store("acme/new", append(value, '!')); err != nil {
+			return err
+		}
+		if err := tx.Delete("acme/old"); err != nil {
+			return err
+		}
+
+		// the transaction reads its own writes
+		_, err = tx.Load("acme/old")
+		assert.Error(t, err)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, fc.txns)
+
+	value, err := cs.Load("acme/new")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("old!"), value)
+	assert.False(t, cs.Exists("acme/old"))
+}
+
+func TestConsulStorage_TxnRollback(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+
+	failed := errors.New("failed")
+	err := cs.Txn(context.Background(), func(tx StorageTx) error {
+		require.NoError(t, tx.Store("acme/a", []byte("a")))
+		return failed
+	})
+	assert.Equal(t, failed, err)
+	assert.False(t, cs.Exists("acme/a"))
+}
+
+func TestConsulStorage_TxnConflict(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+	require.NoError(t, cs.Store("acme/counter", []byte("1")))
+
+	err := cs.Txn(context.Background(), func(tx StorageTx) error {
+		if _, err := tx.Load("acme/counter"); err != nil {
+			return err
+		}
+		_, err := tx.Load("acme/missing")
+		assert.Error(t, err)
+
+		// a concurrent writer changes the loaded key
+		require.NoError(t, cs.Store("acme/counter", []byte("5")))
+		return tx.Store("acme/counter", []byte("2"))
+	})
+	assert.Equal(t, TxnConflictError{Key: "acme/counter"}, err)
+
+	value, err := cs.Load("acme/counter")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("5"), value)
+
+	// a key loaded as missing must not be created meanwhile either
+	err = cs.Txn(context.Background(), func(tx StorageTx) error {
+		if _, err := tx.Load("acme/missing"); err == nil {
+			return errors.New("expected missing key")
+		}
+		require.NoError(t, cs.Store("acme/missing", []byte("x")))
+		return tx.Store("acme/other", []byte("y"))
+	})
+	assert.Equal(t, TxnConflictError{Key: "acme/missing"}, err)
+	assert.False(t, cs.Exists("acme/other"))
+}
+
+func TestConsulStorage_TxnTenants(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+	cs.Tenants = map[string]*Tenant{"customer": {Prefix: "customer", KeyPrefixes: []string{"certificates/customer"}}}
+
+	err := cs.Txn(context.Background(), func(tx StorageTx) error {
+		require.NoError(t, tx.Store("acme/a", []byte("a")))
+		return tx.Store("certificates/customer/b", []byte("b"))
+	})
+	assert.Error(t, err)
+}
@@ -0,0 +1,88 @@
+package storageconsul
+
+import (
+	"context"
+	"sort"
+
+	"github.com/pteich/errors"
+)
+
+// SyncOptions configure Sync
+type SyncOptions struct {
+	// Prefix limits the sync to the keys below it
+	Prefix string
+	// Delete removes keys from the destination that don't exist in the source anymore
+	Delete bool
+	// DryRun only reports what would be copied and deleted
+	DryRun bool
+}
+
+// SyncResult lists the keys a sync copied and deleted
+type SyncResult struct {
+	Copied    []string
+	Deleted   []string
+	Unchanged int
+}
+
+// Sync copies the keys of the storage that are missing or differ in dst, e.g. a storage of another Consul
+// cluster for a blue/green migration. Keys are compared by the checksums of their values, so repeated syncs
+// only copy what changed since and both storages may use different AES keys or prefixes.
+func (cs *ConsulStorage) Sync(ctx context.Context, dst *ConsulStorage, opts SyncOptions) (SyncResult, error) {
+	var result SyncResult
+
+	src, err := cs.loadPrefixData(ctx, opts.Prefix)
+	if err != nil {
+		return result, errors.Wrap(err, "unable to load source keys")
+	}
+	existing, err := dst.loadPrefixData(ctx, opts.Prefix)
+	if err != nil {
+		return result, errors.Wrap(err, "unable to load destination keys")
+	}
+
+	keys := make([]string, 0, len(src))
+	for key := range src {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if current, exists := existing[key]; exists && dataChecksum(current) == dataChecksum(src[key]) {
+			result.Unchanged++
+			continue
+		}
+
+		if !opts.DryRun {
+			if err := dst.StoreContext(ctx, key, src[key].Value); err != nil {
+				return result, errors.Wrapf(err, "unable to copy %s", key)
+			}
+		}
+		result.Copied = append(result.Copied, key)
+	}
+
+	if opts.Delete {
+		for key := range existing {
+			if _, exists := src[key]; !exists {
+				result.Deleted = append(result.Deleted, key)
+			}
+		}
+		sort.Strings(result.Deleted)
+
+		if !opts.DryRun {
+			if err := dst.DeleteKeys(ctx, result.Deleted); err != nil {
+				return result, errors.Wrap(err, "unable to delete keys missing in the source")
+			}
+		}
+	}
+
+	cs.logger.Infof("synced %d keys: %d copied, %d deleted, %d unchanged", len(src), len(result.Copied), len(result.Deleted), result.Unchanged)
+	return result, nil
+}
+
+// dataChecksum returns the checksum of the value of data, values stored before checksums were added
+// don't carry one
+func dataChecksum(data *StorageData) string {
+	if data.Checksum != "" {
+		return data.Checksum
+	}
+	return checksum(data.Value)
+}
@@ -0,0 +1,44 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_Sync(t *testing.T) {
+	src, _ := newFakeConsulStorage(t)
+	dst, fc := newFakeConsulStorage(t)
+	dst.AESKey = []byte("consultls-0987654321-caddytls-32")
+
+	require.NoError(t, src.Store("certificates/a.example.com/a.example.com.crt", []byte("a")))
+	require.NoError(t, src.Store("certificates/b.example.com/b.example.com.crt", []byte("b")))
+	require.NoError(t, dst.Store("certificates/b.example.com/b.example.com.crt", []byte("b")))
+	require.NoError(t, dst.Store("certificates/old.example.com/old.example.com.crt", []byte("old")))
+	require.NoError(t, src.Lock(context.Background(), "issue_cert_a.example.com"))
+	defer src.Unlock("issue_cert_a.example.com")
+
+	result, err := src.Sync(context.Background(), dst, SyncOptions{Delete: true, DryRun: true})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"certificates/a.example.com/a.example.com.crt"}, result.Copied)
+	assert.Equal(t, []string{"certificates/old.example.com/old.example.com.crt"}, result.Deleted)
+	assert.Equal(t, 1, result.Unchanged)
+	assert.False(t, dst.Exists("certificates/a.example.com/a.example.com.crt"))
+
+	result, err = src.Sync(context.Background(), dst, SyncOptions{Delete: true})
+	require.NoError(t, err)
+	value, err := dst.Load("certificates/a.example.com/a.example.com.crt")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("a"), value)
+	assert.False(t, dst.Exists("certificates/old.example.com/old.example.com.crt"))
+
+	// a second sync has nothing left to copy
+	writes := fc.index
+	result, err = src.Sync(context.Background(), dst, SyncOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, result.Copied)
+	assert.Equal(t, 2, result.Unchanged)
+	assert.Equal(t, writes, fc.index)
+}
@@ -0,0 +1,230 @@
+package storageconsul
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// Tenant keeps all keys starting with one of its key prefixes under a separate Consul prefix
+// that is accessed with a separate ACL token
+type Tenant struct {
+	KeyPrefixes []string `json:"key_prefixes"`
+	Prefix      string   `json:"prefix"`
+	Token       string   `json:"token"`
+	// TokenFile is read for the token of the tenant instead of using Token, like the TokenFile of the storage
+	TokenFile string `json:"token_file"`
+
+	client *consul.Client
+	shared *sharedClient
+}
+
+const (
+	// accountsTenant is the name of the tenant ACME accounts are kept in with an AccountPrefix
+	accountsTenant = "acme_accounts"
+
+	// acmeDir is the directory certmagic stores ACME accounts and their private keys in
+	acmeDir = "acme"
+)
+
+// matches reports whether key belongs to one of the key prefixes of the tenant and
+// returns the length of the longest matching key prefix
+func (t *Tenant) matches(key string) (int, bool) {
+	return matchKeyPrefixes(t.KeyPrefixes, key)
+}
+
+// matchKeyPrefixes reports whether key starts with one of the key prefixes, matching whole
+// path segments, and returns the length of the longest matching key prefix
+func matchKeyPrefixes(keyPrefixes []string, key string) (int, bool) {
+	key = strings.Trim(key, "/")
+
+	longest, found := 0, false
+	for _, keyPrefix := range keyPrefixes {
+		keyPrefix = strings.Trim(keyPrefix, "/")
+		if key == keyPrefix || strings.HasPrefix(key, keyPrefix+"/") {
+			if len(keyPrefix) >= longest {
+				longest, found = len(keyPrefix), true
+			}
+		}
+	}
+
+	return longest, found
+}
+
+// resolvePlaceholders replaces the placeholders in the settings of the tenant like in the prefix of the storage
+func (t *Tenant) resolvePlaceholders() error {
+	fields := []*string{&t.Prefix, &t.Token, &t.TokenFile}
+	for i := range t.KeyPrefixes {
+		fields = append(fields, &t.KeyPrefixes[i])
+	}
+	for _, field := range fields {
+		resolved, err := resolvePlaceholders(*field)
+		if err != nil {
+			return errors.Wrapf(err, "unable to resolve placeholders in %s", *field)
+		}
+		*field = resolved
+	}
+	return nil
+}
+
+// overlappingTenants returns a problem for every key prefix that is equal to or nested in a key prefix
+// of another tenant or the same one, the keys below it would belong to more than one of them
+func overlappingTenants(tenants map[string]*Tenant) []string {
+	names := make([]string, 0, len(tenants))
+	for name, t := range tenants {
+		if t != nil {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	type owned struct {
+		tenant    string
+		keyPrefix string
+	}
+	var seen []owned
+	var problems []string
+	for _, name := range names {
+		for _, keyPrefix := range tenants[name].KeyPrefixes {
+			for _, other := range seen {
+				_, nested := matchKeyPrefixes([]string{other.keyPrefix}, keyPrefix)
+				_, contains := matchKeyPrefixes([]string{keyPrefix}, other.keyPrefix)
+				if nested || contains {
+					problems = append(problems, fmt.Sprintf("key prefix %s of tenant %s overlaps key prefix %s of tenant %s",
+						keyPrefix, name, other.keyPrefix, other.tenant))
+				}
+			}
+			seen = append(seen, owned{tenant: name, keyPrefix: keyPrefix})
+		}
+	}
+	return problems
+}
+
+// tenant returns the tenant key belongs to or nil if it belongs to no tenant
+func (cs *ConsulStorage) tenant(key string) *Tenant {
+	var tenant *Tenant
+	longest := -1
+	for _, t := range cs.Tenants {
+		if length, ok := t.matches(key); ok && length > longest {
+			tenant, longest = t, length
+		}
+	}
+	return tenant
+}
+
+// client returns the Consul client to access key with
+func (cs *ConsulStorage) client(key string) *consul.Client {
+	if t := cs.tenant(key); t != nil && t.client != nil {
+		return t.client
+	}
+	return cs.ConsulClient
+}
+
+// keyPrefix returns the Consul prefix key is stored under
+func (cs *ConsulStorage) keyPrefix(key string) string {
+	if t := cs.tenant(key); t != nil {
+		return t.Prefix
+	}
+	return cs.Prefix
+}
+
+// namespace is a Consul prefix together with the KV store to access it
+type namespace struct {
+	prefix string
+	kv     kvBackend
+	tenant *Tenant
+}
+
+// namespaces returns the default namespace, the fallback one and the ones of all tenants
+func (cs *ConsulStorage) namespaces() []namespace {
+	namespaces := []namespace{{prefix: cs.Prefix, kv: cs.clientKV(cs.ConsulClient)}}
+	if cs.FallbackPrefix != "" && cs.FallbackPrefix != cs.Prefix {
+		namespaces = append(namespaces, namespace{prefix: cs.FallbackPrefix, kv: cs.clientKV(cs.ConsulClient)})
+	}
+	for _, t := range cs.Tenants {
+		client := t.client
+		if client == nil {
+			client = cs.ConsulClient
+		}
+		namespaces = append(namespaces, namespace{prefix: t.Prefix, kv: cs.clientKV(client), tenant: t})
+	}
+	return namespaces
+}
+
+// addAccountsTenant adds the tenant that keeps ACME accounts under the AccountPrefix and accesses them with
+// the AccountToken
+func (cs *ConsulStorage) addAccountsTenant() {
+	if cs.AccountPrefix == "" {
+		return
+	}
+	if _, ok := cs.Tenants[accountsTenant]; ok {
+		return
+	}
+	if cs.Tenants == nil {
+		cs.Tenants = make(map[string]*Tenant)
+	}
+	cs.Tenants[accountsTenant] = &Tenant{KeyPrefixes: []string{acmeDir}, Prefix: cs.AccountPrefix, Token: cs.AccountToken}
+}
+
+// connectTenants creates the Consul clients of all tenants with their own tokens
+func (cs *ConsulStorage) connectTenants() error {
+	for name, t := range cs.Tenants {
+		if t == nil || t.Prefix == "" {
+			return errors.Errorf("tenant %s needs a prefix", name)
+		}
+		if t.Token == "" && t.TokenFile == "" {
+			continue
+		}
+
+		// the token file of the storage would replace the token of the tenant
+		cc := cs.ConnectionConfig
+		cc.Token, cc.TokenFile = t.Token, t.TokenFile
+		sc, err := cc.acquireClient()
+		if err != nil {
+			return errors.Wrapf(err, "unable to connect to Consul for tenant %s", name)
+		}
+		t.client, t.shared = sc.client, sc
+	}
+
+	return nil
+}
+
+// releaseTenants gives back the Consul clients of all tenants
+func (cs *ConsulStorage) releaseTenants() error {
+	var err error
+	for _, t := range cs.Tenants {
+		if t == nil {
+			continue
+		}
+		if releaseErr := releaseClient(t.shared); releaseErr != nil {
+			err = releaseErr
+		}
+		t.client, t.shared = nil, nil
+	}
+	return err
+}
+
+// listsNamespace reports whether a List of prefix may find keys in ns
+func (cs *ConsulStorage) listsNamespace(ns namespace, prefix string) bool {
+	if ns.tenant == nil {
+		return true
+	}
+
+	if _, ok := ns.tenant.matches(prefix); ok {
+		return true
+	}
+
+	// the tenant may own keys below prefix
+	prefix = strings.Trim(prefix, "/")
+	for _, keyPrefix := range ns.tenant.KeyPrefixes {
+		keyPrefix = strings.Trim(keyPrefix, "/")
+		if prefix == "" || strings.HasPrefix(keyPrefix, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
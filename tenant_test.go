@@ -0,0 +1,133 @@
+package storageconsul
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_Tenants(t *testing.T) {
+	fc := newFakeConsul(t)
+
+	cs := New()
+	cs.Address = fc.Listener.Addr().String()
+	cs.Token = "default-token"
+	cs.Tenants = map[string]*Tenant{
+		"customer-a": {
+			KeyPrefixes: []string{"certificates/acme/a.example.com"},
+			Prefix:      "tenants/a",
+			Token:       "token-a",
+		},
+	}
+	require.NoError(t, cs.Connect())
+	defer cs.Cleanup()
+
+	require.NoError(t, cs.Store("certificates/acme/a.example.com/a.example.com.crt", []byte("a")))
+	require.NoError(t, cs.Store("certificates/acme/a.example.com.evil/a.example.com.evil.crt", []byte("evil")))
+	require.NoError(t, cs.Store("certificates/acme/b.example.com/b.example.com.crt", []byte("b")))
+
+	assert.Equal(t, "token-a", fc.tokens["tenants/a/certificates/acme/a.example.com/a.example.com.crt"])
+	assert.Equal(t, "default-token", fc.tokens["caddytls/certificates/acme/a.example.com.evil/a.example.com.evil.crt"])
+	assert.Equal(t, "default-token", fc.tokens["caddytls/certificates/acme/b.example.com/b.example.com.crt"])
+
+	value, err := cs.Load("certificates/acme/a.example.com/a.example.com.crt")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a"), value)
+
+	keys, err := cs.List("certificates/acme", false)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"certificates/acme/a.example.com",
+		"certificates/acme/a.example.com.evil",
+		"certificates/acme/b.example.com",
+	}, keys)
+
+	keys, err = cs.List("certificates/acme/b.example.com", true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"certificates/acme/b.example.com/b.example.com.crt"}, keys)
+
+	keys, err = cs.List("certificates/acme/a.example.com", true)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"certificates/acme/a.example.com/a.example.com.crt",
+		"certificates/acme/a.example.com.evil/a.example.com.evil.crt",
+	}, keys)
+}
+
+func TestConsulStorage_AccountPrefix(t *testing.T) {
+	fc := newFakeConsul(t)
+
+	cs := New()
+	cs.Address = fc.Listener.Addr().String()
+	cs.Token = "default-token"
+	cs.AccountPrefix = "caddytls-accounts"
+	cs.AccountToken = "account-token"
+	require.NoError(t, cs.Connect())
+	defer cs.Cleanup()
+
+	account := "acme/acme-v02.api.letsencrypt.org-directory/users/admin@example.com/admin.key"
+	require.NoError(t, cs.Store(account, []byte("account key")))
+	require.NoError(t, cs.Store("certificates/acme/a.example.com/a.example.com.crt", []byte("a")))
+
+	assert.Equal(t, "account-token", fc.tokens["caddytls-accounts/"+account])
+	assert.Equal(t, "default-token", fc.tokens["caddytls/certificates/acme/a.example.com/a.example.com.crt"])
+
+	value, err := cs.Load(account)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("account key"), value)
+
+	policies := cs.aclPolicies()
+	require.Len(t, policies, 2)
+	assert.Equal(t, "tenant "+accountsTenant, policies[1].name)
+	assert.Contains(t, policies[1].rules, `key_prefix "caddytls-accounts/"`)
+}
+
+func TestConsulStorage_OverlappingTenants(t *testing.T) {
+	cs := New()
+	cs.Tenants = map[string]*Tenant{
+		"customer-a": {KeyPrefixes: []string{"certificates/acme/a.example.com"}, Prefix: "tenants/a"},
+		"customer-b": {KeyPrefixes: []string{"certificates/acme/a.example.com"}, Prefix: "tenants/b"},
+		"customer-c": {KeyPrefixes: []string{"certificates/acme"}, Prefix: "tenants/c"},
+	}
+
+	err := cs.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "key prefix certificates/acme/a.example.com of tenant customer-b overlaps key prefix certificates/acme/a.example.com of tenant customer-a")
+	assert.Contains(t, err.Error(), "key prefix certificates/acme of tenant customer-c overlaps key prefix certificates/acme/a.example.com of tenant customer-a")
+
+	// only whole segments overlap
+	cs.Tenants = map[string]*Tenant{
+		"customer-a": {KeyPrefixes: []string{"certificates/acme/a.example.com"}, Prefix: "tenants/a"},
+		"customer-d": {KeyPrefixes: []string{"certificates/acme/a.example.com.evil"}, Prefix: "tenants/d"},
+	}
+	require.NoError(t, cs.Validate())
+	cs.Tenants["customer-c"] = &Tenant{KeyPrefixes: []string{"certificates/acme"}, Prefix: "tenants/c"}
+
+	// validation doesn't depend on how the storage connects
+	cs.Connection = "primary"
+	assert.Error(t, cs.Validate())
+}
+
+func TestConsulStorage_TenantPlaceholders(t *testing.T) {
+	os.Setenv("TENANT_A_TOKEN", "token-a")
+	defer os.Unsetenv("TENANT_A_TOKEN")
+	os.Setenv("TENANT_A_DOMAIN", "a.example.com")
+	defer os.Unsetenv("TENANT_A_DOMAIN")
+
+	cs := New()
+	cs.Tenants = map[string]*Tenant{
+		"customer-a": {
+			KeyPrefixes: []string{"certificates/acme/{env.TENANT_A_DOMAIN}"},
+			Prefix:      "tenants/{env.TENANT_A_DOMAIN}",
+			Token:       "{env.TENANT_A_TOKEN}",
+		},
+	}
+	require.NoError(t, cs.configure())
+
+	tenant := cs.Tenants["customer-a"]
+	assert.Equal(t, []string{"certificates/acme/a.example.com"}, tenant.KeyPrefixes)
+	assert.Equal(t, "tenants/a.example.com", tenant.Prefix)
+	assert.Equal(t, "token-a", tenant.Token)
+}
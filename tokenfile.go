@@ -0,0 +1,91 @@
+package storageconsul
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pteich/errors"
+)
+
+// tokenFile provides the ACL token read from a file and picks up changes of the file,
+// so the token can be rotated without recreating the client or its lock sessions
+type tokenFile struct {
+	path string
+	mu   sync.RWMutex
+	val  string
+	stop chan struct{}
+}
+
+// newTokenFile reads the token from path and rereads it every interval until close is called
+func newTokenFile(path string, interval time.Duration) (*tokenFile, error) {
+	tf := &tokenFile{path: path, stop: make(chan struct{})}
+	if err := tf.reload(); err != nil {
+		return nil, err
+	}
+
+	if interval <= 0 {
+		interval = DefaultTokenFileInterval
+	}
+	go tf.watch(interval)
+
+	return tf, nil
+}
+
+func (tf *tokenFile) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			// keep the current token if the file is being replaced or can't be read for a moment
+			tf.reload()
+		case <-tf.stop:
+			return
+		}
+	}
+}
+
+// reload reads the token from the file
+func (tf *tokenFile) reload() error {
+	contents, err := ioutil.ReadFile(tf.path)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read token file %s", tf.path)
+	}
+
+	token := strings.TrimSpace(string(contents))
+	if token == "" {
+		return errors.Errorf("token file %s is empty", tf.path)
+	}
+
+	tf.mu.Lock()
+	tf.val = token
+	tf.mu.Unlock()
+	return nil
+}
+
+// token returns the current token
+func (tf *tokenFile) token() string {
+	tf.mu.RLock()
+	defer tf.mu.RUnlock()
+	return tf.val
+}
+
+func (tf *tokenFile) close() {
+	close(tf.stop)
+}
+
+// tokenTransport authenticates requests with the current token of a tokenFile
+type tokenTransport struct {
+	next   http.RoundTripper
+	tokens *tokenFile
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("X-Consul-Token", t.tokens.token())
+	return t.next.RoundTrip(req)
+}
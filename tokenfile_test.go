@@ -0,0 +1,83 @@
+package storageconsul
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_TokenFileRotation(t *testing.T) {
+	fc := newFakeConsul(t)
+
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(path, []byte("first-token\n"), 0600))
+
+	cs := New()
+	cs.Address = fc.Listener.Addr().String()
+	cs.Token = "static-token"
+	cs.TokenFile = path
+	cs.TokenFileInterval = caddy.Duration(10 * time.Millisecond)
+	require.NoError(t, cs.Connect())
+	defer cs.Cleanup()
+	client := cs.ConsulClient
+
+	require.NoError(t, cs.Store("first", []byte("value")))
+	fc.mu.Lock()
+	assert.Equal(t, "first-token", fc.tokens["caddytls/first"])
+	fc.mu.Unlock()
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("second-token"), 0600))
+	assert.Eventually(t, func() bool {
+		if err := cs.Store("second", []byte("value")); err != nil {
+			return false
+		}
+		fc.mu.Lock()
+		defer fc.mu.Unlock()
+		return fc.tokens["caddytls/second"] == "second-token"
+	}, time.Second, 20*time.Millisecond)
+
+	// the client is kept
+	assert.Same(t, client, cs.ConsulClient)
+}
+
+func TestConsulStorage_TokenFileTenants(t *testing.T) {
+	fc := newFakeConsul(t)
+
+	path := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, ioutil.WriteFile(path, []byte("storage-token"), 0600))
+
+	cs := New()
+	cs.Address = fc.Listener.Addr().String()
+	cs.TokenFile = path
+	cs.Tenants = map[string]*Tenant{
+		"customer-a": {KeyPrefixes: []string{"certificates/a.example.com"}, Prefix: "tenants/a", Token: "tenant-token"},
+	}
+	require.NoError(t, cs.Connect())
+	defer cs.Cleanup()
+
+	require.NoError(t, cs.Store("certificates/a.example.com/a.example.com.crt", []byte("value")))
+	require.NoError(t, cs.Store("certificates/b.example.com/b.example.com.crt", []byte("value")))
+
+	// the tenant keeps its own token
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	assert.Equal(t, "tenant-token", fc.tokens["tenants/a/certificates/a.example.com/a.example.com.crt"])
+	assert.Equal(t, "storage-token", fc.tokens["caddytls/certificates/b.example.com/b.example.com.crt"])
+}
+
+func TestNewTokenFile(t *testing.T) {
+	dir := t.TempDir()
+
+	_, err := newTokenFile(filepath.Join(dir, "missing"), time.Second)
+	assert.Error(t, err)
+
+	path := filepath.Join(dir, "empty")
+	require.NoError(t, ioutil.WriteFile(path, []byte(" \n"), 0600))
+	_, err = newTokenFile(path, time.Second)
+	assert.Error(t, err)
+}
@@ -0,0 +1,5 @@
+module github.com/pteich/caddy-tlsconsul/tools/gendict
+
+go 1.16
+
+require github.com/klauspost/compress v1.17.0
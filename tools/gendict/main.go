@@ -0,0 +1,137 @@
+// Command gendict trains the zstd dictionary embedded by the storage on generated certificate data.
+// The samples resemble what certmagic stores: PEM certificate chains and private keys as well as
+// the JSON metadata of certificates and ACME accounts.
+//
+//	go run . -out ../../pem.zdict
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/dict"
+)
+
+func main() {
+	out := flag.String("out", "pem.zdict", "file to write the dictionary to")
+	samples := flag.Int("samples", 300, "number of generated certificates")
+	size := flag.Int("size", 64<<10, "maximum dictionary size")
+	flag.Parse()
+
+	input, err := generate(*samples)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	zdict, err := dict.BuildZstdDict(input, dict.Options{MaxDictSize: *size, HashBytes: 6, ZstdDictID: 0x7c5c})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if err := os.WriteFile(*out, zdict, 0644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %d bytes dictionary from %d samples to %s", len(zdict), len(input), *out)
+}
+
+func generate(n int) ([][]byte, error) {
+	issuerKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	issuer := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Country: []string{"US"}, Organization: []string{"Let's Encrypt"}, CommonName: "E1"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(5, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	issuerDER, err := x509.CreateCertificate(rand.Reader, issuer, issuer, &issuerKey.PublicKey, issuerKey)
+	if err != nil {
+		return nil, err
+	}
+	issuerPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: issuerDER})
+
+	var input [][]byte
+	for i := 0; i < n; i++ {
+		domain := fmt.Sprintf("host%d.example%d.com", i, i%17)
+
+		var pub interface{}
+		var keyPEM []byte
+		if i%3 == 0 {
+			key, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				return nil, err
+			}
+			pub = &key.PublicKey
+			keyPEM = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		} else {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				return nil, err
+			}
+			der, err := x509.MarshalECPrivateKey(key)
+			if err != nil {
+				return nil, err
+			}
+			pub = &key.PublicKey
+			keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+		}
+
+		leaf := &x509.Certificate{
+			SerialNumber:          big.NewInt(int64(1000 + i)),
+			Subject:               pkix.Name{CommonName: domain},
+			DNSNames:              []string{domain, "www." + domain},
+			NotBefore:             time.Now(),
+			NotAfter:              time.Now().AddDate(0, 3, 0),
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+			ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			OCSPServer:            []string{"http://e1.o.lencr.org"},
+			IssuingCertificateURL: []string{"http://e1.i.lencr.org/"},
+		}
+		leafDER, err := x509.CreateCertificate(rand.Reader, leaf, issuer, pub, issuerKey)
+		if err != nil {
+			return nil, err
+		}
+		chain := append(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER}), issuerPEM...)
+
+		meta, err := json.MarshalIndent(map[string]interface{}{
+			"sans": []string{domain, "www." + domain},
+			"issuer_data": map[string]string{
+				"url": fmt.Sprintf("https://acme-v02.api.letsencrypt.org/acme/cert/%x", leaf.SerialNumber),
+				"ca":  "https://acme-v02.api.letsencrypt.org/directory",
+			},
+		}, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+
+		account, err := json.MarshalIndent(map[string]interface{}{
+			"status":               "valid",
+			"contact":              []string{fmt.Sprintf("mailto:admin@example%d.com", i%17)},
+			"location":             fmt.Sprintf("https://acme-v02.api.letsencrypt.org/acme/acct/%d", 100000+i),
+			"termsOfServiceAgreed": true,
+		}, "", "\t")
+		if err != nil {
+			return nil, err
+		}
+
+		input = append(input, chain, keyPEM, meta, account)
+	}
+
+	return input, nil
+}
@@ -0,0 +1,218 @@
+package storageconsul
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket that limits the rate of requests toward Consul
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a rateLimiter allowing rate requests per second with bursts of up to burst requests
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(rate)))
+	}
+
+	return &rateLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until a request is allowed or ctx is done
+func (rl *rateLimiter) wait(ctx context.Context) error {
+	rl.mu.Lock()
+	now := time.Now()
+	rl.tokens = math.Min(rl.burst, rl.tokens+now.Sub(rl.last).Seconds()*rl.rate)
+	rl.last = now
+
+	// reserve a token, a negative balance is paid off by waiting
+	rl.tokens--
+	delay := time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+	rl.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		// give back the reserved token
+		rl.mu.Lock()
+		rl.tokens++
+		rl.mu.Unlock()
+		return ctx.Err()
+	}
+}
+
+// rateLimitedTransport delays requests that exceed the configured rate
+type rateLimitedTransport struct {
+	next    http.RoundTripper
+	limiter *rateLimiter
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.limiter.wait(req.Context()); err != nil {
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
+
+// concurrencyLimitedTransport bounds the number of in-flight requests
+type concurrencyLimitedTransport struct {
+	next http.RoundTripper
+	sem  chan struct{}
+}
+
+func (t *concurrencyLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// blocking queries are long-lived by design (e.g. lock monitoring) and would starve all other requests
+	if req.URL.Query().Get("index") != "" {
+		return t.next.RoundTrip(req)
+	}
+
+	select {
+	case t.sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		<-t.sem
+		return nil, err
+	}
+
+	// the request is in flight until its body is read
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: func() { <-t.sem }}
+	return resp, nil
+}
+
+// releasingBody calls release once when the body is closed
+type releasingBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
+
+// throttledTransport retries requests Consul rejected because of its rate limits after the delay it asks for
+type throttledTransport struct {
+	next    http.RoundTripper
+	retries int
+}
+
+func (t *throttledTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || !isThrottled(resp) {
+			return resp, err
+		}
+		throttledRequests.Inc()
+
+		// the body of the request has to be sent again
+		if attempt >= t.retries || (req.Body != nil && req.GetBody == nil) {
+			return resp, nil
+		}
+		throttleRetries.Add(1)
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return resp, nil
+			}
+		}
+
+		delay := throttleDelay(resp, attempt)
+		resp.Body.Close()
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+		req = retry
+	}
+}
+
+// isThrottled reports whether Consul rejected the request because of its rate limits, reads are
+// answered with 429 and writes with 503 and a rate limit message
+func isThrottled(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusServiceUnavailable:
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+		return err == nil && strings.Contains(string(body), "rate limit exceeded")
+	}
+	return false
+}
+
+// throttleDelay returns the delay requested by the Retry-After header of resp, without one the
+// delay doubles with every attempt
+func throttleDelay(resp *http.Response, attempt int) time.Duration {
+	delay := DefaultThrottleDelay << uint(attempt)
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds >= 0 {
+		delay = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(resp.Header.Get("Retry-After")); err == nil {
+		delay = time.Until(at)
+	}
+	return time.Duration(math.Min(float64(delay), float64(DefaultMaxThrottleDelay)))
+}
+
+// wrapTransport adds the configured limits to the transport used for Consul requests
+func (cc ConnectionConfig) wrapTransport(next http.RoundTripper) http.RoundTripper {
+	if cc.MaxConcurrentRequests > 0 {
+		next = &concurrencyLimitedTransport{
+			next: next,
+			sem:  make(chan struct{}, cc.MaxConcurrentRequests),
+		}
+	}
+
+	if cc.RateLimit > 0 {
+		next = &rateLimitedTransport{
+			next:    next,
+			limiter: newRateLimiter(cc.RateLimit, cc.RateBurst),
+		}
+	}
+
+	// retries pass the limits above again
+	retries := cc.ThrottleRetries
+	if retries == 0 {
+		retries = DefaultThrottleRetries
+	}
+	if retries > 0 {
+		next = &throttledTransport{next: next, retries: retries}
+	}
+
+	return next
+}
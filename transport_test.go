@@ -0,0 +1,170 @@
+package storageconsul
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimiter_Burst(t *testing.T) {
+	rl := newRateLimiter(10, 3)
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, rl.wait(context.Background()))
+	}
+	assert.Less(t, int64(time.Since(start)), int64(50*time.Millisecond))
+
+	// the fourth request has to wait for a new token
+	assert.NoError(t, rl.wait(context.Background()))
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(80*time.Millisecond))
+}
+
+func TestRateLimiter_ContextCanceled(t *testing.T) {
+	rl := newRateLimiter(1, 1)
+	assert.NoError(t, rl.wait(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	err := rl.wait(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+type blockingRoundTripper struct {
+	inFlight chan struct{}
+	release  chan struct{}
+}
+
+func (rt *blockingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.inFlight <- struct{}{}
+	<-rt.release
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func TestConcurrencyLimitedTransport(t *testing.T) {
+	rt := &blockingRoundTripper{inFlight: make(chan struct{}, 10), release: make(chan struct{})}
+	transport := &concurrencyLimitedTransport{next: rt, sem: make(chan struct{}, 2)}
+
+	for i := 0; i < 3; i++ {
+		go func() {
+			req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:8500/v1/kv/test", nil)
+			if resp, err := transport.RoundTrip(req); err == nil {
+				resp.Body.Close()
+			}
+		}()
+	}
+
+	<-rt.inFlight
+	<-rt.inFlight
+	select {
+	case <-rt.inFlight:
+		t.Fatal("third request passed the concurrency limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// blocking queries bypass the limit
+	go func() {
+		req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:8500/v1/kv/test?index=42", nil)
+		transport.RoundTrip(req)
+	}()
+	<-rt.inFlight
+
+	close(rt.release)
+	<-rt.inFlight
+}
+
+func TestConcurrencyLimitedTransport_OpenBodies(t *testing.T) {
+	rt := &blockingRoundTripper{inFlight: make(chan struct{}, 10), release: make(chan struct{})}
+	close(rt.release)
+	transport := &concurrencyLimitedTransport{next: rt, sem: make(chan struct{}, 2)}
+
+	var bodies []io.ReadCloser
+	for i := 0; i < 2; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://127.0.0.1:8500/v1/kv/test", nil)
+		resp, err := transport.RoundTrip(req)
+		require.NoError(t, err)
+		bodies = append(bodies, resp.Body)
+	}
+
+	// responses whose bodies aren't closed yet still count against the limit
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "http://127.0.0.1:8500/v1/kv/test", nil)
+	_, err := transport.RoundTrip(req)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	// closing a body twice releases it only once
+	bodies[0].Close()
+	bodies[0].Close()
+	assert.Len(t, transport.sem, 1)
+
+	req, _ = http.NewRequest(http.MethodGet, "http://127.0.0.1:8500/v1/kv/test", nil)
+	resp, err := transport.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	bodies[1].Close()
+	assert.Len(t, transport.sem, 0)
+}
+
+func TestThrottledTransport(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		if len(bodies) < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		w.Write([]byte("true"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &throttledTransport{next: http.DefaultTransport, retries: 3}}
+	resp, err := client.Post(server.URL+"/v1/kv/test", "", strings.NewReader("value"))
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, []string{"value", "value", "value"}, bodies)
+}
+
+func TestThrottledTransport_RetriesExhausted(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("rate limit exceeded"))
+	}))
+	defer server.Close()
+
+	client := &http.Client{Transport: &throttledTransport{next: http.DefaultTransport, retries: 1}}
+	resp, err := client.Get(server.URL + "/v1/kv/test")
+	require.NoError(t, err)
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, "rate limit exceeded", string(body))
+	assert.Equal(t, 2, requests)
+}
+
+func TestThrottleDelay(t *testing.T) {
+	resp := &http.Response{Header: http.Header{}}
+	assert.Equal(t, DefaultThrottleDelay, throttleDelay(resp, 0))
+	assert.Equal(t, 4*DefaultThrottleDelay, throttleDelay(resp, 2))
+	assert.Equal(t, DefaultMaxThrottleDelay, throttleDelay(resp, 10))
+
+	resp.Header.Set("Retry-After", "7")
+	assert.Equal(t, 7*time.Second, throttleDelay(resp, 2))
+}
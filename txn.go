@@ -0,0 +1,51 @@
+package storageconsul
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// maxTxnOps is the number of operations Consul accepts in one transaction
+const maxTxnOps = 64
+
+// kvTxn is the part of Consul's transaction API the storage uses, it is implemented by *consul.Txn and
+// by backends that can apply several operations atomically
+type kvTxn interface {
+	Txn(txn consul.TxnOps, q *consul.QueryOptions) (bool, *consul.TxnResponse, *consul.QueryMeta, error)
+}
+
+// txn returns the transaction API to access key with, if the backend supports transactions
+func (cs *ConsulStorage) txn(key string) (kvTxn, bool) {
+	txn, ok := cs.kv(key).(kvTxn)
+	return txn, ok
+}
+
+// runTxn applies ops in one transaction in the namespace of key, if one of them fails none is applied
+func (cs *ConsulStorage) runTxn(ctx context.Context, key string, ops consul.TxnOps) (*consul.TxnResponse, error) {
+	txn, ok := cs.txn(key)
+	if !ok {
+		return nil, errors.New("the backend doesn't support transactions")
+	}
+
+	committed, resp, _, err := txn.Txn(ops, cs.queryOptions(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to run transaction")
+	}
+	if !committed {
+		var reasons []string
+		for _, txnErr := range resp.Errors {
+			reason := txnErr.What
+			if txnErr.OpIndex < len(ops) && ops[txnErr.OpIndex].KV != nil {
+				reason = fmt.Sprintf("%s %s: %s", ops[txnErr.OpIndex].KV.Verb, ops[txnErr.OpIndex].KV.Key, txnErr.What)
+			}
+			reasons = append(reasons, reason)
+		}
+		return resp, errors.Errorf("transaction rolled back: %s", strings.Join(reasons, "; "))
+	}
+
+	return resp, nil
+}
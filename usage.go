@@ -0,0 +1,47 @@
+package storageconsul
+
+import (
+	"context"
+	"strings"
+
+	"github.com/pteich/errors"
+)
+
+// PrefixUsage is the number of keys and the bytes they take up in the KV store below a top-level prefix
+type PrefixUsage struct {
+	Keys  int   `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// Usage returns the usage of the KV store per top-level prefix of the storage, e.g. certificates,
+// locks, ocsp and acme accounts. Bytes are counted as stored, that is encrypted and compressed.
+// Values stored under hashed keys or deduplicated are counted below _hashed and _blobs.
+func (cs *ConsulStorage) Usage(ctx context.Context) (map[string]PrefixUsage, error) {
+	ctx, cancel := withTimeout(ctx, cs.ListTimeout)
+	defer cancel()
+
+	usage := make(map[string]PrefixUsage)
+	seen := make(map[string]bool)
+	for _, ns := range cs.namespaces() {
+		pairs, _, err := ns.kv.List(ns.prefix+"/", cs.queryOptions(ctx))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to list keys at %s", ns.prefix)
+		}
+
+		for _, pair := range pairs {
+			// namespaces may overlap, count each key once
+			if seen[pair.Key] {
+				continue
+			}
+			seen[pair.Key] = true
+
+			top := strings.SplitN(cs.storageKey(ns.prefix, pair.Key), "/", 2)[0]
+			u := usage[top]
+			u.Keys++
+			u.Bytes += int64(len(pair.Value))
+			usage[top] = u
+		}
+	}
+
+	return usage, nil
+}
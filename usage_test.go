@@ -0,0 +1,26 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_Usage(t *testing.T) {
+	cs := setupConsulEnv(t)
+
+	require.NoError(t, cs.Store("certificates/example.com/example.com.crt", []byte("crt")))
+	require.NoError(t, cs.Store("certificates/example.com/example.com.key", []byte("key")))
+	require.NoError(t, cs.Store("ocsp/example.com", []byte("ocsp")))
+
+	usage, err := cs.Usage(context.Background())
+	require.NoError(t, err)
+
+	assert.Len(t, usage, 2)
+	assert.Equal(t, 2, usage["certificates"].Keys)
+	assert.Equal(t, 1, usage["ocsp"].Keys)
+	// values are counted as stored with their metadata and encryption
+	assert.Greater(t, usage["ocsp"].Bytes, int64(len("ocsp")))
+}
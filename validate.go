@@ -0,0 +1,227 @@
+package storageconsul
+
+import (
+	"fmt"
+	"strings"
+
+	consul "github.com/hashicorp/consul/api"
+	"github.com/pteich/errors"
+)
+
+// Validate checks the configuration for problems that would otherwise only show up at the first
+// storage call and reports all of them at once. It is called by Caddy after Provision.
+func (cs *ConsulStorage) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if !validAESKeyLength(cs.AESKey) {
+		problem("aes_key must be 16, 24 or 32 bytes long, got %d", len(cs.AESKey))
+	}
+	for i, key := range cs.PreviousAESKeys {
+		if !validAESKeyLength(key) {
+			problem("previous_aes_key %d must be 16, 24 or 32 bytes long, got %d", i+1, len(key))
+		}
+	}
+
+	if err := validatePrefix(cs.Prefix); err != nil {
+		problem("invalid prefix: %v", err)
+	}
+	if cs.FallbackPrefix != "" {
+		if err := validatePrefix(cs.FallbackPrefix); err != nil {
+			problem("invalid fallback_prefix: %v", err)
+		}
+	}
+	for name, t := range cs.Tenants {
+		if t == nil || t.Prefix == "" {
+			problem("tenant %s needs a prefix", name)
+		} else if err := validatePrefix(t.Prefix); err != nil {
+			problem("invalid prefix of tenant %s: %v", name, err)
+		}
+	}
+	problems = append(problems, overlappingTenants(cs.Tenants)...)
+
+	if err := cs.validLayout(); err != nil {
+		problem("invalid layout: %v", err)
+	}
+	if cs.KeySeparator != "" {
+		if err := validKeySeparator(cs.KeySeparator); err != nil {
+			problem("invalid key_separator: %v", err)
+		}
+	}
+
+	for name, p := range cs.KeyPolicies {
+		if p != nil && p.CoalesceWindow < 0 {
+			problem("coalesce_window of key policy %s must not be negative", name)
+		}
+		if p != nil && p.TTL < 0 {
+			problem("ttl of key policy %s must not be negative", name)
+		}
+		if p != nil && p.CompareAndSet && p.CoalesceWindow > 0 {
+			problem("key policy %s can't combine compare_and_set with coalesce_window", name)
+		}
+		if _, txn := cs.defaultKV().(kvTxn); p != nil && p.CompareAndSet && !txn {
+			problem("compare_and_set of key policy %s requires a backend with transactions", name)
+		}
+	}
+
+	if cs.ChallengeTokenTTL < 0 {
+		problem("challenge_token_ttl must not be negative")
+	}
+
+	for prefix, q := range cs.Quotas {
+		if strings.Contains(prefix, "/") || prefix == "" {
+			problem("quota prefix %q must be a top-level prefix", prefix)
+		}
+		if q != nil && (q.MaxKeys < 0 || q.MaxBytes < 0) {
+			problem("quota of %s must not be negative", prefix)
+		}
+	}
+	if len(cs.Quotas) > 0 && cs.FlatKeys {
+		problem("quotas can't be combined with flat_keys")
+	}
+
+	if cs.Token != "" && cs.TokenFile != "" {
+		problem("token and token_file are mutually exclusive")
+	}
+	if cs.Password != "" && cs.Username == "" {
+		problem("password requires a username")
+	}
+
+	if cs.TlsCAFile != "" && cs.TlsCAPem != "" {
+		problem("tls_ca_file and tls_ca_pem are mutually exclusive")
+	}
+	if cs.TlsInsecure && (cs.TlsCAFile != "" || cs.TlsCAPem != "" || cs.TlsServerName != "") {
+		problem("tls_insecure skips verification, so tls_ca_file, tls_ca_pem and tls_server_name have no effect")
+	}
+	if cs.TlsServerCertPin != "" {
+		if _, err := parseCertPin(cs.TlsServerCertPin); err != nil {
+			problem("%v", err)
+		}
+		if cs.TlsInsecure {
+			problem("tls_insecure and tls_server_cert_pin are mutually exclusive")
+		}
+	}
+	usesTLS := cs.TlsInsecure || cs.TlsCAFile != "" || cs.TlsCAPem != "" || cs.TlsServerName != "" || cs.TlsServerCertPin != "" || cs.SpiffeSocket != ""
+	if usesTLS && !cs.TlsEnabled && strings.HasPrefix(cs.Address, "http://") {
+		problem("TLS options are set but tls_enabled is off and the address %s uses http", cs.Address)
+	}
+
+	if cs.ProxyURL != "" {
+		if _, err := parseProxyURL(cs.ProxyURL); err != nil {
+			problem("%v", err)
+		}
+	}
+
+	if cs.RateLimit < 0 || cs.RateBurst < 0 || cs.MaxConcurrentRequests < 0 {
+		problem("rate_limit, rate_burst and max_concurrent_requests must not be negative")
+	}
+	if cs.RateBurst > 0 && cs.RateLimit == 0 {
+		problem("rate_burst requires a rate_limit")
+	}
+
+	if cs.LockRetryInterval < 0 || cs.LockMaxRetryInterval < 0 {
+		problem("lock_retry_interval and lock_max_retry_interval must not be negative")
+	}
+	if cs.LockMaxRetryInterval > 0 && cs.LockRetryInterval > cs.LockMaxRetryInterval {
+		problem("lock_retry_interval must not be greater than lock_max_retry_interval")
+	}
+
+	if cs.LockGCInterval < 0 || cs.LockGCMaxAge < 0 {
+		problem("lock_gc_interval and lock_gc_max_age must not be negative")
+	}
+	if cs.LockGCMaxAge > 0 && cs.LockGCInterval == 0 {
+		problem("lock_gc_max_age requires a lock_gc_interval")
+	}
+
+	switch cs.LockSessionBehavior {
+	case "", consul.SessionBehaviorRelease, consul.SessionBehaviorDelete:
+	default:
+		problem("lock_session_behavior must be %s or %s, got %s", consul.SessionBehaviorRelease, consul.SessionBehaviorDelete, cs.LockSessionBehavior)
+	}
+
+	if cs.backupsEnabled() && cs.Backup.Endpoint == "" {
+		problem("backup_bucket needs a backup_endpoint")
+	}
+	if cs.backupsEnabled() && len(cs.AESKey) == 0 {
+		problem("backup_bucket needs an aes_key to encrypt the archives")
+	}
+	if cs.Backup.Keep < 0 || cs.Backup.Interval < 0 {
+		problem("backup_keep and backup_interval must not be negative")
+	}
+
+	if cs.serviceEnabled() {
+		if cs.Backend != "" && cs.Backend != BackendConsul {
+			problem("service_name requires the consul backend")
+		}
+		if cs.Service.Port < 0 || cs.Service.Port > 65535 {
+			problem("service_port must be between 0 and 65535, got %d", cs.Service.Port)
+		}
+		if cs.Service.CheckTTL < 0 || cs.Service.CheckInterval < 0 || cs.Service.DeregisterAfter < 0 {
+			problem("service_check_ttl, service_check_interval and service_deregister_after must not be negative")
+		}
+		if cs.Service.CheckHTTP != "" && cs.Service.CheckTTL > 0 {
+			problem("service_check_http and service_check_ttl are mutually exclusive")
+		}
+	}
+
+	if cs.IntegrityScanInterval < 0 || cs.IntegrityScanSample < 0 {
+		problem("integrity_scan_interval and integrity_scan_sample must not be negative")
+	}
+
+	if cs.DecryptFailureWebhook != "" {
+		if err := validWebhook(cs.DecryptFailureWebhook); err != nil {
+			problem("%v", err)
+		}
+	}
+
+	switch cs.ValueEnvelope {
+	case "", EnvelopeBinary:
+	case EnvelopeJSON:
+		if cs.ArmorValues || cs.LegacyValueFormat {
+			problem("value_envelope json can't be combined with armor_values or legacy_value_format")
+		}
+	default:
+		problem("value_envelope must be %s or %s, got %s", EnvelopeBinary, EnvelopeJSON, cs.ValueEnvelope)
+	}
+
+	if cs.RequireBoundValues && (len(cs.AESKey) == 0 || cs.LegacyValueFormat) {
+		problem("require_bound_values needs an aes_key and can't be combined with legacy_value_format")
+	}
+
+	if cs.MaxValueSize < 0 {
+		problem("max_value_size must not be negative")
+	}
+
+	if cs.LogLevel != "" {
+		if _, err := cs.logLevel(); err != nil {
+			problem("%v", err)
+		}
+	}
+	if cs.LogSampleFirst < 0 || cs.LogSampleThereafter < 0 {
+		problem("log_sample_first and log_sample_thereafter must not be negative")
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid Consul storage config: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// validAESKeyLength reports whether key selects AES-128, AES-192 or AES-256
+func validAESKeyLength(key []byte) bool {
+	switch len(key) {
+	case 16, 24, 32:
+		return true
+	}
+	return false
+}
+
+// validatePrefix checks that prefix can be used as prefix of Consul keys
+func validatePrefix(prefix string) error {
+	if strings.HasPrefix(prefix, "/") || strings.HasSuffix(prefix, "/") {
+		return errors.Errorf("%q must not start or end with a slash", prefix)
+	}
+	return validateKey(prefix)
+}
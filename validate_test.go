@@ -0,0 +1,34 @@
+package storageconsul
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_Validate(t *testing.T) {
+	require.NoError(t, New().Validate())
+
+	cs := New()
+	cs.AESKey = []byte("too short")
+	cs.Prefix = "/caddytls"
+	cs.Token = "token"
+	cs.TokenFile = "/run/secrets/consul-token"
+	cs.TlsCAFile = "/etc/ssl/consul-ca.pem"
+	cs.Address = "http://127.0.0.1:8500"
+
+	err := cs.Validate()
+	require.Error(t, err)
+	// all problems are reported at once
+	assert.Contains(t, err.Error(), "aes_key must be 16, 24 or 32 bytes long, got 9")
+	assert.Contains(t, err.Error(), "invalid prefix")
+	assert.Contains(t, err.Error(), "token and token_file are mutually exclusive")
+	assert.Contains(t, err.Error(), "tls_enabled is off")
+
+	cs = New()
+	cs.TlsEnabled = true
+	cs.TlsCAFile = "/etc/ssl/consul-ca.pem"
+	cs.Tenants = map[string]*Tenant{"customer-a": {Prefix: "tenants/a"}}
+	assert.NoError(t, cs.Validate())
+}
@@ -0,0 +1,65 @@
+package storageconsul
+
+import (
+	"context"
+	"fmt"
+)
+
+// DefaultValueSizeWarning is the percentage of Consul's maximum value size above which stored values are logged
+const DefaultValueSizeWarning = 80
+
+// consulMaxValueSize is the default limit of Consul for the size of a single value
+const consulMaxValueSize = 512 * 1024
+
+// ValueTooLargeError is returned for writes of values larger than max_value_size, they are rejected
+// before anything is sent to Consul
+type ValueTooLargeError struct {
+	Key   string
+	Size  int
+	Limit int
+}
+
+func (e ValueTooLargeError) Error() string {
+	return fmt.Sprintf("value of %s has %d bytes, more than the maximum of %d bytes", e.Key, e.Size, e.Limit)
+}
+
+// checkMaxValueSize returns a ValueTooLargeError if value of key exceeds MaxValueSize
+func (cs *ConsulStorage) checkMaxValueSize(key string, value []byte) error {
+	if cs.MaxValueSize > 0 && len(value) > cs.MaxValueSize {
+		return ValueTooLargeError{Key: key, Size: len(value), Limit: cs.MaxValueSize}
+	}
+	return nil
+}
+
+// consulValueSizeLimit returns the maximum size of a value the Consul cluster accepts
+func (cs *ConsulStorage) consulValueSizeLimit() int {
+	if cs.ConsulMaxValueSize > 0 {
+		return cs.ConsulMaxValueSize
+	}
+	return consulMaxValueSize
+}
+
+// valueSizeWarning returns the size of a stored value above which a warning is logged, zero if disabled
+func (cs *ConsulStorage) valueSizeWarning() int {
+	switch {
+	case cs.ValueSizeWarning < 0:
+		return 0
+	case cs.ValueSizeWarning == 0:
+		return cs.consulValueSizeLimit() * DefaultValueSizeWarning / 100
+	}
+	return cs.consulValueSizeLimit() * cs.ValueSizeWarning / 100
+}
+
+// checkValueSize warns about an encoded value for consulKey that approaches Consul's maximum value size,
+// so oversized chains are noticed before writes start failing
+func (cs *ConsulStorage) checkValueSize(ctx context.Context, consulKey string, size int) {
+	warning := cs.valueSizeWarning()
+	if warning == 0 || size < warning {
+		return
+	}
+
+	largeValues.Inc()
+	largeValuesDebugVar.Add(1)
+	cs.log(ctx).Warnf("value of %s has %d bytes, %d%% of Consul's maximum value size of %d bytes",
+		consulKey, size, size*100/cs.consulValueSizeLimit(), cs.consulValueSizeLimit())
+}
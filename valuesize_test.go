@@ -0,0 +1,49 @@
+package storageconsul
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_ValueSizeWarning(t *testing.T) {
+	cs := New()
+	assert.Equal(t, consulMaxValueSize*DefaultValueSizeWarning/100, cs.valueSizeWarning())
+
+	cs.ConsulMaxValueSize = 1000
+	cs.ValueSizeWarning = 50
+	assert.Equal(t, 500, cs.valueSizeWarning())
+
+	cs.ValueSizeWarning = -1
+	assert.Zero(t, cs.valueSizeWarning())
+}
+
+func TestConsulStorage_LargeValues(t *testing.T) {
+	cs, _ := newFakeConsulStorage(t)
+	cs.ConsulMaxValueSize = 2048
+
+	large := testutil.ToFloat64(largeValues)
+	require.NoError(t, cs.Store("certificates/small.example.com", bytes.Repeat([]byte("a"), 100)))
+	assert.Equal(t, large, testutil.ToFloat64(largeValues))
+
+	chain := make([]byte, 1800)
+	_, err := rand.Read(chain)
+	require.NoError(t, err)
+	require.NoError(t, cs.Store("certificates/large.example.com", chain))
+	assert.Equal(t, large+1, testutil.ToFloat64(largeValues))
+}
+
+func TestConsulStorage_MaxValueSize(t *testing.T) {
+	cs, fc := newFakeConsulStorage(t)
+	cs.MaxValueSize = 1024
+
+	err := cs.Store("certificates/large.example.com", make([]byte, 1025))
+	assert.Equal(t, ValueTooLargeError{Key: "certificates/large.example.com", Size: 1025, Limit: 1024}, err)
+	assert.Empty(t, fc.kv)
+
+	assert.NoError(t, cs.Store("certificates/small.example.com", make([]byte, 1024)))
+}
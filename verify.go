@@ -0,0 +1,75 @@
+package storageconsul
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"os"
+	"path"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/pteich/errors"
+)
+
+// verifyDir is the directory below the prefix that holds the short-lived keys written by Verify
+const verifyDir = "_verify"
+
+// Verify writes, reads and deletes a key of its own and acquires and releases a lock to check that the
+// storage is usable with the configured backend, token and encryption. It is run by Provision with
+// VerifyOnStart and returns an error naming the step that failed.
+func (cs *ConsulStorage) Verify(ctx context.Context) error {
+	key, err := verifyKey()
+	if err != nil {
+		return err
+	}
+	value := []byte("verify " + key)
+
+	if err := cs.StoreContext(ctx, key, value); err != nil {
+		return errors.Wrapf(err, "verify: unable to store %s", key)
+	}
+
+	loaded, err := cs.LoadContext(ctx, key)
+	if err != nil {
+		_ = cs.DeleteContext(ctx, key)
+		return errors.Wrapf(err, "verify: unable to load %s", key)
+	}
+	if !bytes.Equal(loaded, value) {
+		_ = cs.DeleteContext(ctx, key)
+		return errors.Errorf("verify: loaded value of %s doesn't match the stored one", key)
+	}
+
+	if err := cs.DeleteContext(ctx, key); err != nil {
+		return errors.Wrapf(err, "verify: unable to delete %s", key)
+	}
+
+	if err := cs.Lock(ctx, key); err != nil {
+		return errors.Wrapf(err, "verify: unable to acquire lock %s", key)
+	}
+	if err := cs.Unlock(key); err != nil {
+		return errors.Wrapf(err, "verify: unable to release lock %s", key)
+	}
+
+	// a released lock leaves its key behind
+	if err := cs.DeleteContext(ctx, key); err != nil {
+		if _, notExist := err.(certmagic.ErrNotExist); !notExist {
+			return errors.Wrapf(err, "verify: unable to delete lock %s", key)
+		}
+	}
+
+	return nil
+}
+
+// verifyKey returns a key unique to this attempt, so instances starting at the same time don't collide
+func verifyKey() (string, error) {
+	random := make([]byte, 8)
+	if _, err := rand.Read(random); err != nil {
+		return "", errors.Wrap(err, "verify: unable to create key")
+	}
+
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "caddy"
+	}
+	return path.Join(verifyDir, escapeSegment(hostname)+"-"+hex.EncodeToString(random)), nil
+}
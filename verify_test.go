@@ -0,0 +1,18 @@
+package storageconsul
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConsulStorage_Verify(t *testing.T) {
+	cs := setupConsulEnv(t)
+	require.NoError(t, cs.Verify(context.Background()))
+
+	// the test key is removed again
+	_, err := cs.List(verifyDir, true)
+	assert.Error(t, err)
+}